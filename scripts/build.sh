@@ -47,9 +47,6 @@ rm "$path/scripts/opkg-build"
 rm "$path/scripts/postinstall.sh"
 rm "$path/scripts/install.sh"
 
-# Not needed on i386 builds
-rm -f "$path/assets/ngrok/ngrok_osx"
-
 # tar -cvf "release/$ds_name.tar" $path
 # rm -rf $path
 
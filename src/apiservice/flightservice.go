@@ -0,0 +1,193 @@
+/**
+ * Dronesmith API
+ *
+ * Copyright (C) 2017 Dronesmith Technologies Inc, all rights reserved.
+ * Unauthorized copying of any source code or assets within this project, via
+ * any medium is strictly prohibited.
+ *
+ * Proprietary and confidential.
+ */
+
+package apiservice
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "os"
+  "strings"
+
+  "flightlog"
+  "flightlog/export"
+  "config"
+)
+
+const FLIGHTS_PREFIX = "/api/flights"
+
+type FlightEntry struct {
+  flightlog.Entry
+  Recording bool `json:"recording"`
+}
+
+// Serves the flight log catalog.
+//
+//   GET    /api/flights                 every flight, newest first
+//   GET    /api/flights/:name           a single flight
+//   GET    /api/flights/:name/download  the raw .tlog
+//   GET    /api/flights/:name/export?format=gpx|kml|geojson|csv[&msg=NAME]
+//   DELETE /api/flights/:name
+type FlightAPI struct {
+  catalog   *flightlog.Catalog
+  recording func() string
+}
+
+// recording returns the name of the log currently being written, if any. That
+// log can't be deleted and its metadata is still changing.
+func NewFlightAPI(catalog *flightlog.Catalog, recording func() string) *FlightAPI {
+  return &FlightAPI{catalog, recording}
+}
+
+func (fa *FlightAPI) sendJSON(code int, data interface{}, w http.ResponseWriter) {
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(code)
+  if err := json.NewEncoder(w).Encode(data); err != nil {
+    panic(err)
+  }
+}
+
+func (fa *FlightAPI) sendError(code int, err error, w http.ResponseWriter) {
+  fa.sendJSON(code, map[string]string{"error": err.Error()}, w)
+}
+
+func (fa *FlightAPI) entry(e flightlog.Entry) FlightEntry {
+  return FlightEntry{e, e.Name == fa.recording()}
+}
+
+func (fa *FlightAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+  config.Log(config.LOG_INFO, "REQUEST", req.Method, req.URL.Path)
+
+  rest := strings.Trim(strings.TrimPrefix(req.URL.Path, FLIGHTS_PREFIX), "/")
+  action := ""
+  for _, a := range []string{"download", "export"} {
+    if strings.HasSuffix(rest, "/" + a) {
+      rest = strings.TrimSuffix(rest, "/" + a)
+      action = a
+    }
+  }
+  download := action == "download"
+
+  switch {
+  case rest == "" && req.Method == "GET":
+    list, err := fa.catalog.List()
+    if err != nil {
+      fa.sendError(500, err, w)
+      return
+    }
+
+    flights := make([]FlightEntry, len(list))
+    for i, e := range list {
+      flights[i] = fa.entry(e)
+    }
+    fa.sendJSON(200, flights, w)
+
+  case rest != "" && download && req.Method == "GET":
+    fpath, err := fa.catalog.Path(rest)
+    if err != nil {
+      fa.sendError(404, err, w)
+      return
+    }
+
+    f, err := os.Open(fpath)
+    if err != nil {
+      fa.sendError(500, err, w)
+      return
+    }
+    defer f.Close()
+
+    info, err := f.Stat()
+    if err != nil {
+      fa.sendError(500, err, w)
+      return
+    }
+
+    w.Header().Set("Content-Type", "application/octet-stream")
+    w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", rest))
+    http.ServeContent(w, req, rest, info.ModTime(), f)
+
+  case rest != "" && action == "export" && req.Method == "GET":
+    fa.handleExport(rest, req, w)
+
+  case rest != "" && action == "" && req.Method == "GET":
+    e, err := fa.catalog.Get(rest)
+    if err != nil {
+      fa.sendError(404, err, w)
+      return
+    }
+    fa.sendJSON(200, fa.entry(e), w)
+
+  case rest != "" && action == "" && req.Method == "DELETE":
+    if rest == fa.recording() {
+      fa.sendError(409, fmt.Errorf("Flight %s is still being recorded.", rest), w)
+      return
+    }
+
+    if err := fa.catalog.Delete(rest); err != nil {
+      fa.sendError(404, err, w)
+      return
+    }
+
+    config.Log(config.LOG_INFO, "api: ", "Deleted flight", rest)
+    fa.sendJSON(200, map[string]string{"status": "OK"}, w)
+
+  default:
+    http.Error(w, http.StatusText(404), 404)
+  }
+}
+
+// Converts a flight on the fly. CSV needs a msg to pick the table, without one
+// every table comes back in a zip.
+func (fa *FlightAPI) handleExport(name string, req *http.Request, w http.ResponseWriter) {
+  format := req.URL.Query().Get("format")
+  msg := req.URL.Query().Get("msg")
+
+  kind, ok := export.Formats[format]
+  if !ok {
+    fa.sendError(400, fmt.Errorf("Unknown export format %s", format), w)
+    return
+  }
+
+  fpath, err := fa.catalog.Path(name)
+  if err != nil {
+    fa.sendError(404, err, w)
+    return
+  }
+
+  recs, err := flightlog.ReadFile(fpath)
+  if err != nil && len(recs) == 0 {
+    fa.sendError(500, err, w)
+    return
+  }
+
+  // Render first so a bad msg is still a proper error response.
+  var buf bytes.Buffer
+  if err := export.Write(&buf, format, name, msg, recs); err != nil {
+    fa.sendError(400, err, w)
+    return
+  }
+
+  ctype, ext := kind[0], kind[1]
+  if format == export.FORMAT_CSV && msg == "" {
+    ctype, ext = "application/zip", ".zip"
+  } else if format == export.FORMAT_CSV {
+    ext = "." + msg + ext
+  }
+
+  fname := flightlog.BaseName(name) + ext
+  w.Header().Set("Content-Type", ctype)
+  w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fname))
+  w.WriteHeader(200)
+  if _, err := buf.WriteTo(w); err != nil {
+    panic(err)
+  }
+}
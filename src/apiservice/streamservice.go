@@ -19,10 +19,13 @@ import (
 	"time"
 
   "config"
+  "metrics"
 )
 
 const patience time.Duration = time.Second * 1
 
+var streamClients = metrics.NewGauge("dslink_stream_clients", "Clients of GET /api/stream.")
+
 type StreamBroker struct {
 	Notifier       chan []byte
 	newClients     chan chan []byte
@@ -82,10 +85,12 @@ func (broker *StreamBroker) listen() {
 		select {
 		case s := <-broker.newClients:
 			broker.clients[s] = true
+			streamClients.Set(float64(len(broker.clients)))
 			config.Log(config.LOG_INFO, "Stream | Client added.", len(broker.clients), "registered clients")
 
 		case s := <-broker.closingClients:
 			delete(broker.clients, s)
+			streamClients.Set(float64(len(broker.clients)))
 			config.Log(config.LOG_INFO, "Stream | Removed client.", len(broker.clients), "registered clients")
 
 		case event := <-broker.Notifier:
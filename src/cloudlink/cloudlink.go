@@ -3,19 +3,20 @@ package cloudlink
 import (
   "bytes"
   "config"
-  "net"
   "time"
-  "strings"
   "strconv"
   "math/rand"
   "sync"
   "net/http"
   "encoding/json"
-  "fmt"
 
   "mavlink/parser"
 
+  "cloudlink/codejob"
   "cloudlink/dronedp"
+  "cloudlink/terminal"
+  "cloudlink/transport"
+  "flightlog"
 )
 
 const (
@@ -25,25 +26,40 @@ const (
   // DEFAULT_DSC_ADDRESS = "127.0.0.1:4002"
 
   TIME_OUT_CNT = 15
+
+  // Big enough for any UDP datagram the server could send.
+  RX_BUFFER_SIZE = 65536
+  RETRANSMIT_PERIOD = 200 * time.Millisecond
 )
 
 type CloudLink struct {
-  addr        *net.UDPAddr
-  conn        *net.UDPConn
-  rx          []byte
+  conn        transport.Transport
+  connMut     sync.RWMutex
+  dsc         []string
+  dscIdx      int
+  dialing     bool
   sessionId   uint32
+  hadSession  bool
   messageCnt  int
-  codeStatus  int
-  terminalOnline bool
   timer       *time.Timer
 
   uid         string
 
-  termRunner  *TermLauncher
-  codeRunner  *CodeLauncher
+  terms       *terminal.Manager
+  cloudTerm   *cloudTerm
+  termWait    bool
+  termMut     sync.Mutex
+  jobs        *codejob.Service
   syncer      *FlightSyncer
+  catalog     *flightlog.Catalog
   store       *Store
 
+  link        *dronedp.Link
+  counterCeil uint64
+  rxFloor     uint64
+  warnedPlain bool
+  codecMut    sync.RWMutex
+
   rawFmuCmd   []byte
   packmut     sync.RWMutex
 
@@ -64,25 +80,27 @@ func NewCloudLink() (*CloudLink, error) {
 
   cl.msgs = make(map[byte][]byte)
 
-  // cl.codeRunner, err = NewCodeLauncher(*config.AssetsPath + "assets/exec.py")
-  // if err != nil {
-  //   return nil, fmt.Errorf("Asset Manager: %s could not be opened.\n", *config.AssetsPath + "assets/exec.py")
-  // }
+  cl.catalog = flightlog.NewCatalog(*config.FlightLogPath)
+  cl.syncer = NewFlightSyncer(cl.catalog)
 
-  cl.termRunner, err = NewTermLauncher(*config.AssetsPath + "assets/ngrok")
-  if err != nil {
-    return nil, fmt.Errorf("Asset Manager: %s could not be opened.\n", *config.AssetsPath + "assets/ngrok")
+  // Other destinations don't wait for a cloud session.
+  if !cl.syncer.NeedsCloud() {
+    config.Log(config.LOG_INFO, "cl: ", "Turning on Syncer")
+    cl.syncer.Start("", "")
   }
 
-  cl.syncer = NewFlightSyncer(*config.FlightLogPath)
-
   // Use cwd
   cl.store, err = NewStore(*config.AssetsPath + ".")
   if err != nil {
     return nil, err
   }
 
-  cl.store.Load()
+  cl.initCodec()
+
+  cl.initTerminals()
+  if err := cl.initJobs(); err != nil {
+    return nil, err
+  }
 
   return cl, nil
 }
@@ -91,21 +109,29 @@ func (cl *CloudLink) GetStore() *Store {
   return cl.store
 }
 
+func (cl *CloudLink) GetCatalog() *flightlog.Catalog {
+  return cl.catalog
+}
+
 func (cl *CloudLink) SendSensor(name string, val map[string]interface{}) (*http.Response, error) {
   // JSON req
   if buf, err := json.Marshal(val); err != nil {
     return nil, err
   } else {
-
-    return http.Post(*config.DSCHttp + "/rt/drone/" + cl.syncer.DroneId + "/sensor/" + name, "application/json", bytes.NewBuffer(buf))
+    _, drone := cl.syncer.ids()
+    return http.Post(*config.DSCHttp + "/rt/drone/" + drone + "/sensor/" + name, "application/json", bytes.NewBuffer(buf))
   }
 }
 
 func (cl *CloudLink) Logout() error {
-  cl.sessionId = 0
+  cl.setSession(0)
   cl.messageCnt = TIME_OUT_CNT
-  cl.codeStatus = 0
-  cl.terminalOnline = false
+  cl.setCloudTerminal(false)
+
+  // The token goes with the account, and so do shells opened with it.
+  if cl.terms != nil {
+    cl.terms.CloseAll()
+  }
 
   if err := cl.store.Del(); err != nil {
     return err
@@ -137,6 +163,11 @@ func (cl *CloudLink) IsOnlineNonBlock() bool {
   return cl.sessionId != 0
 }
 
+// Progress of the flight log uploads.
+func (cl *CloudLink) SyncStatus() SyncStatus {
+  return cl.syncer.Status()
+}
+
 func (cl *CloudLink) SendSyncLock(name string) {
   cl.syncer.Lock(name)
 }
@@ -157,91 +188,61 @@ func (cl *CloudLink) Monitor() {
 }
 
 func (cl *CloudLink) Serve() error {
-  {
-    var err error
-    var localAddr *net.UDPAddr
-
-    // Attempt connection
-    if cl.addr, err = net.ResolveUDPAddr("udp4", *config.DSCAddress); err != nil {
-  		return err
-  	} else {
-      if localAddr, err = net.ResolveUDPAddr("udp4", "0.0.0.0:0"); err != nil {
-        return err
-      } else {
-        if cl.conn, err = net.DialUDP("udp", localAddr, cl.addr); err != nil {
-    			return err
-    		}
-        config.Log(config.LOG_INFO, "cl:  Listening on", *config.DSCAddress)
-      }
-  	}
+  // Attempt connection
+  cl.dsc = transport.Candidates(*config.DSCAddress, *config.DSCFallback)
+  cl.dscIdx = 0
+  if err := cl.dial(); err != nil {
+    return err
   }
 
-  cl.rx = make([]byte, 2048)
-  cl.sessionId = 0
+  cl.setSession(0)
   cl.messageCnt = TIME_OUT_CNT
-  cl.codeStatus = 0
-  cl.terminalOnline = false
   cl.timer = time.NewTimer(1 * time.Second)
-  cl.syncTimer = time.NewTimer((time.Duration)(*config.SyncThrottle) * time.Millisecond)
-
-
-  // read thread
-  go func() {
-    for {
-      n, _, err := cl.conn.ReadFromUDP(cl.rx)
-
-      if err != nil {
-        // log.Println(err)
-        cl.sessionId = 0
-      } else if n > 0 {
-        // parse message
-        if decoded, err := dronedp.ParseMsg(cl.rx[:n]); err != nil {
-          config.Log(config.LOG_WARN, err)
-        } else {
-          cl.handleMessage(decoded)
-        }
-      }
-      // Wait a little before reading again
-      time.Sleep(1 * time.Millisecond)
-    }
-  }()
+  cl.syncTimer = time.NewTimer((time.Duration)(config.Get().Sync) * time.Millisecond)
+  retransmit := time.NewTicker(RETRANSMIT_PERIOD)
+  defer retransmit.Stop()
 
   for {
 
     select {
       // "Untrottled" messages. We want to send these back as fast as possible.
     case packet := <-cl.noThrottleMsg:
-      if send, err := dronedp.GenerateMsg(dronedp.OP_MAVLINK_BIN, cl.sessionId, packet); err != nil {
+      if err := cl.send(dronedp.OP_MAVLINK_BIN, packet, false); err != nil {
         config.Log(config.LOG_WARN, "cl: ", err)
-      } else {
-        // could be no connection
-        if cl.conn != nil {
-          cl.conn.Write(send)
-        }
       }
 
     case <-cl.syncTimer.C:
       if cl.IsOnlineNonBlock() {
         cl.msgMut.RLock()
         for _, packet := range cl.msgs {
-          if send, err := dronedp.GenerateMsg(dronedp.OP_MAVLINK_BIN, cl.sessionId, packet); err != nil {
+          if err := cl.send(dronedp.OP_MAVLINK_BIN, packet, false); err != nil {
             config.Log(config.LOG_WARN, "cl: ", err)
-          } else {
-            // could be no connection
-            if cl.conn != nil {
-              cl.conn.Write(send)
-              op := packet[0x05]
-              delete(cl.msgs, op)
-            }
+          } else if cl.getConn() != nil {
+            op := packet[0x05]
+            delete(cl.msgs, op)
           }
         }
         cl.msgMut.RUnlock()
       }
 
-      cl.syncTimer.Reset((time.Duration)(*config.SyncThrottle) * time.Millisecond)
+      cl.syncTimer.Reset((time.Duration)(config.Get().Sync) * time.Millisecond)
+
+    case now := <-retransmit.C:
+      frames, lost := cl.getLink().Retransmit(now)
+      cl.write(frames)
+      for _, seq := range lost {
+        config.Log(config.LOG_WARN, "cl: ", "DroneDP message", seq, "was never acknowledged.")
+      }
 
     case <-cl.timer.C:
       cl.timer.Reset(1 * time.Second)
+
+      // A stream connection dropped, get it back.
+      if cl.getConn() == nil {
+        cl.resetSession()
+        cl.redial(false)
+      }
+
       cl.uid = cl.store.Get("ruid")
       if cl.uid != "" {
         cl.sendStatus()
@@ -249,42 +250,6 @@ func (cl *CloudLink) Serve() error {
         cl.genRandomId()
         cl.uid = cl.store.Get("ruid");
       }
-
-    // case cl.codeStatus = <-cl.codeRunner.Pid:
-      // just need the figure, no update
-
-    // case str := <-cl.codeRunner.Update:
-    //   config.Log(config.LOG_INFO, "cl: ", str)
-    //   // send code updates
-    //   cop := dronedp.CodeMsg{Op: "code", Msg: str, Status: cl.codeStatus}
-    //   if send, err := dronedp.GenerateMsg(dronedp.OP_STATUS, cl.sessionId, cop); err != nil {
-    //     config.Log(config.LOG_WARN, "cl: ", err)
-    //   } else {
-    //     cl.conn.Write(send)
-    //   }
-
-    case publicTunnel := <-cl.termRunner.Update:
-      // send terminal update
-      // log.Println(publicTunnel)
-      urls := strings.Split(publicTunnel, "tcp://")
-      urls = strings.Split(urls[1], ":")
-      if ival, err := strconv.Atoi(urls[1]); err != nil {
-        config.Log(config.LOG_WARN, "cl: ", err)
-      } else {
-        top := dronedp.TerminalMsg{
-            Op: "terminal",
-            Status: cl.terminalOnline,
-            Msg: dronedp.TerminalInfo{
-              Url: urls[0], Port: ival, User: "", Pass: "",
-            },
-        }
-
-        if send, err := dronedp.GenerateMsg(dronedp.OP_TERMINAL, cl.sessionId, top); err != nil {
-          config.Log(config.LOG_WARN, "cl: ", err)
-        } else {
-          cl.conn.Write(send)
-        }
-      }
     }
   }
 
@@ -352,24 +317,36 @@ func (cl *CloudLink) UpdateSerialId(uid uint64) {
 func (cl *CloudLink) sendStatus() {
   var sm dronedp.StatusMsg
   if cl.sessionId == 0 {
-    if cl.syncer.IsRunning() {
+    if cl.syncer.NeedsCloud() && cl.syncer.IsRunning() {
       config.Log(config.LOG_INFO, "cl: ", "Turning off Syncer")
       cl.syncer.Stop()
     }
 
      em := cl.store.Get("email")
      ps := cl.store.Get("pass")
+
+     // An authenticated device is known by its key, the password stays home.
+     // It offers a key exchange instead, for encrypting the session.
+     var pub string
+     if codec := cl.getCodec(); codec.Authenticated() {
+       ps = ""
+       if p, err := codec.Offer(); err != nil {
+         config.Log(config.LOG_WARN, "cl: ", err)
+       } else {
+         pub = p
+       }
+     }
     sm = dronedp.StatusMsg{Op: "connect",
-      Serial: string(cl.uid), SimId: *config.SimId, Email: em, Password: ps,}
+      Serial: string(cl.uid), SimId: *config.SimId, Email: em, Password: ps, PubKey: pub,
+      Features: []string{dronedp.FEATURE_FRAGMENT, dronedp.FEATURE_ACK},}
   } else {
     sm = dronedp.StatusMsg{Op: "status",}
   }
 
   // config.Log(config.LOG_INFO, sm)
-  if ddpdata, err := dronedp.GenerateMsg(dronedp.OP_STATUS, cl.sessionId, sm); err != nil {
+  // Sent every second anyway, no point acking it.
+  if err := cl.send(dronedp.OP_STATUS, sm, false); err != nil {
     config.Log(config.LOG_WARN, "cl: ", err)
-  } else {
-    cl.conn.Write(ddpdata)
   }
 
   cl.checkOnline()
@@ -377,9 +354,17 @@ func (cl *CloudLink) sendStatus() {
 
 func (cl *CloudLink) handleMessage(decoded *dronedp.Msg) {
   cl.messageCnt = TIME_OUT_CNT
+  codec := cl.getCodec()
   if decoded.Session != cl.sessionId {
     config.Log(config.LOG_INFO, "cl: ", "Session changed:", decoded.Session)
-    cl.sessionId = decoded.Session
+
+    // The server moved on without us, so did our session key. Reconnect to
+    // agree a new one.
+    if cl.sessionId != 0 && codec.Sealed() {
+      cl.resetSession()
+      return
+    }
+    cl.setSession(decoded.Session)
   }
 
   switch decoded.Op {
@@ -387,66 +372,70 @@ func (cl *CloudLink) handleMessage(decoded *dronedp.Msg) {
     // Send message to FMU
     chunk := decoded.Data.([]byte)
     cl.SetRawFmuCmd(chunk)
+  case dronedp.OP_CODE:
+    if cl.authenticated("CODE") {
+      cl.submitJob(decoded.Data.(string))
+    }
+  case dronedp.OP_TERMINAL:
+    if cl.sealed("TERMINAL") {
+      cl.terminalControl(decoded.Data.(*dronedp.TerminalMsg))
+    }
+  case dronedp.OP_TERMINAL_DATA:
+    if cl.sealed("TERMINAL_DATA") {
+      cl.terminalInput(decoded.Data.(*dronedp.TerminalData))
+    }
   case dronedp.OP_STATUS:
-    statusMsg, _ := decoded.Data.(*dronedp.StatusMsg)
+    statusMsg, ok := decoded.Data.(*dronedp.StatusMsg)
+    if !ok {
+      return
+    }
+    cl.getLink().Enable(dronedp.Features(statusMsg.Features))
+
+    if statusMsg.PubKey != "" && !codec.Sealed() {
+      if err := codec.Accept(decoded.Session, statusMsg.PubKey); err != nil {
+        config.Log(config.LOG_WARN, "cl: ", "Key exchange failed:", err)
+      } else {
+        config.Log(config.LOG_INFO, "cl: ", "DroneDP session encrypted.")
+      }
+    } else if codec.Authenticated() && !codec.Sealed() && !cl.warnedPlain {
+      config.Log(config.LOG_WARN, "cl: ", "Server doesn't support encrypted DroneDP, frames are only authenticated.")
+      cl.warnedPlain = true
+    }
     droneId := statusMsg.Drone["_id"].(string)
 
     // avoid sending to the wrong person
-    if cl.syncer.IsRunning() && (cl.syncer.UserId != statusMsg.User || cl.syncer.DroneId != droneId) {
+    if !cl.syncer.NeedsCloud() {
+      // syncing elsewhere, nothing to do
+    } else if user, drone := cl.syncer.ids(); cl.syncer.IsRunning() && (user != statusMsg.User || drone != droneId) {
       config.Log(config.LOG_INFO, "cl: ", "Turning off Syncer")
       cl.syncer.Stop()
     }
 
     // Get this party started
-    if !cl.syncer.IsRunning() {
+    if cl.syncer.NeedsCloud() && !cl.syncer.IsRunning() {
       config.Log(config.LOG_INFO, "cl: ", "Turning on Syncer")
       cl.syncer.Start(statusMsg.User, droneId)
     }
 
-    // Code launching currently not supported.
-    // if statusMsg.Code != "" && cl.codeStatus == 0 {
-    //   config.Log(config.LOG_INFO, "cl: ", "Got CODE, running job.")
-    //
-    //   go func() {
-    //     if err := cl.codeRunner.execScript(statusMsg.Code); err != nil {
-    //       config.Log(config.LOG_ERROR, "cl: ", err)
-    //     }
-    //   }()
-    // }
-
-    if statusMsg.Terminal {
-      if !cl.terminalOnline {
-        config.Log(config.LOG_INFO, "cl: ", "Got TERMINAL, opening tunnel")
-        cl.terminalOnline = true
-
-        go func() {
-          if err := cl.termRunner.Open(); err != nil {
-            config.Log(config.LOG_ERROR, "cl: ", err)
-          }
-        }()
-      }
-    } else {
-      if cl.terminalOnline {
-        config.Log(config.LOG_INFO, "cl: ", "Got TERMINAL, shutting down tunnel")
-
-        go func() {
-          if err := cl.termRunner.Close(); err != nil {
-            config.Log(config.LOG_ERROR, "cl: ", err)
-          } else {
-            cl.terminalOnline = false
-          }
-        }()
-      }
+    if statusMsg.CancelJob != 0 && cl.authenticated("job cancel") {
+      cl.cancelJob(statusMsg.CancelJob)
     }
+
+    cl.setCloudTerminal(statusMsg.Terminal && cl.sealed("TERMINAL"))
   }
 }
 
 func (cl *CloudLink) checkOnline() {
   cl.messageCnt--
   if cl.messageCnt == 0 {
-    cl.sessionId = 0
+    cl.resetSession()
     cl.messageCnt = TIME_OUT_CNT
     config.Log(config.LOG_WARN, "cl: ", "No response from server.")
+
+    // UDP may be blocked here, try the fallbacks.
+    if len(cl.dsc) > 1 {
+      cl.nextTransport()
+    }
   }
 }
 
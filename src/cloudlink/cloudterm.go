@@ -0,0 +1,184 @@
+package cloudlink
+
+import (
+  "crypto/subtle"
+  "fmt"
+  "sync"
+
+  "config"
+  "cloudlink/dronedp"
+  "cloudlink/terminal"
+)
+
+const STORE_TERMINAL_TOKEN = "termtoken"
+
+// The terminal the cloud has open, tunnelled over DroneDP.
+type cloudTerm struct {
+  session   *terminal.Session
+  rx        *terminal.Reorder
+  tx        uint32
+  mut       sync.Mutex
+}
+
+func (cl *CloudLink) initTerminals() {
+  if *config.DisableTerminal {
+    return
+  }
+  cl.terms = terminal.NewManager(*config.TerminalShell)
+}
+
+// Open terminals, nil if they're disabled.
+func (cl *CloudLink) Terminals() *terminal.Manager {
+  return cl.terms
+}
+
+func (cl *CloudLink) HasTerminalToken() bool {
+  return cl.store.Get(STORE_TERMINAL_TOKEN) != ""
+}
+
+func (cl *CloudLink) CheckTerminalToken(token string) bool {
+  return terminal.CheckToken(cl.store.Get(STORE_TERMINAL_TOKEN), token)
+}
+
+// Sets the token local terminals are opened with. Changing a token needs the
+// current one; the first one needs the password the device was set up with,
+// so it can't be claimed by whoever gets to it first.
+func (cl *CloudLink) SetTerminalToken(token, current string) error {
+  if cl.HasTerminalToken() {
+    if !cl.CheckTerminalToken(current) {
+      return fmt.Errorf("Current terminal token is wrong.")
+    }
+  } else if pass := cl.store.Get(STORE_PASS); pass == "" {
+    return fmt.Errorf("Set up the device before setting a terminal token.")
+  } else if subtle.ConstantTimeCompare([]byte(pass), []byte(current)) != 1 {
+    return fmt.Errorf("Account password is wrong.")
+  }
+  if len(token) < 8 {
+    return fmt.Errorf("Terminal token must be at least 8 characters.")
+  }
+  return cl.store.Set(STORE_TERMINAL_TOKEN, terminal.HashToken(token))
+}
+
+// A shell is only handed to a cloud that proved it holds the device key, over
+// a link nobody else can read.
+func (cl *CloudLink) sealed(what string) bool {
+  if cl.getCodec().Sealed() {
+    return true
+  }
+  config.Log(config.LOG_WARN, "cl: ", "Got", what, "over unsealed DroneDP, ignoring it. Provision a device key to allow it.")
+  return false
+}
+
+// Whether a status reply asking for a terminal would open one.
+func (cl *CloudLink) wouldOpenTerminal() bool {
+  cl.termMut.Lock()
+  defer cl.termMut.Unlock()
+  return cl.cloudTerm == nil && !cl.termWait
+}
+
+// Opens or closes the cloud's terminal, following the status reply.
+func (cl *CloudLink) setCloudTerminal(on bool) {
+  cl.termMut.Lock()
+  defer cl.termMut.Unlock()
+
+  if !on {
+    cl.termWait = false
+    if cl.cloudTerm != nil {
+      config.Log(config.LOG_INFO, "cl: ", "Got TERMINAL, closing terminal")
+      cl.cloudTerm.session.Close()
+      cl.cloudTerm = nil
+    }
+    return
+  }
+
+  // The cloud keeps asking until it sees the answer. After a refusal, or the
+  // shell exiting, wait for it to stop before opening another.
+  if cl.cloudTerm != nil || cl.termWait {
+    return
+  }
+  if cl.terms == nil || !*config.CloudTerminal {
+    config.Log(config.LOG_WARN, "cl: ", "Got TERMINAL, but cloud terminals are disabled.")
+    cl.termWait = true
+    cl.send(dronedp.OP_TERMINAL, dronedp.TerminalMsg{Op: "terminal", Msg: "Disabled."}, true)
+    return
+  }
+
+  config.Log(config.LOG_INFO, "cl: ", "Got TERMINAL, opening terminal")
+  s, err := cl.terms.Open("cloud", 0, 0)
+  if err != nil {
+    config.Log(config.LOG_ERROR, "cl: ", err)
+    cl.termWait = true
+    cl.send(dronedp.OP_TERMINAL, dronedp.TerminalMsg{Op: "terminal", Msg: err.Error()}, true)
+    return
+  }
+
+  ct := &cloudTerm{session: s, rx: terminal.NewReorder()}
+  cl.cloudTerm = ct
+  cl.send(dronedp.OP_TERMINAL, dronedp.TerminalMsg{Op: "terminal", Status: true, Session: s.Id}, true)
+  go cl.pumpCloudTerminal(ct)
+}
+
+// Sends the shell's output to the cloud until it exits or is closed.
+func (cl *CloudLink) pumpCloudTerminal(ct *cloudTerm) {
+  buf := make([]byte, 4096)
+  for {
+    n, err := ct.session.Read(buf)
+    if err != nil {
+      break
+    }
+
+    ct.mut.Lock()
+    td := dronedp.TerminalData{Session: ct.session.Id, Seq: ct.tx, Data: buf[:n]}
+    ct.tx++
+    ct.mut.Unlock()
+
+    if err := cl.send(dronedp.OP_TERMINAL_DATA, td, true); err != nil {
+      config.Log(config.LOG_WARN, "cl: ", err)
+    }
+  }
+
+  ct.session.Close()
+  cl.termMut.Lock()
+  if cl.cloudTerm == ct {
+    cl.cloudTerm = nil
+    cl.termWait = true
+  }
+  cl.termMut.Unlock()
+
+  cl.send(dronedp.OP_TERMINAL, dronedp.TerminalMsg{Op: "terminal", Session: ct.session.Id}, true)
+}
+
+func (cl *CloudLink) getCloudTerm(session uint32) *cloudTerm {
+  cl.termMut.Lock()
+  defer cl.termMut.Unlock()
+
+  if cl.cloudTerm == nil || cl.cloudTerm.session.Id != session {
+    return nil
+  }
+  return cl.cloudTerm
+}
+
+// Keystrokes from the cloud.
+func (cl *CloudLink) terminalInput(td *dronedp.TerminalData) {
+  ct := cl.getCloudTerm(td.Session)
+  if ct == nil {
+    return
+  }
+
+  ct.mut.Lock()
+  chunks := ct.rx.Push(td.Seq, td.Data)
+  ct.mut.Unlock()
+
+  for _, chunk := range chunks {
+    ct.session.Write(chunk)
+  }
+}
+
+func (cl *CloudLink) terminalControl(tm *dronedp.TerminalMsg) {
+  if tm.Op != "resize" {
+    return
+  }
+  if ct := cl.getCloudTerm(tm.Session); ct != nil {
+    ct.session.Resize(tm.Rows, tm.Cols)
+  }
+}
@@ -0,0 +1,123 @@
+// +build !windows
+
+package codejob
+
+import (
+  "io/ioutil"
+  "os"
+  "testing"
+  "time"
+)
+
+// Runs jobs with sh standing in for python.
+func newTestService(t *testing.T, limits Limits) (*Service, func()) {
+  dir, err := ioutil.TempDir("", "codejob")
+  if err != nil {
+    t.Fatal(err)
+  }
+  s, err := NewService(dir, "/bin/sh", limits)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return s, func() { os.RemoveAll(dir) }
+}
+
+func waitDone(t *testing.T, s *Service, id int) Job {
+  for i := 0; i < 500; i++ {
+    if j, _ := s.Job(id); j.Done() {
+      return j
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+  t.Fatalf("job %d never finished", id)
+  return Job{}
+}
+
+func TestRunAndStream(t *testing.T) {
+  s, done := newTestService(t, Limits{Timeout: 5 * time.Second})
+  defer done()
+
+  events, unsub := s.Subscribe()
+  defer unsub()
+
+  j, err := s.Submit("echo hello\necho oops >&2\nexit 3\n", SOURCE_LOCAL)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  j = waitDone(t, s, j.Id)
+  if j.State != STATE_FAILED || j.Exit != 3 {
+    t.Errorf("got state %s exit %d", j.State, j.Exit)
+  }
+  if len(j.Output) != 2 {
+    t.Fatalf("got output %+v", j.Output)
+  }
+
+  lines := map[string]string{}
+  for _, l := range j.Output {
+    lines[l.Stream] = l.Text
+  }
+  if lines[STREAM_STDOUT] != "hello" || lines[STREAM_STDERR] != "oops" {
+    t.Errorf("got output %+v", j.Output)
+  }
+
+  var states []string
+  got := 0
+  for len(states) < 3 {
+    select {
+    case ev := <-events:
+      if ev.Line != nil {
+        got++
+      } else {
+        states = append(states, ev.Job.State)
+      }
+    case <-time.After(time.Second):
+      t.Fatalf("missing events, got states %v", states)
+    }
+  }
+  if got != 2 || states[0] != STATE_QUEUED || states[1] != STATE_RUNNING || states[2] != STATE_FAILED {
+    t.Errorf("got %d lines, states %v", got, states)
+  }
+}
+
+func TestCancelAndTimeout(t *testing.T) {
+  s, done := newTestService(t, Limits{Timeout: 300 * time.Millisecond})
+  defer done()
+
+  slow, _ := s.Submit("sleep 5\n", SOURCE_LOCAL)
+  queued, _ := s.Submit("sleep 5\n", SOURCE_CLOUD)
+  if err := s.Cancel(queued.Id); err != nil {
+    t.Fatal(err)
+  }
+
+  if j := waitDone(t, s, slow.Id); j.State != STATE_TIMEOUT {
+    t.Errorf("slow job: got %s", j.State)
+  }
+  if j := waitDone(t, s, queued.Id); j.State != STATE_CANCELLED || !j.Started.IsZero() {
+    t.Errorf("queued job: got %s, started %v", j.State, j.Started)
+  }
+  if err := s.Cancel(queued.Id); err != ErrFinished {
+    t.Errorf("cancelling twice: got %v", err)
+  }
+}
+
+func TestHistoryReloads(t *testing.T) {
+  s, done := newTestService(t, Limits{})
+  defer done()
+
+  j, _ := s.Submit("echo hi\n", SOURCE_LOCAL)
+  waitDone(t, s, j.Id)
+  time.Sleep(50 * time.Millisecond)
+
+  s2, err := NewService(s.dir, "/bin/sh", Limits{})
+  if err != nil {
+    t.Fatal(err)
+  }
+  jobs := s2.Jobs()
+  if len(jobs) != 1 || jobs[0].Id != j.Id || jobs[0].State != STATE_DONE {
+    t.Fatalf("got %+v", jobs)
+  }
+  if next, _ := s2.Submit("true\n", SOURCE_LOCAL); next.Id != j.Id + 1 {
+    t.Errorf("next id %d", next.Id)
+  }
+}
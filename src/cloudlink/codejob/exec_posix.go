@@ -0,0 +1,83 @@
+// +build !windows
+
+package codejob
+
+import (
+  "fmt"
+  "io/ioutil"
+  "os"
+  "os/exec"
+  "os/user"
+  "path/filepath"
+  "strconv"
+  "syscall"
+)
+
+const SCRIPT_NAME = "job.py"
+
+// Looks up the user jobs run as. nil if there isn't one, or we aren't root
+// and couldn't switch anyway.
+func credential(name string) (*syscall.Credential, error) {
+  if name == "" || os.Geteuid() != 0 {
+    return nil, nil
+  }
+
+  u, err := user.Lookup(name)
+  if err != nil {
+    return nil, fmt.Errorf("Code user %s: %v", name, err)
+  }
+  uid, _ := strconv.ParseUint(u.Uid, 10, 32)
+  gid, _ := strconv.ParseUint(u.Gid, 10, 32)
+  return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: []uint32{}}, nil
+}
+
+// Writes out the job's script in a scratch directory it owns.
+func prepare(work, code string, limits Limits) (string, error) {
+  if err := os.MkdirAll(work, 0755); err != nil {
+    return "", err
+  }
+  script := filepath.Join(work, SCRIPT_NAME)
+  if err := ioutil.WriteFile(script, []byte(code), 0644); err != nil {
+    return "", err
+  }
+
+  cred, err := credential(limits.User)
+  if err != nil {
+    return "", err
+  }
+  if cred != nil {
+    if err := os.Chown(work, int(cred.Uid), int(cred.Gid)); err != nil {
+      return "", err
+    }
+  }
+  return script, nil
+}
+
+// The interpreter runs under a shell that sets the resource limits first, in
+// its own process group so the whole tree can be killed.
+func command(interp, script string, limits Limits) (*exec.Cmd, error) {
+  cred, err := credential(limits.User)
+  if err != nil {
+    return nil, err
+  }
+
+  sh := ""
+  if limits.CPU > 0 {
+    sh += fmt.Sprintf("ulimit -t %d && ", int64(limits.CPU.Seconds() + 0.5))
+  }
+  if limits.Memory > 0 {
+    sh += fmt.Sprintf("ulimit -v %d && ", limits.Memory / 1024)
+  }
+  sh += `exec "$0" "$1"`
+
+  cmd := exec.Command("/bin/sh", "-c", sh, interp, script)
+  cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: cred}
+  cmd.Env = []string{"PATH=/usr/local/bin:/usr/bin:/bin", "HOME=" + filepath.Dir(script), "PYTHONUNBUFFERED=1"}
+  return cmd, nil
+}
+
+func kill(cmd *exec.Cmd) {
+  if cmd.Process != nil {
+    syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+  }
+}
@@ -0,0 +1,31 @@
+package codejob
+
+import (
+  "io/ioutil"
+  "os"
+  "os/exec"
+  "path/filepath"
+)
+
+const SCRIPT_NAME = "job.py"
+
+// No users or resource limits here, only the timeout applies.
+func prepare(work, code string, limits Limits) (string, error) {
+  if err := os.MkdirAll(work, 0755); err != nil {
+    return "", err
+  }
+  script := filepath.Join(work, SCRIPT_NAME)
+  return script, ioutil.WriteFile(script, []byte(code), 0644)
+}
+
+func command(interp, script string, limits Limits) (*exec.Cmd, error) {
+  cmd := exec.Command(interp, script)
+  cmd.Env = append(os.Environ(), "PYTHONUNBUFFERED=1")
+  return cmd, nil
+}
+
+func kill(cmd *exec.Cmd) {
+  if cmd.Process != nil {
+    cmd.Process.Kill()
+  }
+}
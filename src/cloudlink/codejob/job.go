@@ -0,0 +1,86 @@
+package codejob
+
+import (
+  "time"
+)
+
+const (
+  STATE_QUEUED = "queued"
+  STATE_RUNNING = "running"
+  STATE_DONE = "done"
+  STATE_FAILED = "failed"
+  STATE_CANCELLED = "cancelled"
+  STATE_TIMEOUT = "timeout"
+
+  SOURCE_CLOUD = "cloud"
+  SOURCE_LOCAL = "local"
+
+  STREAM_STDOUT = "stdout"
+  STREAM_STDERR = "stderr"
+
+  // Only the tail of a job's output is kept.
+  MAX_OUTPUT_LINES = 1000
+  MAX_LINE_LEN = 4096
+)
+
+type Line struct {
+  Time      time.Time `json:"time"`
+  Stream    string    `json:"stream"`
+  Text      string    `json:"text"`
+}
+
+type Job struct {
+  Id        int       `json:"id"`
+  Source    string    `json:"source"`
+  Code      string    `json:"code"`
+  State     string    `json:"state"`
+  Pid       int       `json:"pid,omitempty"`
+  Exit      int       `json:"exit"`
+  Error     string    `json:"error,omitempty"`
+  Queued    time.Time `json:"queued"`
+  Started   time.Time `json:"started,omitempty"`
+  Finished  time.Time `json:"finished,omitempty"`
+
+  Output    []Line    `json:"output,omitempty"`
+  Dropped   int       `json:"dropped,omitempty"`
+}
+
+func (j *Job) Done() bool {
+  return j.State != STATE_QUEUED && j.State != STATE_RUNNING
+}
+
+// A copy without the output, for listings.
+func (j *Job) Summary() Job {
+  s := *j
+  s.Output = nil
+  return s
+}
+
+func (j *Job) copy() Job {
+  c := *j
+  c.Output = append([]Line(nil), j.Output...)
+  return c
+}
+
+func (j *Job) addLine(l Line) {
+  if len(j.Output) >= MAX_OUTPUT_LINES {
+    j.Output = append(j.Output[:0], j.Output[1:]...)
+    j.Dropped++
+  }
+  j.Output = append(j.Output, l)
+}
+
+// Something that happened to a job. Line is set for output, otherwise the
+// job's state changed.
+type Event struct {
+  Job       Job       `json:"job"`
+  Line      *Line     `json:"line,omitempty"`
+}
+
+// What a job is allowed to use. Zero means no limit.
+type Limits struct {
+  User      string          // run as this user, if we're root
+  CPU       time.Duration   // CPU time
+  Memory    int64           // address space, bytes
+  Timeout   time.Duration   // wall clock
+}
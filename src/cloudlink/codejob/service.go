@@ -0,0 +1,377 @@
+package codejob
+
+import (
+  "bufio"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "strconv"
+  "sync"
+  "time"
+)
+
+const (
+  HISTORY_FILE = "history.json"
+  MAX_HISTORY = 50
+  MAX_QUEUED = 10
+  MAX_CODE_LEN = 256 * 1024
+
+  SUBSCRIBER_BUFFER = 256
+)
+
+var (
+  ErrQueueFull = errors.New("Too many jobs queued.")
+  ErrNoJob = errors.New("No such job.")
+  ErrFinished = errors.New("Job already finished.")
+)
+
+// Runs user code one job at a time, in the order it was submitted. Each job
+// gets a scratch directory under dir, the limits, and its output streamed to
+// subscribers. Finished jobs are kept in a short history, saved in dir.
+type Service struct {
+  dir       string
+  interp    string
+  limits    Limits
+
+  mut       sync.Mutex
+  jobs      []*Job
+  nextId    int
+  queue     chan *Job
+  cancel    map[int]chan string
+  subs      map[chan Event]bool
+}
+
+func NewService(dir, interp string, limits Limits) (*Service, error) {
+  if err := os.MkdirAll(dir, 0755); err != nil {
+    return nil, err
+  }
+
+  s := &Service{
+    dir: dir,
+    interp: interp,
+    limits: limits,
+    nextId: 1,
+    queue: make(chan *Job, MAX_QUEUED),
+    cancel: make(map[int]chan string),
+    subs: make(map[chan Event]bool),
+  }
+  s.load()
+
+  go s.run()
+  return s, nil
+}
+
+// Queues code to run.
+func (s *Service) Submit(code, source string) (Job, error) {
+  if code == "" {
+    return Job{}, fmt.Errorf("No code given.")
+  } else if len(code) > MAX_CODE_LEN {
+    return Job{}, fmt.Errorf("Code is over %d bytes.", MAX_CODE_LEN)
+  }
+
+  s.mut.Lock()
+  j := &Job{Id: s.nextId, Source: source, Code: code, State: STATE_QUEUED, Queued: time.Now()}
+  select {
+  case s.queue <- j:
+  default:
+    s.mut.Unlock()
+    return Job{}, ErrQueueFull
+  }
+  s.nextId++
+  s.jobs = append(s.jobs, j)
+  s.cancel[j.Id] = make(chan string, 1)
+  s.trim()
+  ev := Event{Job: j.Summary()}
+  s.mut.Unlock()
+
+  s.publish(ev)
+  return ev.Job, nil
+}
+
+// Stops a queued or running job.
+func (s *Service) Cancel(id int) error {
+  s.mut.Lock()
+  defer s.mut.Unlock()
+
+  j := s.find(id)
+  if j == nil {
+    return ErrNoJob
+  } else if j.Done() {
+    return ErrFinished
+  }
+
+  select {
+  case s.cancel[id] <- STATE_CANCELLED:
+  default:
+  }
+  return nil
+}
+
+// All jobs still known about, oldest first, without their output.
+func (s *Service) Jobs() []Job {
+  s.mut.Lock()
+  defer s.mut.Unlock()
+
+  list := make([]Job, len(s.jobs))
+  for i, j := range s.jobs {
+    list[i] = j.Summary()
+  }
+  return list
+}
+
+func (s *Service) Job(id int) (Job, error) {
+  s.mut.Lock()
+  defer s.mut.Unlock()
+
+  if j := s.find(id); j != nil {
+    return j.copy(), nil
+  }
+  return Job{}, ErrNoJob
+}
+
+// Events for every job from now on. Slow subscribers miss events rather than
+// holding up the job. Call the returned func when done.
+func (s *Service) Subscribe() (<-chan Event, func()) {
+  ch := make(chan Event, SUBSCRIBER_BUFFER)
+
+  s.mut.Lock()
+  s.subs[ch] = true
+  s.mut.Unlock()
+
+  return ch, func() {
+    s.mut.Lock()
+    if s.subs[ch] {
+      delete(s.subs, ch)
+      close(ch)
+    }
+    s.mut.Unlock()
+  }
+}
+
+func (s *Service) publish(ev Event) {
+  s.mut.Lock()
+  defer s.mut.Unlock()
+
+  for ch := range s.subs {
+    select {
+    case ch <- ev:
+    default:
+    }
+  }
+}
+
+// Must be called with the lock held.
+func (s *Service) find(id int) *Job {
+  for _, j := range s.jobs {
+    if j.Id == id {
+      return j
+    }
+  }
+  return nil
+}
+
+// Drops the oldest finished jobs past MAX_HISTORY. Must be called with the
+// lock held.
+func (s *Service) trim() {
+  for len(s.jobs) > MAX_HISTORY && s.jobs[0].Done() {
+    s.jobs = s.jobs[1:]
+  }
+}
+
+func (s *Service) setState(j *Job, update func(j *Job)) {
+  s.mut.Lock()
+  update(j)
+  ev := Event{Job: j.Summary()}
+  if j.Done() {
+    delete(s.cancel, j.Id)
+  }
+  s.mut.Unlock()
+
+  s.publish(ev)
+}
+
+func (s *Service) run() {
+  for j := range s.queue {
+    s.mut.Lock()
+    cancel := s.cancel[j.Id]
+    s.mut.Unlock()
+
+    // Cancelled while queued.
+    select {
+    case state := <-cancel:
+      s.setState(j, func(j *Job) {
+        j.State, j.Finished = state, time.Now()
+      })
+      s.save()
+      continue
+    default:
+    }
+
+    s.execute(j, cancel)
+    s.save()
+  }
+}
+
+func (s *Service) execute(j *Job, cancel chan string) {
+  fail := func(err error) {
+    s.setState(j, func(j *Job) {
+      j.State, j.Error, j.Exit, j.Finished = STATE_FAILED, err.Error(), -1, time.Now()
+    })
+  }
+
+  work := filepath.Join(s.dir, strconv.Itoa(j.Id))
+  defer os.RemoveAll(work)
+
+  script, err := prepare(work, j.Code, s.limits)
+  if err != nil {
+    fail(err)
+    return
+  }
+
+  cmd, err := command(s.interp, script, s.limits)
+  if err != nil {
+    fail(err)
+    return
+  }
+  cmd.Dir = work
+
+  stdout, err := cmd.StdoutPipe()
+  if err != nil {
+    fail(err)
+    return
+  }
+  stderr, err := cmd.StderrPipe()
+  if err != nil {
+    fail(err)
+    return
+  }
+
+  if err := cmd.Start(); err != nil {
+    fail(err)
+    return
+  }
+  s.setState(j, func(j *Job) {
+    j.State, j.Pid, j.Started = STATE_RUNNING, cmd.Process.Pid, time.Now()
+  })
+
+  var wg sync.WaitGroup
+  wg.Add(2)
+  go s.pipe(j, STREAM_STDOUT, stdout, &wg)
+  go s.pipe(j, STREAM_STDERR, stderr, &wg)
+
+  exited := make(chan error, 1)
+  go func() {
+    wg.Wait()
+    exited <- cmd.Wait()
+  }()
+
+  var timeout <-chan time.Time
+  if s.limits.Timeout > 0 {
+    timer := time.NewTimer(s.limits.Timeout)
+    defer timer.Stop()
+    timeout = timer.C
+  }
+
+  state := ""
+  select {
+  case err = <-exited:
+  case state = <-cancel:
+  case <-timeout:
+    state = STATE_TIMEOUT
+  }
+  if state != "" {
+    kill(cmd)
+    err = <-exited
+  }
+
+  s.setState(j, func(j *Job) {
+    j.Finished = time.Now()
+    j.Exit = exitCode(cmd, err)
+    switch {
+    case state != "":
+      j.State = state
+    case err != nil:
+      j.State, j.Error = STATE_FAILED, err.Error()
+    default:
+      j.State = STATE_DONE
+    }
+  })
+}
+
+func (s *Service) pipe(j *Job, stream string, r io.Reader, wg *sync.WaitGroup) {
+  defer wg.Done()
+
+  scanner := bufio.NewScanner(r)
+  scanner.Buffer(make([]byte, MAX_LINE_LEN), MAX_LINE_LEN)
+  for scanner.Scan() {
+    l := Line{Time: time.Now(), Stream: stream, Text: scanner.Text()}
+
+    s.mut.Lock()
+    j.addLine(l)
+    ev := Event{Job: j.Summary(), Line: &l}
+    s.mut.Unlock()
+
+    s.publish(ev)
+  }
+
+  // Over long lines stop the scanner, don't leave the process blocked on a
+  // full pipe.
+  io.Copy(ioutil.Discard, r)
+}
+
+func exitCode(cmd *exec.Cmd, err error) int {
+  if cmd.ProcessState != nil {
+    return cmd.ProcessState.ExitCode()
+  } else if err != nil {
+    return -1
+  }
+  return 0
+}
+
+func (s *Service) load() {
+  data, err := ioutil.ReadFile(filepath.Join(s.dir, HISTORY_FILE))
+  if err != nil {
+    return
+  }
+
+  var jobs []*Job
+  if json.Unmarshal(data, &jobs) != nil {
+    return
+  }
+
+  for _, j := range jobs {
+    // We went down with it.
+    if !j.Done() {
+      j.State, j.Error = STATE_FAILED, "Interrupted by a restart."
+    }
+    if j.Id >= s.nextId {
+      s.nextId = j.Id + 1
+    }
+  }
+  s.jobs = jobs
+  s.trim()
+}
+
+func (s *Service) save() {
+  s.mut.Lock()
+  var done []*Job
+  for _, j := range s.jobs {
+    if j.Done() {
+      done = append(done, j)
+    }
+  }
+  data, err := json.Marshal(done)
+  s.mut.Unlock()
+
+  if err == nil {
+    path := filepath.Join(s.dir, HISTORY_FILE)
+    if ioutil.WriteFile(path + ".tmp", data, 0644) == nil {
+      os.Rename(path + ".tmp", path)
+    }
+  }
+}
@@ -0,0 +1,93 @@
+package cloudlink
+
+import (
+  "time"
+
+  "config"
+  "cloudlink/codejob"
+  "cloudlink/dronedp"
+)
+
+func (cl *CloudLink) initJobs() error {
+  if *config.DisableCode {
+    return nil
+  }
+
+  limits := codejob.Limits{
+    User: *config.CodeUser,
+    CPU: time.Duration(*config.CodeCPU) * time.Second,
+    Memory: int64(*config.CodeMemory) << 20,
+    Timeout: time.Duration(*config.CodeTimeout) * time.Second,
+  }
+
+  var err error
+  if cl.jobs, err = codejob.NewService(*config.AssetsPath + ".jobs", *config.CodeInterpreter, limits); err != nil {
+    return err
+  }
+
+  go cl.streamJobs()
+  return nil
+}
+
+// The code job service, nil if running code is disabled.
+func (cl *CloudLink) Jobs() *codejob.Service {
+  return cl.jobs
+}
+
+// Whether a frame that asks us to run something could only have come from
+// the cloud. Without a device key anyone able to spoof a UDP reply from the
+// DSC address could send it.
+func (cl *CloudLink) authenticated(what string) bool {
+  if cl.getCodec().Authenticated() {
+    return true
+  }
+  config.Log(config.LOG_WARN, "cl: ", "Got", what, "over unauthenticated DroneDP, ignoring it. Provision a device key to allow it.")
+  return false
+}
+
+func (cl *CloudLink) submitJob(code string) {
+  if cl.jobs == nil {
+    config.Log(config.LOG_WARN, "cl: ", "Got CODE, but running code is disabled.")
+    return
+  }
+
+  if j, err := cl.jobs.Submit(code, codejob.SOURCE_CLOUD); err != nil {
+    config.Log(config.LOG_WARN, "cl: ", "Got CODE, not queued:", err)
+  } else {
+    config.Log(config.LOG_INFO, "cl: ", "Got CODE, queued job", j.Id)
+  }
+}
+
+func (cl *CloudLink) cancelJob(id int) {
+  if cl.jobs == nil {
+    return
+  }
+  if err := cl.jobs.Cancel(id); err != nil && err != codejob.ErrFinished {
+    config.Log(config.LOG_WARN, "cl: ", "Cancelling job", id, err)
+  }
+}
+
+// Passes job output and state changes on to the cloud. State changes have to
+// arrive, output is best effort like telemetry.
+func (cl *CloudLink) streamJobs() {
+  events, _ := cl.jobs.Subscribe()
+  for ev := range events {
+    if cl.sessionId == 0 {
+      continue
+    }
+
+    cop := dronedp.CodeMsg{Op: "code", Status: ev.Job.Pid, Job: ev.Job.Id, State: ev.Job.State, Exit: ev.Job.Exit}
+    if ev.Line != nil {
+      cop.Msg, cop.Stream = ev.Line.Text, ev.Line.Stream
+    } else {
+      cop.Msg = ev.Job.Error
+      if ev.Job.Done() {
+        cop.Status = 0
+      }
+    }
+
+    if err := cl.send(dronedp.OP_STATUS, cop, ev.Line == nil); err != nil {
+      config.Log(config.LOG_WARN, "cl: ", err)
+    }
+  }
+}
@@ -0,0 +1,147 @@
+package cloudlink
+
+import (
+  "time"
+
+  "config"
+  "cloudlink/transport"
+)
+
+func (cl *CloudLink) getConn() transport.Transport {
+  cl.connMut.RLock()
+  defer cl.connMut.RUnlock()
+  return cl.conn
+}
+
+// Swaps in a new connection, closing the old one. Its read loop notices and
+// exits.
+func (cl *CloudLink) setConn(t transport.Transport) {
+  cl.connMut.Lock()
+  old := cl.conn
+  cl.conn = t
+  cl.connMut.Unlock()
+
+  if old != nil {
+    old.Close()
+  }
+}
+
+// Connects to the current DSC address, moving down the fallbacks if it can't.
+// Each try can take up to transport.DIAL_TIMEOUT, so once Serve is running
+// this goes through redial.
+func (cl *CloudLink) dial() error {
+  var err error
+  for range cl.dsc {
+    var t transport.Transport
+    if t, err = transport.Dial(cl.dsc[cl.dscIdx]); err == nil {
+      cloudDials.With(cl.dsc[cl.dscIdx], "ok").Inc()
+      cl.setConn(t)
+      config.Log(config.LOG_INFO, "cl: ", "Talking to DSC on", t)
+      go cl.readLoop(t)
+      return nil
+    }
+
+    cloudDials.With(cl.dsc[cl.dscIdx], "error").Inc()
+    config.Log(config.LOG_WARN, "cl: ", err)
+    cl.dscIdx = (cl.dscIdx + 1) % len(cl.dsc)
+  }
+  return err
+}
+
+// Dials in the background, so a TCP or WebSocket candidate that takes its
+// time doesn't hold up status chirps and retransmits. next moves on to the
+// following address first. Does nothing while a dial is already under way.
+func (cl *CloudLink) redial(next bool) {
+  cl.connMut.Lock()
+  if cl.dialing {
+    cl.connMut.Unlock()
+    return
+  }
+  cl.dialing = true
+  cl.connMut.Unlock()
+
+  go func() {
+    if next {
+      cl.dscIdx = (cl.dscIdx + 1) % len(cl.dsc)
+    }
+    cl.dial()
+
+    cl.connMut.Lock()
+    cl.dialing = false
+    cl.connMut.Unlock()
+  }()
+}
+
+// Tries the next DSC address, when the current one has stopped answering.
+func (cl *CloudLink) nextTransport() {
+  cl.setConn(nil)
+  cl.redial(true)
+}
+
+// Every session change goes through here, to keep count of them.
+func (cl *CloudLink) setSession(id uint32) {
+  if id != 0 && cl.sessionId == 0 {
+    if cl.hadSession {
+      cloudReconnects.Inc()
+    }
+    cl.hadSession = true
+  }
+
+  cl.sessionId = id
+  if id != 0 {
+    cloudSession.Set(1)
+  } else {
+    cloudSession.Set(0)
+  }
+}
+
+// Forgets the DroneDP session, so the next status chirp reconnects.
+func (cl *CloudLink) resetSession() {
+  cl.setSession(0)
+  cl.getCodec().Drop()
+  cl.getLink().Enable(false, false)
+  cl.getLink().Reset()
+  cl.setCloudTerminal(false)
+}
+
+func (cl *CloudLink) readLoop(t transport.Transport) {
+  rx := make([]byte, RX_BUFFER_SIZE)
+  for {
+    n, err := t.Read(rx)
+
+    // Replaced while we were reading.
+    if cl.getConn() != t {
+      return
+    }
+
+    if err != nil {
+      cl.setSession(0)
+
+      // A stream is done once it errors. Drop it, the status timer dials again.
+      if t.Stream() {
+        config.Log(config.LOG_WARN, "cl: ", "Lost", t, err)
+        cl.connMut.Lock()
+        if cl.conn == t {
+          cl.conn = nil
+        }
+        cl.connMut.Unlock()
+        t.Close()
+        return
+      }
+    } else if n > 0 {
+      // parse message
+      decoded, replies, err := cl.getLink().Receive(rx[:n])
+      if err == nil && decoded != nil && cl.hasEffects(decoded) {
+        cl.saveFloor()
+      }
+      cl.write(replies)
+      if err != nil {
+        config.Log(config.LOG_WARN, err)
+      } else if decoded != nil {
+        cl.handleMessage(decoded)
+      }
+    }
+    // Wait a little before reading again
+    time.Sleep(1 * time.Millisecond)
+  }
+}
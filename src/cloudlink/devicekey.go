@@ -0,0 +1,165 @@
+package cloudlink
+
+import (
+  "crypto/sha256"
+  "encoding/hex"
+  "strconv"
+  "time"
+
+  "config"
+  "cloudlink/dronedp"
+)
+
+const (
+  STORE_DEVICE_KEY = "ddpkey"
+  STORE_DDP_COUNTER = "ddpcounter"
+  // The newest counter taken from the server, see dronedp.Codec.SetFloor.
+  STORE_DDP_RX = "ddprx"
+
+  // The frame counter is persisted this far ahead, so it never has to be
+  // written per frame and still can't go backwards after a reboot.
+  COUNTER_RESERVE = 1 << 16
+)
+
+// Builds the DroneDP codec from the provisioned key, if there is one, and the
+// link on top of it.
+func (cl *CloudLink) initCodec() {
+  var key []byte
+  if hexKey := cl.store.Get(STORE_DEVICE_KEY); hexKey != "" {
+    var err error
+    if key, err = dronedp.ParseKey(hexKey); err != nil {
+      config.Log(config.LOG_ERROR, "cl: ", "Ignoring device key:", err)
+      key = nil
+    }
+  }
+
+  // Start above both the clock and whatever we reserved last time, in case
+  // the clock came up wrong.
+  start := uint64(time.Now().UnixNano() / 1000)
+  if saved, err := strconv.ParseUint(cl.store.Get(STORE_DDP_COUNTER), 10, 64); err == nil && saved > start {
+    start = saved
+  }
+
+  // Nothing the server sent before we went down is taken again.
+  codec := dronedp.NewCodec(key, start)
+  floor, _ := strconv.ParseUint(cl.store.Get(STORE_DDP_RX), 10, 64)
+  codec.SetFloor(floor)
+
+  cl.codecMut.Lock()
+  cl.link = dronedp.NewLink(codec, *config.DDPMtu)
+  cl.counterCeil = 0
+  cl.rxFloor = floor
+  cl.codecMut.Unlock()
+
+  if key == nil {
+    config.Log(config.LOG_WARN, "cl: ", "No device key provisioned, DroneDP is unauthenticated.")
+  }
+}
+
+func (cl *CloudLink) getLink() *dronedp.Link {
+  cl.codecMut.RLock()
+  defer cl.codecMut.RUnlock()
+  return cl.link
+}
+
+func (cl *CloudLink) getCodec() *dronedp.Codec {
+  return cl.getLink().Codec()
+}
+
+// Sends a message to the cloud, fragmented if it has to be. reliable messages
+// are retransmitted until acked, when the server does acks.
+func (cl *CloudLink) send(op dronedp.OP, data interface{}, reliable bool) error {
+  frames, err := cl.getLink().Send(op, cl.sessionId, data, reliable)
+  if err != nil {
+    return err
+  }
+  cl.write(frames)
+  return nil
+}
+
+// Writes out frames, keeping the persisted counter ahead of them.
+func (cl *CloudLink) write(frames [][]byte) {
+  // could be no connection
+  conn := cl.getConn()
+  if conn == nil || len(frames) == 0 {
+    return
+  }
+  for _, frame := range frames {
+    conn.Write(frame)
+  }
+
+  codec := cl.getCodec()
+  if !codec.Authenticated() {
+    return
+  }
+
+  cl.codecMut.Lock()
+  if n := codec.Counter(); n >= cl.counterCeil {
+    cl.counterCeil = n + COUNTER_RESERVE
+    if err := cl.store.Set(STORE_DDP_COUNTER, strconv.FormatUint(cl.counterCeil, 10)); err != nil {
+      config.Log(config.LOG_ERROR, "cl: ", "Saving DroneDP counter:", err)
+    }
+  }
+  cl.codecMut.Unlock()
+}
+
+// Whether acting on msg does more than report. Only those save the server's
+// counter, so routine traffic doesn't write to flash; the rest can be played
+// back after a restart to no effect.
+func (cl *CloudLink) hasEffects(msg *dronedp.Msg) bool {
+  switch msg.Op {
+  case dronedp.OP_CODE, dronedp.OP_TERMINAL, dronedp.OP_TERMINAL_DATA:
+    return true
+  case dronedp.OP_STATUS:
+    if sm, ok := msg.Data.(*dronedp.StatusMsg); ok {
+      return sm.CancelJob != 0 || (sm.Terminal && cl.wouldOpenTerminal())
+    }
+  }
+  return false
+}
+
+// Saves the server's counter before a frame with effects is acted on, so it
+// can't be played back to us after a restart.
+func (cl *CloudLink) saveFloor() {
+  n := cl.getCodec().AuthCounter()
+
+  cl.codecMut.Lock()
+  defer cl.codecMut.Unlock()
+  if n <= cl.rxFloor {
+    return
+  }
+  cl.rxFloor = n
+  if err := cl.store.Set(STORE_DDP_RX, strconv.FormatUint(n, 10)); err != nil {
+    config.Log(config.LOG_ERROR, "cl: ", "Saving DroneDP receive counter:", err)
+  }
+}
+
+// Provisions the device key, hex encoded. An empty key removes it.
+func (cl *CloudLink) SetDeviceKey(hexKey string) error {
+  if hexKey != "" {
+    if _, err := dronedp.ParseKey(hexKey); err != nil {
+      return err
+    }
+  }
+
+  if err := cl.store.Set(STORE_DEVICE_KEY, hexKey); err != nil {
+    return err
+  }
+
+  cl.initCodec()
+
+  // Start a fresh session under the new key.
+  cl.setSession(0)
+  return nil
+}
+
+// A short fingerprint of the provisioned key, for matching it up with the
+// cloud's copy. Empty if there's no key.
+func (cl *CloudLink) DeviceKeyFingerprint() string {
+  hexKey := cl.store.Get(STORE_DEVICE_KEY)
+  if hexKey == "" {
+    return ""
+  }
+  sum := sha256.Sum256([]byte(hexKey))
+  return hex.EncodeToString(sum[:8])
+}
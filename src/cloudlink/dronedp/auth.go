@@ -0,0 +1,238 @@
+package dronedp
+
+import (
+  "crypto/cipher"
+  "crypto/ecdh"
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/binary"
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "sync"
+)
+
+const (
+  // First byte of an authenticated frame. Plain frames start with the session.
+  VERSION_AUTH byte = 0xA1
+
+  KEY_LEN = 32
+  MAC_LEN = 16
+
+  // version, session, op, counter, payload len
+  AUTH_HEADER_LEN = 1 + 4 + 1 + 8 + 2
+
+  REPLAY_WINDOW = 64
+)
+
+var (
+  ErrAuth = errors.New("D2P.Parse: Authentication failed")
+  ErrReplay = errors.New("D2P.Parse: Replayed or stale frame")
+  ErrVersion = errors.New("D2P.Parse: Unauthenticated frame, the server may be too old")
+  ErrDowngrade = errors.New("D2P.Parse: Unsealed frame in a sealed session")
+)
+
+// Authenticated DroneDP. Every frame carries a counter that only goes up, and
+// ends in a truncated HMAC-SHA256 over the rest of the frame under the
+// device's key:
+//
+//   byte 0:      VERSION_AUTH
+//   byte 1-4:    session
+//   byte 5:      op
+//   byte 6-13:   counter, big endian
+//   byte 14-15:  payload length
+//   byte 16-N:   payload
+//   last 16:     HMAC-SHA256(key, bytes 0-N), truncated
+//
+// A counter is only accepted once, and only if it's no more than
+// REPLAY_WINDOW behind the newest seen, so both ends have to keep their counters rising across restarts
+// (seeding them from the clock does). The receiving end has to remember how
+// far it got as well, see SetFloor. With no key a Codec speaks the original
+// unauthenticated frames.
+type Codec struct {
+  key       []byte
+  server    bool
+  mut       sync.Mutex
+  tx        uint64
+  rx        uint64
+  window    uint64
+  floor     uint64
+  authRx    uint64
+
+  // Set once a session key has been agreed, see seal.go.
+  priv      *ecdh.PrivateKey
+  aead      cipher.AEAD
+}
+
+// Parses a hex encoded device key.
+func ParseKey(s string) ([]byte, error) {
+  key, err := hex.DecodeString(s)
+  if err != nil || len(key) != KEY_LEN {
+    return nil, fmt.Errorf("Device key must be %d hex encoded bytes.", KEY_LEN)
+  }
+  return key, nil
+}
+
+// txStart is where our counter picks up. It has to be above anything sent
+// before with this key, or the other end will take us for a replay.
+func NewCodec(key []byte, txStart uint64) *Codec {
+  return &Codec{key: key, tx: txStart}
+}
+
+// The cloud's end, for tests and tools. Only the nonces differ.
+func NewServerCodec(key []byte, txStart uint64) *Codec {
+  return &Codec{key: key, server: true, tx: txStart}
+}
+
+func (c *Codec) Authenticated() bool {
+  return c.key != nil
+}
+
+// The last counter we sent.
+func (c *Codec) Counter() uint64 {
+  c.mut.Lock()
+  defer c.mut.Unlock()
+  return c.tx
+}
+
+// Refuses counters at or below n from now on. A restart forgets the replay
+// window, so this is where the newest counter taken before it goes.
+func (c *Codec) SetFloor(n uint64) {
+  c.mut.Lock()
+  defer c.mut.Unlock()
+  if n > c.floor {
+    c.floor = n
+  }
+}
+
+// The newest counter taken on an authenticated but unsealed frame. Those
+// frames would still check out after a restart, so this has to be saved and
+// given to SetFloor before acting on them. Sealed frames don't need it, their
+// session key is gone by then.
+func (c *Codec) AuthCounter() uint64 {
+  c.mut.Lock()
+  defer c.mut.Unlock()
+  return c.authRx
+}
+
+func (c *Codec) mac(data []byte) []byte {
+  h := hmac.New(sha256.New, c.key)
+  h.Write(data)
+  return h.Sum(nil)[:MAC_LEN]
+}
+
+func (c *Codec) Generate(opCode OP, session uint32, data interface{}) ([]byte, error) {
+  payload, err := encodePayload(opCode, data)
+  if err != nil {
+    return nil, err
+  }
+  return c.generate(opCode, session, payload)
+}
+
+// Frames an already encoded payload.
+func (c *Codec) generate(opCode OP, session uint32, payload []byte) ([]byte, error) {
+  if c.key == nil {
+    return framePlain(opCode, session, payload)
+  }
+
+  c.mut.Lock()
+  c.tx++
+  counter := c.tx
+  aead := c.aead
+  c.mut.Unlock()
+
+  if aead != nil {
+    return c.seal(aead, opCode, session, counter, payload), nil
+  }
+
+  frame := make([]byte, AUTH_HEADER_LEN, AUTH_HEADER_LEN + len(payload) + MAC_LEN)
+  frame[0] = VERSION_AUTH
+  binary.BigEndian.PutUint32(frame[1:], session)
+  frame[5] = byte(opCode)
+  binary.BigEndian.PutUint64(frame[6:], counter)
+  binary.BigEndian.PutUint16(frame[14:], uint16(len(payload)))
+  frame = append(frame, payload...)
+
+  return append(frame, c.mac(frame)...), nil
+}
+
+func (c *Codec) Parse(data []byte) (*Msg, error) {
+  if c.key == nil {
+    return ParseMsg(data)
+  }
+
+  if len(data) > 0 && data[0] == VERSION_SEALED {
+    return c.open(data)
+  } else if c.Sealed() {
+    // Once there's a session key nothing less will do, or frames could be
+    // stripped back to HMAC only.
+    return nil, ErrDowngrade
+  } else if len(data) < AUTH_HEADER_LEN + MAC_LEN {
+    return nil, ErrAuth
+  } else if data[0] != VERSION_AUTH {
+    return nil, ErrVersion
+  }
+
+  body, sum := data[:len(data) - MAC_LEN], data[len(data) - MAC_LEN:]
+  if !hmac.Equal(c.mac(body), sum) {
+    return nil, ErrAuth
+  }
+
+  length := int(binary.BigEndian.Uint16(body[14:]))
+  if length != len(body) - AUTH_HEADER_LEN {
+    return nil, errors.New("D2P.Parse: Bad length")
+  }
+
+  counter := binary.BigEndian.Uint64(body[6:])
+  if err := c.checkCounter(counter); err != nil {
+    return nil, err
+  }
+
+  c.mut.Lock()
+  if counter > c.authRx {
+    c.authRx = counter
+  }
+  c.mut.Unlock()
+
+  msg := &Msg{
+    Op: OP(body[5]),
+    Session: binary.BigEndian.Uint32(body[1:]),
+  }
+
+  var err error
+  msg.Data, err = decodePayload(msg.Op, body[AUTH_HEADER_LEN:])
+  if err != nil {
+    return nil, err
+  }
+  return msg, nil
+}
+
+// Accepts each counter once. UDP can reorder, so counters up to REPLAY_WINDOW
+// behind the newest are still let through, the first time they're seen.
+func (c *Codec) checkCounter(counter uint64) error {
+  c.mut.Lock()
+  defer c.mut.Unlock()
+
+  if counter <= c.floor {
+    return ErrReplay
+  }
+
+  if counter > c.rx {
+    shift := counter - c.rx
+    if shift >= REPLAY_WINDOW {
+      c.window = 0
+    } else {
+      c.window <<= shift
+    }
+    c.window |= 1
+    c.rx = counter
+    return nil
+  }
+
+  back := c.rx - counter
+  if back >= REPLAY_WINDOW || c.window & (1 << back) != 0 {
+    return ErrReplay
+  }
+  c.window |= 1 << back
+  return nil
+}
@@ -13,17 +13,11 @@ import (
 type OP uint8
 
 const (
-  // TODO - actual TLS or hmac authentication here. Keep this out of code. Not actually 'secure.'
-  // SECURE_KEY []byte = []byte{
-  //   0xd7, 0xe6, 0xaf, 0x0b, 0x14, 0x90, 0x7e, 0xa5, 0x0a, 0xfd, 0xe8, 0xbb,
-  //   0x57, 0x4f, 0x3d, 0x99, 0x81, 0x88, 0xd9, 0xf5, 0x1b, 0x90, 0x7d, 0x3d,
-  //   0x44, 0xe7, 0x94, 0xe3, 0x30, 0xf0, 0x55, 0xd9,
-  // }
-
   // Ops
   OP_STATUS OP = 0x10
   OP_CODE OP = 0x11
   OP_TERMINAL OP = 0x12
+  OP_TERMINAL_DATA OP = 0x15
   OP_MAVLINK_TEXT OP = 0xFD
   OP_MAVLINK_BIN OP = 0xFE
 )
@@ -45,43 +39,66 @@ type StatusMsg struct {
   Drone     map[string]interface{}     `json:"drone,omitempty"`
   User      string          `json:"user,omitempty"`
   Terminal  bool            `json:"terminal,omitempty"`
+
+  // X25519 public key, hex encoded, for agreeing a session key.
+  PubKey    string          `json:"pubkey,omitempty"`
+
+  // Framing extensions this end handles, FEATURE_FRAGMENT and FEATURE_ACK.
+  Features  []string        `json:"features,omitempty"`
+
+  // Id of a code job to stop.
+  CancelJob int             `json:"cancelJob,omitempty"`
 }
 
 type CodeMsg struct {
   Op        string  `json:"op"`
   Msg       string  `json:"msg"`
   Status    int     `json:"status"`
+
+  Job       int     `json:"job"`
+  State     string  `json:"state"`
+  Stream    string  `json:"stream,omitempty"`
+  Exit      int     `json:"exit"`
 }
 
+// Terminal session state from the device, or a resize from the cloud.
 type TerminalMsg struct {
-  Op        string        `json:"op"`
-  Status    bool          `json:"status"`
-  Msg       TerminalInfo  `json:"msg"`
+  Op        string  `json:"op"`
+  Status    bool    `json:"status"`
+  Session   uint32  `json:"session"`
+  Rows      uint16  `json:"rows,omitempty"`
+  Cols      uint16  `json:"cols,omitempty"`
+  Msg       string  `json:"msg,omitempty"`
 }
 
-type TerminalInfo struct {
-  User      string `json:"uname"`
-  Pass      string `json:"pass"`
-  Port      int    `json:"port"`
-  Url       string `json:"url"`
+// A chunk of terminal input or output. Seq counts chunks per direction, so
+// the other end can put them back in order.
+type TerminalData struct {
+  Session   uint32
+  Seq       uint32
+  Data      []byte
 }
 
+const TERMINAL_DATA_HEADER_LEN = 8
+
 // 859132162
 // 19703425322537218
 
-// =============================================================================
-// GenerateMsg
-// =============================================================================
-func GenerateMsg(opCode OP, session uint32, data interface{}) ([]byte, error) {
-  var err error = nil
-  var payload []byte
-
+func encodePayload(opCode OP, data interface{}) ([]byte, error) {
   switch opCode {
     // Binary encoded messages for storing flight data.
-  case OP_MAVLINK_BIN:
+  case OP_MAVLINK_BIN, OP_FRAGMENT, OP_ACK:
     packet := data.([]byte)
-    payload = make([]byte, len(packet))
+    payload := make([]byte, len(packet))
     copy(payload, packet)
+    return payload, nil
+
+  case OP_TERMINAL_DATA:
+    td := data.(TerminalData)
+    payload := make([]byte, TERMINAL_DATA_HEADER_LEN, TERMINAL_DATA_HEADER_LEN + len(td.Data))
+    binary.BigEndian.PutUint32(payload, td.Session)
+    binary.BigEndian.PutUint32(payload[4:], td.Seq)
+    return append(payload, td.Data...), nil
 
     // Status and MAVLINK messages contain are json encoded
   case OP_CODE:
@@ -91,15 +108,74 @@ func GenerateMsg(opCode OP, session uint32, data interface{}) ([]byte, error) {
   case OP_TERMINAL:
     fallthrough
   case OP_STATUS:
-    payload, err = json.Marshal(data)
-    if err != nil {
-      return nil, err
-    }
+    return json.Marshal(data)
 
   default:
     return nil, errors.New("D2P.Gen: Unknown Op code.")
   }
+}
+
+func decodePayload(op OP, decoded []byte) (interface{}, error) {
+  var err error
+  var data interface{}
+
+  switch (op) {
+  case OP_MAVLINK_BIN, OP_FRAGMENT, OP_ACK:
+    data = decoded
+
+  case OP_MAVLINK_TEXT:
+    data = &mavlink.Packet{}
+    err = json.Unmarshal(decoded, data)
+
+    // Code job updates share the op, they come out as *CodeMsg.
+  case OP_STATUS:
+    sm := &StatusMsg{}
+    if err = json.Unmarshal(decoded, sm); err == nil && sm.Op == "code" {
+      cm := &CodeMsg{}
+      err = json.Unmarshal(decoded, cm)
+      data = cm
+    } else {
+      data = sm
+    }
+
+  case OP_CODE:
+    data = string(decoded[:])
+
+  case OP_TERMINAL:
+    data = &TerminalMsg{}
+    err = json.Unmarshal(decoded, data)
+
+  case OP_TERMINAL_DATA:
+    if len(decoded) < TERMINAL_DATA_HEADER_LEN {
+      return nil, errors.New("D2P.Parse: Short terminal data.")
+    }
+    data = &TerminalData{
+      Session: binary.BigEndian.Uint32(decoded),
+      Seq: binary.BigEndian.Uint32(decoded[4:]),
+      Data: decoded[TERMINAL_DATA_HEADER_LEN:],
+    }
 
+  default:
+    return nil, errors.New("D2P.Parse: Unknown Op code.")
+
+  }
+
+  return data, err
+}
+
+// =============================================================================
+// GenerateMsg
+// =============================================================================
+func GenerateMsg(opCode OP, session uint32, data interface{}) ([]byte, error) {
+  payload, err := encodePayload(opCode, data)
+  if err != nil {
+    return nil, err
+  }
+  return framePlain(opCode, session, payload)
+}
+
+func framePlain(opCode OP, session uint32, payload []byte) ([]byte, error) {
+  var err error
   buf := bytes.NewBuffer(make([]byte, 0))
 
   // session
@@ -171,25 +247,10 @@ func ParseMsg(data []byte) (*Msg, error) {
     return nil, err
   }
 
-  switch (msg.Op) {
-  case OP_MAVLINK_BIN:
-    msg.Data = decoded
-
-  case OP_MAVLINK_TEXT:
-    msg.Data = &mavlink.Packet{}
-    err = json.Unmarshal(decoded, msg.Data)
-
-  case OP_STATUS:
-    msg.Data = &StatusMsg{}
-    err = json.Unmarshal(decoded, msg.Data)
-
-  case OP_CODE:
-    msg.Data = string(decoded[:])
-
-  default:
-    return nil, errors.New("D2P.Parse: Unknown Op code.")
-
+  msg.Data, err = decodePayload(msg.Op, decoded)
+  if err != nil {
+    return nil, err
   }
 
-  return msg, err
+  return msg, nil
 }
@@ -0,0 +1,235 @@
+package dronedp
+
+import (
+  "bytes"
+  "testing"
+)
+
+var testKey = bytes.Repeat([]byte{0x42}, KEY_LEN)
+
+func TestPlainRoundTrip(t *testing.T) {
+  frame, err := GenerateMsg(OP_STATUS, 7, StatusMsg{Op: "status"})
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  msg, err := ParseMsg(frame)
+  if err != nil {
+    t.Fatal(err)
+  } else if msg.Session != 7 || msg.Data.(*StatusMsg).Op != "status" {
+    t.Errorf("got %+v", msg)
+  }
+}
+
+func TestAuthRoundTrip(t *testing.T) {
+  tx := NewCodec(testKey, 100)
+  rx := NewCodec(testKey, 0)
+
+  frame, err := tx.Generate(OP_MAVLINK_BIN, 9, []byte{0xfe, 0x01, 0x02})
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  msg, err := rx.Parse(frame)
+  if err != nil {
+    t.Fatal(err)
+  } else if msg.Session != 9 || msg.Op != OP_MAVLINK_BIN || !bytes.Equal(msg.Data.([]byte), []byte{0xfe, 0x01, 0x02}) {
+    t.Errorf("got %+v", msg)
+  }
+
+  // The same frame again is a replay.
+  if _, err := rx.Parse(frame); err != ErrReplay {
+    t.Errorf("replay: got %v", err)
+  }
+
+  // A late frame inside the window is accepted once.
+  late, _ := NewCodec(testKey, 80).Generate(OP_MAVLINK_BIN, 9, []byte{0x00})
+  if _, err := rx.Parse(late); err != nil {
+    t.Errorf("late frame: got %v", err)
+  }
+  if _, err := rx.Parse(late); err != ErrReplay {
+    t.Errorf("late replay: got %v", err)
+  }
+
+  // Anything further back than the window is dropped.
+  old, _ := NewCodec(testKey, 0).Generate(OP_MAVLINK_BIN, 9, []byte{0x00})
+  if _, err := rx.Parse(old); err != ErrReplay {
+    t.Errorf("stale counter: got %v", err)
+  }
+}
+
+func TestAuthRejects(t *testing.T) {
+  tx := NewCodec(testKey, 0)
+  frame, _ := tx.Generate(OP_STATUS, 1, StatusMsg{Op: "connect", Email: "a@b.c"})
+
+  cases := map[string][]byte{}
+
+  flipped := append([]byte(nil), frame...)
+  flipped[AUTH_HEADER_LEN + 3] ^= 0x01
+  cases["tampered payload"] = flipped
+
+  session := append([]byte(nil), frame...)
+  session[4] ^= 0x01
+  cases["tampered session"] = session
+
+  cases["truncated"] = frame[:len(frame) - 1]
+
+  plain, _ := GenerateMsg(OP_STATUS, 1, StatusMsg{Op: "connect"})
+  cases["unauthenticated"] = plain
+
+  for name, data := range cases {
+    if _, err := NewCodec(testKey, 0).Parse(data); err == nil {
+      t.Errorf("%s: accepted", name)
+    }
+  }
+
+  other := bytes.Repeat([]byte{0x24}, KEY_LEN)
+  if _, err := NewCodec(other, 0).Parse(frame); err != ErrAuth {
+    t.Errorf("wrong key: got %v", err)
+  }
+}
+
+// A restart forgets the replay window. The floor saved before it keeps old
+// frames out.
+func TestFloorAfterRestart(t *testing.T) {
+  srv := NewServerCodec(testKey, 500)
+  old, _ := srv.Generate(OP_MAVLINK_BIN, 9, []byte{0x01})
+
+  dev := NewCodec(testKey, 0)
+  if _, err := dev.Parse(old); err != nil {
+    t.Fatal(err)
+  }
+  saved := dev.AuthCounter()
+  if saved != 501 {
+    t.Fatalf("auth counter %d, want 501", saved)
+  }
+
+  // Without the floor the frame checks out again.
+  if _, err := NewCodec(testKey, 0).Parse(old); err != nil {
+    t.Fatalf("fresh codec: got %v", err)
+  }
+
+  restarted := NewCodec(testKey, 0)
+  restarted.SetFloor(saved)
+  if _, err := restarted.Parse(old); err != ErrReplay {
+    t.Errorf("replay after restart: got %v", err)
+  }
+  next, _ := srv.Generate(OP_MAVLINK_BIN, 9, []byte{0x02})
+  if _, err := restarted.Parse(next); err != nil {
+    t.Errorf("next frame: got %v", err)
+  }
+
+  // The floor never goes down.
+  lowered := NewCodec(testKey, 0)
+  lowered.SetFloor(saved)
+  lowered.SetFloor(10)
+  below, _ := NewServerCodec(testKey, 299).Generate(OP_MAVLINK_BIN, 9, []byte{0x03})
+  if _, err := lowered.Parse(below); err != ErrReplay {
+    t.Errorf("lowered floor: got %v", err)
+  }
+}
+
+func TestParseKey(t *testing.T) {
+  if _, err := ParseKey("00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff"); err != nil {
+    t.Error(err)
+  }
+  for _, bad := range []string{"", "0011", "zz112233445566778899aabbccddeeff00112233445566778899aabbccddeeff"} {
+    if _, err := ParseKey(bad); err == nil {
+      t.Errorf("%q accepted", bad)
+    }
+  }
+}
+
+func TestSealedSession(t *testing.T) {
+  dev := NewCodec(testKey, 1000)
+  srv := NewServerCodec(testKey, 5000)
+
+  devPub, _ := dev.Offer()
+  srvPub, _ := srv.Offer()
+  if err := srv.Accept(77, devPub); err != nil {
+    t.Fatal(err)
+  }
+  if err := dev.Accept(77, srvPub); err != nil {
+    t.Fatal(err)
+  }
+  if !dev.Sealed() || !srv.Sealed() {
+    t.Fatal("not sealed after the exchange")
+  }
+
+  cmd := []byte{0xfe, 0x21, 0x00, 0xff, 0xbe, 0x4c}
+  frame, _ := srv.Generate(OP_MAVLINK_BIN, 77, cmd)
+  if frame[0] != VERSION_SEALED || bytes.Contains(frame, cmd) {
+    t.Fatalf("frame isn't sealed: % x", frame)
+  }
+
+  msg, err := dev.Parse(frame)
+  if err != nil {
+    t.Fatal(err)
+  } else if !bytes.Equal(msg.Data.([]byte), cmd) || msg.Session != 77 {
+    t.Errorf("got %+v", msg)
+  }
+
+  if _, err := dev.Parse(frame); err != ErrReplay {
+    t.Errorf("replay: got %v", err)
+  }
+
+  up, _ := dev.Generate(OP_STATUS, 77, StatusMsg{Op: "status"})
+  if _, err := srv.Parse(up); err != nil {
+    t.Errorf("device to server: %v", err)
+  }
+
+  // A device's own frame bounced back at it doesn't open.
+  echo, _ := dev.Generate(OP_MAVLINK_BIN, 77, cmd)
+  if _, err := dev.Parse(echo); err != ErrAuth {
+    t.Errorf("reflected frame: got %v", err)
+  }
+
+  // Nor does an HMAC only frame, even a fresh one, once the session is sealed.
+  plain, _ := NewServerCodec(testKey, 9000).Generate(OP_MAVLINK_BIN, 77, cmd)
+  if _, err := dev.Parse(plain); err != ErrDowngrade {
+    t.Errorf("downgraded frame: got %v", err)
+  }
+
+  tampered, _ := srv.Generate(OP_MAVLINK_BIN, 77, cmd)
+  tampered[5] = byte(OP_STATUS)
+  if _, err := dev.Parse(tampered); err != ErrAuth {
+    t.Errorf("tampered header: got %v", err)
+  }
+
+  // Another session's key can't open it.
+  other := NewCodec(testKey, 0)
+  other.Offer()
+  otherSrv := NewServerCodec(testKey, 0)
+  p, _ := otherSrv.Offer()
+  other.Accept(77, p)
+  fresh, _ := srv.Generate(OP_MAVLINK_BIN, 77, cmd)
+  if _, err := other.Parse(fresh); err != ErrAuth {
+    t.Errorf("other session: got %v", err)
+  }
+}
+
+// Dropping the session key goes back to authenticated frames, for the next
+// handshake.
+func TestDropUnseals(t *testing.T) {
+  dev := NewCodec(testKey, 1000)
+  srv := NewServerCodec(testKey, 5000)
+  devPub, _ := dev.Offer()
+  srvPub, _ := srv.Offer()
+  srv.Accept(1, devPub)
+  dev.Accept(1, srvPub)
+
+  plain, _ := NewServerCodec(testKey, 6000).Generate(OP_STATUS, 0, StatusMsg{Op: "status"})
+  if _, err := dev.Parse(plain); err != ErrDowngrade {
+    t.Fatalf("sealed: got %v", err)
+  }
+  dev.Drop()
+  if _, err := dev.Parse(plain); err != nil {
+    t.Errorf("after drop: got %v", err)
+  }
+}
+
+func TestOfferNeedsKey(t *testing.T) {
+  if _, err := NewCodec(nil, 0).Offer(); err == nil {
+    t.Error("offered a key exchange without a device key")
+  }
+}
@@ -0,0 +1,386 @@
+package dronedp
+
+import (
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "sync"
+  "time"
+)
+
+const (
+  // Ops for the extended framing. Both carry binary payloads.
+  OP_FRAGMENT OP = 0x13
+  OP_ACK OP = 0x14
+
+  FEATURE_FRAGMENT = "frag"
+  FEATURE_ACK = "ack"
+
+  DEFAULT_MTU = 1200
+
+  // seq, flags, op, index, count
+  FRAGMENT_HEADER_LEN = 4 + 1 + 1 + 1 + 1
+  // Worst case frame around a fragment: sealed header and tag, or the
+  // authenticated header and HMAC.
+  FRAME_OVERHEAD = AUTH_HEADER_LEN + MAC_LEN + FRAGMENT_HEADER_LEN
+  MAX_FRAGMENTS = 255
+
+  FLAG_ACK byte = 0x01
+
+  RETRY_INTERVAL = 500 * time.Millisecond
+  MAX_RETRIES = 5
+
+  // Partial messages are given up on after this long.
+  REASSEMBLY_TIMEOUT = 10 * time.Second
+  MAX_PARTIAL = 32
+
+  // How many recent sequence numbers are remembered, to drop duplicates.
+  SEEN_WINDOW = 256
+)
+
+var ErrTooLarge = errors.New("D2P.Gen: Message too large to fragment")
+
+type pendingMsg struct {
+  op        OP
+  session   uint32
+  seq       uint32
+  chunks    [][]byte
+  tries     int
+  next      time.Time
+}
+
+type partialMsg struct {
+  op        OP
+  parts     [][]byte
+  got       int
+  started   time.Time
+}
+
+// Extended DroneDP framing on top of a Codec. A message that doesn't fit the
+// path MTU, or that has to arrive, is sent as OP_FRAGMENT frames instead:
+//
+//   byte 0-3:  message sequence number
+//   byte 4:    flags, FLAG_ACK if the receiver has to acknowledge it
+//   byte 5:    the message's own op
+//   byte 6:    fragment index
+//   byte 7:    fragment count
+//   byte 8-N:  a slice of the message payload
+//
+// Complete messages are acknowledged with an OP_ACK carrying the sequence
+// number. Unacknowledged messages are sent again, with fresh frames so the
+// replay counters still go up, until MAX_RETRIES. Everything else, telemetry
+// mostly, goes out as plain frames and is fire and forget.
+//
+// Fragments and acks are only used once the other end has said it handles
+// them, see Enable. Sequence numbers only mean something within a session, a
+// restarted server starts again from 1, so a frame from another session makes
+// the Link forget the last one's.
+type Link struct {
+  codec     *Codec
+  mtu       int
+
+  mut       sync.Mutex
+  frag      bool
+  ack       bool
+  session   uint32
+  seq       uint32
+  pending   map[uint32]*pendingMsg
+  partial   map[uint32]*partialMsg
+  seen      []uint32
+  seenNext  int
+}
+
+func NewLink(codec *Codec, mtu int) *Link {
+  if mtu <= FRAME_OVERHEAD {
+    mtu = DEFAULT_MTU
+  }
+
+  return &Link{
+    codec: codec,
+    mtu: mtu,
+    pending: make(map[uint32]*pendingMsg),
+    partial: make(map[uint32]*partialMsg),
+    seen: make([]uint32, 0, SEEN_WINDOW),
+  }
+}
+
+func (l *Link) Codec() *Codec {
+  return l.codec
+}
+
+// Turns fragmentation and acknowledgement on or off, following what the
+// other end supports. Turning acks off forgets anything waiting on one.
+func (l *Link) Enable(frag, ack bool) {
+  l.mut.Lock()
+  defer l.mut.Unlock()
+
+  l.frag, l.ack = frag, ack
+  if !ack {
+    l.pending = make(map[uint32]*pendingMsg)
+  }
+}
+
+// Forgets duplicates, partial messages and anything waiting on an ack, for
+// when the session is dropped.
+func (l *Link) Reset() {
+  l.mut.Lock()
+  defer l.mut.Unlock()
+  l.reset()
+}
+
+// Must be called with the lock held.
+func (l *Link) reset() {
+  l.pending = make(map[uint32]*pendingMsg)
+  l.partial = make(map[uint32]*partialMsg)
+  l.seen = l.seen[:0]
+  l.seenNext = 0
+}
+
+// Whether the features we support are in list.
+func Features(list []string) (frag, ack bool) {
+  for _, f := range list {
+    switch f {
+    case FEATURE_FRAGMENT: frag = true
+    case FEATURE_ACK: ack = true
+    }
+  }
+  return
+}
+
+// Frames a message. reliable asks for it to be acknowledged, which only
+// happens when the other end does acks.
+func (l *Link) Send(op OP, session uint32, data interface{}, reliable bool) ([][]byte, error) {
+  l.mut.Lock()
+  frag, ack := l.frag, l.ack && reliable
+  l.mut.Unlock()
+
+  payload, err := encodePayload(op, data)
+  if err != nil {
+    return nil, err
+  }
+
+  if !ack && (!frag || len(payload) + FRAME_OVERHEAD <= l.mtu) {
+    frame, err := l.codec.generate(op, session, payload)
+    if err != nil {
+      return nil, err
+    }
+    return [][]byte{frame}, nil
+  }
+
+  size := l.mtu - FRAME_OVERHEAD
+  if !frag {
+    size = len(payload)
+  }
+
+  var chunks [][]byte
+  for len(payload) > size {
+    chunks = append(chunks, payload[:size])
+    payload = payload[size:]
+  }
+  chunks = append(chunks, payload)
+  if len(chunks) > MAX_FRAGMENTS {
+    return nil, ErrTooLarge
+  }
+
+  l.mut.Lock()
+  l.seq++
+  msg := &pendingMsg{op: op, session: session, seq: l.seq, chunks: chunks, tries: 1}
+  if ack {
+    msg.next = time.Now().Add(RETRY_INTERVAL)
+    l.pending[msg.seq] = msg
+  }
+  l.mut.Unlock()
+
+  return l.frames(msg, ack)
+}
+
+func (l *Link) frames(msg *pendingMsg, ack bool) ([][]byte, error) {
+  var flags byte
+  if ack {
+    flags = FLAG_ACK
+  }
+
+  frames := make([][]byte, 0, len(msg.chunks))
+  for i, chunk := range msg.chunks {
+    seg := make([]byte, FRAGMENT_HEADER_LEN, FRAGMENT_HEADER_LEN + len(chunk))
+    binary.BigEndian.PutUint32(seg, msg.seq)
+    seg[4] = flags
+    seg[5] = byte(msg.op)
+    seg[6] = byte(i)
+    seg[7] = byte(len(msg.chunks))
+    seg = append(seg, chunk...)
+
+    frame, err := l.codec.generate(OP_FRAGMENT, msg.session, seg)
+    if err != nil {
+      return nil, err
+    }
+    frames = append(frames, frame)
+  }
+  return frames, nil
+}
+
+// Frames that are due to be sent again. Messages out of retries are dropped
+// and returned in lost.
+func (l *Link) Retransmit(now time.Time) (frames [][]byte, lost []uint32) {
+  l.mut.Lock()
+  var due []*pendingMsg
+  for seq, msg := range l.pending {
+    if now.Before(msg.next) {
+      continue
+    }
+    if msg.tries >= MAX_RETRIES {
+      delete(l.pending, seq)
+      lost = append(lost, seq)
+      continue
+    }
+    msg.tries++
+    msg.next = now.Add(RETRY_INTERVAL << uint(msg.tries - 1))
+    due = append(due, msg)
+  }
+  l.mut.Unlock()
+
+  for _, msg := range due {
+    if f, err := l.frames(msg, true); err == nil {
+      frames = append(frames, f...)
+    }
+  }
+  return frames, lost
+}
+
+// Messages still waiting on an ack.
+func (l *Link) Pending() int {
+  l.mut.Lock()
+  defer l.mut.Unlock()
+  return len(l.pending)
+}
+
+// Takes in a frame. Returns the message once it's complete, nil while it's
+// still being put together or for acks, and any frames to send back.
+func (l *Link) Receive(data []byte) (*Msg, [][]byte, error) {
+  msg, err := l.codec.Parse(data)
+  if err != nil {
+    return nil, nil, err
+  }
+
+  l.mut.Lock()
+  if msg.Session != l.session {
+    l.reset()
+    l.session = msg.Session
+  }
+  l.mut.Unlock()
+
+  switch msg.Op {
+  case OP_ACK:
+    payload := msg.Data.([]byte)
+    if len(payload) != 4 {
+      return nil, nil, errors.New("D2P.Parse: Bad ack")
+    }
+    l.mut.Lock()
+    delete(l.pending, binary.BigEndian.Uint32(payload))
+    l.mut.Unlock()
+    return nil, nil, nil
+
+  case OP_FRAGMENT:
+    return l.reassemble(msg)
+  }
+
+  return msg, nil, nil
+}
+
+func (l *Link) reassemble(frame *Msg) (*Msg, [][]byte, error) {
+  seg := frame.Data.([]byte)
+  if len(seg) < FRAGMENT_HEADER_LEN {
+    return nil, nil, errors.New("D2P.Parse: Short fragment")
+  }
+
+  seq := binary.BigEndian.Uint32(seg)
+  flags, op := seg[4], OP(seg[5])
+  index, count := int(seg[6]), int(seg[7])
+  if count == 0 || index >= count {
+    return nil, nil, fmt.Errorf("D2P.Parse: Bad fragment %d of %d", index, count)
+  }
+
+  var replies [][]byte
+  ackIt := func() {
+    if flags & FLAG_ACK == 0 {
+      return
+    }
+    seqb := make([]byte, 4)
+    binary.BigEndian.PutUint32(seqb, seq)
+    if ack, err := l.codec.generate(OP_ACK, frame.Session, seqb); err == nil {
+      replies = append(replies, ack)
+    }
+  }
+
+  l.mut.Lock()
+  defer l.mut.Unlock()
+
+  // Already delivered, the ack must have been lost.
+  if l.wasSeen(seq) {
+    ackIt()
+    return nil, replies, nil
+  }
+
+  now := time.Now()
+  for s, p := range l.partial {
+    if now.Sub(p.started) > REASSEMBLY_TIMEOUT {
+      delete(l.partial, s)
+    }
+  }
+
+  p := l.partial[seq]
+  if p == nil {
+    if len(l.partial) >= MAX_PARTIAL {
+      return nil, nil, errors.New("D2P.Parse: Too many partial messages")
+    }
+    p = &partialMsg{op: op, parts: make([][]byte, count), started: now}
+    l.partial[seq] = p
+  }
+  if len(p.parts) != count || p.op != op {
+    delete(l.partial, seq)
+    return nil, nil, errors.New("D2P.Parse: Fragments don't match")
+  }
+
+  if p.parts[index] == nil {
+    p.parts[index] = append([]byte(nil), seg[FRAGMENT_HEADER_LEN:]...)
+    p.got++
+  }
+  if p.got < count {
+    return nil, nil, nil
+  }
+
+  delete(l.partial, seq)
+  l.markSeen(seq)
+  ackIt()
+
+  var payload []byte
+  for _, part := range p.parts {
+    payload = append(payload, part...)
+  }
+
+  data, err := decodePayload(op, payload)
+  if err != nil {
+    return nil, replies, err
+  }
+  return &Msg{Op: op, Session: frame.Session, Data: data}, replies, nil
+}
+
+// Must be called with the lock held.
+func (l *Link) wasSeen(seq uint32) bool {
+  for _, s := range l.seen {
+    if s == seq {
+      return true
+    }
+  }
+  return false
+}
+
+// Must be called with the lock held.
+func (l *Link) markSeen(seq uint32) {
+  if len(l.seen) < SEEN_WINDOW {
+    l.seen = append(l.seen, seq)
+    return
+  }
+  l.seen[l.seenNext] = seq
+  l.seenNext = (l.seenNext + 1) % SEEN_WINDOW
+}
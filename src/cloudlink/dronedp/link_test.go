@@ -0,0 +1,183 @@
+package dronedp
+
+import (
+  "bytes"
+  "strings"
+  "testing"
+  "time"
+)
+
+func linkPair(key []byte) (*Link, *Link) {
+  dev := NewLink(NewCodec(key, 100), 300)
+  srv := NewLink(NewServerCodec(key, 100), 300)
+  dev.Enable(true, true)
+  srv.Enable(true, true)
+  return dev, srv
+}
+
+func TestFragmentReassembly(t *testing.T) {
+  for _, key := range [][]byte{nil, testKey} {
+    dev, srv := linkPair(key)
+
+    big := StatusMsg{Op: "status", Drone: map[string]interface{}{"notes": strings.Repeat("x", 2000)}}
+    frames, err := srv.Send(OP_STATUS, 3, big, false)
+    if err != nil {
+      t.Fatal(err)
+    } else if len(frames) < 7 {
+      t.Fatalf("%d frames for a 2KB message at MTU 300", len(frames))
+    }
+    for _, f := range frames {
+      if len(f) > 300 {
+        t.Errorf("frame of %d bytes over the MTU", len(f))
+      }
+    }
+
+    // Delivered out of order, with a duplicate.
+    frames = append([][]byte{frames[len(frames) - 1]}, frames...)
+    var got *Msg
+    for i := len(frames) - 1; i >= 0; i-- {
+      msg, replies, err := dev.Receive(frames[i])
+      if err != nil && err != ErrReplay {
+        t.Fatal(err)
+      } else if len(replies) != 0 {
+        t.Error("acked a message that didn't ask for it")
+      }
+      if msg != nil {
+        got = msg
+      }
+    }
+
+    if got == nil || got.Op != OP_STATUS || got.Session != 3 {
+      t.Fatalf("got %+v", got)
+    }
+    if notes := got.Data.(*StatusMsg).Drone["notes"].(string); len(notes) != 2000 {
+      t.Errorf("notes came back %d bytes", len(notes))
+    }
+  }
+}
+
+func TestSmallMessagesStayPlain(t *testing.T) {
+  dev, srv := linkPair(testKey)
+
+  frames, _ := dev.Send(OP_MAVLINK_BIN, 1, []byte{0xfe, 0x00}, false)
+  if len(frames) != 1 {
+    t.Fatalf("%d frames", len(frames))
+  }
+  msg, _, err := srv.Receive(frames[0])
+  if err != nil || msg.Op != OP_MAVLINK_BIN {
+    t.Errorf("got %+v, %v", msg, err)
+  }
+}
+
+func TestAckAndRetransmit(t *testing.T) {
+  dev, srv := linkPair(testKey)
+
+  frames, err := dev.Send(OP_STATUS, 1, StatusMsg{Op: "connect"}, true)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  // First copy is lost, the retransmit gets through.
+  later := time.Now().Add(time.Second)
+  retry, lost := dev.Retransmit(later)
+  if len(retry) != len(frames) || len(lost) != 0 {
+    t.Fatalf("retransmitted %d frames, lost %v", len(retry), lost)
+  }
+
+  var acks [][]byte
+  for _, f := range retry {
+    msg, replies, err := srv.Receive(f)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if msg != nil && msg.Data.(*StatusMsg).Op != "connect" {
+      t.Errorf("got %+v", msg)
+    }
+    acks = append(acks, replies...)
+  }
+  if len(acks) != 1 {
+    t.Fatalf("%d acks", len(acks))
+  }
+
+  if _, _, err := dev.Receive(acks[0]); err != nil {
+    t.Fatal(err)
+  }
+  if dev.Pending() != 0 {
+    t.Error("still pending after the ack")
+  }
+}
+
+// A restarted server numbers its messages from 1 again, under a new session.
+// They mustn't be taken for duplicates of the old session's.
+func TestNewSessionForgetsSeen(t *testing.T) {
+  dev, srv := linkPair(testKey)
+
+  deliver := func(srv *Link, session uint32, notes string) *Msg {
+    frames, err := srv.Send(OP_STATUS, session, StatusMsg{Op: "status", Drone: map[string]interface{}{"notes": notes}}, true)
+    if err != nil {
+      t.Fatal(err)
+    }
+    var got *Msg
+    for _, f := range frames {
+      msg, replies, err := dev.Receive(f)
+      if err != nil {
+        t.Fatal(err)
+      } else if msg != nil {
+        got = msg
+      }
+      for _, ack := range replies {
+        srv.Receive(ack)
+      }
+    }
+    return got
+  }
+
+  if got := deliver(srv, 5, "first"); got == nil {
+    t.Fatal("first message not delivered")
+  }
+
+  restarted := NewLink(NewServerCodec(testKey, 10000), 300)
+  restarted.Enable(true, true)
+  got := deliver(restarted, 6, strings.Repeat("y", 500))
+  if got == nil || got.Session != 6 {
+    t.Fatalf("message from the new session dropped: %+v", got)
+  }
+  if restarted.Pending() != 0 {
+    t.Error("new session's message wasn't acked")
+  }
+
+  // Anything still waiting on the old session's ack is dropped with it.
+  dev.Send(OP_STATUS, 5, StatusMsg{Op: "status"}, true)
+  dev.Reset()
+  if dev.Pending() != 0 {
+    t.Error("pending after reset")
+  }
+}
+
+func TestRetransmitGivesUp(t *testing.T) {
+  dev, _ := linkPair(nil)
+  dev.Send(OP_STATUS, 1, StatusMsg{Op: "status"}, true)
+
+  now := time.Now()
+  var lost []uint32
+  for i := 0; i < MAX_RETRIES + 1 && len(lost) == 0; i++ {
+    now = now.Add(time.Minute)
+    _, lost = dev.Retransmit(now)
+  }
+  if len(lost) != 1 || dev.Pending() != 0 {
+    t.Errorf("lost %v, %d pending", lost, dev.Pending())
+  }
+}
+
+func TestDisabledLinkIsPlain(t *testing.T) {
+  dev := NewLink(NewCodec(nil, 0), 300)
+
+  payload := bytes.Repeat([]byte{0x01}, 1000)
+  frames, _ := dev.Send(OP_MAVLINK_BIN, 1, payload, true)
+  if len(frames) != 1 {
+    t.Fatalf("%d frames without fragmentation", len(frames))
+  }
+  if msg, err := ParseMsg(frames[0]); err != nil || !bytes.Equal(msg.Data.([]byte), payload) {
+    t.Errorf("old parser can't read it: %v", err)
+  }
+}
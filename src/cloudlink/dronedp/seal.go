@@ -0,0 +1,173 @@
+package dronedp
+
+import (
+  "crypto/aes"
+  "crypto/cipher"
+  "crypto/ecdh"
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/binary"
+  "encoding/hex"
+  "errors"
+)
+
+const (
+  // First byte of an encrypted frame.
+  VERSION_SEALED byte = 0xA2
+
+  // version, session, op, counter
+  SEALED_HEADER_LEN = 1 + 4 + 1 + 8
+
+  SESSION_INFO = "dronedp session v2"
+)
+
+// Encrypted DroneDP. The connect handshake runs over authenticated frames and
+// carries an X25519 public key each way, so both ends can agree a session key
+// nobody watching the link can work out. The key is derived with HKDF-SHA256,
+// salted with the device key and bound to the session id. From then on frames
+// are sealed with AES-256-GCM:
+//
+//   byte 0:      VERSION_SEALED
+//   byte 1-4:    session
+//   byte 5:      op
+//   byte 6-13:   counter, big endian
+//   byte 14-N:   ciphertext and 16 byte tag, with bytes 0-13 as additional data
+//
+// The nonce is a direction byte, three zeros and the counter. Counters never
+// repeat, and the direction byte keeps a frame from being reflected back at
+// its sender.
+
+// Our half of the key exchange, hex encoded for the connect message. Stays
+// the same until the session is dropped, as connect is sent every second.
+func (c *Codec) Offer() (string, error) {
+  if c.key == nil {
+    return "", errors.New("D2P: Encryption needs a device key.")
+  }
+
+  c.mut.Lock()
+  defer c.mut.Unlock()
+
+  if c.priv == nil {
+    priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+    if err != nil {
+      return "", err
+    }
+    c.priv = priv
+  }
+  return hex.EncodeToString(c.priv.PublicKey().Bytes()), nil
+}
+
+// Completes the exchange with the other end's public key. Frames sent after
+// this are encrypted, and only encrypted frames are taken until Drop.
+func (c *Codec) Accept(session uint32, peer string) error {
+  raw, err := hex.DecodeString(peer)
+  if err != nil {
+    return err
+  }
+  pub, err := ecdh.X25519().NewPublicKey(raw)
+  if err != nil {
+    return err
+  }
+
+  c.mut.Lock()
+  defer c.mut.Unlock()
+
+  if c.priv == nil {
+    return errors.New("D2P: No key exchange in progress.")
+  }
+  shared, err := c.priv.ECDH(pub)
+  if err != nil {
+    return err
+  }
+
+  info := make([]byte, len(SESSION_INFO) + 4)
+  copy(info, SESSION_INFO)
+  binary.BigEndian.PutUint32(info[len(SESSION_INFO):], session)
+
+  block, err := aes.NewCipher(hkdf(shared, c.key, info))
+  if err != nil {
+    return err
+  }
+  if c.aead, err = cipher.NewGCM(block); err != nil {
+    return err
+  }
+
+  c.priv = nil
+  return nil
+}
+
+// Forgets the session key, for when the session is lost.
+func (c *Codec) Drop() {
+  c.mut.Lock()
+  c.priv, c.aead = nil, nil
+  c.mut.Unlock()
+}
+
+func (c *Codec) Sealed() bool {
+  c.mut.Lock()
+  defer c.mut.Unlock()
+  return c.aead != nil
+}
+
+// One block of HKDF-SHA256 (RFC 5869), all an AES-256 key needs.
+func hkdf(secret, salt, info []byte) []byte {
+  h := hmac.New(sha256.New, salt)
+  h.Write(secret)
+  prk := h.Sum(nil)
+
+  h = hmac.New(sha256.New, prk)
+  h.Write(info)
+  h.Write([]byte{1})
+  return h.Sum(nil)
+}
+
+func (c *Codec) nonce(counter uint64, fromServer bool) []byte {
+  n := make([]byte, 12)
+  n[0] = 1
+  if fromServer {
+    n[0] = 2
+  }
+  binary.BigEndian.PutUint64(n[4:], counter)
+  return n
+}
+
+func (c *Codec) seal(aead cipher.AEAD, opCode OP, session uint32, counter uint64, payload []byte) []byte {
+  frame := make([]byte, SEALED_HEADER_LEN, SEALED_HEADER_LEN + len(payload) + aead.Overhead())
+  frame[0] = VERSION_SEALED
+  binary.BigEndian.PutUint32(frame[1:], session)
+  frame[5] = byte(opCode)
+  binary.BigEndian.PutUint64(frame[6:], counter)
+
+  return aead.Seal(frame, c.nonce(counter, c.server), payload, frame[:SEALED_HEADER_LEN])
+}
+
+func (c *Codec) open(data []byte) (*Msg, error) {
+  c.mut.Lock()
+  aead := c.aead
+  c.mut.Unlock()
+
+  if aead == nil || len(data) < SEALED_HEADER_LEN + aead.Overhead() {
+    return nil, ErrAuth
+  }
+
+  header := data[:SEALED_HEADER_LEN]
+  counter := binary.BigEndian.Uint64(header[6:])
+  payload, err := aead.Open(nil, c.nonce(counter, !c.server), data[SEALED_HEADER_LEN:], header)
+  if err != nil {
+    return nil, ErrAuth
+  }
+
+  if err := c.checkCounter(counter); err != nil {
+    return nil, err
+  }
+
+  msg := &Msg{
+    Op: OP(header[5]),
+    Session: binary.BigEndian.Uint32(header[1:]),
+  }
+  if msg.Data, err = decodePayload(msg.Op, payload); err != nil {
+    return nil, err
+  }
+  return msg, nil
+}
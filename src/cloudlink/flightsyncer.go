@@ -3,44 +3,90 @@ package cloudlink
 import (
   "os"
   "path"
-  "bytes"
-  "io/ioutil"
-  "encoding/json"
   "path/filepath"
-  "net/http"
   "fmt"
   "time"
   "config"
   "sync"
-  "io"
+  "strings"
+
+  "cloudlink/upload"
+  "flightlog"
 )
 
 const (
   TICKER_INTERVAL = 15 // seconds
-  MAX_UPLOAD_SIZE = 50000000
+
+  RETRY_BASE = 15 * time.Second
+  RETRY_MAX = 30 * time.Minute
 )
 
 type FlightSyncer struct {
   FlightsPath string
+  catalog *flightlog.Catalog
+  queue *upload.Queue
+  dest upload.Destination
+  needsCloud bool
   DroneId string
   UserId string
   isRunning bool
 
   lockname string
-  quit chan bool
+  quit chan struct{}
   mut sync.RWMutex
 }
 
-func NewFlightSyncer(fpath string) *FlightSyncer {
-  return &FlightSyncer{
-    fpath,
+func NewFlightSyncer(catalog *flightlog.Catalog) *FlightSyncer {
+  fs := &FlightSyncer{
+    catalog.Dir(),
+    catalog,
+    upload.NewQueue(filepath.Join(catalog.Dir(), upload.QUEUE_FILE)),
+    nil,
+    false,
     "",
     "",
     false,
     "",
-    make(chan bool),
+    nil,
     sync.RWMutex{},
   }
+
+  limiter := upload.NewLimiter(config.Get().SyncRate * 1024)
+  config.OnChange(func(names []string) {
+    if config.Changed(names, "syncrate") {
+      limiter.SetRate(config.Get().SyncRate * 1024)
+    }
+  })
+
+  opts := upload.Options{
+    DSCBase: *config.DSCHttp,
+    ChunkSize: int64(*config.SyncChunk) * 1024,
+    Limiter: limiter,
+    AccessKey: config.SyncKey,
+    SecretKey: config.SyncSecret,
+    Ids: fs.ids,
+  }
+
+  dest, err := upload.NewDestination(*config.SyncDest, opts)
+  if err != nil {
+    config.Log(config.LOG_ERROR, "sync: ", err, "Syncing to Dronesmith Cloud.")
+    dest, _ = upload.NewDestination(upload.DEST_DSC, opts)
+  }
+
+  _, fs.needsCloud = dest.(*upload.DSC)
+  fs.dest = dest
+  return fs
+}
+
+// Whether the syncer waits for a cloud session, or runs on its own.
+func (fs *FlightSyncer) NeedsCloud() bool {
+  return fs.needsCloud
+}
+
+func (fs *FlightSyncer) ids() (string, string) {
+  fs.mut.RLock()
+  defer fs.mut.RUnlock()
+  return copystr(fs.UserId), copystr(fs.DroneId)
 }
 
 func (fs *FlightSyncer) IsRunning() bool {
@@ -63,70 +109,60 @@ func (fs *FlightSyncer) Unlock() {
 }
 
 func (fs *FlightSyncer) Start(userId, droneId string) error {
-  if droneId == "" || fs.isRunning {
+  fs.mut.Lock()
+  defer fs.mut.Unlock()
+
+  if (fs.needsCloud && droneId == "") || fs.isRunning {
     // config.Log(config.LOG_ERROR, "sy |", "User Id:", userId, "Drone Id:", droneId, "Running:", fs.isRunning)
     return fmt.Errorf("User Id and Drone Id required to start the syncer.")
   }
 
-  fs.mut.Lock()
   fs.UserId = userId
   fs.DroneId = droneId
   fs.isRunning = true
-  fs.mut.Unlock()
+  fs.quit = make(chan struct{})
 
-  go fs.listener()
+  go fs.listener(fs.quit)
 
   return nil
 }
 
+// Doesn't wait for the upload in progress, which is cancelled and stays queued.
 func (fs *FlightSyncer) Stop() {
+  fs.mut.Lock()
+  defer fs.mut.Unlock()
+
+  if !fs.isRunning {
+    return
+  }
   fs.DroneId = ""
   fs.UserId = ""
   fs.isRunning = false
-  fs.quit <- true
+  close(fs.quit)
 }
 
-func (fs *FlightSyncer) listener() {
+func (fs *FlightSyncer) listener(quit chan struct{}) {
 
   checker := time.NewTimer(TICKER_INTERVAL * time.Second)
 
   for {
     select {
-    case <-fs.quit:
+    case <-quit:
       checker.Stop()
       return
 
     case <-checker.C:
-      // check flight directory
-      files, _ := filepath.Glob(fs.FlightsPath + "/Flight*")
-      filesDone := make(chan bool, len(files))
-
-      for _, f := range files {
-        // verify the saver currently doesn't have the file
-        fs.mut.RLock()
-        if fs.lockname != f {
-          // go fs.upload(f, filesDone)
-
-          // The Edison doesn't have enough RAM to facilitate these in paralell,
-          // so do this sequentially for now.
-          fs.upload(f, filesDone)
-        } else {
-          // Can't sync it, we're done for now
-          filesDone <- true
-        }
-        fs.mut.RUnlock()
-      }
+      fs.scan()
 
-      // synchronize logic
-      for _, _ = range files {
-        c := <- filesDone
-        if c == false {
-          config.Log(config.LOG_ERROR, "sync: Error syncing a file")
+      // The Edison doesn't have enough RAM to facilitate these in paralell,
+      // so do this sequentially for now.
+      for _, it := range fs.queue.Due(time.Now()) {
+        if upload.Cancelled(quit) {
+          break
         }
+        fs.upload(it, quit)
       }
 
-      close(filesDone)
-
       // Note that we're manually resetting the timer here. This is because we
       // want to sync any new flights first before attempting another search.
       checker.Reset(TICKER_INTERVAL * time.Second)
@@ -134,140 +170,126 @@ func (fs *FlightSyncer) listener() {
   }
 }
 
-func (fs *FlightSyncer) upload(fname string, done chan bool) {
+// Queues every finished log that hasn't been synced, and drops queue entries
+// for logs that are gone.
+func (fs *FlightSyncer) scan() {
+  files, _ := filepath.Glob(fs.FlightsPath + "/Flight*")
 
-  var userTemp string
-  var droneTemp string
+  fs.mut.RLock()
+  lockname := fs.lockname
+  fs.mut.RUnlock()
+
+  present := make(map[string]bool)
+  for _, f := range files {
+    name := filepath.Base(f)
+    if fs.catalog.IsSynced(name) || f == lockname || flightlog.IsOpen(f) {
+      continue
+    }
 
-  if fs.DroneId == "" {
-    config.Log(config.LOG_ERROR, "Cannot sync. User Id or Drone Id nil")
-    done <- false
-    return
-  } else {
-    userTemp = copystr(fs.UserId)
-    droneTemp = copystr(fs.DroneId)
+    info, err := os.Stat(f)
+    if err != nil || info.IsDir() {
+      continue
+    } else if info.Size() == 0 {
+      config.Log(config.LOG_INFO, "Empty flight log. Removing garbage file.")
+      if err := fs.catalog.Delete(name); err != nil {
+        config.Log(config.LOG_ERROR, "Could not remove file.")
+      }
+      continue
+    }
+
+    present[name] = true
+    if err := fs.queue.Add(name, info.Size(), info.ModTime()); err != nil {
+      config.Log(config.LOG_ERROR, "sync: Could not queue", name, err)
+    }
   }
 
-  if file, err := os.OpenFile(path.Join(fname), os.O_RDWR, 0600); err != nil {
-    config.Log(config.LOG_ERROR, "error opening file", err)
-    done <- false
+  fs.queue.Prune(func(name string) bool { return present[name] })
+}
+
+// One attempt at a queued log. Failures are put back in the queue with a
+// backoff, progress is kept so the next attempt resumes.
+func (fs *FlightSyncer) upload(it upload.Item, cancel <-chan struct{}) {
+  dest := fs.dest.String()
+  fs.queue.Update(it.Name, func(qi *upload.Item) {
+    // A session belongs to the destination it was opened with.
+    if qi.Dest != dest {
+      qi.Dest, qi.Session, qi.Offset = dest, "", 0
+    }
+    qi.State = upload.STATE_UPLOADING
+    it = *qi
+  })
+
+  err := fs.send(it, cancel)
+  if err == nil {
+    syncUploads.With("ok").Inc()
+    fs.queue.Remove(it.Name)
+    config.Log(config.LOG_INFO, "File successfully synced!")
     return
-  } else {
-    // XXX - analyze memory footprint of this.
-    chunk := make([]byte, MAX_UPLOAD_SIZE)
-
-    if readBytes, err := file.Read(chunk); err != nil {
-      config.Log(config.LOG_ERROR, "error reading file", err)
-
-      if err == io.EOF {
-        config.Log(config.LOG_INFO, "Got EOF. Removing garbage file.")
-        if err := os.Remove(fname); err != nil {
-          config.Log(config.LOG_ERROR, "Could not remove file.")
-          done <- false
-          return
-        }
-      }
+  } else if err == upload.ErrCancelled {
+    // Not the upload's fault, it carries on when the syncer is restarted.
+    fs.queue.Update(it.Name, func(qi *upload.Item) {
+      qi.State = upload.STATE_QUEUED
+    })
+    return
+  }
 
-      done <- false
-      return
-    } else {
-      buf := bytes.NewBuffer(chunk[:readBytes])
-
-      // upload data
-      res, err := http.Post(*config.DSCHttp + "/rt/mission/mavlinkBinary",
-        "application/octet-stream", buf)
-      if err != nil {
-        config.Log(config.LOG_ERROR, "POST mission:", err)
-        done <- false
-        return
-      }
+  fs.queue.Update(it.Name, func(qi *upload.Item) {
+    qi.Attempts++
+    qi.State = upload.STATE_RETRY
+    qi.LastError = err.Error()
+    qi.NextTry = time.Now().Add(upload.Backoff(qi.Attempts, RETRY_BASE, RETRY_MAX))
+  })
+  syncUploads.With("error").Inc()
+  config.Log(config.LOG_ERROR, "sync: Error syncing", it.Name, err)
+}
 
-      body, err := ioutil.ReadAll(res.Body)
-      if err != nil {
-        config.Log(config.LOG_ERROR, "Reading POST mission respone:", err)
-        done <- false
-        return
-      }
+func (fs *FlightSyncer) send(it upload.Item, cancel <-chan struct{}) error {
+  file, err := os.Open(filepath.Join(fs.FlightsPath, it.Name))
+  if err != nil {
+    return err
+  }
+  defer file.Close()
 
-      res.Body.Close()
-      file.Close()
-
-      resMap := make(map[string]string)
-      if err := json.Unmarshal(body, &resMap); err != nil {
-        config.Log(config.LOG_ERROR, "Parsing POST mission JSON:", body, err)
-        done <- false
-        return
-      } else if resMap["status"] == "OK" {
-        // synthesize the JSON
-        sendMap := make(map[string]string)
-        sendMap["user"] = userTemp
-        sendMap["drone"] = droneTemp
-
-        if jsonChunk, err := json.Marshal(sendMap); err != nil {
-          config.Log(config.LOG_ERROR, "Could not build JSON")
-          done <- false
-          return
-        } else {
-
-          // send associate request
-          body, err := put(*config.DSCHttp + "/rt/mission/" + resMap["id"] + "/associate",
-            "application/json", bytes.NewBuffer(jsonChunk))
-          if err != nil {
-            config.Log(config.LOG_ERROR, "Sending PUT mission:", err)
-            done <- false
-            return
-          } else {
-
-            if err := json.Unmarshal(body, &resMap); err != nil {
-              config.Log(config.LOG_ERROR, "Parsing PUT mission JSON:", body, err)
-              done <- false
-              return
-            } else {
-              if resMap["status"] == "OK" {
-                // remove the file
-                if err := os.Remove(fname); err != nil {
-                  config.Log(config.LOG_ERROR, "Could not remove file.")
-                  done <- false
-                  return
-                }
-
-                config.Log(config.LOG_INFO, "File successfully synced!")
-                done <- true
-                return
-              } else {
-                config.Log(config.LOG_ERROR, "Association failed.")
-                done <- false
-                return
-              }
-            }
-          }
-        }
-      } else {
-        config.Log(config.LOG_ERROR, "Upload failed: ", resMap["error"])
-        done <- false
-        return
-      }
+  encoding := ""
+  if strings.HasSuffix(it.Name, flightlog.GZIP_EXT) {
+    encoding = "gzip"
+  }
+
+  last := it.Offset
+  ref, err := fs.dest.Upload(it, file, encoding, func(session string, off int64) {
+    if off > last {
+      syncBytes.Add(float64(off - last))
     }
+    last = off
+    fs.queue.Update(it.Name, func(qi *upload.Item) {
+      qi.Session, qi.Offset = session, off
+    })
+  }, cancel)
+  if err != nil {
+    return err
   }
+  config.Log(config.LOG_DEBUG, "sync: ", it.Name, "stored as", ref)
+
+  // keep the file, but don't upload it again
+  return fs.catalog.MarkSynced(it.Name)
+}
+
+type SyncStatus struct {
+  Running   bool            `json:"running"`
+  Dest      string          `json:"destination"`
+  Recording string          `json:"recording"`
+  Queue     []upload.Item   `json:"queue"`
 }
 
-func put(url, ctype string, data *bytes.Buffer) ([]byte, error) {
-	client := &http.Client{}
-	request, err := http.NewRequest("PUT", url, data)
-	request.ContentLength = int64(data.Len())
-  request.Header.Add("Content-Type", ctype)
-	response, err := client.Do(request)
-	if err != nil {
-		return nil, err
-	} else {
-		defer response.Body.Close()
-		contents, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-		  return nil, err
-		}
-
-    return contents, nil
-	}
+func (fs *FlightSyncer) Status() SyncStatus {
+  fs.mut.RLock()
+  defer fs.mut.RUnlock()
+
+  st := SyncStatus{Running: fs.isRunning, Dest: fs.dest.String(), Queue: fs.queue.Items()}
+  if fs.lockname != "" {
+    st.Recording = filepath.Base(fs.lockname)
+  }
+  return st
 }
 
 func copystr(a string) string {
@@ -0,0 +1,19 @@
+package cloudlink
+
+import (
+  "metrics"
+)
+
+var (
+  cloudSession = metrics.NewGauge("dslink_cloud_session",
+    "1 while there's a DroneDP session with Dronesmith Cloud.")
+  cloudReconnects = metrics.NewCounter("dslink_cloud_reconnects_total",
+    "DroneDP sessions agreed after an earlier one was lost.")
+  cloudDials = metrics.NewCounterVec("dslink_cloud_dials_total",
+    "Connections opened to Dronesmith Cloud, by address and result.", "address", "result")
+
+  syncUploads = metrics.NewCounterVec("dslink_sync_uploads_total",
+    "Flight log upload attempts, by result: ok or error.", "result")
+  syncBytes = metrics.NewCounter("dslink_sync_bytes_total",
+    "Flight log bytes uploaded.")
+)
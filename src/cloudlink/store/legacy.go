@@ -0,0 +1,60 @@
+package store
+
+import (
+  "encoding/json"
+  "encoding/pem"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+)
+
+// The store before version 1: "key-value" pairs joined with ";" in a PEM
+// block. Keys never had a "-" in them, so the first one splits.
+const LEGACY_FILE_NAME = ".lmon"
+
+// Lists that used to be comma separated strings.
+var legacyLists = map[string]bool{"output": true}
+
+// Reads an old store in dir, nil if there isn't one.
+func migrateLegacy(dir string) (map[string]json.RawMessage, error) {
+  data, err := ioutil.ReadFile(filepath.Join(dir, LEGACY_FILE_NAME))
+  if os.IsNotExist(err) {
+    return nil, nil
+  } else if err != nil {
+    return nil, err
+  }
+
+  values := make(map[string]json.RawMessage)
+  blk, _ := pem.Decode(data)
+  if blk == nil {
+    // Empty or unreadable, nothing to keep.
+    return values, nil
+  }
+
+  for _, pair := range strings.Split(string(blk.Bytes), ";") {
+    kv := strings.SplitN(pair, "-", 2)
+    if len(kv) != 2 || kv[0] == "" {
+      continue
+    }
+
+    var raw []byte
+    if legacyLists[kv[0]] {
+      list := []string{}
+      for _, v := range strings.Split(kv[1], ",") {
+        if v != "" {
+          list = append(list, v)
+        }
+      }
+      raw, _ = json.Marshal(list)
+    } else {
+      raw, _ = json.Marshal(kv[1])
+    }
+    values[kv[0]] = raw
+  }
+  return values, nil
+}
+
+func removeLegacy(dir string) {
+  os.Remove(filepath.Join(dir, LEGACY_FILE_NAME))
+}
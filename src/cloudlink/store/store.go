@@ -0,0 +1,374 @@
+package store
+
+import (
+  "crypto/aes"
+  "crypto/cipher"
+  "crypto/rand"
+  "encoding/base64"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sync"
+)
+
+const (
+  FILE_NAME = ".store.json"
+  KEY_FILE_NAME = ".store.key"
+
+  VERSION = 1
+)
+
+var ErrNotString = errors.New("Store value isn't a string.")
+
+// On disk. Values are JSON strings or lists of strings. Secrets are stored as
+// {"enc": "<base64 nonce and AES-GCM ciphertext>"}, under a key kept in a
+// separate file, so the store on its own doesn't give them away.
+type file struct {
+  Version   int                         `json:"version"`
+  Values    map[string]json.RawMessage  `json:"values"`
+}
+
+type sealed struct {
+  Enc       string  `json:"enc"`
+}
+
+// Small persistent settings. Every change is written straight through, to a
+// temporary file that's then renamed over the old one, so a crash or power
+// cut leaves either the old store or the new one.
+type Store struct {
+  path      string
+  keyPath   string
+
+  mut       sync.RWMutex
+  values    map[string]json.RawMessage
+  secrets   map[string]bool
+
+  // Readers share mut, so the key is loaded under its own lock.
+  keyMut    sync.Mutex
+  aead      cipher.AEAD
+}
+
+// Opens the store in dir, migrating an old one there if that's all there is.
+func Open(dir string) (*Store, error) {
+  s := &Store{
+    path: filepath.Join(dir, FILE_NAME),
+    keyPath: filepath.Join(dir, KEY_FILE_NAME),
+    values: make(map[string]json.RawMessage),
+    secrets: make(map[string]bool),
+  }
+
+  if _, err := os.Stat(s.path); os.IsNotExist(err) {
+    migrated, err := migrateLegacy(dir)
+    if err != nil {
+      return nil, err
+    }
+    if migrated != nil {
+      s.values = migrated
+      if err := s.save(); err != nil {
+        return nil, err
+      }
+      removeLegacy(dir)
+    }
+    return s, nil
+  } else if err != nil {
+    return nil, err
+  }
+
+  return s, s.Load()
+}
+
+// Rereads the store from disk.
+func (s *Store) Load() error {
+  data, err := ioutil.ReadFile(s.path)
+  if os.IsNotExist(err) {
+    return nil
+  } else if err != nil {
+    return err
+  }
+
+  var f file
+  if err := json.Unmarshal(data, &f); err != nil {
+    return fmt.Errorf("Store %s is corrupt: %v", s.path, err)
+  }
+  if f.Version > VERSION {
+    return fmt.Errorf("Store %s is version %d, this build only knows up to %d.", s.path, f.Version, VERSION)
+  }
+  if f.Values == nil {
+    f.Values = make(map[string]json.RawMessage)
+  }
+
+  s.mut.Lock()
+  s.values = f.Values
+  s.mut.Unlock()
+  return nil
+}
+
+// Marks names as secrets, encrypted at rest. Any already stored in the clear
+// are encrypted now.
+func (s *Store) Secret(names ...string) error {
+  s.mut.Lock()
+  defer s.mut.Unlock()
+
+  changed := false
+  for _, name := range names {
+    s.secrets[name] = true
+
+    raw, ok := s.values[name]
+    var str string
+    if ok && json.Unmarshal(raw, &str) == nil {
+      enc, err := s.seal(str)
+      if err != nil {
+        return err
+      }
+      s.values[name] = enc
+      changed = true
+    }
+  }
+
+  if changed {
+    return s.save()
+  }
+  return nil
+}
+
+// A string value, "" if it isn't set.
+func (s *Store) Get(name string) string {
+  str, _ := s.Lookup(name)
+  return str
+}
+
+// A string value and whether it's set.
+func (s *Store) Lookup(name string) (string, bool) {
+  s.mut.RLock()
+  defer s.mut.RUnlock()
+
+  raw, ok := s.values[name]
+  if !ok {
+    return "", false
+  }
+
+  if s.secrets[name] {
+    str, err := s.open(raw)
+    return str, err == nil
+  }
+
+  var str string
+  if json.Unmarshal(raw, &str) != nil {
+    return "", false
+  }
+  return str, true
+}
+
+func (s *Store) Set(name, value string) error {
+  s.mut.Lock()
+  defer s.mut.Unlock()
+
+  var raw json.RawMessage
+  var err error
+  if s.secrets[name] {
+    raw, err = s.seal(value)
+  } else {
+    raw, err = json.Marshal(value)
+  }
+  if err != nil {
+    return err
+  }
+
+  return s.put(name, raw)
+}
+
+// A list value, nil if it isn't set or isn't a list.
+func (s *Store) GetList(name string) []string {
+  s.mut.RLock()
+  defer s.mut.RUnlock()
+
+  var list []string
+  if raw, ok := s.values[name]; ok {
+    json.Unmarshal(raw, &list)
+  }
+  return list
+}
+
+func (s *Store) SetList(name string, list []string) error {
+  if list == nil {
+    list = []string{}
+  }
+  raw, err := json.Marshal(list)
+  if err != nil {
+    return err
+  }
+
+  s.mut.Lock()
+  defer s.mut.Unlock()
+  return s.put(name, raw)
+}
+
+// Must be called with the lock held. Rolls back if it can't be saved.
+func (s *Store) put(name string, raw json.RawMessage) error {
+  old, had := s.values[name]
+  s.values[name] = raw
+  if err := s.save(); err != nil {
+    if had {
+      s.values[name] = old
+    } else {
+      delete(s.values, name)
+    }
+    return err
+  }
+  return nil
+}
+
+// Removes one value.
+func (s *Store) Delete(name string) error {
+  s.mut.Lock()
+  defer s.mut.Unlock()
+
+  if _, ok := s.values[name]; !ok {
+    return nil
+  }
+  delete(s.values, name)
+  return s.save()
+}
+
+// Removes everything but keep.
+func (s *Store) Clear(keep ...string) error {
+  s.mut.Lock()
+  defer s.mut.Unlock()
+
+  values := make(map[string]json.RawMessage)
+  for _, name := range keep {
+    if raw, ok := s.values[name]; ok {
+      values[name] = raw
+    }
+  }
+  s.values = values
+  return s.save()
+}
+
+// Must be called with the lock held.
+func (s *Store) save() error {
+  data, err := json.MarshalIndent(file{VERSION, s.values}, "", "  ")
+  if err != nil {
+    return err
+  }
+  return writeAtomic(s.path, data, 0600)
+}
+
+func writeAtomic(path string, data []byte, perm os.FileMode) error {
+  tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path) + ".tmp")
+  if err != nil {
+    return err
+  }
+  defer os.Remove(tmp.Name())
+
+  if _, err := tmp.Write(data); err != nil {
+    tmp.Close()
+    return err
+  }
+  if err := tmp.Chmod(perm); err != nil {
+    tmp.Close()
+    return err
+  }
+  if err := tmp.Sync(); err != nil {
+    tmp.Close()
+    return err
+  }
+  if err := tmp.Close(); err != nil {
+    return err
+  }
+  if err := os.Rename(tmp.Name(), path); err != nil {
+    return err
+  }
+
+  // Make the rename itself stick.
+  if dir, err := os.Open(filepath.Dir(path)); err == nil {
+    dir.Sync()
+    dir.Close()
+  }
+  return nil
+}
+
+// Must be called with the lock held, read or write. The key is made on first
+// use.
+func (s *Store) cipher() (cipher.AEAD, error) {
+  s.keyMut.Lock()
+  defer s.keyMut.Unlock()
+
+  if s.aead != nil {
+    return s.aead, nil
+  }
+
+  key, err := ioutil.ReadFile(s.keyPath)
+  if os.IsNotExist(err) {
+    key = make([]byte, 32)
+    if _, err := io.ReadFull(rand.Reader, key); err != nil {
+      return nil, err
+    }
+    if err := writeAtomic(s.keyPath, key, 0600); err != nil {
+      return nil, err
+    }
+  } else if err != nil {
+    return nil, err
+  } else if len(key) != 32 {
+    return nil, fmt.Errorf("Store key %s is damaged.", s.keyPath)
+  }
+
+  block, err := aes.NewCipher(key)
+  if err != nil {
+    return nil, err
+  }
+  if s.aead, err = cipher.NewGCM(block); err != nil {
+    return nil, err
+  }
+  return s.aead, nil
+}
+
+// Must be called with the lock held.
+func (s *Store) seal(value string) (json.RawMessage, error) {
+  aead, err := s.cipher()
+  if err != nil {
+    return nil, err
+  }
+
+  nonce := make([]byte, aead.NonceSize())
+  if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+    return nil, err
+  }
+  out := aead.Seal(nonce, nonce, []byte(value), nil)
+  return json.Marshal(sealed{base64.StdEncoding.EncodeToString(out)})
+}
+
+// Must be called with the lock held. Secrets stored before they were marked
+// as such are still in the clear, and are read as they are.
+func (s *Store) open(raw json.RawMessage) (string, error) {
+  var str string
+  if json.Unmarshal(raw, &str) == nil {
+    return str, nil
+  }
+
+  var enc sealed
+  if err := json.Unmarshal(raw, &enc); err != nil {
+    return "", err
+  }
+  data, err := base64.StdEncoding.DecodeString(enc.Enc)
+  if err != nil {
+    return "", err
+  }
+
+  aead, err := s.cipher()
+  if err != nil {
+    return "", err
+  }
+  if len(data) < aead.NonceSize() {
+    return "", ErrNotString
+  }
+  plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+  if err != nil {
+    return "", err
+  }
+  return string(plain), nil
+}
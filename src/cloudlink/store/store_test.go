@@ -0,0 +1,190 @@
+package store
+
+import (
+  "bytes"
+  "encoding/pem"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "reflect"
+  "strings"
+  "testing"
+)
+
+func tempDir(t *testing.T) (string, func()) {
+  dir, err := ioutil.TempDir("", "store")
+  if err != nil {
+    t.Fatal(err)
+  }
+  return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestRoundTrip(t *testing.T) {
+  dir, done := tempDir(t)
+  defer done()
+
+  s, err := Open(dir)
+  if err != nil {
+    t.Fatal(err)
+  }
+  s.Secret("pass")
+
+  // The old format couldn't take any of these.
+  email, pass := "first-last@example.com", "p;a-s,s\nword"
+  if err := s.Set("email", email); err != nil {
+    t.Fatal(err)
+  }
+  s.Set("pass", pass)
+  s.SetList("output", []string{"127.0.0.1:14550", "10.0.0.2:14551"})
+
+  raw, _ := ioutil.ReadFile(filepath.Join(dir, FILE_NAME))
+  if bytes.Contains(raw, []byte("p;a-s")) {
+    t.Error("secret stored in the clear")
+  }
+  if m, _ := filepath.Glob(filepath.Join(dir, "*.tmp*")); len(m) != 0 {
+    t.Errorf("left behind %v", m)
+  }
+
+  s2, err := Open(dir)
+  if err != nil {
+    t.Fatal(err)
+  }
+  s2.Secret("pass")
+  if s2.Get("email") != email || s2.Get("pass") != pass {
+    t.Errorf("got %q %q", s2.Get("email"), s2.Get("pass"))
+  }
+  if list := s2.GetList("output"); len(list) != 2 || list[1] != "10.0.0.2:14551" {
+    t.Errorf("got %v", list)
+  }
+  if _, ok := s2.Lookup("missing"); ok {
+    t.Error("missing value found")
+  }
+
+  // Without the key file, secrets can't be read.
+  os.Remove(filepath.Join(dir, KEY_FILE_NAME))
+  s3, _ := Open(dir)
+  s3.Secret("pass")
+  if s3.Get("pass") != "" || s3.Get("email") != email {
+    t.Errorf("got %q %q", s3.Get("pass"), s3.Get("email"))
+  }
+}
+
+func TestMigrateLegacy(t *testing.T) {
+  dir, done := tempDir(t)
+  defer done()
+
+  // Long enough that the old loader, reading 512 bytes, would lose some.
+  pairs := []string{"email-me@example.com", "pass-se-cret", "output-127.0.0.1:14550,10.0.0.2:14551", "step-complete"}
+  pairs = append(pairs, "padding-" + strings.Repeat("x", 600))
+  var buf bytes.Buffer
+  pem.Encode(&buf, &pem.Block{Type: "LMON", Bytes: []byte(strings.Join(pairs, ";"))})
+  ioutil.WriteFile(filepath.Join(dir, LEGACY_FILE_NAME), buf.Bytes(), 0600)
+
+  s, err := Open(dir)
+  if err != nil {
+    t.Fatal(err)
+  }
+  s.Secret("pass")
+
+  if s.Get("email") != "me@example.com" || s.Get("pass") != "se-cret" || s.Get("step") != "complete" {
+    t.Errorf("got %q %q %q", s.Get("email"), s.Get("pass"), s.Get("step"))
+  }
+  if !reflect.DeepEqual(s.GetList("output"), []string{"127.0.0.1:14550", "10.0.0.2:14551"}) {
+    t.Errorf("got %v", s.GetList("output"))
+  }
+  if len(s.Get("padding")) != 600 {
+    t.Error("lost the end of the old store")
+  }
+  if _, err := os.Stat(filepath.Join(dir, LEGACY_FILE_NAME)); !os.IsNotExist(err) {
+    t.Error("old store left behind")
+  }
+
+  // Marking the secret encrypted what was migrated in the clear.
+  raw, _ := ioutil.ReadFile(filepath.Join(dir, FILE_NAME))
+  if bytes.Contains(raw, []byte("se-cret")) {
+    t.Error("migrated secret still in the clear")
+  }
+}
+
+func TestNewerVersionRefused(t *testing.T) {
+  dir, done := tempDir(t)
+  defer done()
+
+  ioutil.WriteFile(filepath.Join(dir, FILE_NAME), []byte(`{"version": 99, "values": {}}`), 0600)
+  if _, err := Open(dir); err == nil {
+    t.Error("opened a store from the future")
+  }
+}
+
+func TestClearKeeps(t *testing.T) {
+  dir, done := tempDir(t)
+  defer done()
+
+  s, err := Open(dir)
+  if err != nil {
+    t.Fatal(err)
+  }
+  s.Secret("key")
+  s.Set("email", "me@example.com")
+  s.Set("key", "0123")
+  s.Set("token", "hash")
+
+  if err := s.Clear("key", "token", "missing"); err != nil {
+    t.Fatal(err)
+  }
+
+  s2, err := Open(dir)
+  if err != nil {
+    t.Fatal(err)
+  }
+  s2.Secret("key")
+  if s2.Get("email") != "" || s2.Get("key") != "0123" || s2.Get("token") != "hash" {
+    t.Errorf("got %q %q %q", s2.Get("email"), s2.Get("key"), s2.Get("token"))
+  }
+  if _, ok := s2.Lookup("missing"); ok {
+    t.Error("kept a value that was never set")
+  }
+}
+
+// After a restart the key is loaded by whichever secret is read first.
+func TestConcurrentSecrets(t *testing.T) {
+  dir, done := tempDir(t)
+  defer done()
+
+  s, err := Open(dir)
+  if err != nil {
+    t.Fatal(err)
+  }
+  s.Secret("pass", "key")
+  s.Set("pass", "se-cret")
+  s.Set("key", "0123")
+
+  s2, err := Open(dir)
+  if err != nil {
+    t.Fatal(err)
+  }
+  s2.Secret("pass", "key")
+
+  errs := make(chan string, 20)
+  for i := 0; i < 10; i++ {
+    go func() {
+      if v := s2.Get("pass"); v != "se-cret" {
+        errs <- "pass " + v
+      } else {
+        errs <- ""
+      }
+    }()
+    go func() {
+      if v := s2.Get("key"); v != "0123" {
+        errs <- "key " + v
+      } else {
+        errs <- ""
+      }
+    }()
+  }
+  for i := 0; i < 20; i++ {
+    if e := <-errs; e != "" {
+      t.Error("got", e)
+    }
+  }
+}
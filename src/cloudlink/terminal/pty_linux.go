@@ -0,0 +1,64 @@
+// +build linux
+
+package terminal
+
+import (
+  "os"
+  "os/exec"
+  "strconv"
+  "syscall"
+  "unsafe"
+)
+
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+  conn, err := f.SyscallConn()
+  if err != nil {
+    return err
+  }
+
+  // Through the raw conn, so the master stays non blocking and Close can
+  // interrupt a Read.
+  var errno syscall.Errno
+  if err := conn.Control(func(fd uintptr) {
+    _, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+  }); err != nil {
+    return err
+  }
+  if errno != 0 {
+    return errno
+  }
+  return nil
+}
+
+// Opens a new pseudo terminal pair.
+func openPty() (pty, tty *os.File, err error) {
+  pty, err = os.OpenFile("/dev/ptmx", os.O_RDWR | syscall.O_NOCTTY, 0)
+  if err != nil {
+    return nil, nil, err
+  }
+
+  var n uint32
+  var unlock int32
+  if err = ioctl(pty, syscall.TIOCGPTN, unsafe.Pointer(&n)); err == nil {
+    err = ioctl(pty, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock))
+  }
+  if err == nil {
+    tty, err = os.OpenFile("/dev/pts/" + strconv.Itoa(int(n)), os.O_RDWR | syscall.O_NOCTTY, 0)
+  }
+  if err != nil {
+    pty.Close()
+    return nil, nil, err
+  }
+  return pty, tty, nil
+}
+
+func setSize(pty *os.File, rows, cols uint16) error {
+  ws := struct{ Row, Col, X, Y uint16 }{rows, cols, 0, 0}
+  return ioctl(pty, syscall.TIOCSWINSZ, unsafe.Pointer(&ws))
+}
+
+// Runs cmd in its own session with tty as its controlling terminal.
+func attach(cmd *exec.Cmd, tty *os.File) {
+  cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+  cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+}
@@ -0,0 +1,19 @@
+// +build !linux
+
+package terminal
+
+import (
+  "os"
+  "os/exec"
+)
+
+func openPty() (pty, tty *os.File, err error) {
+  return nil, nil, ErrUnsupported
+}
+
+func setSize(pty *os.File, rows, cols uint16) error {
+  return ErrUnsupported
+}
+
+func attach(cmd *exec.Cmd, tty *os.File) {
+}
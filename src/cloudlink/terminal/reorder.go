@@ -0,0 +1,34 @@
+package terminal
+
+// Puts sequenced chunks back in order. Chunks ahead of the next expected one
+// are held, up to MAX_AHEAD of them; anything already delivered is dropped.
+type Reorder struct {
+  next      uint32
+  held      map[uint32][]byte
+}
+
+const MAX_AHEAD = 64
+
+func NewReorder() *Reorder {
+  return &Reorder{held: make(map[uint32][]byte)}
+}
+
+// Takes in chunk seq and returns whatever can now be delivered, in order.
+func (r *Reorder) Push(seq uint32, data []byte) [][]byte {
+  if seq - r.next >= MAX_AHEAD {
+    // Already delivered, or too far ahead to hold on to.
+    return nil
+  }
+  r.held[seq] = data
+
+  var out [][]byte
+  for {
+    chunk, ok := r.held[r.next]
+    if !ok {
+      return out
+    }
+    delete(r.held, r.next)
+    out = append(out, chunk)
+    r.next++
+  }
+}
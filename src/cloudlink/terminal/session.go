@@ -0,0 +1,174 @@
+package terminal
+
+import (
+  "crypto/sha256"
+  "crypto/subtle"
+  "encoding/hex"
+  "errors"
+  "os"
+  "os/exec"
+  "sort"
+  "sync"
+  "time"
+)
+
+const (
+  DEFAULT_ROWS = 24
+  DEFAULT_COLS = 80
+  MAX_SESSIONS = 4
+)
+
+var (
+  ErrUnsupported = errors.New("Terminals aren't supported on this OS.")
+  ErrTooMany = errors.New("Too many terminal sessions open.")
+)
+
+// A shell running on a pseudo terminal.
+type Session struct {
+  Id        uint32    `json:"id"`
+  Who       string    `json:"who"`
+  Started   time.Time `json:"started"`
+
+  cmd       *exec.Cmd
+  pty       *os.File
+  done      chan struct{}
+  once      sync.Once
+}
+
+func (s *Session) Read(p []byte) (int, error) {
+  return s.pty.Read(p)
+}
+
+func (s *Session) Write(p []byte) (int, error) {
+  return s.pty.Write(p)
+}
+
+func (s *Session) Resize(rows, cols uint16) error {
+  if rows == 0 || cols == 0 {
+    return nil
+  }
+  return setSize(s.pty, rows, cols)
+}
+
+// Closed once the shell has exited.
+func (s *Session) Done() <-chan struct{} {
+  return s.done
+}
+
+// Hangs up on the shell.
+func (s *Session) Close() error {
+  s.once.Do(func() {
+    s.pty.Close()
+    if s.cmd.Process != nil {
+      s.cmd.Process.Kill()
+    }
+  })
+  return nil
+}
+
+// Keeps track of the open terminals, whichever way they were opened.
+type Manager struct {
+  shell     string
+
+  mut       sync.Mutex
+  sessions  map[uint32]*Session
+  nextId    uint32
+}
+
+// shell falls back to /bin/sh if it isn't there.
+func NewManager(shell string) *Manager {
+  if _, err := os.Stat(shell); err != nil {
+    shell = "/bin/sh"
+  }
+  return &Manager{shell: shell, sessions: make(map[uint32]*Session), nextId: 1}
+}
+
+// Starts a login shell. who is a note for listings, where it was opened from.
+func (m *Manager) Open(who string, rows, cols uint16) (*Session, error) {
+  m.mut.Lock()
+  if len(m.sessions) >= MAX_SESSIONS {
+    m.mut.Unlock()
+    return nil, ErrTooMany
+  }
+  id := m.nextId
+  m.nextId++
+  m.mut.Unlock()
+
+  pty, tty, err := openPty()
+  if err != nil {
+    return nil, err
+  }
+  defer tty.Close()
+
+  if rows == 0 || cols == 0 {
+    rows, cols = DEFAULT_ROWS, DEFAULT_COLS
+  }
+  setSize(pty, rows, cols)
+
+  cmd := exec.Command(m.shell, "-l")
+  cmd.Env = append(os.Environ(), "TERM=xterm-256color")
+  if home, err := os.UserHomeDir(); err == nil {
+    cmd.Dir = home
+  }
+  attach(cmd, tty)
+  if err := cmd.Start(); err != nil {
+    pty.Close()
+    return nil, err
+  }
+
+  s := &Session{Id: id, Who: who, Started: time.Now(), cmd: cmd, pty: pty, done: make(chan struct{})}
+
+  m.mut.Lock()
+  m.sessions[id] = s
+  m.mut.Unlock()
+
+  go func() {
+    cmd.Wait()
+    s.Close()
+
+    m.mut.Lock()
+    delete(m.sessions, id)
+    m.mut.Unlock()
+    close(s.done)
+  }()
+
+  return s, nil
+}
+
+func (m *Manager) Get(id uint32) *Session {
+  m.mut.Lock()
+  defer m.mut.Unlock()
+  return m.sessions[id]
+}
+
+// Open sessions, oldest first.
+func (m *Manager) Sessions() []*Session {
+  m.mut.Lock()
+  defer m.mut.Unlock()
+
+  list := make([]*Session, 0, len(m.sessions))
+  for _, s := range m.sessions {
+    list = append(list, s)
+  }
+  sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+  return list
+}
+
+func (m *Manager) CloseAll() {
+  for _, s := range m.Sessions() {
+    s.Close()
+  }
+}
+
+// Access tokens are only kept hashed.
+func HashToken(token string) string {
+  sum := sha256.Sum256([]byte(token))
+  return hex.EncodeToString(sum[:])
+}
+
+func CheckToken(hash, token string) bool {
+  if hash == "" || token == "" {
+    return false
+  }
+  return subtle.ConstantTimeCompare([]byte(hash), []byte(HashToken(token))) == 1
+}
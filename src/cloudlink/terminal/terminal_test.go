@@ -0,0 +1,81 @@
+package terminal
+
+import (
+  "bytes"
+  "runtime"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestReorder(t *testing.T) {
+  r := NewReorder()
+
+  if out := r.Push(1, []byte("b")); len(out) != 0 {
+    t.Fatalf("delivered early: %q", out)
+  }
+  if out := r.Push(0, []byte("a")); len(out) != 2 || string(out[0]) != "a" || string(out[1]) != "b" {
+    t.Fatalf("got %q", out)
+  }
+  if out := r.Push(0, []byte("a")); len(out) != 0 {
+    t.Errorf("duplicate delivered: %q", out)
+  }
+  if out := r.Push(2 + MAX_AHEAD, []byte("z")); len(out) != 0 {
+    t.Errorf("too far ahead delivered: %q", out)
+  }
+  if out := r.Push(2, []byte("c")); len(out) != 1 || string(out[0]) != "c" {
+    t.Errorf("got %q", out)
+  }
+}
+
+func TestToken(t *testing.T) {
+  hash := HashToken("s3cret")
+  if !CheckToken(hash, "s3cret") || CheckToken(hash, "s3cre") || CheckToken("", "") {
+    t.Error("token check is wrong")
+  }
+}
+
+func TestShell(t *testing.T) {
+  if runtime.GOOS != "linux" {
+    t.Skip("no pty support")
+  }
+
+  m := NewManager("/bin/sh")
+  s, err := m.Open("test", 0, 0)
+  if err != nil {
+    t.Skip(err)
+  }
+  defer s.Close()
+
+  if err := s.Resize(40, 100); err != nil {
+    t.Error(err)
+  }
+  s.Write([]byte("stty size; echo mark$((40+2))\n"))
+
+  var out bytes.Buffer
+  buf := make([]byte, 1024)
+  deadline := time.Now().Add(5 * time.Second)
+  for !strings.Contains(out.String(), "mark42") && time.Now().Before(deadline) {
+    n, err := s.Read(buf)
+    if err != nil {
+      break
+    }
+    out.Write(buf[:n])
+  }
+  if !strings.Contains(out.String(), "40 100") || !strings.Contains(out.String(), "mark42") {
+    t.Fatalf("got %q", out.String())
+  }
+  if len(m.Sessions()) != 1 {
+    t.Errorf("got %d sessions", len(m.Sessions()))
+  }
+
+  s.Write([]byte("exit\n"))
+  select {
+  case <-s.Done():
+  case <-time.After(5 * time.Second):
+    t.Fatal("shell didn't exit")
+  }
+  if len(m.Sessions()) != 0 {
+    t.Errorf("got %d sessions after exit", len(m.Sessions()))
+  }
+}
@@ -0,0 +1,88 @@
+package transport
+
+import (
+  "bufio"
+  "crypto/tls"
+  "encoding/binary"
+  "fmt"
+  "io"
+  "net"
+  "sync"
+)
+
+// Biggest frame accepted off a stream. DroneDP payloads are at most 64K.
+const MAX_FRAME = 1 << 17
+
+// Frames over TCP, each preceded by its length as a 4 byte big endian int.
+type streamTransport struct {
+  conn    net.Conn
+  r       *bufio.Reader
+  name    string
+  wmut    sync.Mutex
+}
+
+func dialStream(scheme, addr string) (Transport, error) {
+  dialer := &net.Dialer{Timeout: DIAL_TIMEOUT}
+
+  var conn net.Conn
+  var err error
+  if scheme == "tls" {
+    host, _, _ := net.SplitHostPort(addr)
+    conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: host})
+  } else {
+    conn, err = dialer.Dial("tcp", addr)
+  }
+  if err != nil {
+    return nil, err
+  }
+  return NewStream(conn, scheme + "://" + addr), nil
+}
+
+// Wraps an established connection. The cloud side uses this on accepted ones.
+func NewStream(conn net.Conn, name string) Transport {
+  return &streamTransport{conn: conn, r: bufio.NewReader(conn), name: name}
+}
+
+func (t *streamTransport) Read(buf []byte) (int, error) {
+  var hdr [4]byte
+  if _, err := io.ReadFull(t.r, hdr[:]); err != nil {
+    return 0, err
+  }
+
+  n := int(binary.BigEndian.Uint32(hdr[:]))
+  if n > MAX_FRAME || n > len(buf) {
+    return 0, fmt.Errorf("Frame of %d bytes from %s is too large.", n, t.name)
+  }
+  if _, err := io.ReadFull(t.r, buf[:n]); err != nil {
+    return 0, err
+  }
+  return n, nil
+}
+
+func (t *streamTransport) Write(frame []byte) error {
+  if len(frame) > MAX_FRAME {
+    return fmt.Errorf("Frame of %d bytes is too large.", len(frame))
+  }
+
+  // One write per frame, so frames from different goroutines don't interleave.
+  out := make([]byte, 4, 4 + len(frame))
+  binary.BigEndian.PutUint32(out, uint32(len(frame)))
+  out = append(out, frame...)
+
+  t.wmut.Lock()
+  defer t.wmut.Unlock()
+  _, err := t.conn.Write(out)
+  return err
+}
+
+func (t *streamTransport) Close() error {
+  return t.conn.Close()
+}
+
+func (t *streamTransport) Stream() bool {
+  return true
+}
+
+func (t *streamTransport) String() string {
+  return t.name
+}
@@ -0,0 +1,83 @@
+package transport
+
+import (
+  "fmt"
+  "net"
+  "net/url"
+  "strings"
+  "time"
+)
+
+const DIAL_TIMEOUT = 10 * time.Second
+
+// Carries DroneDP frames to and from the cloud. Read returns one whole frame.
+type Transport interface {
+  Read(buf []byte) (int, error)
+  Write(frame []byte) error
+  Close() error
+
+  // Whether the connection is gone once Read fails. UDP errors are mostly
+  // ICMP noise and reading carries on.
+  Stream() bool
+  String() string
+}
+
+// Connects to the cloud at a DSC address:
+//
+//   host:port, udp://host:port   plain DroneDP datagrams (default)
+//   tcp://host:port              length prefixed frames over TCP
+//   tls://host:port              the same, over TLS
+//   ws://host:port/path          one frame per binary WebSocket message
+//   wss://host:port/path         the same, over TLS
+func Dial(raw string) (Transport, error) {
+  u, err := parse(raw)
+  if err != nil {
+    return nil, err
+  }
+
+  switch u.Scheme {
+  case "udp":
+    return dialUDP(u.Host)
+  case "tcp", "tls":
+    return dialStream(u.Scheme, u.Host)
+  case "ws", "wss":
+    return dialWS(u)
+  }
+  return nil, fmt.Errorf("Unknown DSC scheme %s", u.Scheme)
+}
+
+func parse(raw string) (*url.URL, error) {
+  if !strings.Contains(raw, "://") {
+    raw = "udp://" + raw
+  }
+
+  u, err := url.Parse(raw)
+  if err != nil {
+    return nil, err
+  }
+  if _, _, err := net.SplitHostPort(u.Host); err != nil {
+    return nil, fmt.Errorf("DSC address %s needs a host and port.", raw)
+  }
+  return u, nil
+}
+
+// The addresses to try in order: the configured one, then the fallbacks.
+// "auto" falls back from UDP to TCP on the same host and port, for networks
+// that block outbound UDP.
+func Candidates(primary, fallback string) []string {
+  list := []string{primary}
+
+  if fallback == "auto" {
+    if u, err := parse(primary); err == nil && u.Scheme == "udp" {
+      list = append(list, "tcp://" + u.Host)
+    }
+    return list
+  }
+
+  for _, f := range strings.Split(fallback, ",") {
+    if f = strings.TrimSpace(f); f != "" && f != primary {
+      list = append(list, f)
+    }
+  }
+  return list
+}
@@ -0,0 +1,88 @@
+package transport
+
+import (
+  "bytes"
+  "net"
+  "reflect"
+  "testing"
+)
+
+func TestCandidates(t *testing.T) {
+  cases := []struct {
+    primary, fallback string
+    want []string
+  }{
+    {"127.0.0.1:4002", "auto", []string{"127.0.0.1:4002", "tcp://127.0.0.1:4002"}},
+    {"udp://dsc.example:4002", "auto", []string{"udp://dsc.example:4002", "tcp://dsc.example:4002"}},
+    {"wss://dsc.example:443/ddp", "auto", []string{"wss://dsc.example:443/ddp"}},
+    {"127.0.0.1:4002", "", []string{"127.0.0.1:4002"}},
+    {"127.0.0.1:4002", "wss://dsc.example:443/ddp, tcp://dsc.example:4002", []string{"127.0.0.1:4002", "wss://dsc.example:443/ddp", "tcp://dsc.example:4002"}},
+  }
+
+  for _, c := range cases {
+    if got := Candidates(c.primary, c.fallback); !reflect.DeepEqual(got, c.want) {
+      t.Errorf("%s %s: got %v", c.primary, c.fallback, got)
+    }
+  }
+}
+
+func TestDialRejects(t *testing.T) {
+  for _, raw := range []string{"ftp://dsc.example:21", "tcp://dsc.example"} {
+    if _, err := Dial(raw); err == nil {
+      t.Errorf("%s: expected an error", raw)
+    }
+  }
+}
+
+func TestStreamFrames(t *testing.T) {
+  ln, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Skip(err)
+  }
+  defer ln.Close()
+
+  // Echo every frame back.
+  go func() {
+    conn, err := ln.Accept()
+    if err != nil {
+      return
+    }
+    s := NewStream(conn, "server")
+    buf := make([]byte, MAX_FRAME)
+    for {
+      n, err := s.Read(buf)
+      if err != nil {
+        s.Close()
+        return
+      }
+      s.Write(buf[:n])
+    }
+  }()
+
+  c, err := Dial("tcp://" + ln.Addr().String())
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer c.Close()
+
+  frames := [][]byte{{0x01}, bytes.Repeat([]byte{0xab}, 70000), {}, {0x02, 0x03}}
+  for _, f := range frames {
+    if err := c.Write(f); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  buf := make([]byte, MAX_FRAME)
+  for i, f := range frames {
+    n, err := c.Read(buf)
+    if err != nil {
+      t.Fatal(err)
+    } else if !bytes.Equal(buf[:n], f) {
+      t.Errorf("frame %d: got %d bytes, want %d", i, n, len(f))
+    }
+  }
+
+  if err := c.Write(make([]byte, MAX_FRAME + 1)); err == nil {
+    t.Error("oversized frame was written")
+  }
+}
@@ -0,0 +1,44 @@
+package transport
+
+import (
+  "net"
+)
+
+type udpTransport struct {
+  conn  *net.UDPConn
+  addr  string
+}
+
+func dialUDP(addr string) (Transport, error) {
+  raddr, err := net.ResolveUDPAddr("udp4", addr)
+  if err != nil {
+    return nil, err
+  }
+  conn, err := net.DialUDP("udp", nil, raddr)
+  if err != nil {
+    return nil, err
+  }
+  return &udpTransport{conn, addr}, nil
+}
+
+func (t *udpTransport) Read(buf []byte) (int, error) {
+  n, _, err := t.conn.ReadFromUDP(buf)
+  return n, err
+}
+
+func (t *udpTransport) Write(frame []byte) error {
+  _, err := t.conn.Write(frame)
+  return err
+}
+
+func (t *udpTransport) Close() error {
+  return t.conn.Close()
+}
+
+func (t *udpTransport) Stream() bool {
+  return false
+}
+
+func (t *udpTransport) String() string {
+  return "udp://" + t.addr
+}
@@ -0,0 +1,71 @@
+package transport
+
+import (
+  "crypto/tls"
+  "fmt"
+  "net"
+  "net/url"
+  "sync"
+
+  "golang.org/x/net/websocket"
+)
+
+// Frames as binary WebSocket messages. Gets through proxies and firewalls
+// that only let HTTPS out.
+type wsTransport struct {
+  ws      *websocket.Conn
+  name    string
+  wmut    sync.Mutex
+}
+
+func dialWS(u *url.URL) (Transport, error) {
+  origin := "http://" + u.Host
+  if u.Scheme == "wss" {
+    origin = "https://" + u.Host
+  }
+
+  cfg, err := websocket.NewConfig(u.String(), origin)
+  if err != nil {
+    return nil, err
+  }
+  cfg.Dialer = &net.Dialer{Timeout: DIAL_TIMEOUT}
+  if u.Scheme == "wss" {
+    cfg.TlsConfig = &tls.Config{ServerName: u.Hostname()}
+  }
+
+  ws, err := websocket.DialConfig(cfg)
+  if err != nil {
+    return nil, err
+  }
+  ws.PayloadType = websocket.BinaryFrame
+  return &wsTransport{ws: ws, name: u.String()}, nil
+}
+
+func (t *wsTransport) Read(buf []byte) (int, error) {
+  var msg []byte
+  if err := websocket.Message.Receive(t.ws, &msg); err != nil {
+    return 0, err
+  }
+  if len(msg) > len(buf) {
+    return 0, fmt.Errorf("Frame of %d bytes from %s is too large.", len(msg), t.name)
+  }
+  return copy(buf, msg), nil
+}
+
+func (t *wsTransport) Write(frame []byte) error {
+  t.wmut.Lock()
+  defer t.wmut.Unlock()
+  return websocket.Message.Send(t.ws, frame)
+}
+
+func (t *wsTransport) Close() error {
+  return t.ws.Close()
+}
+
+func (t *wsTransport) Stream() bool {
+  return true
+}
+
+func (t *wsTransport) String() string {
+  return t.name
+}
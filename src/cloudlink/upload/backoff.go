@@ -0,0 +1,24 @@
+package upload
+
+import (
+  "math/rand"
+  "time"
+)
+
+// Delay before retry number attempt: doubles from base up to max, then a random
+// amount is taken off so a fleet coming back online doesn't retry in lockstep.
+func Backoff(attempt int, base, max time.Duration) time.Duration {
+  d := base
+  for i := 1; i < attempt && d < max; i++ {
+    d *= 2
+  }
+  if d > max {
+    d = max
+  }
+
+  half := int64(d / 2)
+  if half <= 0 {
+    return d
+  }
+  return time.Duration(half + rand.Int63n(half + 1))
+}
@@ -0,0 +1,188 @@
+package upload
+
+import (
+  "bytes"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net/http"
+)
+
+const (
+  DEFAULT_CHUNK_SIZE = 256 * 1024
+
+  UPLOAD_PATH = "/rt/mission/upload"
+)
+
+var errNoUpload = errors.New("Server has no " + UPLOAD_PATH + ".")
+
+// Talks the chunked upload protocol:
+//
+//   POST UPLOAD_PATH {name, size, encoding}  opens a session, returns its id
+//   GET  UPLOAD_PATH/<id>                    returns how much the server has
+//   PUT  UPLOAD_PATH/<id>                    a chunk, with a Content-Range
+//
+// Every response carries the server's offset, which is trusted over ours. The
+// PUT that completes the file returns the new mission id.
+type Client struct {
+  Base      string
+  ChunkSize int64
+  Limiter   *Limiter
+  HTTP      *http.Client
+}
+
+type response struct {
+  Status    string  `json:"status"`
+  Id        string  `json:"id"`
+  Mission   string  `json:"mission"`
+  Offset    int64   `json:"offset"`
+  Error     string  `json:"error"`
+}
+
+func NewClient(base string, chunkSize int64, limiter *Limiter) *Client {
+  if chunkSize <= 0 {
+    chunkSize = DEFAULT_CHUNK_SIZE
+  }
+
+  return &Client{
+    base,
+    chunkSize,
+    limiter,
+    &http.Client{},
+  }
+}
+
+func (c *Client) do(req *http.Request, cancel <-chan struct{}) (*response, error) {
+  res, err := send(c.HTTP, req, cancel)
+  if err != nil {
+    return nil, err
+  }
+  return decode(req, res)
+}
+
+func decode(req *http.Request, res *http.Response) (*response, error) {
+  defer res.Body.Close()
+
+  body, err := ioutil.ReadAll(res.Body)
+  if err != nil {
+    return nil, err
+  }
+
+  var r response
+  if err := json.Unmarshal(body, &r); err != nil {
+    return nil, fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, res.Status)
+  } else if r.Status != "OK" {
+    return &r, fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, r.Error)
+  }
+  return &r, nil
+}
+
+func (c *Client) open(name string, size int64, encoding string, cancel <-chan struct{}) (string, error) {
+  data, _ := json.Marshal(map[string]interface{}{
+    "name": name,
+    "size": size,
+    "encoding": encoding,
+  })
+
+  req, err := http.NewRequest("POST", c.Base + UPLOAD_PATH, bytes.NewReader(data))
+  if err != nil {
+    return "", err
+  }
+  req.Header.Set("Content-Type", "application/json")
+
+  res, err := send(c.HTTP, req, cancel)
+  if err != nil {
+    return "", err
+  } else if res.StatusCode == http.StatusNotFound {
+    res.Body.Close()
+    return "", errNoUpload
+  }
+
+  r, err := decode(req, res)
+  if err != nil {
+    return "", err
+  } else if r.Id == "" {
+    return "", fmt.Errorf("Upload session has no id.")
+  }
+  return r.Id, nil
+}
+
+// How far the server got with a session. Fails if it no longer knows it.
+func (c *Client) offset(session string, cancel <-chan struct{}) (int64, error) {
+  req, err := http.NewRequest("GET", c.Base + UPLOAD_PATH + "/" + session, nil)
+  if err != nil {
+    return 0, err
+  }
+
+  r, err := c.do(req, cancel)
+  if err != nil {
+    return 0, err
+  }
+  return r.Offset, nil
+}
+
+func (c *Client) put(session string, f io.ReaderAt, off, n, size int64, cancel <-chan struct{}) (*response, error) {
+  body := c.Limiter.Reader(io.NewSectionReader(f, off, n))
+  req, err := http.NewRequest("PUT", c.Base + UPLOAD_PATH + "/" + session, body)
+  if err != nil {
+    return nil, err
+  }
+  req.ContentLength = n
+  req.Header.Set("Content-Type", "application/octet-stream")
+  req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", off, off + n - 1, size))
+
+  return c.do(req, cancel)
+}
+
+// Sends the rest of a file, picking up the item's session if the server still
+// has it. progress is called with the session and offset after every step that
+// moved them, so the caller can persist them. Returns the mission id.
+func (c *Client) Upload(it Item, f io.ReaderAt, encoding string, progress func(session string, offset int64), cancel <-chan struct{}) (string, error) {
+  session, off := it.Session, int64(0)
+
+  if session != "" {
+    if o, err := c.offset(session, cancel); err == nil {
+      off = o
+    } else if err == ErrCancelled {
+      return "", err
+    } else {
+      // Expired or unknown, start over.
+      session = ""
+    }
+  }
+
+  if session == "" {
+    var err error
+    if session, err = c.open(it.Name, it.Size, encoding, cancel); err != nil {
+      return "", err
+    }
+  }
+  progress(session, off)
+
+  for {
+    n := it.Size - off
+    if n > c.ChunkSize {
+      n = c.ChunkSize
+    }
+
+    r, err := c.put(session, f, off, n, it.Size, cancel)
+    if err != nil {
+      return "", err
+    }
+
+    if r.Offset < off || r.Offset > it.Size {
+      return "", fmt.Errorf("Server reported offset %d for a %d byte file.", r.Offset, it.Size)
+    }
+    off = r.Offset
+    progress(session, off)
+
+    if off == it.Size {
+      if r.Mission == "" {
+        return "", fmt.Errorf("Upload finished without a mission id.")
+      }
+      return r.Mission, nil
+    }
+  }
+}
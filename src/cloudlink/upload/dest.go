@@ -0,0 +1,87 @@
+package upload
+
+import (
+  "errors"
+  "fmt"
+  "io"
+  "net/url"
+  "os"
+  "strings"
+)
+
+const DEST_DSC = "dsc"
+
+// Somewhere flight logs are synced to. Upload sends the rest of a file,
+// resuming from the item's session where the destination supports it, and
+// reports each step through progress so the queue can persist it. It returns
+// a reference to the stored log (mission id, object URL, path). Closing cancel
+// stops it between requests, or mid-request, with ErrCancelled.
+type Destination interface {
+  Upload(it Item, f io.ReaderAt, encoding string, progress func(session string, offset int64), cancel <-chan struct{}) (string, error)
+  String() string
+}
+
+var ErrCancelled = errors.New("Upload cancelled.")
+
+// Whether cancel has been closed. A nil channel never is.
+func Cancelled(cancel <-chan struct{}) bool {
+  select {
+  case <-cancel:
+    return true
+  default:
+    return false
+  }
+}
+
+type Options struct {
+  DSCBase   string
+  ChunkSize int64
+  Limiter   *Limiter
+
+  // S3 credentials. Fall back to AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+  AccessKey string
+  SecretKey string
+
+  // User and drone ids, for associating uploads with a DSC account.
+  Ids       func() (user, drone string)
+}
+
+// Picks a destination from a URL:
+//
+//   dsc                                   Dronesmith Cloud (default)
+//   s3://bucket/prefix?endpoint=&region=  S3 or anything that speaks it
+//   http(s)://[user:pass@]host/path/      plain HTTP PUT or WebDAV
+//   file:///mnt/usb/flights               a local directory or mount
+func NewDestination(raw string, opts Options) (Destination, error) {
+  if raw == "" || raw == DEST_DSC {
+    return NewDSC(opts.DSCBase, opts.ChunkSize, opts.Limiter, opts.Ids), nil
+  }
+
+  u, err := url.Parse(raw)
+  if err != nil {
+    return nil, err
+  }
+
+  switch u.Scheme {
+  case "s3":
+    key, secret := opts.AccessKey, opts.SecretKey
+    if key == "" {
+      key, secret = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+    }
+    if key == "" || secret == "" {
+      return nil, fmt.Errorf("S3 destination needs an access key and secret.")
+    }
+    return NewS3(u, key, secret, opts.ChunkSize, opts.Limiter)
+
+  case "http", "https":
+    return NewHTTPPut(u, opts.Limiter), nil
+
+  case "file":
+    if u.Path == "" {
+      return nil, fmt.Errorf("File destination needs a path.")
+    }
+    return NewDir(u.Path), nil
+  }
+
+  return nil, fmt.Errorf("Unknown sync destination %s", strings.SplitN(raw, ":", 2)[0])
+}
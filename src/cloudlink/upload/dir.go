@@ -0,0 +1,82 @@
+package upload
+
+import (
+  "io"
+  "os"
+  "path/filepath"
+)
+
+// A local directory, usually a USB stick or an SD card. Files are copied to a
+// hidden partial file first, which doubles as the resume point, and renamed
+// into place once complete.
+type Dir struct {
+  path      string
+}
+
+func NewDir(path string) *Dir {
+  return &Dir{path}
+}
+
+func (d *Dir) String() string {
+  return "file://" + d.path
+}
+
+func (d *Dir) Upload(it Item, f io.ReaderAt, encoding string, progress func(string, int64), cancel <-chan struct{}) (string, error) {
+  if err := os.MkdirAll(d.path, 0755); err != nil {
+    return "", err
+  }
+
+  dst := filepath.Join(d.path, it.Name)
+  part := filepath.Join(d.path, "." + it.Name + ".part")
+
+  out, err := os.OpenFile(part, os.O_WRONLY | os.O_CREATE, 0644)
+  if err != nil {
+    return "", err
+  }
+  defer out.Close()
+
+  info, err := out.Stat()
+  if err != nil {
+    return "", err
+  }
+
+  off := info.Size()
+  if off > it.Size {
+    off = 0
+  }
+  if err := out.Truncate(off); err != nil {
+    return "", err
+  }
+  if _, err := out.Seek(off, io.SeekStart); err != nil {
+    return "", err
+  }
+  progress(part, off)
+
+  in := &cancelReader{io.NewSectionReader(f, off, it.Size - off), cancel}
+  if _, err := io.Copy(out, in); err != nil {
+    return "", err
+  }
+  if err := out.Sync(); err != nil {
+    return "", err
+  }
+  progress(part, it.Size)
+
+  if err := out.Close(); err != nil {
+    return "", err
+  }
+  return dst, os.Rename(part, dst)
+}
+
+// Cuts a copy short once cancel is closed. What was written stays as the
+// resume point.
+type cancelReader struct {
+  r         io.Reader
+  cancel    <-chan struct{}
+}
+
+func (cr *cancelReader) Read(p []byte) (int, error) {
+  if Cancelled(cr.cancel) {
+    return 0, ErrCancelled
+  }
+  return cr.r.Read(p)
+}
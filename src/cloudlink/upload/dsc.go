@@ -0,0 +1,118 @@
+package upload
+
+import (
+  "bytes"
+  "compress/gzip"
+  "encoding/json"
+  "fmt"
+  "io"
+  "net/http"
+  "strings"
+  "sync"
+
+  "flightlog"
+)
+
+const (
+  // The cloud's long standing endpoint, the whole log in one POST.
+  BINARY_PATH = "/rt/mission/mavlinkBinary"
+)
+
+// Dronesmith Cloud: the log is sent with the chunked upload protocol, then the
+// new mission is associated with the user and drone. A server without the
+// chunked upload gets the whole log POSTed to mavlinkBinary instead, from then
+// on.
+type DSC struct {
+  *Client
+  ids       func() (user, drone string)
+
+  binary    bool
+  mut       sync.Mutex
+}
+
+func NewDSC(base string, chunkSize int64, limiter *Limiter, ids func() (string, string)) *DSC {
+  return &DSC{Client: NewClient(base, chunkSize, limiter), ids: ids}
+}
+
+func (d *DSC) String() string {
+  return "dsc " + d.Base
+}
+
+func (d *DSC) Upload(it Item, f io.ReaderAt, encoding string, progress func(string, int64), cancel <-chan struct{}) (string, error) {
+  user, drone := d.ids()
+  if drone == "" {
+    return "", fmt.Errorf("Cannot sync. User Id or Drone Id nil")
+  }
+
+  mission, err := d.send(it, f, encoding, progress, cancel)
+  if err != nil {
+    return "", err
+  }
+
+  data, _ := json.Marshal(map[string]string{"user": user, "drone": drone})
+  req, err := http.NewRequest("PUT", d.Base + "/rt/mission/" + mission + "/associate", bytes.NewReader(data))
+  if err != nil {
+    return "", err
+  }
+  req.Header.Set("Content-Type", "application/json")
+
+  if _, err := d.do(req, cancel); err == ErrCancelled {
+    return "", err
+  } else if err != nil {
+    return "", fmt.Errorf("Association failed: %v", err)
+  }
+  return mission, nil
+}
+
+func (d *DSC) send(it Item, f io.ReaderAt, encoding string, progress func(string, int64), cancel <-chan struct{}) (string, error) {
+  d.mut.Lock()
+  binary := d.binary
+  d.mut.Unlock()
+
+  if !binary {
+    mission, err := d.Client.Upload(it, f, encoding, progress, cancel)
+    if err != errNoUpload {
+      return mission, err
+    }
+
+    d.mut.Lock()
+    d.binary = true
+    d.mut.Unlock()
+  }
+  return d.post(it, f, encoding, progress, cancel)
+}
+
+// mavlinkBinary takes the legacy layout, uncompressed, so logs are inflated and
+// rewritten on the way.
+func (d *DSC) post(it Item, f io.ReaderAt, encoding string, progress func(string, int64), cancel <-chan struct{}) (string, error) {
+  var body io.Reader = io.NewSectionReader(f, 0, it.Size)
+  length := it.Size
+
+  if encoding == "gzip" {
+    gz, err := gzip.NewReader(body)
+    if err != nil {
+      return "", err
+    }
+    defer gz.Close()
+    body, length = gz, -1
+  }
+  if strings.HasSuffix(strings.TrimSuffix(it.Name, flightlog.GZIP_EXT), flightlog.TLOG_EXT) {
+    body, length = flightlog.NewLegacyStream(body), -1
+  }
+
+  req, err := http.NewRequest("POST", d.Base + BINARY_PATH, d.Limiter.Reader(body))
+  if err != nil {
+    return "", err
+  }
+  req.ContentLength = length
+  req.Header.Set("Content-Type", "application/octet-stream")
+
+  r, err := d.do(req, cancel)
+  if err != nil {
+    return "", err
+  } else if r.Id == "" {
+    return "", fmt.Errorf("Upload finished without a mission id.")
+  }
+  progress("", it.Size)
+  return r.Id, nil
+}
@@ -0,0 +1,62 @@
+package upload
+
+import (
+  "fmt"
+  "io"
+  "net/http"
+  "net/url"
+  "strings"
+)
+
+// A plain HTTP PUT of the whole file, which covers WebDAV shares and most
+// upload endpoints. There's no standard way to resume a PUT, so a failed
+// upload starts over.
+type HTTPPut struct {
+  base      *url.URL
+  limiter   *Limiter
+  client    *http.Client
+}
+
+func NewHTTPPut(u *url.URL, limiter *Limiter) *HTTPPut {
+  base := *u
+  if !strings.HasSuffix(base.Path, "/") {
+    base.Path += "/"
+  }
+  return &HTTPPut{&base, limiter, &http.Client{}}
+}
+
+func (h *HTTPPut) String() string {
+  u := *h.base
+  u.User = nil
+  return u.String()
+}
+
+func (h *HTTPPut) Upload(it Item, f io.ReaderAt, encoding string, progress func(string, int64), cancel <-chan struct{}) (string, error) {
+  target := *h.base
+  target.User = nil
+  target.Path += it.Name
+
+  body := h.limiter.Reader(io.NewSectionReader(f, 0, it.Size))
+  req, err := http.NewRequest("PUT", target.String(), body)
+  if err != nil {
+    return "", err
+  }
+  req.ContentLength = it.Size
+  req.Header.Set("Content-Type", "application/octet-stream")
+  if pass, ok := h.base.User.Password(); ok {
+    req.SetBasicAuth(h.base.User.Username(), pass)
+  }
+  progress("", 0)
+
+  res, err := send(h.client, req, cancel)
+  if err != nil {
+    return "", err
+  }
+  res.Body.Close()
+
+  if res.StatusCode / 100 != 2 {
+    return "", fmt.Errorf("PUT %s: %s", target.Path, res.Status)
+  }
+  progress("", it.Size)
+  return target.String(), nil
+}
@@ -0,0 +1,83 @@
+package upload
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "io"
+  "net/http"
+  "time"
+)
+
+// A request is given up on once this long passes with none of its body going
+// out and nothing coming back. There's no limit on the request as a whole,
+// which under the bandwidth cap takes as long as it takes.
+const IDLE_TIMEOUT = 2 * time.Minute
+
+// Shortened by tests.
+var idleTimeout = IDLE_TIMEOUT
+
+var errIdle = errors.New("idle")
+
+// Sends req through client, cutting it off after IDLE_TIMEOUT without
+// progress, or once cancel is closed. As with client.Do, the response body has
+// to be closed.
+func send(client *http.Client, req *http.Request, cancel <-chan struct{}) (*http.Response, error) {
+  if Cancelled(cancel) {
+    return nil, ErrCancelled
+  }
+
+  ctx, stop := context.WithCancelCause(req.Context())
+  timer := time.AfterFunc(idleTimeout, func() { stop(errIdle) })
+  go func() {
+    select {
+    case <-cancel:
+      stop(ErrCancelled)
+    case <-ctx.Done():
+    }
+  }()
+
+  if req.Body != nil {
+    req.Body = &idleBody{req.Body, timer, nil}
+  }
+
+  res, err := client.Do(req.WithContext(ctx))
+  if err != nil {
+    timer.Stop()
+    stop(nil)
+    switch context.Cause(ctx) {
+    case errIdle:
+      return nil, fmt.Errorf("%s %s: no progress in %v.", req.Method, req.URL.Path, idleTimeout)
+    case ErrCancelled:
+      return nil, ErrCancelled
+    }
+    return nil, err
+  }
+
+  timer.Reset(idleTimeout)
+  res.Body = &idleBody{res.Body, timer, func() { stop(nil) }}
+  return res, nil
+}
+
+// Pushes the idle deadline back on every read.
+type idleBody struct {
+  io.ReadCloser
+  timer     *time.Timer
+  done      func()
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+  n, err := b.ReadCloser.Read(p)
+  b.timer.Reset(idleTimeout)
+  return n, err
+}
+
+func (b *idleBody) Close() error {
+  // The transport closes the request body once it's sent, which isn't the end
+  // of the request.
+  if b.done != nil {
+    b.timer.Stop()
+    b.done()
+  }
+  return b.ReadCloser.Close()
+}
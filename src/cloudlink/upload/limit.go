@@ -0,0 +1,78 @@
+package upload
+
+import (
+  "io"
+  "sync"
+  "time"
+)
+
+// Largest read passed through a limiter at once, so the cap is smooth rather
+// than a chunk at full speed followed by a long pause.
+const LIMIT_BURST = 16 * 1024
+
+// Caps throughput to a number of bytes per second, shared by everything
+// reading through it. A nil Limiter, or a rate of 0, doesn't limit anything.
+type Limiter struct {
+  rate      int
+  mut       sync.Mutex
+  next      time.Time
+}
+
+func NewLimiter(bytesPerSec int) *Limiter {
+  return &Limiter{rate: bytesPerSec}
+}
+
+// Changes the cap for everything reading through l.
+func (l *Limiter) SetRate(bytesPerSec int) {
+  l.mut.Lock()
+  l.rate = bytesPerSec
+  l.mut.Unlock()
+}
+
+// Blocks until n more bytes fit under the cap.
+func (l *Limiter) Wait(n int) {
+  if l == nil {
+    return
+  }
+
+  l.mut.Lock()
+  if l.rate <= 0 {
+    l.mut.Unlock()
+    return
+  }
+  now := time.Now()
+  if l.next.Before(now) {
+    l.next = now
+  }
+  wait := l.next.Sub(now)
+  l.next = l.next.Add(time.Duration(n) * time.Second / time.Duration(l.rate))
+  l.mut.Unlock()
+
+  if wait > 0 {
+    time.Sleep(wait)
+  }
+}
+
+// The rate is checked on every read, so a change applies to a transfer already
+// under way.
+func (l *Limiter) Reader(r io.Reader) io.Reader {
+  if l == nil {
+    return r
+  }
+  return &limitedReader{r, l}
+}
+
+type limitedReader struct {
+  r         io.Reader
+  l         *Limiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+  if len(p) > LIMIT_BURST {
+    p = p[:LIMIT_BURST]
+  }
+
+  n, err := lr.r.Read(p)
+  lr.l.Wait(n)
+  return n, err
+}
@@ -0,0 +1,168 @@
+// Package upload moves flight logs to the cloud in resumable chunks. The queue
+// of pending uploads is kept on disk with each file's session and offset, so an
+// upload cut off by a dropped link or a reboot carries on where it stopped.
+package upload
+
+import (
+  "encoding/json"
+  "io/ioutil"
+  "os"
+  "sync"
+  "time"
+)
+
+const (
+  QUEUE_FILE = ".uploads.json"
+
+  STATE_QUEUED = "queued"
+  STATE_UPLOADING = "uploading"
+  STATE_RETRY = "retry"
+)
+
+type Item struct {
+  Name      string    `json:"name"`
+  Size      int64     `json:"size"`
+  ModTime   time.Time `json:"modTime"`
+  Dest      string    `json:"destination"`
+  Session   string    `json:"session"`
+  Offset    int64     `json:"offset"`
+  State     string    `json:"state"`
+  Attempts  int       `json:"attempts"`
+  NextTry   time.Time `json:"nextTry"`
+  LastError string    `json:"lastError"`
+}
+
+type Queue struct {
+  path      string
+  mut       sync.Mutex
+  items     []*Item
+}
+
+func NewQueue(fpath string) *Queue {
+  q := &Queue{path: fpath}
+
+  if data, err := ioutil.ReadFile(fpath); err == nil {
+    json.Unmarshal(data, &q.items)
+  }
+
+  // Nothing is uploading right after a restart.
+  for _, it := range q.items {
+    if it.State == STATE_UPLOADING {
+      it.State = STATE_QUEUED
+    }
+  }
+
+  return q
+}
+
+// Must be called with the lock held.
+func (q *Queue) find(name string) *Item {
+  for _, it := range q.items {
+    if it.Name == name {
+      return it
+    }
+  }
+  return nil
+}
+
+// Queues a file. A file already queued is left alone unless it changed on
+// disk, in which case its upload starts over.
+func (q *Queue) Add(name string, size int64, mod time.Time) error {
+  q.mut.Lock()
+  defer q.mut.Unlock()
+
+  if it := q.find(name); it != nil {
+    if it.Size == size && it.ModTime.Equal(mod) {
+      return nil
+    }
+    *it = Item{Name: name, Size: size, ModTime: mod, State: STATE_QUEUED}
+  } else {
+    q.items = append(q.items, &Item{Name: name, Size: size, ModTime: mod, State: STATE_QUEUED})
+  }
+
+  return q.save()
+}
+
+func (q *Queue) Remove(name string) error {
+  q.mut.Lock()
+  defer q.mut.Unlock()
+
+  for i, it := range q.items {
+    if it.Name == name {
+      q.items = append(q.items[:i], q.items[i + 1:]...)
+      return q.save()
+    }
+  }
+  return nil
+}
+
+// Drops every item keep turns down, for files that were deleted or synced
+// some other way.
+func (q *Queue) Prune(keep func(name string) bool) error {
+  q.mut.Lock()
+  defer q.mut.Unlock()
+
+  items := q.items[:0]
+  for _, it := range q.items {
+    if keep(it.Name) {
+      items = append(items, it)
+    }
+  }
+
+  if len(items) == len(q.items) {
+    return nil
+  }
+  q.items = items
+  return q.save()
+}
+
+// Applies fn to the named item and saves the queue.
+func (q *Queue) Update(name string, fn func(*Item)) error {
+  q.mut.Lock()
+  defer q.mut.Unlock()
+
+  if it := q.find(name); it != nil {
+    fn(it)
+    return q.save()
+  }
+  return nil
+}
+
+// Items ready for another try, in the order they were queued.
+func (q *Queue) Due(now time.Time) []Item {
+  q.mut.Lock()
+  defer q.mut.Unlock()
+
+  var due []Item
+  for _, it := range q.items {
+    if !now.Before(it.NextTry) {
+      due = append(due, *it)
+    }
+  }
+  return due
+}
+
+func (q *Queue) Items() []Item {
+  q.mut.Lock()
+  defer q.mut.Unlock()
+
+  items := make([]Item, len(q.items))
+  for i, it := range q.items {
+    items[i] = *it
+  }
+  return items
+}
+
+// Must be called with the lock held.
+func (q *Queue) save() error {
+  data, err := json.Marshal(q.items)
+  if err != nil {
+    return err
+  }
+
+  tmp := q.path + ".tmp"
+  if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+    return err
+  }
+  return os.Rename(tmp, q.path)
+}
@@ -0,0 +1,231 @@
+package upload
+
+import (
+  "bytes"
+  "encoding/xml"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// S3 won't take a multipart piece smaller than this, except the last.
+const S3_MIN_PART = 5 * 1024 * 1024
+
+// S3 and the object stores that copy its API (MinIO, Ceph, Wasabi...), by
+// multipart upload. The upload id is the session, and resuming asks the store
+// which parts it already has. Objects are addressed path-style, which every
+// stand-in supports.
+type S3 struct {
+  endpoint  string
+  bucket    string
+  prefix    string
+  partSize  int64
+  limiter   *Limiter
+  signer    signer
+  client    *http.Client
+}
+
+type s3Part struct {
+  PartNumber  int     `xml:"PartNumber"`
+  ETag        string  `xml:"ETag"`
+  Size        int64   `xml:"Size,omitempty"`
+}
+
+type s3Error struct {
+  Code        string  `xml:"Code"`
+  Message     string  `xml:"Message"`
+}
+
+// s3://bucket/prefix?endpoint=host:port&region=us-east-1&secure=false
+func NewS3(u *url.URL, key, secret string, partSize int64, limiter *Limiter) (*S3, error) {
+  if u.Host == "" {
+    return nil, fmt.Errorf("S3 destination needs a bucket.")
+  }
+
+  q := u.Query()
+  region := q.Get("region")
+  if region == "" {
+    region = "us-east-1"
+  }
+
+  host := q.Get("endpoint")
+  if host == "" {
+    host = "s3." + region + ".amazonaws.com"
+  }
+  scheme := "https"
+  if q.Get("secure") == "false" {
+    scheme = "http"
+  }
+
+  if partSize < S3_MIN_PART {
+    partSize = S3_MIN_PART
+  }
+
+  return &S3{
+    scheme + "://" + host,
+    u.Host,
+    strings.Trim(u.Path, "/"),
+    partSize,
+    limiter,
+    signer{key, secret, region, "s3"},
+    &http.Client{},
+  }, nil
+}
+
+func (s *S3) String() string {
+  return "s3://" + s.bucket + "/" + s.prefix
+}
+
+func (s *S3) objectURL(name string) string {
+  key := name
+  if s.prefix != "" {
+    key = s.prefix + "/" + name
+  }
+  return s.endpoint + "/" + s.bucket + "/" + uriEncode(key, false)
+}
+
+// Signs and sends a request. A nil body with payload == "" is an empty one.
+func (s *S3) do(method, target string, query url.Values, body io.Reader, length int64, payload string, cancel <-chan struct{}) ([]byte, http.Header, error) {
+  u, err := url.Parse(target)
+  if err != nil {
+    return nil, nil, err
+  }
+  u.RawQuery = strings.Replace(query.Encode(), "uploads=", "uploads", 1)
+
+  req, err := http.NewRequest(method, u.String(), body)
+  if err != nil {
+    return nil, nil, err
+  }
+  req.ContentLength = length
+
+  if payload == "" {
+    payload = sha256Hex(nil)
+  }
+  req.Header.Set("X-Amz-Content-Sha256", payload)
+  s.signer.sign(req, payload, time.Now())
+
+  res, err := send(s.client, req, cancel)
+  if err != nil {
+    return nil, nil, err
+  }
+  defer res.Body.Close()
+
+  data, err := ioutil.ReadAll(res.Body)
+  if err != nil {
+    return nil, nil, err
+  }
+
+  // CompleteMultipartUpload can fail with a 200 and an error in the body.
+  if res.StatusCode / 100 != 2 || bytes.Contains(data, []byte("<Error>")) {
+    var e s3Error
+    xml.Unmarshal(data, &e)
+    if e.Code == "" {
+      e.Code = res.Status
+    }
+    return nil, nil, fmt.Errorf("S3 %s: %s %s", method, e.Code, e.Message)
+  }
+  return data, res.Header, nil
+}
+
+func (s *S3) create(target string, cancel <-chan struct{}) (string, error) {
+  data, _, err := s.do("POST", target, url.Values{"uploads": {""}}, nil, 0, "", cancel)
+  if err != nil {
+    return "", err
+  }
+
+  var r struct {
+    UploadId  string  `xml:"UploadId"`
+  }
+  if err := xml.Unmarshal(data, &r); err != nil || r.UploadId == "" {
+    return "", fmt.Errorf("S3 multipart upload has no id.")
+  }
+  return r.UploadId, nil
+}
+
+func (s *S3) listParts(target, uploadId string, cancel <-chan struct{}) ([]s3Part, error) {
+  data, _, err := s.do("GET", target, url.Values{"uploadId": {uploadId}}, nil, 0, "", cancel)
+  if err != nil {
+    return nil, err
+  }
+
+  var r struct {
+    Parts   []s3Part  `xml:"Part"`
+  }
+  if err := xml.Unmarshal(data, &r); err != nil {
+    return nil, err
+  }
+  return r.Parts, nil
+}
+
+func (s *S3) Upload(it Item, f io.ReaderAt, encoding string, progress func(string, int64), cancel <-chan struct{}) (string, error) {
+  target := s.objectURL(it.Name)
+  uploadId := it.Session
+
+  // Only trust parts numbered 1..n with no gaps.
+  var parts []s3Part
+  var off int64
+  if uploadId != "" {
+    have, err := s.listParts(target, uploadId, cancel)
+    if err == ErrCancelled {
+      return "", err
+    } else if err != nil {
+      uploadId = ""
+    }
+    for i, p := range have {
+      if p.PartNumber != i + 1 {
+        break
+      }
+      parts = append(parts, p)
+      off += p.Size
+    }
+  }
+
+  if uploadId == "" {
+    var err error
+    if uploadId, err = s.create(target, cancel); err != nil {
+      return "", err
+    }
+    parts, off = nil, 0
+  }
+  progress(uploadId, off)
+
+  for off < it.Size {
+    n := it.Size - off
+    if n > s.partSize {
+      n = s.partSize
+    }
+
+    num := len(parts) + 1
+    query := url.Values{"partNumber": {strconv.Itoa(num)}, "uploadId": {uploadId}}
+    body := s.limiter.Reader(io.NewSectionReader(f, off, n))
+
+    _, hdr, err := s.do("PUT", target, query, body, n, UNSIGNED_PAYLOAD, cancel)
+    if err != nil {
+      return "", err
+    }
+
+    parts = append(parts, s3Part{PartNumber: num, ETag: hdr.Get("ETag")})
+    off += n
+    progress(uploadId, off)
+  }
+
+  var complete struct {
+    XMLName xml.Name  `xml:"CompleteMultipartUpload"`
+    Parts   []s3Part  `xml:"Part"`
+  }
+  for _, p := range parts {
+    complete.Parts = append(complete.Parts, s3Part{PartNumber: p.PartNumber, ETag: p.ETag})
+  }
+  data, _ := xml.Marshal(complete)
+
+  _, _, err := s.do("POST", target, url.Values{"uploadId": {uploadId}}, bytes.NewReader(data), int64(len(data)), sha256Hex(data), cancel)
+  if err != nil {
+    return "", err
+  }
+  return target, nil
+}
@@ -0,0 +1,132 @@
+package upload
+
+import (
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/hex"
+  "fmt"
+  "net/http"
+  "sort"
+  "strings"
+  "time"
+)
+
+const (
+  SIGV4_ALGORITHM = "AWS4-HMAC-SHA256"
+  SIGV4_DATE = "20060102T150405Z"
+
+  // Streamed bodies aren't hashed, S3 accepts this over any transport.
+  UNSIGNED_PAYLOAD = "UNSIGNED-PAYLOAD"
+)
+
+// AWS Signature Version 4, header flavour. Signs the host and any x-amz-*
+// headers already on the request.
+type signer struct {
+  key       string
+  secret    string
+  region    string
+  service   string
+}
+
+func sha256Hex(data []byte) string {
+  sum := sha256.Sum256(data)
+  return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+  h := hmac.New(sha256.New, key)
+  h.Write([]byte(data))
+  return h.Sum(nil)
+}
+
+// RFC 3986 encoding, as SigV4 wants it.
+func uriEncode(s string, encodeSlash bool) string {
+  var b strings.Builder
+  for i := 0; i < len(s); i++ {
+    c := s[i]
+    switch {
+    case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+      c == '-', c == '_', c == '.', c == '~':
+      b.WriteByte(c)
+    case c == '/' && !encodeSlash:
+      b.WriteByte(c)
+    default:
+      fmt.Fprintf(&b, "%%%02X", c)
+    }
+  }
+  return b.String()
+}
+
+func (s signer) sign(req *http.Request, payloadHash string, now time.Time) {
+  amzDate := now.UTC().Format(SIGV4_DATE)
+  date := amzDate[:8]
+  req.Header.Set("X-Amz-Date", amzDate)
+
+  host := req.Host
+  if host == "" {
+    host = req.URL.Host
+  }
+
+  // headers
+  headers := map[string]string{"host": host}
+  for k, v := range req.Header {
+    lk := strings.ToLower(k)
+    if strings.HasPrefix(lk, "x-amz-") {
+      headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+    }
+  }
+  names := make([]string, 0, len(headers))
+  for k := range headers {
+    names = append(names, k)
+  }
+  sort.Strings(names)
+
+  var canonHeaders strings.Builder
+  for _, k := range names {
+    canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+  }
+  signed := strings.Join(names, ";")
+
+  // query
+  query := req.URL.Query()
+  keys := make([]string, 0, len(query))
+  for k := range query {
+    keys = append(keys, k)
+  }
+  sort.Strings(keys)
+
+  var params []string
+  for _, k := range keys {
+    vals := query[k]
+    sort.Strings(vals)
+    for _, v := range vals {
+      params = append(params, uriEncode(k, true) + "=" + uriEncode(v, true))
+    }
+  }
+
+  path := req.URL.Path
+  if path == "" {
+    path = "/"
+  }
+
+  canonical := strings.Join([]string{
+    req.Method,
+    uriEncode(path, false),
+    strings.Join(params, "&"),
+    canonHeaders.String(),
+    signed,
+    payloadHash,
+  }, "\n")
+
+  scope := date + "/" + s.region + "/" + s.service + "/aws4_request"
+  toSign := SIGV4_ALGORITHM + "\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+  k := hmacSHA256([]byte("AWS4" + s.secret), date)
+  k = hmacSHA256(k, s.region)
+  k = hmacSHA256(k, s.service)
+  k = hmacSHA256(k, "aws4_request")
+  sig := hex.EncodeToString(hmacSHA256(k, toSign))
+
+  req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+    SIGV4_ALGORITHM, s.key, scope, signed, sig))
+}
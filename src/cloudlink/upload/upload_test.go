@@ -0,0 +1,223 @@
+package upload
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+)
+
+// Accepts chunked uploads, and drops the connection on every failEvery'th PUT.
+type fakeServer struct {
+  mut       sync.Mutex
+  sessions  map[string]*bytes.Buffer
+  puts      int
+  failEvery int
+}
+
+func (s *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  s.mut.Lock()
+  defer s.mut.Unlock()
+
+  reply := func(v map[string]interface{}) {
+    v["status"] = "OK"
+    json.NewEncoder(w).Encode(v)
+  }
+
+  id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, UPLOAD_PATH), "/")
+  switch {
+  case r.Method == "POST" && id == "":
+    id = fmt.Sprintf("s%d", len(s.sessions))
+    s.sessions[id] = new(bytes.Buffer)
+    reply(map[string]interface{}{"id": id})
+
+  case r.Method == "GET" && s.sessions[id] != nil:
+    reply(map[string]interface{}{"offset": s.sessions[id].Len()})
+
+  case r.Method == "PUT" && s.sessions[id] != nil:
+    s.puts++
+    if s.failEvery > 0 && s.puts % s.failEvery == 0 {
+      hj, _ := w.(http.Hijacker)
+      conn, _, _ := hj.Hijack()
+      conn.Close()
+      return
+    }
+
+    var start, end, size int64
+    fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size)
+    buf := s.sessions[id]
+    if start != int64(buf.Len()) {
+      json.NewEncoder(w).Encode(map[string]interface{}{"status": "error", "error": "bad range"})
+      return
+    }
+    data, _ := ioutil.ReadAll(r.Body)
+    buf.Write(data)
+
+    res := map[string]interface{}{"offset": buf.Len()}
+    if int64(buf.Len()) == size {
+      res["mission"] = "m-" + id
+    }
+    reply(res)
+
+  default:
+    json.NewEncoder(w).Encode(map[string]interface{}{"status": "error", "error": "no such session"})
+  }
+}
+
+func TestResumableUpload(t *testing.T) {
+  fs := &fakeServer{sessions: make(map[string]*bytes.Buffer), failEvery: 3}
+  srv := httptest.NewServer(fs)
+  defer srv.Close()
+
+  data := bytes.Repeat([]byte("flight data "), 1000)
+  c := NewClient(srv.URL, 1000, nil)
+  it := Item{Name: "Flight test.tlog", Size: int64(len(data))}
+
+  var mission string
+  for tries := 0; mission == "" && tries < 20; tries++ {
+    var err error
+    mission, err = c.Upload(it, bytes.NewReader(data), "", func(session string, off int64) {
+      it.Session, it.Offset = session, off
+    }, nil)
+    if err == nil {
+      break
+    }
+  }
+
+  if mission != "m-s0" {
+    t.Fatalf("got mission %q, want m-s0 (one session resumed)", mission)
+  }
+  if !bytes.Equal(fs.sessions["s0"].Bytes(), data) {
+    t.Error("uploaded data doesn't match")
+  }
+}
+
+func TestQueuePersists(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "upload")
+  defer os.RemoveAll(dir)
+  fpath := filepath.Join(dir, QUEUE_FILE)
+
+  mod := time.Now().Truncate(time.Second)
+  q := NewQueue(fpath)
+  q.Add("a", 100, mod)
+  q.Add("b", 200, mod)
+  q.Update("a", func(it *Item) {
+    it.Session, it.Offset, it.State = "s1", 50, STATE_UPLOADING
+  })
+  q.Update("b", func(it *Item) { it.NextTry = time.Now().Add(time.Hour) })
+
+  q = NewQueue(fpath)
+  due := q.Due(time.Now())
+  if len(due) != 1 || due[0].Name != "a" || due[0].Offset != 50 || due[0].State != STATE_QUEUED {
+    t.Fatalf("due after reload: %+v", due)
+  }
+
+  // Re-adding an unchanged file keeps its progress, a changed one starts over.
+  q.Add("a", 100, mod)
+  if q.Items()[0].Session != "s1" {
+    t.Error("unchanged file lost its session")
+  }
+  q.Add("a", 150, mod)
+  if it := q.Items()[0]; it.Session != "" || it.Offset != 0 {
+    t.Errorf("changed file kept its progress: %+v", it)
+  }
+
+  q.Prune(func(name string) bool { return name != "b" })
+  if items := q.Items(); len(items) != 1 || items[0].Name != "a" {
+    t.Errorf("after prune: %+v", items)
+  }
+}
+
+func TestBackoff(t *testing.T) {
+  base, max := time.Second, time.Minute
+  for attempt := 1; attempt < 12; attempt++ {
+    want := base << uint(attempt - 1)
+    if want > max {
+      want = max
+    }
+    if d := Backoff(attempt, base, max); d < want / 2 || d > want {
+      t.Errorf("attempt %d: %v outside [%v, %v]", attempt, d, want / 2, want)
+    }
+  }
+}
+
+func TestLimiterSetRate(t *testing.T) {
+  l := NewLimiter(0)
+  r := l.Reader(bytes.NewReader(make([]byte, 4 * LIMIT_BURST)))
+
+  l.SetRate(LIMIT_BURST)
+  go l.SetRate(LIMIT_BURST)
+
+  start := time.Now()
+  if _, err := ioutil.ReadAll(r); err != nil {
+    t.Fatal(err)
+  }
+  // Capped once the new rate lands, though the reader was made uncapped.
+  if d := time.Since(start); d < 2 * time.Second {
+    t.Errorf("Read 4 bursts at 1 burst/s in %v", d)
+  }
+}
+
+func TestIdleTimeout(t *testing.T) {
+  idleTimeout = 200 * time.Millisecond
+  defer func() { idleTimeout = IDLE_TIMEOUT }()
+
+  hang := make(chan bool)
+  srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    ioutil.ReadAll(r.Body)
+    if r.URL.Path == "/hang" {
+      <-hang
+    }
+    w.Write([]byte(`{"status": "OK", "id": "x"}`))
+  }))
+  defer srv.Close()
+  defer close(hang)
+
+  c := NewClient(srv.URL, 0, NewLimiter(8 * LIMIT_BURST))
+
+  // Slower than the timeout as a whole, but never idle for long.
+  req, _ := http.NewRequest("POST", srv.URL + "/slow", c.Limiter.Reader(bytes.NewReader(make([]byte, 10 * LIMIT_BURST))))
+  if _, err := c.do(req, nil); err != nil {
+    t.Fatal(err)
+  }
+
+  req, _ = http.NewRequest("POST", srv.URL + "/hang", nil)
+  if _, err := c.do(req, nil); err == nil || !strings.Contains(err.Error(), "no progress") {
+    t.Fatal("Expected an idle timeout, got", err)
+  }
+}
+
+func TestCancel(t *testing.T) {
+  hang := make(chan bool)
+  srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if r.Method == "PUT" {
+      <-hang
+    }
+    w.Write([]byte(`{"status": "OK", "id": "x"}`))
+  }))
+  defer srv.Close()
+  defer close(hang)
+
+  c := NewClient(srv.URL, 0, nil)
+  cancel := make(chan struct{})
+  time.AfterFunc(100 * time.Millisecond, func() { close(cancel) })
+
+  // Stops mid-chunk, long before the idle timeout.
+  it := Item{Name: "Flight x.tlog", Size: 1000}
+  _, err := c.Upload(it, bytes.NewReader(make([]byte, it.Size)), "", func(string, int64) {}, cancel)
+  if err != ErrCancelled {
+    t.Fatal("Expected the upload to be cancelled, got", err)
+  }
+
+  if _, err := c.Upload(it, bytes.NewReader(make([]byte, it.Size)), "", func(string, int64) {}, cancel); err != ErrCancelled {
+    t.Fatal("Expected a cancelled upload not to start, got", err)
+  }
+}
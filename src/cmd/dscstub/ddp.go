@@ -0,0 +1,297 @@
+package main
+
+import (
+  "log"
+  "math/rand"
+  "net"
+  "time"
+
+  "cloudlink/dronedp"
+  "cloudlink/terminal"
+  "cloudlink/transport"
+)
+
+const (
+  MAX_CODE_EVENTS = 200
+  MAX_TERMINAL_OUTPUT = 64 * 1024
+  RETRANSMIT_PERIOD = 200 * time.Millisecond
+)
+
+// One engine talking to us, known by its address.
+type device struct {
+  Addr      string              `json:"addr"`
+  Session   uint32              `json:"session"`
+  Serial    string              `json:"serial"`
+  Email     string              `json:"email"`
+  SimId     string              `json:"simId"`
+  Sealed    bool                `json:"sealed"`
+  Features  []string            `json:"features"`
+  LastSeen  time.Time           `json:"lastSeen"`
+  Status    int                 `json:"statusMsgs"`
+  Mavlink   int                 `json:"mavlinkMsgs"`
+  Errors    int                 `json:"badFrames"`
+  Terminal  *dronedp.TerminalMsg `json:"terminal,omitempty"`
+  Code      []dronedp.CodeMsg   `json:"code"`
+
+  link      *dronedp.Link
+  write     func([]byte) error
+  devPub    string
+  termRx    *terminal.Reorder
+  termTx    uint32
+  termOut   []byte
+}
+
+func (d *device) send(op dronedp.OP, data interface{}, reliable bool) error {
+  frames, err := d.link.Send(op, d.Session, data, reliable)
+  if err != nil {
+    return err
+  }
+  for _, f := range frames {
+    d.write(f)
+  }
+  return nil
+}
+
+func (s *Stub) device(addr string, write func([]byte) error) *device {
+  s.mut.Lock()
+  defer s.mut.Unlock()
+
+  d := s.devices[addr]
+  if d == nil {
+    codec := dronedp.NewServerCodec(s.key, uint64(time.Now().UnixNano() / 1000))
+    d = &device{Addr: addr, link: dronedp.NewLink(codec, dronedp.DEFAULT_MTU), write: write, termRx: terminal.NewReorder()}
+    s.devices[addr] = d
+    log.Println("New device at", addr)
+  }
+  d.write = write
+  return d
+}
+
+func (s *Stub) ServeUDP(conn net.PacketConn) {
+  buf := make([]byte, 65536)
+  for {
+    n, addr, err := conn.ReadFrom(buf)
+    if err != nil {
+      log.Println(err)
+      return
+    }
+
+    d := s.device("udp " + addr.String(), func(f []byte) error {
+      _, err := conn.WriteTo(f, addr)
+      return err
+    })
+    s.handle(d, append([]byte(nil), buf[:n]...))
+  }
+}
+
+func (s *Stub) ServeTCP(ln net.Listener) {
+  for {
+    conn, err := ln.Accept()
+    if err != nil {
+      log.Println(err)
+      return
+    }
+
+    go func() {
+      name := "tcp " + conn.RemoteAddr().String()
+      t := transport.NewStream(conn, name)
+      defer t.Close()
+
+      d := s.device(name, t.Write)
+      buf := make([]byte, transport.MAX_FRAME)
+      for {
+        n, err := t.Read(buf)
+        if err != nil {
+          log.Println(name, err)
+          return
+        }
+        s.handle(d, append([]byte(nil), buf[:n]...))
+      }
+    }()
+  }
+}
+
+// Resends unacked messages to every device.
+func (s *Stub) retransmit() {
+  for now := range time.Tick(RETRANSMIT_PERIOD) {
+    s.mut.Lock()
+    for _, d := range s.devices {
+      frames, lost := d.link.Retransmit(now)
+      for _, f := range frames {
+        d.write(f)
+      }
+      for _, seq := range lost {
+        log.Println(d.Addr, "never acked message", seq)
+      }
+    }
+    s.mut.Unlock()
+  }
+}
+
+func (s *Stub) handle(d *device, data []byte) {
+  msg, replies, err := d.link.Receive(data)
+  if err == dronedp.ErrDowngrade && isConnect(s.key, data) {
+    // The device lost the session and is starting over.
+    d.link.Codec().Drop()
+    msg, replies, err = d.link.Receive(data)
+  }
+  for _, f := range replies {
+    d.write(f)
+  }
+
+  s.mut.Lock()
+  defer s.mut.Unlock()
+
+  d.LastSeen = time.Now()
+  if err != nil {
+    d.Errors++
+    log.Println(d.Addr, err)
+    return
+  } else if msg == nil {
+    return
+  }
+
+  switch msg.Op {
+  case dronedp.OP_STATUS:
+    switch m := msg.Data.(type) {
+    case *dronedp.StatusMsg:
+      s.status(d, msg.Session, m)
+    case *dronedp.CodeMsg:
+      d.Code = append(d.Code, *m)
+      if len(d.Code) > MAX_CODE_EVENTS {
+        d.Code = d.Code[1:]
+      }
+    }
+
+  case dronedp.OP_MAVLINK_BIN:
+    d.Mavlink++
+    s.last = d
+    if s.gcs != nil {
+      s.gcs.Write(msg.Data.([]byte))
+    }
+
+  case dronedp.OP_TERMINAL:
+    d.Terminal = msg.Data.(*dronedp.TerminalMsg)
+    d.termRx, d.termTx, d.termOut = terminal.NewReorder(), 0, nil
+    log.Printf("%s terminal %+v", d.Addr, *d.Terminal)
+
+  case dronedp.OP_TERMINAL_DATA:
+    td := msg.Data.(*dronedp.TerminalData)
+    for _, chunk := range d.termRx.Push(td.Seq, td.Data) {
+      d.termOut = append(d.termOut, chunk...)
+    }
+    if over := len(d.termOut) - MAX_TERMINAL_OUTPUT; over > 0 {
+      d.termOut = d.termOut[over:]
+    }
+
+  default:
+    log.Println(d.Addr, "unexpected op", msg.Op)
+  }
+}
+
+// Whether data is a genuine authenticated connect, checked with a codec of its
+// own so the device's replay state isn't touched.
+func isConnect(key []byte, data []byte) bool {
+  msg, err := dronedp.NewServerCodec(key, 0).Parse(data)
+  if err != nil || msg.Op != dronedp.OP_STATUS {
+    return false
+  }
+  sm, ok := msg.Data.(*dronedp.StatusMsg)
+  return ok && sm.Op == "connect"
+}
+
+// The handshake. Must be called with the lock held.
+func (s *Stub) status(d *device, session uint32, sm *dronedp.StatusMsg) {
+  d.Status++
+  codec := d.link.Codec()
+
+  if sm.Op == "connect" {
+    // connect goes out every second until it's answered. Answering a repeat
+    // would start another key exchange under the first.
+    if d.Session != 0 && sm.PubKey != "" && sm.PubKey == d.devPub {
+      return
+    }
+
+    d.Session = rand.Uint32() | 1
+    d.Serial, d.Email, d.SimId, d.devPub = sm.Serial, sm.Email, sm.SimId, sm.PubKey
+    d.Features = nil
+    for _, f := range sm.Features {
+      if f == dronedp.FEATURE_FRAGMENT || f == dronedp.FEATURE_ACK {
+        d.Features = append(d.Features, f)
+      }
+    }
+    log.Printf("%s connected, serial %s, session %d", d.Addr, d.Serial, d.Session)
+
+    codec.Drop()
+    d.link.Enable(false, false)
+    reply := s.statusReply()
+    reply.Features = d.Features
+    if sm.PubKey != "" && codec.Authenticated() {
+      if pub, err := codec.Offer(); err == nil {
+        reply.PubKey = pub
+      }
+    }
+    d.send(dronedp.OP_STATUS, reply, false)
+
+    if reply.PubKey != "" {
+      if err := codec.Accept(d.Session, sm.PubKey); err != nil {
+        log.Println(d.Addr, "key exchange failed:", err)
+      }
+    }
+    d.Sealed = codec.Sealed()
+    d.link.Enable(dronedp.Features(d.Features))
+    return
+  }
+
+  reply := s.statusReply()
+  reply.Features = d.Features
+  if d.Terminal != nil && !d.Terminal.Status && s.terminal {
+    // It refused or the shell exited, it waits for us to drop the request.
+    reply.Terminal = false
+    s.terminal = false
+  }
+  if s.cancelJob != 0 {
+    reply.CancelJob, s.cancelJob = s.cancelJob, 0
+  }
+  d.send(dronedp.OP_STATUS, reply, false)
+}
+
+// Must be called with the lock held.
+func (s *Stub) statusReply() dronedp.StatusMsg {
+  return dronedp.StatusMsg{
+    Op: "status",
+    Drone: map[string]interface{}{"_id": s.drone},
+    User: s.user,
+    Terminal: s.terminal,
+  }
+}
+
+// Passes MAVLink from devices to a ground station, and the ground station's
+// back to the last device that sent any.
+func (s *Stub) PassMavlink(addr string) error {
+  raddr, err := net.ResolveUDPAddr("udp", addr)
+  if err != nil {
+    return err
+  }
+  conn, err := net.DialUDP("udp", nil, raddr)
+  if err != nil {
+    return err
+  }
+  s.gcs = conn
+
+  go func() {
+    buf := make([]byte, 2048)
+    for {
+      n, err := conn.Read(buf)
+      if err != nil {
+        continue
+      }
+      s.mut.Lock()
+      if d := s.last; d != nil && d.Session != 0 {
+        d.send(dronedp.OP_MAVLINK_BIN, append([]byte(nil), buf[:n]...), false)
+      }
+      s.mut.Unlock()
+    }
+  }()
+  return nil
+}
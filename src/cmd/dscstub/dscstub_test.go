@@ -0,0 +1,148 @@
+package main
+
+import (
+  "bytes"
+  "io/ioutil"
+  "net"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+
+  "cloudlink/dronedp"
+  "cloudlink/upload"
+  "flightlog"
+)
+
+var testKey = bytes.Repeat([]byte{0x42}, dronedp.KEY_LEN)
+
+// The engine's side of the handshake, against the stub over UDP.
+func TestHandshake(t *testing.T) {
+  s := NewStub(testKey, "d1", "u1")
+  pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+  if err != nil {
+    t.Skip(err)
+  }
+  defer pc.Close()
+  go s.ServeUDP(pc)
+
+  conn, err := net.Dial("udp", pc.LocalAddr().String())
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer conn.Close()
+  conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+  codec := dronedp.NewCodec(testKey, 1000)
+  link := dronedp.NewLink(codec, dronedp.DEFAULT_MTU)
+  pub, _ := codec.Offer()
+
+  send := func(session uint32, data interface{}) {
+    frames, err := link.Send(dronedp.OP_STATUS, session, data, false)
+    if err != nil {
+      t.Fatal(err)
+    }
+    for _, f := range frames {
+      conn.Write(f)
+    }
+  }
+  recv := func() *dronedp.StatusMsg {
+    buf := make([]byte, 65536)
+    n, err := conn.Read(buf)
+    if err != nil {
+      t.Fatal(err)
+    }
+    msg, _, err := link.Receive(buf[:n])
+    if err != nil {
+      t.Fatal(err)
+    }
+    if msg.Session == 0 {
+      t.Fatal("no session")
+    }
+    return msg.Data.(*dronedp.StatusMsg)
+  }
+
+  send(0, dronedp.StatusMsg{Op: "connect", Serial: "abc", PubKey: pub, Features: []string{dronedp.FEATURE_ACK}})
+  reply := recv()
+  if reply.PubKey == "" || reply.Drone["_id"] != "d1" || len(reply.Features) != 1 {
+    t.Fatalf("got %+v", reply)
+  }
+
+  s.mut.Lock()
+  d := s.current()
+  session := d.Session
+  s.mut.Unlock()
+
+  if err := codec.Accept(session, reply.PubKey); err != nil {
+    t.Fatal(err)
+  }
+  send(session, dronedp.StatusMsg{Op: "status"})
+  if r := recv(); r.User != "u1" {
+    t.Errorf("got %+v", r)
+  }
+
+  s.mut.Lock()
+  if !d.Sealed || d.Serial != "abc" || d.Status != 2 || d.Errors != 0 {
+    t.Errorf("got %+v", d)
+  }
+  s.mut.Unlock()
+
+  // The device drops the session and connects again, unsealed.
+  codec.Drop()
+  pub, _ = codec.Offer()
+  send(0, dronedp.StatusMsg{Op: "connect", Serial: "abc", PubKey: pub})
+  if reply := recv(); reply.PubKey == "" {
+    t.Fatalf("reconnect: got %+v", reply)
+  }
+
+  s.mut.Lock()
+  defer s.mut.Unlock()
+  if d.Session == session || d.Errors != 0 {
+    t.Errorf("reconnect: got %+v", d)
+  }
+}
+
+// The engine's uploader, against the stub's HTTP API.
+func TestUpload(t *testing.T) {
+  s := NewStub(nil, "d1", "u1")
+  srv := httptest.NewServer(s)
+  defer srv.Close()
+
+  dir, err := ioutil.TempDir("", "dscstub")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  var tlog bytes.Buffer
+  tw := flightlog.NewTlogWriter(&tlog)
+  for i := 0; i < 2000; i++ {
+    tw.Write(time.Unix(1470052800 + int64(i), 0), append([]byte{0xFE, 9, byte(i), 1, 1, 0}, make([]byte, 9 + 2)...))
+  }
+  data := tlog.Bytes()
+  fpath := filepath.Join(dir, "Flight 1.tlog")
+  ioutil.WriteFile(fpath, data, 0644)
+  f, _ := os.Open(fpath)
+  defer f.Close()
+
+  // Chunked, then mavlinkBinary once the stub stops serving it.
+  for _, chunked := range []bool{true, false} {
+    s.SetChunked(chunked)
+    dsc := upload.NewDSC(srv.URL, 16 * 1024, nil, func() (string, string) { return "u1", "d1" })
+    mission, err := dsc.Upload(upload.Item{Name: "Flight 1.tlog", Size: int64(len(data))}, f, "", func(string, int64) {}, nil)
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    s.mut.Lock()
+    m := s.missions[mission]
+    s.mut.Unlock()
+    if m == nil || !bytes.Equal(m.data, data) || m.Drone != "d1" || m.User != "u1" {
+      t.Fatalf("chunked %v: got %+v", chunked, m)
+    }
+    if named := m.Name == "Flight 1.tlog"; named != chunked {
+      t.Errorf("chunked %v: mission %s named %q", chunked, m.Id, m.Name)
+    }
+  }
+}
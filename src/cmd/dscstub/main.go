@@ -0,0 +1,80 @@
+// Command dscstub stands in for Dronesmith Cloud, so cloudlink can be worked
+// on offline.
+//
+//   dscstub [-udp :4002] [-tcp :4002] [-http :4000] [-key <hex>] [-mavlink <host:port>] [-terminal] [-nochunked]
+//
+// It speaks DroneDP (the connect/status handshake, sessions, authenticated
+// and encrypted frames, fragments and acks, MAVLink, code and terminals) and
+// serves the cloud's HTTP endpoints for flight logs and sensors. Whatever the
+// engine sends is kept in memory and shown under /stub/ on the HTTP port. Run
+// the engine with --dsc 127.0.0.1:4002 --dscHttp http://127.0.0.1:4000.
+package main
+
+import (
+  "flag"
+  "fmt"
+  "log"
+  "net"
+  "net/http"
+  "os"
+
+  "cloudlink/dronedp"
+)
+
+var (
+  udpAddr   = flag.String("udp", ":4002", "Address to take DroneDP datagrams on.")
+  tcpAddr   = flag.String("tcp", "", "Address to take DroneDP over TCP on, for testing the fallback. Off by default.")
+  httpAddr  = flag.String("http", ":4000", "Address to serve the cloud's HTTP API and /stub/ on.")
+  keyHex    = flag.String("key", "", "Device key, hex encoded. Devices must use authenticated frames when set.")
+  mavAddr   = flag.String("mavlink", "", "Ground station to pass MAVLink through to, e.g. 127.0.0.1:14550.")
+  askTerm   = flag.Bool("terminal", false, "Ask connected devices for a terminal from the start.")
+  noChunked = flag.Bool("nochunked", false, "Answer /rt/mission/upload with a 404, so devices fall back to mavlinkBinary.")
+  droneId   = flag.String("drone", "stubdrone", "Drone id handed to devices.")
+  userId    = flag.String("user", "stubuser", "User id handed to devices.")
+)
+
+func main() {
+  flag.Usage = func() {
+    fmt.Fprintln(os.Stderr, "usage: dscstub [flags]")
+    flag.PrintDefaults()
+  }
+  flag.Parse()
+
+  var key []byte
+  if *keyHex != "" {
+    var err error
+    if key, err = dronedp.ParseKey(*keyHex); err != nil {
+      log.Fatal(err)
+    }
+  }
+
+  s := NewStub(key, *droneId, *userId)
+  s.SetTerminal(*askTerm)
+  s.SetChunked(!*noChunked)
+
+  if *mavAddr != "" {
+    if err := s.PassMavlink(*mavAddr); err != nil {
+      log.Fatal(err)
+    }
+    log.Println("Passing MAVLink through to", *mavAddr)
+  }
+
+  udp, err := net.ListenPacket("udp", *udpAddr)
+  if err != nil {
+    log.Fatal(err)
+  }
+  log.Println("DroneDP on udp", udp.LocalAddr())
+  go s.ServeUDP(udp)
+
+  if *tcpAddr != "" {
+    ln, err := net.Listen("tcp", *tcpAddr)
+    if err != nil {
+      log.Fatal(err)
+    }
+    log.Println("DroneDP on tcp", ln.Addr())
+    go s.ServeTCP(ln)
+  }
+
+  log.Println("HTTP on", *httpAddr)
+  log.Fatal(http.ListenAndServe(*httpAddr, s))
+}
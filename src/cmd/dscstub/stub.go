@@ -0,0 +1,441 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "net"
+  "net/http"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+
+  "cloudlink/dronedp"
+  "flightlog"
+)
+
+type mission struct {
+  Id        string    `json:"id"`
+  Name      string    `json:"name"`
+  Size      int64     `json:"size"`
+  Encoding  string    `json:"encoding"`
+  User      string    `json:"user"`
+  Drone     string    `json:"drone"`
+  Complete  bool      `json:"complete"`
+  Created   time.Time `json:"created"`
+
+  data      []byte
+}
+
+type sensor struct {
+  Drone     string                  `json:"drone"`
+  Name      string                  `json:"name"`
+  Time      time.Time               `json:"time"`
+  Value     map[string]interface{}  `json:"value"`
+}
+
+type Stub struct {
+  key       []byte
+  drone     string
+  user      string
+
+  mut       sync.Mutex
+  devices   map[string]*device
+  last      *device
+  gcs       *net.UDPConn
+  terminal  bool
+  noChunked bool
+  cancelJob int
+
+  missions  map[string]*mission
+  uploads   map[string]*mission
+  sensors   []sensor
+  nextId    int
+
+  mux       *http.ServeMux
+}
+
+func NewStub(key []byte, drone, user string) *Stub {
+  s := &Stub{
+    key: key,
+    drone: drone,
+    user: user,
+    devices: make(map[string]*device),
+    missions: make(map[string]*mission),
+    uploads: make(map[string]*mission),
+    mux: http.NewServeMux(),
+  }
+
+  // What the engine calls.
+  s.mux.HandleFunc("/rt/mission/mavlinkBinary", s.legacyUpload)
+  s.mux.HandleFunc("/rt/mission/upload", s.upload)
+  s.mux.HandleFunc("/rt/mission/upload/", s.upload)
+  s.mux.HandleFunc("/rt/mission/", s.associate)
+  s.mux.HandleFunc("/rt/drone/", s.sensor)
+
+  // For looking at what it sent, and poking it.
+  s.mux.HandleFunc("/stub/devices", s.listDevices)
+  s.mux.HandleFunc("/stub/missions", s.listMissions)
+  s.mux.HandleFunc("/stub/missions/", s.getMission)
+  s.mux.HandleFunc("/stub/sensors", s.listSensors)
+  s.mux.HandleFunc("/stub/code", s.code)
+  s.mux.HandleFunc("/stub/terminal", s.terminalCtl)
+
+  go s.retransmit()
+  return s
+}
+
+func (s *Stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  s.mux.ServeHTTP(w, r)
+}
+
+func (s *Stub) SetTerminal(on bool) {
+  s.mut.Lock()
+  s.terminal = on
+  s.mut.Unlock()
+}
+
+// Off answers the chunked upload with a 404, like a server that only has
+// mavlinkBinary.
+func (s *Stub) SetChunked(on bool) {
+  s.mut.Lock()
+  s.noChunked = !on
+  s.mut.Unlock()
+}
+
+func reply(w http.ResponseWriter, code int, v interface{}) {
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(code)
+  json.NewEncoder(w).Encode(v)
+}
+
+func fail(w http.ResponseWriter, code int, err string) {
+  reply(w, code, map[string]string{"status": "error", "error": err})
+}
+
+// Must be called with the lock held.
+func (s *Stub) newId(prefix string) string {
+  s.nextId++
+  return prefix + strconv.Itoa(s.nextId)
+}
+
+// =============================================================================
+// Cloud API
+// =============================================================================
+
+// The old single POST of a whole log, in the legacy layout. It's kept as a
+// .tlog, like the chunked uploads.
+func (s *Stub) legacyUpload(w http.ResponseWriter, r *http.Request) {
+  if r.Method != "POST" {
+    fail(w, 405, "POST only")
+    return
+  }
+  var buf bytes.Buffer
+  if _, err := flightlog.ConvertLegacy(r.Body, &buf); err != nil {
+    fail(w, 400, err.Error())
+    return
+  }
+  data := buf.Bytes()
+
+  s.mut.Lock()
+  m := &mission{Id: s.newId("m"), Size: int64(len(data)), Complete: true, Created: time.Now(), data: data}
+  s.missions[m.Id] = m
+  s.mut.Unlock()
+
+  reply(w, 200, map[string]string{"status": "OK", "id": m.Id})
+}
+
+// The chunked protocol, see cloudlink/upload.
+func (s *Stub) upload(w http.ResponseWriter, r *http.Request) {
+  id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/rt/mission/upload"), "/")
+
+  s.mut.Lock()
+  defer s.mut.Unlock()
+
+  if s.noChunked {
+    http.NotFound(w, r)
+    return
+  }
+
+  if id == "" {
+    if r.Method != "POST" {
+      fail(w, 405, "POST only")
+      return
+    }
+    var req struct {
+      Name      string  `json:"name"`
+      Size      int64   `json:"size"`
+      Encoding  string  `json:"encoding"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Size < 0 {
+      fail(w, 400, "Bad upload request.")
+      return
+    }
+    m := &mission{Id: s.newId("u"), Name: req.Name, Size: req.Size, Encoding: req.Encoding, Created: time.Now()}
+    s.uploads[m.Id] = m
+    reply(w, 200, map[string]interface{}{"status": "OK", "id": m.Id, "offset": 0})
+    return
+  }
+
+  m := s.uploads[id]
+  if m == nil {
+    fail(w, 404, "No such upload.")
+    return
+  }
+
+  switch r.Method {
+  case "GET":
+    reply(w, 200, map[string]interface{}{"status": "OK", "id": id, "offset": len(m.data)})
+
+  case "PUT":
+    var from, to, size int64
+    if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &from, &to, &size); err != nil || size != m.Size {
+      fail(w, 400, "Bad Content-Range.")
+      return
+    }
+    data, err := ioutil.ReadAll(r.Body)
+    if err != nil || int64(len(data)) != to - from + 1 {
+      fail(w, 400, "Body doesn't match Content-Range.")
+      return
+    }
+
+    // Anything but the next chunk is ignored, the offset tells the client
+    // where we are.
+    if from == int64(len(m.data)) {
+      m.data = append(m.data, data...)
+    }
+
+    res := map[string]interface{}{"status": "OK", "id": id, "offset": len(m.data)}
+    if int64(len(m.data)) == m.Size {
+      if !m.Complete {
+        m.Complete = true
+        m.Id = s.newId("m")
+        s.missions[m.Id] = m
+      }
+      res["mission"] = m.Id
+    }
+    reply(w, 200, res)
+
+  default:
+    fail(w, 405, "GET or PUT only")
+  }
+}
+
+// PUT /rt/mission/<id>/associate
+func (s *Stub) associate(w http.ResponseWriter, r *http.Request) {
+  parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+  if len(parts) != 4 || parts[3] != "associate" || r.Method != "PUT" {
+    fail(w, 404, "Not found.")
+    return
+  }
+
+  var req struct {
+    User    string  `json:"user"`
+    Drone   string  `json:"drone"`
+  }
+  if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+    fail(w, 400, err.Error())
+    return
+  }
+
+  s.mut.Lock()
+  defer s.mut.Unlock()
+  m := s.missions[parts[2]]
+  if m == nil {
+    fail(w, 404, "No such mission.")
+    return
+  }
+  m.User, m.Drone = req.User, req.Drone
+  reply(w, 200, map[string]string{"status": "OK"})
+}
+
+// POST /rt/drone/<id>/sensor/<name>
+func (s *Stub) sensor(w http.ResponseWriter, r *http.Request) {
+  parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+  if len(parts) != 5 || parts[3] != "sensor" || r.Method != "POST" {
+    fail(w, 404, "Not found.")
+    return
+  }
+
+  var val map[string]interface{}
+  if err := json.NewDecoder(r.Body).Decode(&val); err != nil {
+    fail(w, 400, err.Error())
+    return
+  }
+
+  s.mut.Lock()
+  s.sensors = append(s.sensors, sensor{parts[2], parts[4], time.Now(), val})
+  s.mut.Unlock()
+
+  reply(w, 200, map[string]string{"status": "OK"})
+}
+
+// =============================================================================
+// Inspection API
+// =============================================================================
+
+// GET /stub/devices
+func (s *Stub) listDevices(w http.ResponseWriter, r *http.Request) {
+  s.mut.Lock()
+  defer s.mut.Unlock()
+
+  list := make([]*device, 0, len(s.devices))
+  for _, d := range s.devices {
+    list = append(list, d)
+  }
+  sort.Slice(list, func(i, j int) bool { return list[i].Addr < list[j].Addr })
+  reply(w, 200, list)
+}
+
+// GET /stub/missions
+func (s *Stub) listMissions(w http.ResponseWriter, r *http.Request) {
+  s.mut.Lock()
+  defer s.mut.Unlock()
+
+  list := []*mission{}
+  for _, m := range s.uploads {
+    if !m.Complete {
+      list = append(list, m)
+    }
+  }
+  for _, m := range s.missions {
+    list = append(list, m)
+  }
+  sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+  reply(w, 200, list)
+}
+
+// GET /stub/missions/<id>, the uploaded bytes.
+func (s *Stub) getMission(w http.ResponseWriter, r *http.Request) {
+  id := strings.TrimPrefix(r.URL.Path, "/stub/missions/")
+
+  s.mut.Lock()
+  m := s.missions[id]
+  s.mut.Unlock()
+  if m == nil {
+    fail(w, 404, "No such mission.")
+    return
+  }
+
+  w.Header().Set("Content-Type", "application/octet-stream")
+  w.Write(m.data)
+}
+
+// GET /stub/sensors
+func (s *Stub) listSensors(w http.ResponseWriter, r *http.Request) {
+  s.mut.Lock()
+  defer s.mut.Unlock()
+  reply(w, 200, append([]sensor{}, s.sensors...))
+}
+
+// Must be called with the lock held.
+func (s *Stub) current() *device {
+  var cur *device
+  for _, d := range s.devices {
+    if d.Session != 0 && (cur == nil || d.LastSeen.After(cur.LastSeen)) {
+      cur = d
+    }
+  }
+  return cur
+}
+
+// POST /stub/code {"code": "..."} runs code on the device, DELETE
+// /stub/code?job=<id> cancels a job. The device's updates show up in
+// /stub/devices.
+func (s *Stub) code(w http.ResponseWriter, r *http.Request) {
+  s.mut.Lock()
+  defer s.mut.Unlock()
+
+  d := s.current()
+  if d == nil {
+    fail(w, 409, "No device connected.")
+    return
+  }
+
+  switch r.Method {
+  case "POST":
+    var req struct {
+      Code  string  `json:"code"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+      fail(w, 400, err.Error())
+      return
+    }
+    if err := d.send(dronedp.OP_CODE, req.Code, true); err != nil {
+      fail(w, 500, err.Error())
+      return
+    }
+
+  case "DELETE":
+    job, err := strconv.Atoi(r.URL.Query().Get("job"))
+    if err != nil {
+      fail(w, 400, "Which job?")
+      return
+    }
+    // Goes out with the next status reply.
+    s.cancelJob = job
+
+  default:
+    fail(w, 405, "POST or DELETE only")
+    return
+  }
+  reply(w, 200, map[string]string{"status": "OK"})
+}
+
+// GET /stub/terminal returns the terminal's output so far. PUT
+// {"on": true|false} asks for or closes a terminal, {"input": "ls\n"} types
+// into it and {"rows": 40, "cols": 120} resizes it.
+func (s *Stub) terminalCtl(w http.ResponseWriter, r *http.Request) {
+  s.mut.Lock()
+  defer s.mut.Unlock()
+
+  d := s.current()
+
+  switch r.Method {
+  case "GET":
+    res := map[string]interface{}{"requested": s.terminal}
+    if d != nil {
+      res["terminal"] = d.Terminal
+      res["output"] = string(d.termOut)
+    }
+    reply(w, 200, res)
+    return
+
+  case "PUT":
+    var req struct {
+      On      *bool   `json:"on"`
+      Input   string  `json:"input"`
+      Rows    uint16  `json:"rows"`
+      Cols    uint16  `json:"cols"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+      fail(w, 400, err.Error())
+      return
+    }
+
+    if req.On != nil {
+      s.terminal = *req.On
+    }
+    if req.Input != "" || req.Rows != 0 {
+      if d == nil || d.Terminal == nil || !d.Terminal.Status {
+        fail(w, 409, "No terminal open.")
+        return
+      }
+      if req.Input != "" {
+        td := dronedp.TerminalData{Session: d.Terminal.Session, Seq: d.termTx, Data: []byte(req.Input)}
+        d.termTx++
+        d.send(dronedp.OP_TERMINAL_DATA, td, true)
+      }
+      if req.Rows != 0 {
+        d.send(dronedp.OP_TERMINAL, dronedp.TerminalMsg{Op: "resize", Session: d.Terminal.Session, Rows: req.Rows, Cols: req.Cols}, true)
+      }
+    }
+    reply(w, 200, map[string]string{"status": "OK"})
+
+  default:
+    fail(w, 405, "GET or PUT only")
+  }
+}
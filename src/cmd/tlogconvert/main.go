@@ -0,0 +1,83 @@
+// Command tlogconvert rewrites flight logs from the engine's old format (Go
+// time.MarshalBinary stamps) as standard .tlog files.
+//
+//   tlogconvert [-keep] <file or directory>...
+//
+// Directories are scanned for "Flight*.log". The engine does the same for its
+// own flight directory on startup, this is for logs that were copied off.
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+  "path/filepath"
+  "strings"
+
+  "flightlog"
+)
+
+var keep = flag.Bool("keep", false, "Keep the original logs instead of deleting them.")
+
+func convert(fpath string) error {
+  if !*keep {
+    _, err := flightlog.ConvertFile(fpath)
+    return err
+  }
+
+  src, err := os.Open(fpath)
+  if err != nil {
+    return err
+  }
+  defer src.Close()
+
+  out := strings.TrimSuffix(fpath, flightlog.LEGACY_EXT) + flightlog.TLOG_EXT
+  dst, err := os.Create(out)
+  if err != nil {
+    return err
+  }
+  defer dst.Close()
+
+  _, err = flightlog.ConvertLegacy(src, dst)
+  return err
+}
+
+func main() {
+  flag.Usage = func() {
+    fmt.Fprintln(os.Stderr, "usage: tlogconvert [-keep] <file or directory>...")
+    flag.PrintDefaults()
+  }
+  flag.Parse()
+
+  if flag.NArg() == 0 {
+    flag.Usage()
+    os.Exit(2)
+  }
+
+  var files []string
+  for _, arg := range flag.Args() {
+    if info, err := os.Stat(arg); err != nil {
+      fmt.Fprintln(os.Stderr, err)
+      os.Exit(1)
+    } else if info.IsDir() {
+      matches, _ := filepath.Glob(filepath.Join(arg, "Flight*" + flightlog.LEGACY_EXT))
+      files = append(files, matches...)
+    } else {
+      files = append(files, arg)
+    }
+  }
+
+  failed := 0
+  for _, f := range files {
+    if err := convert(f); err != nil {
+      fmt.Fprintln(os.Stderr, f + ":", err)
+      failed++
+    } else {
+      fmt.Println(f)
+    }
+  }
+
+  if failed > 0 {
+    os.Exit(1)
+  }
+}
@@ -2,133 +2,52 @@ package config
 
 import (
   "flag"
-  "log"
+  "fmt"
   "os"
+  "regexp"
+  "strings"
+  "time"
   // "net"
   // "strconv"
-  "encoding/json"
   "io/ioutil"
+
+  "logger"
 )
 
-func init() {
+// Parses the flags and loads the settings. Called first thing from main, and
+// by tests before they use anything here.
+func Init() {
   flag.Parse()
 
-  Version = VER + "-" + gitHash[len(gitHash)-8:]
-
-  logFile, _ = os.Create(*loggingFile)
-  logger = log.New(logFile, "[MON] ", log.LstdFlags)
-
-  file, e := ioutil.ReadFile(*configFile)
-   if e != nil {
-       logger.Printf("Error: %v\n", e)
-   } else {
-     var jsontype map[string]interface{}
-     json.Unmarshal(file, &jsontype)
-
-     // update config with each type
-     if jsontype["flights"] != nil {
-       flights := jsontype["flights"].(string)
-       FlightLogPath = &flights
-     }
-
-     if jsontype["master"] != nil {
-       master := jsontype["master"].(string)
-       LinkPath = &master
-     }
-
-     if jsontype["output"] != nil {
-       output := jsontype["output"].(string)
-       Output = &output
-     }
-
-     if jsontype["status"] != nil {
-       status := jsontype["status"].(float64)
-       statusI := int(status)
-       StatusPort = &statusI
-     }
-
-     if jsontype["dsc"] != nil {
-       dsc := jsontype["dsc"].(string)
-       DSCAddress = &dsc
-     }
-
-     if jsontype["dscHttp"] != nil {
-       dscHttp := jsontype["dscHttp"].(string)
-       DSCHttp = &dscHttp
-     }
-
-     if jsontype["setup"] != nil {
-       setup := jsontype["setup"].(string)
-       SetupPath = &setup
-     }
-
-     if jsontype["assets"] != nil {
-       assets := jsontype["assets"].(string)
-       AssetsPath = &assets
-     }
-
-     if jsontype["sync"] != nil {
-       syncf := jsontype["sync"].(float64)
-       synci := int(syncf)
-       SyncThrottle = &synci
-     }
-
-     if jsontype["stream"] != nil {
-       streamf := jsontype["stream"].(float64)
-       streami := int(streamf)
-       SyncAPI = &streami
-     }
-
-     if jsontype["noflights"] != nil {
-       noflights := jsontype["noflights"].(bool)
-       DisableFlights = &noflights
-     }
-
-     if jsontype["remote"] != nil {
-       remote := jsontype["remote"].(string)
-       Remote = &remote
-     }
-
-     if jsontype["log"] != nil {
-       log := jsontype["log"].(string)
-       loggingFile = &log
-     }
-
-     if jsontype["daemon"] != nil {
-       dae := jsontype["daemon"].(bool)
-       daemon = &dae
-     }
-
-     if jsontype["debug"] != nil {
-       dae := jsontype["debug"].(bool)
-       debugMode = &dae
-     }
-
-     if jsontype["simid"] != nil {
-       simId := jsontype["simid"].(string)
-       SimId = &simId
-     }
-
-     if jsontype["simidfile"] != nil {
-       simIdf := jsontype["simidfile"].(string)
-       SimDatFile = &simIdf
-     }
-
-     // If it's empty, don't do anything.
-     if *SimDatFile != "" {
-       file, e := ioutil.ReadFile(*SimDatFile)
-        if e != nil {
-            logger.Printf("Error: %v\n", e)
-        } else {
-          if len(file) < 64 {
-            logger.Printf("Invalid SimID length")
-          } else {
-            str := string(file[:64])
-            SimId = &str
-          }
-        }
+  Version = VER
+  if len(gitHash) >= 8 {
+    Version += "-" + gitHash[len(gitHash)-8:]
+  }
+
+  c, src, errs := resolve()
+  current, sources = *c, src
+  bind()
+
+  engineLog = newLogger()
+  setLogLevel()
+
+  for _, e := range errs {
+    Log(LOG_ERROR, "config: ", e.Error())
+  }
+
+  // If it's empty, don't do anything.
+  if *SimDatFile != "" {
+    file, e := ioutil.ReadFile(*SimDatFile)
+    if e != nil {
+      Log(LOG_ERROR, "Error:", e)
+    } else {
+      if len(file) < 64 {
+        Log(LOG_ERROR, "Invalid SimID length")
+      } else {
+        *SimId = string(file[:64])
       }
-   }
+    }
+  }
 
    if *SimId != "" {
      Log(LOG_INFO, "Found a Sim ID:", *SimId)
@@ -160,10 +79,13 @@ func init() {
 }
 
 const (
-  LOG_DEBUG = iota
-  LOG_INFO
-  LOG_WARN
-  LOG_ERROR
+  LOG_DEBUG = logger.DEBUG
+  LOG_INFO = logger.INFO
+  LOG_WARN = logger.WARN
+  LOG_ERROR = logger.ERROR
+
+  // Entries kept in memory for /index/logs.
+  LOG_HISTORY = 2000
 )
 
 const (
@@ -172,68 +94,132 @@ const (
 
 var (
     // Config flags
-    LinkPath        = flag.String(      "master", "127.0.0.1:14550", 	              "Flight controller address, as either a UDP address or serial device path.")
-    Output          = flag.String(      "output", "", 									            "Create datalinks for other apps to connect to the flight controller.")
+    LinkPath        = flag.String(      "master", "127.0.0.1:14550", 	              "Flight controller address, as either a UDP address, serial device path, \"auto\" to scan serial ports, \"sim://\" for the built-in simulator, or \"replay:<file>\" to play back a flight log.")
     // UseNsh    = flag.Bool(    "shell",  false,  						  "Puts FC in shell mode, allowing access to the debug shell.")
     // StatusAddress   = flag.String(      "status", "127.0.0.1:8080",                 "Address which the status server will serve on. Should be in <IP>:<Port> format.")
     StatusPort      = flag.Int(         "status",    8080,                          "Port to host DS Link's status page on.")
     // StatusAddress string
-    DSCAddress      = flag.String(      "dsc",    "127.0.0.1:4002",                 "Address to talk to Dronesmith Cloud. Should be in <IP>:<Port> format.")
+    DSCAddress      = flag.String(      "dsc",    "127.0.0.1:4002",                 "Address to talk to Dronesmith Cloud. Either <IP>:<Port> for UDP, or a udp://, tcp://, tls://, ws:// or wss:// URL.")
+    DSCFallback     = flag.String(      "dscfallback", "auto",                      "Comma separated DSC addresses to try when the server doesn't answer. \"auto\" falls back from UDP to TCP on the same address.")
+    DDPMtu          = flag.Int(         "ddpmtu",  1200,                            "Largest DroneDP frame to send to Dronesmith Cloud, in bytes. Bigger messages are fragmented.")
     DSCHttp         = flag.String(      "dscHttp", "127.0.0.1:4000",                "HTTP Address to talk to Dronesmith Cloud. Should be in <IP>:<Port> format.")
     SetupPath       = flag.String(      "setup",  "",                               "Path to files for initial setup.") // TODO change this to `/var/lib/lmon-setup`
     AssetsPath      = flag.String(      "assets", "",                               "Path to system assets folder.")
     FlightLogPath   = flag.String(      "flights", "./flights",                     "Path to store flight log data.")
-    SyncThrottle    = flag.Int(         "sync",    1000,                            "Update time period to sync flight data in milliseconds.")
-    SyncAPI         = flag.Int(         "stream",    1000,                          "Update time period for GET /api/stream request")
+    SyncDest        = flag.String(      "syncdest",  "dsc",                         "Where to sync flight logs: dsc, s3://bucket/prefix, an http(s) PUT/WebDAV URL or file:///path.")
+    SyncChunk       = flag.Int(         "syncchunk", 256,                           "Size of each flight log upload request in KB.")
     DisableFlights  = flag.Bool(        "noflights", false,                         "Disables flight logging.")
+    LogCompress     = flag.String(      "logcompress", "none",                      "Flight log compression, none or gzip.")
+    LogRotateSize   = flag.Int(         "logrotate",   32,                          "Start a new flight log file after this many MB. 0 disables rotation.")
+    LogQuota        = flag.Int(         "logquota",    512,                         "MB of disk flight logs may use. The oldest synced logs are deleted first. 0 disables the quota.")
+    LogTrigger      = flag.String(      "logtrigger", "armed",                      "When to log flights: armed, inair, manual (API only) or always.")
+    LogPreTrigger   = flag.Int(         "logpre",     10,                           "Seconds of data from before the trigger to include in a flight log.")
+    LogPostTrigger  = flag.Int(         "logpost",    5,                            "Seconds to keep logging after the trigger ends.")
+    DisableCode     = flag.Bool(        "nocode",     false,                        "Disables running user code sent from the cloud or the local API.")
+    CodeInterpreter = flag.String(      "codepython", "python",                     "Interpreter user code is run with.")
+    CodeUser        = flag.String(      "codeuser",   "nobody",                     "User to run user code as, when DS Link runs as root.")
+    CodeCPU         = flag.Int(         "codecpu",    60,                           "CPU seconds a code job may use. 0 is unlimited.")
+    CodeMemory      = flag.Int(         "codemem",    128,                          "MB of memory a code job may use. 0 is unlimited.")
+    CodeTimeout     = flag.Int(         "codetimeout", 300,                         "Seconds a code job may run for. 0 is unlimited.")
+    DisableTerminal = flag.Bool(        "noterminal", false,                        "Disables remote terminals, both local and through the cloud.")
+    CloudTerminal   = flag.Bool(        "cloudterminal", false,                     "Lets the cloud open a terminal through the DroneDP connection.")
+    TerminalShell   = flag.String(      "termshell",  "/bin/bash",                  "Shell remote terminals run. Falls back to /bin/sh.")
     Remote          = flag.String(      "remote",  "",                              "Specify a remote UDP address. Required for certain flight controllers.")
     SimDatFile      = flag.String(      "simidfile",    "",                         "Either a file that contains a SimId, the unique identifier for a sim drone.")
     SimId           = flag.String(      "simid",      "",                           "The value of a sim id.")
 
+    // Per message flight logging rates. Only settable in config.json.
+    LogProfile      map[string]interface{}
+
+    // Credentials for an S3 sync destination. Only settable in config.json.
+    SyncKey         string
+    SyncSecret      string
+
+    // Can change while running, so they're read through Get() rather than
+    // these.
+    output          = flag.String(      "output", "", 									            "Create datalinks for other apps to connect to the flight controller.")
+    syncThrottle    = flag.Int(         "sync",    1000,                            "Update time period to sync flight data in milliseconds.")
+    syncRate        = flag.Int(         "syncrate",  0,                             "Cap on flight log upload bandwidth in KB/s. 0 is unlimited.")
+    syncAPI         = flag.Int(         "stream",    1000,                          "Update time period for GET /api/stream request")
+    readySubsystems = flag.String(      "readysubsystems", "heartbeat",             "Comma separated flight controller subsystems that must be online for /readyz, like heartbeat,gps,imu.")
+    readyCloud      = flag.Bool(        "readycloud", false,                        "Whether /readyz needs a Dronesmith Cloud session.")
+
     // Privates
     loggingFile     = flag.String(      "log",    "dsengine.log",                   "Log File path and name.")
     daemon          = flag.Bool(        "daemon", false,                            "Surpresses console logging if true.")
     debugMode       = flag.Bool(        "debug",  false,                            "Output debug information if true.")
+    logLevelName    = flag.String(      "loglevel", "info",                         "Least important messages to log: debug, info, warn or error. -debug means debug.")
+    logLevels       = flag.String(      "loglevels", "",                            "Levels for single subsystems, overriding -loglevel, as fl=debug,cl=warn. Subsystems are fl, cl, ss, sync, vehicle and so on.")
+    logFormat       = flag.String(      "logformat", "text",                        "Format of the log file, text or json.")
+    logMaxSize      = flag.Int(         "logmaxsize", 10,                           "Start a new log file after this many MB. 0 disables.")
+    logMaxAge       = flag.Int(         "logmaxage",  24,                           "Start a new log file after this many hours. 0 disables.")
+    logKeep         = flag.Int(         "logkeep",    5,                            "Old log files to keep. 0 keeps them all.")
     configFile      = flag.String(      "config",     "./config.json",              "Location to load a config file from, including the filename. Must be a valid JSON file. CLI only config option.")
 
     // set by the linker
     gitHash   string
 
-    logFile *os.File
-    logger *log.Logger
+    engineLog *logger.Logger
 
     Version   string
 )
 
+func newLogger() *logger.Logger {
+  opts := logger.Options{
+    Path: *loggingFile,
+    Format: *logFormat,
+    MaxSize: int64(*logMaxSize) * 1024 * 1024,
+    MaxAge: time.Duration(*logMaxAge) * time.Hour,
+    Keep: *logKeep,
+    History: LOG_HISTORY,
+  }
+  if !*daemon {
+    opts.Console = os.Stderr
+  }
+
+  l, err := logger.New(opts)
+  if err != nil {
+    // Still log to the console and /index/logs.
+    opts.Path = ""
+    l, _ = logger.New(opts)
+    l.Log("", LOG_ERROR, "Could not open log file: " + err.Error())
+  }
+  return l
+}
+
+func setLogLevel() {
+  level, _ := logger.ParseLevel(*logLevelName)
+  if *debugMode {
+    level = LOG_DEBUG
+  }
+  levels, _ := logger.ParseLevels(*logLevels)
+
+  engineLog.SetLevel(level)
+  engineLog.SetLevels(levels)
+}
+
+// The engine's log, for the status server.
+func Logger() *logger.Logger {
+  return engineLog
+}
+
+// Messages starting "cl: " and the like are logged under that subsystem.
+var subsystemPrefix = regexp.MustCompile(`^([a-z]+): *`)
+
 func Log(level int, vals... interface{}) {
-    switch level {
-      // debugs and warnings don't get saved to a file. This is to avoid clutter.
-    case LOG_DEBUG:
-      if !*daemon {
-        if *debugMode {
-          log.SetPrefix("[DEBUG] ")
-          log.Println(vals...)
+  subsystem := ""
+  if len(vals) > 0 {
+    if str, ok := vals[0].(string); ok {
+      if m := subsystemPrefix.FindStringSubmatch(str); m != nil {
+        subsystem = m[1]
+        rest := make([]interface{}, 0, len(vals))
+        if str = str[len(m[0]):]; str != "" {
+          rest = append(rest, str)
         }
+        vals = append(rest, vals[1:]...)
       }
-    case LOG_WARN:
-      if !*daemon {
-        log.SetPrefix("[WARN] ")
-        log.Println(vals...)
-      }
-    case LOG_ERROR:
-      logger.SetPrefix("[ERROR] ")
-      logger.Println(vals...)
-      if !*daemon {
-        log.SetPrefix("[ERROR] ")
-        log.Println(vals...)
-      }
-    case LOG_INFO:
-      if !*daemon {
-        log.SetPrefix("[INFO] ")
-        log.Println(vals...)
-      }
-
-      logger.SetPrefix("[INFO] ")
-      logger.Println(vals...)
     }
+  }
+
+  engineLog.Log(subsystem, level, strings.TrimSuffix(fmt.Sprintln(vals...), "\n"))
 }
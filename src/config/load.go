@@ -0,0 +1,370 @@
+package config
+
+import (
+  "encoding/json"
+  "flag"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sort"
+  "sync"
+
+  "config/settings"
+  "logger"
+)
+
+const (
+  ENV_PREFIX = "DSLINK_"
+
+  SOURCE_DEFAULT = "default"
+  SOURCE_FILE = "file"
+  SOURCE_ENV = "env"
+  SOURCE_FLAG = "flag"
+)
+
+// Every setting, named as its flag and config.json key. Sources override each
+// other in order: flag defaults, config.json, DSLINK_<NAME> environment
+// variables, then flags given on the command line.
+type Config struct {
+  Master          string                  `json:"master"`
+  Output          string                  `json:"output" reload:"true"`
+  Status          int                     `json:"status" valid:"min=1,max=65535"`
+  DSC             string                  `json:"dsc"`
+  DSCFallback     string                  `json:"dscfallback"`
+  DDPMtu          int                     `json:"ddpmtu" valid:"min=128,max=65507"`
+  DSCHttp         string                  `json:"dscHttp"`
+  Setup           string                  `json:"setup"`
+  Assets          string                  `json:"assets"`
+  Flights         string                  `json:"flights"`
+  Sync            int                     `json:"sync" reload:"true" valid:"min=10"`
+  SyncDest        string                  `json:"syncdest"`
+  SyncRate        int                     `json:"syncrate" reload:"true" valid:"min=0"`
+  SyncChunk       int                     `json:"syncchunk" valid:"min=1"`
+  SyncKey         string                  `json:"synckey"`
+  SyncSecret      string                  `json:"syncsecret" secret:"true"`
+  Stream          int                     `json:"stream" reload:"true" valid:"min=10"`
+  NoFlights       bool                    `json:"noflights"`
+  LogProfile      map[string]interface{}  `json:"logprofile"`
+  LogCompress     string                  `json:"logcompress" valid:"oneof=none|gzip"`
+  LogRotate       int                     `json:"logrotate" valid:"min=0"`
+  LogQuota        int                     `json:"logquota" valid:"min=0"`
+  LogTrigger      string                  `json:"logtrigger" valid:"oneof=armed|inair|manual|always"`
+  LogPre          int                     `json:"logpre" valid:"min=0"`
+  LogPost         int                     `json:"logpost" valid:"min=0"`
+  NoCode          bool                    `json:"nocode"`
+  CodePython      string                  `json:"codepython"`
+  CodeUser        string                  `json:"codeuser"`
+  CodeCPU         int                     `json:"codecpu" valid:"min=0"`
+  CodeMem         int                     `json:"codemem" valid:"min=0"`
+  CodeTimeout     int                     `json:"codetimeout" valid:"min=0"`
+  NoTerminal      bool                    `json:"noterminal"`
+  CloudTerminal   bool                    `json:"cloudterminal"`
+  TermShell       string                  `json:"termshell"`
+  Remote          string                  `json:"remote"`
+  SimIdFile       string                  `json:"simidfile"`
+  SimId           string                  `json:"simid"`
+  ReadySubsystems string                  `json:"readysubsystems" reload:"true"`
+  ReadyCloud      bool                    `json:"readycloud" reload:"true"`
+  Log             string                  `json:"log"`
+  Daemon          bool                    `json:"daemon"`
+  Debug           bool                    `json:"debug" reload:"true"`
+  LogLevel        string                  `json:"loglevel" reload:"true" valid:"oneof=debug|info|warn|error"`
+  LogLevels       string                  `json:"loglevels" reload:"true"`
+  LogFormat       string                  `json:"logformat" valid:"oneof=text|json"`
+  LogMaxSize      int                     `json:"logmaxsize" valid:"min=0"`
+  LogMaxAge       int                     `json:"logmaxage" valid:"min=0"`
+  LogKeep         int                     `json:"logkeep" valid:"min=0"`
+}
+
+func (c *Config) Check() settings.Errors {
+  if _, err := logger.ParseLevels(c.LogLevels); err != nil {
+    return settings.Errors{{Path: "loglevels", Msg: err.Error()}}
+  }
+  return nil
+}
+
+var (
+  current         Config
+  sources         map[string]string
+  changeFuncs     []func([]string)
+  mut             sync.RWMutex
+
+  // One reload at a time, change funcs included.
+  reloadMut       sync.Mutex
+)
+
+// Points the flag variables at the loaded settings, so reloads show through.
+func bind() {
+  LinkPath = &current.Master
+  output = &current.Output
+  StatusPort = &current.Status
+  DSCAddress = &current.DSC
+  DSCFallback = &current.DSCFallback
+  DDPMtu = &current.DDPMtu
+  DSCHttp = &current.DSCHttp
+  SetupPath = &current.Setup
+  AssetsPath = &current.Assets
+  FlightLogPath = &current.Flights
+  syncThrottle = &current.Sync
+  SyncDest = &current.SyncDest
+  syncRate = &current.SyncRate
+  SyncChunk = &current.SyncChunk
+  syncAPI = &current.Stream
+  DisableFlights = &current.NoFlights
+  LogCompress = &current.LogCompress
+  LogRotateSize = &current.LogRotate
+  LogQuota = &current.LogQuota
+  LogTrigger = &current.LogTrigger
+  LogPreTrigger = &current.LogPre
+  LogPostTrigger = &current.LogPost
+  DisableCode = &current.NoCode
+  CodeInterpreter = &current.CodePython
+  CodeUser = &current.CodeUser
+  CodeCPU = &current.CodeCPU
+  CodeMemory = &current.CodeMem
+  CodeTimeout = &current.CodeTimeout
+  DisableTerminal = &current.NoTerminal
+  CloudTerminal = &current.CloudTerminal
+  TerminalShell = &current.TermShell
+  Remote = &current.Remote
+  SimDatFile = &current.SimIdFile
+  SimId = &current.SimId
+  readySubsystems = &current.ReadySubsystems
+  readyCloud = &current.ReadyCloud
+  loggingFile = &current.Log
+  daemon = &current.Daemon
+  debugMode = &current.Debug
+  logLevelName = &current.LogLevel
+  logLevels = &current.LogLevels
+  logFormat = &current.LogFormat
+  logMaxSize = &current.LogMaxSize
+  logMaxAge = &current.LogMaxAge
+  logKeep = &current.LogKeep
+
+  LogProfile = current.LogProfile
+  SyncKey = current.SyncKey
+  SyncSecret = current.SyncSecret
+
+}
+
+// Builds the settings from every source. A setting that's the wrong type or
+// out of range is reported and left at what the source below it said, or its
+// default if that's bad too.
+func resolve() (*Config, map[string]string, settings.Errors) {
+  defaults := &Config{}
+  flag.VisitAll(func(f *flag.Flag) {
+    settings.Set(defaults, f.Name, f.DefValue)
+  })
+
+  c := *defaults
+  src := make(map[string]string)
+  var errs settings.Errors
+
+  layer := func(name string, set []string, e settings.Errors) {
+    for _, n := range set {
+      src[n] = name
+    }
+    errs = append(errs, e...)
+  }
+
+  if data, err := ioutil.ReadFile(*configFile); err == nil {
+    set, e := settings.Merge(&c, data)
+    layer(SOURCE_FILE, set, e)
+  } else if !os.IsNotExist(err) {
+    errs = append(errs, settings.FieldError{Path: *configFile, Msg: err.Error()})
+  }
+
+  set, e := settings.Env(&c, ENV_PREFIX, os.Environ())
+  layer(SOURCE_ENV, set, e)
+
+  set = nil
+  flag.Visit(func(f *flag.Flag) {
+    if err := settings.Set(&c, f.Name, f.Value.String()); err == nil {
+      set = append(set, f.Name)
+    }
+  })
+  layer(SOURCE_FLAG, set, nil)
+
+  invalid := settings.Validate(&c)
+  for _, e := range invalid {
+    settings.Copy(&c, defaults, []string{e.Path})
+    delete(src, e.Path)
+  }
+  errs = append(errs, invalid...)
+
+  for _, f := range settings.Fields(&c) {
+    if _, ok := src[f.Name]; !ok {
+      src[f.Name] = SOURCE_DEFAULT
+    }
+  }
+  return &c, src, errs
+}
+
+// Rereads every source. Settings that can change while running take effect
+// straight away and are returned in changed. Any others that changed are in
+// restart, and wait for the next start.
+func Reload() (changed, restart []string, errs settings.Errors) {
+  reloadMut.Lock()
+  defer reloadMut.Unlock()
+  return reload()
+}
+
+// Must be called with reloadMut held.
+func reload() (changed, restart []string, errs settings.Errors) {
+  c, src, errs := resolve()
+  for _, e := range errs {
+    Log(LOG_ERROR, "config: ", e.Error())
+  }
+
+  reload := make(map[string]bool)
+  for _, f := range settings.Fields(c) {
+    reload[f.Name] = f.Reload
+  }
+
+  mut.Lock()
+  for _, name := range settings.Diff(&current, c) {
+    if reload[name] {
+      changed = append(changed, name)
+      sources[name] = src[name]
+    } else {
+      restart = append(restart, name)
+    }
+  }
+  settings.Copy(&current, c, changed)
+  setLogLevel()
+  funcs := changeFuncs
+  mut.Unlock()
+
+  if len(changed) != 0 {
+    Log(LOG_INFO, "config: ", "Reloaded, changed", changed)
+    for _, f := range funcs {
+      f(changed)
+    }
+  }
+  if len(restart) != 0 {
+    Log(LOG_WARN, "config: ", "Changes that need a restart", restart)
+  }
+  return changed, restart, errs
+}
+
+// Checks and saves settings given as a JSON object to config.json, then
+// reloads. Nothing is saved if any setting is bad.
+func Patch(data []byte) (changed, restart []string, errs settings.Errors) {
+  // Two patches at once would each write back config.json without the other.
+  reloadMut.Lock()
+  defer reloadMut.Unlock()
+
+  mut.RLock()
+  next := current
+  mut.RUnlock()
+
+  set, errs := settings.Merge(&next, data)
+  if len(errs) != 0 {
+    return nil, nil, errs
+  }
+  if errs = settings.Validate(&next); len(errs) != 0 {
+    return nil, nil, errs
+  }
+
+  var patch, file map[string]json.RawMessage
+  json.Unmarshal(data, &patch)
+  if old, err := ioutil.ReadFile(*configFile); err == nil {
+    if err := json.Unmarshal(old, &file); err != nil {
+      return nil, nil, settings.Errors{{Path: *configFile, Msg: err.Error()}}
+    }
+  }
+  if file == nil {
+    file = make(map[string]json.RawMessage)
+  }
+  for _, name := range set {
+    file[name] = patch[name]
+  }
+
+  if err := writeFile(*configFile, file); err != nil {
+    return nil, nil, settings.Errors{{Path: *configFile, Msg: err.Error()}}
+  }
+
+  // Problems elsewhere in the sources are logged by Reload, they aren't this
+  // patch's.
+  changed, restart, _ = reload()
+  return changed, restart, nil
+}
+
+func writeFile(fpath string, file map[string]json.RawMessage) error {
+  data, err := json.MarshalIndent(file, "", "  ")
+  if err != nil {
+    return err
+  }
+
+  tmp, err := ioutil.TempFile(filepath.Dir(fpath), filepath.Base(fpath) + ".tmp")
+  if err != nil {
+    return err
+  }
+  defer os.Remove(tmp.Name())
+
+  if _, err := tmp.Write(append(data, '\n')); err != nil {
+    tmp.Close()
+    return err
+  }
+  if err := tmp.Close(); err != nil {
+    return err
+  }
+  return os.Rename(tmp.Name(), fpath)
+}
+
+// Called with the names of the settings that changed on each reload.
+func OnChange(f func(names []string)) {
+  mut.Lock()
+  defer mut.Unlock()
+  changeFuncs = append(changeFuncs, f)
+}
+
+// The settings in effect, secrets hidden, and where each came from.
+func Current() (map[string]interface{}, map[string]string) {
+  mut.RLock()
+  defer mut.RUnlock()
+
+  src := make(map[string]string, len(sources))
+  for k, v := range sources {
+    src[k] = v
+  }
+  return settings.Values(&current), src
+}
+
+// The settings in effect. The ones that can change while running are read
+// through this, or followed with OnChange, as the rest of current is rewritten
+// on reload.
+func Get() Config {
+  mut.RLock()
+  defer mut.RUnlock()
+  return current
+}
+
+// Where a setting's value came from, one of the SOURCE_ constants.
+func Source(name string) string {
+  mut.RLock()
+  defer mut.RUnlock()
+  return sources[name]
+}
+
+// The settings that can change while running.
+func Reloadable() []string {
+  var names []string
+  for _, f := range settings.Fields(&current) {
+    if f.Reload {
+      names = append(names, f.Name)
+    }
+  }
+  sort.Strings(names)
+  return names
+}
+
+// Whether name is among the names passed to an OnChange func.
+func Changed(names []string, name string) bool {
+  for _, n := range names {
+    if n == name {
+      return true
+    }
+  }
+  return false
+}
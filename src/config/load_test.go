@@ -0,0 +1,101 @@
+package config
+
+import (
+  "encoding/json"
+  "flag"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sync"
+  "testing"
+)
+
+func TestMain(m *testing.M) {
+  // Log to the console only.
+  flag.Set("log", "")
+  Init()
+  os.Exit(m.Run())
+}
+
+// Readers going through Get while settings are reloaded; run with -race.
+func TestReloadWhileReading(t *testing.T) {
+  dir, err := ioutil.TempDir("", "config")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  old := *configFile
+  *configFile = filepath.Join(dir, "config.json")
+  defer func() { *configFile = old }()
+
+  done := make(chan bool)
+  go func() {
+    for {
+      select {
+      case <-done:
+        return
+      default:
+        c := Get()
+        _ = c.Sync + len(c.ReadySubsystems)
+      }
+    }
+  }()
+
+  var seen []string
+  OnChange(func(names []string) {
+    seen = names
+  })
+
+  ioutil.WriteFile(*configFile, []byte(`{"sync": 2500, "readysubsystems": "heartbeat,gps", "status": 9000}`), 0600)
+  changed, restart, errs := Reload()
+  close(done)
+
+  if len(errs) != 0 {
+    t.Fatal(errs)
+  }
+  if !Changed(changed, "sync") || !Changed(changed, "readysubsystems") || !Changed(seen, "sync") {
+    t.Errorf("changed %v, OnChange got %v", changed, seen)
+  }
+  if !Changed(restart, "status") {
+    t.Errorf("restart %v", restart)
+  }
+  if c := Get(); c.Sync != 2500 || c.ReadySubsystems != "heartbeat,gps" || c.Status == 9000 {
+    t.Errorf("got sync %d, readysubsystems %q, status %d", c.Sync, c.ReadySubsystems, c.Status)
+  }
+}
+
+// Patches at once each land in config.json.
+func TestConcurrentPatch(t *testing.T) {
+  dir, err := ioutil.TempDir("", "config")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  old := *configFile
+  *configFile = filepath.Join(dir, "config.json")
+  defer func() { *configFile = old }()
+
+  patches := []string{`{"syncrate": 64}`, `{"stream": 500}`, `{"readycloud": true}`, `{"logpost": 7}`}
+  var wg sync.WaitGroup
+  for _, p := range patches {
+    wg.Add(1)
+    go func(p string) {
+      defer wg.Done()
+      if _, _, errs := Patch([]byte(p)); len(errs) != 0 {
+        t.Error(errs)
+      }
+    }(p)
+  }
+  wg.Wait()
+
+  data, _ := ioutil.ReadFile(*configFile)
+  var file map[string]interface{}
+  json.Unmarshal(data, &file)
+  for _, name := range []string{"syncrate", "stream", "readycloud", "logpost"} {
+    if _, ok := file[name]; !ok {
+      t.Errorf("%s lost from %s", name, data)
+    }
+  }
+}
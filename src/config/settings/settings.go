@@ -0,0 +1,299 @@
+// Typed settings built up from layers: defaults, a JSON file, environment
+// variables and flags, each overriding the last. Settings are the exported
+// fields of a struct, named by their json tag, with optional tags:
+//
+//   reload:"true"                 may change while running
+//   secret:"true"                 never shown by Values
+//   valid:"min=1,max=65535"       bounds for numbers
+//   valid:"oneof=none|gzip"       allowed strings
+package settings
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "reflect"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+const REDACTED = "********"
+
+// A setting that couldn't be used, with the path to it, like
+// "status" or "logprofile.HEARTBEAT".
+type FieldError struct {
+  Path      string  `json:"path"`
+  Msg       string  `json:"error"`
+}
+
+func (e FieldError) Error() string {
+  return e.Path + ": " + e.Msg
+}
+
+type Errors []FieldError
+
+func (e Errors) Error() string {
+  msgs := make([]string, len(e))
+  for i := range e {
+    msgs[i] = e[i].Error()
+  }
+  return strings.Join(msgs, "; ")
+}
+
+type Field struct {
+  Name      string
+  Reload    bool
+  Secret    bool
+
+  index     int
+  valid     string
+}
+
+// The settings of the struct v points to, in field order.
+func Fields(v interface{}) []Field {
+  t := reflect.TypeOf(v).Elem()
+  fields := make([]Field, 0, t.NumField())
+  for i := 0; i < t.NumField(); i++ {
+    f := t.Field(i)
+    name := strings.Split(f.Tag.Get("json"), ",")[0]
+    if name == "" || name == "-" || f.PkgPath != "" {
+      continue
+    }
+    fields = append(fields, Field{
+      Name: name,
+      Reload: f.Tag.Get("reload") == "true",
+      Secret: f.Tag.Get("secret") == "true",
+      index: i,
+      valid: f.Tag.Get("valid"),
+    })
+  }
+  return fields
+}
+
+func lookup(v interface{}, name string) (Field, reflect.Value, bool) {
+  for _, f := range Fields(v) {
+    if f.Name == name {
+      return f, reflect.ValueOf(v).Elem().Field(f.index), true
+    }
+  }
+  return Field{}, reflect.Value{}, false
+}
+
+// Sets one setting from text, as given in a flag or environment variable.
+func Set(v interface{}, name, value string) error {
+  _, fv, ok := lookup(v, name)
+  if !ok {
+    return FieldError{name, "unknown setting"}
+  }
+
+  switch fv.Kind() {
+  case reflect.String:
+    fv.SetString(value)
+  case reflect.Int:
+    n, err := strconv.Atoi(value)
+    if err != nil {
+      return FieldError{name, "must be a whole number"}
+    }
+    fv.SetInt(int64(n))
+  case reflect.Bool:
+    b, err := strconv.ParseBool(value)
+    if err != nil {
+      return FieldError{name, "must be true or false"}
+    }
+    fv.SetBool(b)
+  default:
+    // Anything else is given as JSON.
+    if err := decode(fv, []byte(value)); err != nil {
+      return FieldError{name, err.Error()}
+    }
+  }
+  return nil
+}
+
+// Sets the settings in a JSON object. Returns the names set, and an error for
+// each one that couldn't be, leaving it as it was.
+func Merge(v interface{}, data []byte) ([]string, Errors) {
+  var raw map[string]json.RawMessage
+  if err := json.Unmarshal(data, &raw); err != nil {
+    return nil, Errors{{"", "must be a JSON object: " + err.Error()}}
+  }
+
+  var set []string
+  var errs Errors
+  for _, name := range sortedKeys(raw) {
+    _, fv, ok := lookup(v, name)
+    if !ok {
+      errs = append(errs, FieldError{name, "unknown setting"})
+      continue
+    }
+    if err := decode(fv, raw[name]); err != nil {
+      errs = append(errs, FieldError{name, err.Error()})
+      continue
+    }
+    set = append(set, name)
+  }
+  return set, errs
+}
+
+func decode(fv reflect.Value, data []byte) error {
+  if bytes.Equal(bytes.TrimSpace(data), []byte("null")) {
+    return fmt.Errorf("can't be null")
+  }
+
+  nv := reflect.New(fv.Type())
+  if err := json.Unmarshal(data, nv.Interface()); err != nil {
+    return fmt.Errorf("must be %s", kindName(fv.Type()))
+  }
+  fv.Set(nv.Elem())
+  return nil
+}
+
+func kindName(t reflect.Type) string {
+  switch t.Kind() {
+  case reflect.String:
+    return "a string"
+  case reflect.Int:
+    return "a whole number"
+  case reflect.Bool:
+    return "true or false"
+  case reflect.Map:
+    return "an object"
+  case reflect.Slice:
+    return "a list"
+  }
+  return "a " + t.String()
+}
+
+// Sets the settings found in the environment, as prefix and the setting name
+// in upper case: DSLINK_SYNCRATE=64.
+func Env(v interface{}, prefix string, environ []string) ([]string, Errors) {
+  env := make(map[string]string)
+  for _, kv := range environ {
+    if i := strings.Index(kv, "="); i > 0 {
+      env[kv[:i]] = kv[i+1:]
+    }
+  }
+
+  var set []string
+  var errs Errors
+  for _, f := range Fields(v) {
+    val, ok := env[prefix + strings.ToUpper(f.Name)]
+    if !ok {
+      continue
+    }
+    if err := Set(v, f.Name, val); err != nil {
+      fe := err.(FieldError)
+      fe.Msg += " (from " + prefix + strings.ToUpper(f.Name) + ")"
+      errs = append(errs, fe)
+      continue
+    }
+    set = append(set, f.Name)
+  }
+  return set, errs
+}
+
+// For checks the valid tag can't express. Validate runs it after the tags.
+type Checker interface {
+  Check() Errors
+}
+
+// Checks every setting against its valid tag.
+func Validate(v interface{}) Errors {
+  var errs Errors
+  rv := reflect.ValueOf(v).Elem()
+  for _, f := range Fields(v) {
+    if f.valid == "" {
+      continue
+    }
+    if msg := check(rv.Field(f.index), f.valid); msg != "" {
+      errs = append(errs, FieldError{f.Name, msg})
+    }
+  }
+
+  if c, ok := v.(Checker); ok {
+    errs = append(errs, c.Check()...)
+  }
+  return errs
+}
+
+func check(fv reflect.Value, rules string) string {
+  for _, rule := range strings.Split(rules, ",") {
+    kv := strings.SplitN(rule, "=", 2)
+    if len(kv) != 2 {
+      continue
+    }
+
+    switch kv[0] {
+    case "min", "max":
+      if fv.Kind() != reflect.Int {
+        continue
+      }
+      bound, _ := strconv.ParseInt(kv[1], 10, 64)
+      if kv[0] == "min" && fv.Int() < bound {
+        return "must be at least " + kv[1]
+      }
+      if kv[0] == "max" && fv.Int() > bound {
+        return "must be at most " + kv[1]
+      }
+    case "oneof":
+      opts := strings.Split(kv[1], "|")
+      found := false
+      for _, o := range opts {
+        if fv.String() == o {
+          found = true
+        }
+      }
+      if !found {
+        return "must be one of " + strings.Join(opts, ", ")
+      }
+    }
+  }
+  return ""
+}
+
+// The names of the settings that differ between a and b.
+func Diff(a, b interface{}) []string {
+  av, bv := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+  var names []string
+  for _, f := range Fields(a) {
+    if !reflect.DeepEqual(av.Field(f.index).Interface(), bv.Field(f.index).Interface()) {
+      names = append(names, f.Name)
+    }
+  }
+  return names
+}
+
+// Copies the named settings from src to dst.
+func Copy(dst, src interface{}, names []string) {
+  dv, sv := reflect.ValueOf(dst).Elem(), reflect.ValueOf(src).Elem()
+  for _, name := range names {
+    if f, _, ok := lookup(dst, name); ok {
+      dv.Field(f.index).Set(sv.Field(f.index))
+    }
+  }
+}
+
+// Every setting by name, with secrets that are set hidden.
+func Values(v interface{}) map[string]interface{} {
+  rv := reflect.ValueOf(v).Elem()
+  vals := make(map[string]interface{})
+  for _, f := range Fields(v) {
+    fv := rv.Field(f.index)
+    if f.Secret && !fv.IsZero() {
+      vals[f.Name] = REDACTED
+    } else {
+      vals[f.Name] = fv.Interface()
+    }
+  }
+  return vals
+}
+
+func sortedKeys(m map[string]json.RawMessage) []string {
+  keys := make([]string, 0, len(m))
+  for k := range m {
+    keys = append(keys, k)
+  }
+  sort.Strings(keys)
+  return keys
+}
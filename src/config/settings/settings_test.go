@@ -0,0 +1,105 @@
+package settings
+
+import (
+  "reflect"
+  "testing"
+)
+
+type testConfig struct {
+  Master    string                  `json:"master"`
+  Status    int                     `json:"status" valid:"min=1,max=65535"`
+  Compress  string                  `json:"logcompress" valid:"oneof=none|gzip"`
+  Rate      int                     `json:"syncrate" reload:"true" valid:"min=0"`
+  Debug     bool                    `json:"debug" reload:"true"`
+  Secret    string                  `json:"syncsecret" secret:"true"`
+  Profile   map[string]interface{}  `json:"logprofile"`
+
+  unexported int
+}
+
+func (c *testConfig) Check() Errors {
+  if c.Master == "" {
+    return Errors{{"master", "can't be empty"}}
+  }
+  return nil
+}
+
+func defaults() *testConfig {
+  return &testConfig{Master: "127.0.0.1:14550", Status: 8080, Compress: "none"}
+}
+
+func TestLayers(t *testing.T) {
+  c := defaults()
+
+  set, errs := Merge(c, []byte(`{"status": 9090, "syncrate": 64, "logprofile": {"HEARTBEAT": 1}}`))
+  if len(errs) != 0 || !reflect.DeepEqual(set, []string{"logprofile", "status", "syncrate"}) {
+    t.Fatalf("got %v %v", set, errs)
+  }
+
+  set, errs = Env(c, "DSLINK_", []string{"PATH=/bin", "DSLINK_SYNCRATE=128", "DSLINK_DEBUG=true"})
+  if len(errs) != 0 || len(set) != 2 {
+    t.Fatalf("got %v %v", set, errs)
+  }
+
+  if err := Set(c, "master", "sim://"); err != nil {
+    t.Fatal(err)
+  }
+
+  if c.Master != "sim://" || c.Status != 9090 || c.Rate != 128 || !c.Debug || c.Profile["HEARTBEAT"] != 1.0 {
+    t.Errorf("got %+v", c)
+  }
+}
+
+func TestErrors(t *testing.T) {
+  c := defaults()
+
+  _, errs := Merge(c, []byte(`{"status": "high", "master": 5, "bogus": 1, "debug": null}`))
+  paths := make(map[string]string)
+  for _, e := range errs {
+    paths[e.Path] = e.Msg
+  }
+  if paths["status"] != "must be a whole number" || paths["master"] != "must be a string" || paths["bogus"] != "unknown setting" || paths["debug"] == "" {
+    t.Errorf("got %v", errs)
+  }
+  // Bad values leave the setting alone.
+  if c.Status != 8080 || c.Master != "127.0.0.1:14550" {
+    t.Errorf("got %+v", c)
+  }
+
+  if _, errs := Env(c, "DSLINK_", []string{"DSLINK_STATUS=x"}); len(errs) != 1 || errs[0].Path != "status" {
+    t.Errorf("got %v", errs)
+  }
+
+  c.Status = 70000
+  c.Compress = "zip"
+  c.Rate = -1
+  c.Master = ""
+  errs = Validate(c)
+  if len(errs) != 4 || errs[3].Path != "master" || errs[0].Error() != "status: must be at most 65535" || errs[1].Error() != "logcompress: must be one of none, gzip" {
+    t.Errorf("got %v", errs)
+  }
+}
+
+func TestDiffAndValues(t *testing.T) {
+  a, b := defaults(), defaults()
+  b.Rate = 10
+  b.Secret = "hunter2"
+
+  diff := Diff(a, b)
+  if !reflect.DeepEqual(diff, []string{"syncrate", "syncsecret"}) {
+    t.Fatalf("got %v", diff)
+  }
+
+  Copy(a, b, []string{"syncrate"})
+  if a.Rate != 10 || a.Secret != "" {
+    t.Errorf("got %+v", a)
+  }
+
+  vals := Values(b)
+  if vals["syncsecret"] != REDACTED || vals["syncrate"] != 10 {
+    t.Errorf("got %v", vals)
+  }
+  if _, ok := vals["unexported"]; ok {
+    t.Error("unexported field listed")
+  }
+}
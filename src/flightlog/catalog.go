@@ -0,0 +1,256 @@
+package flightlog
+
+import (
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+const (
+  // Hidden, so the syncer's "Flight*" glob never picks it up.
+  INDEX_FILE = ".index.json"
+)
+
+type Entry struct {
+  Name      string    `json:"name"`
+  Size      int64     `json:"size"`
+  ModTime   time.Time `json:"modTime"`
+  Synced    bool      `json:"synced"`
+  SyncedAt  time.Time `json:"syncedAt,omitempty"`
+  Summary   Summary   `json:"summary"`
+
+  // Seen while it was being written, so the summary is out of date.
+  partial   bool
+}
+
+// Catalog of the flights in a directory. Summaries are expensive to work out on
+// the Edison, so they're cached in an index next to the logs and only redone
+// when a log's size or modification time changes.
+type Catalog struct {
+  dir       string
+  mut       sync.Mutex
+  entries   map[string]*Entry
+
+  // The log being written, summarized once it's closed.
+  active    string
+}
+
+func NewCatalog(dir string) *Catalog {
+  c := &Catalog{
+    dir: dir,
+    entries: make(map[string]*Entry),
+  }
+
+  if data, err := ioutil.ReadFile(filepath.Join(dir, INDEX_FILE)); err == nil {
+    var entries []*Entry
+    if json.Unmarshal(data, &entries) == nil {
+      for _, e := range entries {
+        c.entries[e.Name] = e
+      }
+    }
+  }
+
+  return c
+}
+
+// Sets the log being written, "" once it's closed.
+func (c *Catalog) SetActive(name string) {
+  c.mut.Lock()
+  c.active = name
+  c.mut.Unlock()
+}
+
+func (c *Catalog) Dir() string {
+  return c.dir
+}
+
+// Checks name refers to a log in the catalog directory and returns its path.
+func (c *Catalog) Path(name string) (string, error) {
+  if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+    return "", fmt.Errorf("Invalid flight name %s", name)
+  }
+
+  fpath := filepath.Join(c.dir, name)
+  if _, err := os.Stat(fpath); err != nil {
+    return "", fmt.Errorf("Flight %s not found.", name)
+  }
+
+  return fpath, nil
+}
+
+// Lists every flight, newest first, bringing the index up to date on the way.
+func (c *Catalog) List() ([]Entry, error) {
+  c.mut.Lock()
+  defer c.mut.Unlock()
+
+  if err := c.refresh(); err != nil {
+    return nil, err
+  }
+
+  list := make([]Entry, 0, len(c.entries))
+  for _, e := range c.entries {
+    list = append(list, *e)
+  }
+
+  sort.Slice(list, func(i, j int) bool {
+    return list[i].ModTime.After(list[j].ModTime)
+  })
+
+  return list, nil
+}
+
+func (c *Catalog) Get(name string) (Entry, error) {
+  c.mut.Lock()
+  defer c.mut.Unlock()
+
+  if err := c.refresh(); err != nil {
+    return Entry{}, err
+  }
+
+  if e, ok := c.entries[name]; ok {
+    return *e, nil
+  }
+  return Entry{}, fmt.Errorf("Flight %s not found.", name)
+}
+
+func (c *Catalog) Delete(name string) error {
+  fpath, err := c.Path(name)
+  if err != nil {
+    return err
+  }
+
+  c.mut.Lock()
+  defer c.mut.Unlock()
+
+  if err := os.Remove(fpath); err != nil {
+    return err
+  }
+
+  delete(c.entries, name)
+  return c.save()
+}
+
+// Records that a flight made it to the cloud. The log is kept around.
+func (c *Catalog) MarkSynced(name string) error {
+  c.mut.Lock()
+  defer c.mut.Unlock()
+
+  e, ok := c.entries[name]
+  if !ok {
+    if err := c.refresh(); err != nil {
+      return err
+    }
+    if e, ok = c.entries[name]; !ok {
+      return fmt.Errorf("Flight %s not found.", name)
+    }
+  }
+
+  e.Synced = true
+  e.SyncedAt = time.Now()
+  return c.save()
+}
+
+func (c *Catalog) IsSynced(name string) bool {
+  c.mut.Lock()
+  defer c.mut.Unlock()
+
+  e, ok := c.entries[name]
+  return ok && e.Synced
+}
+
+// Rescans the directory. Must be called with the lock held.
+func (c *Catalog) refresh() error {
+  files, err := filepath.Glob(filepath.Join(c.dir, "Flight*"))
+  if err != nil {
+    return err
+  }
+
+  changed := false
+  seen := make(map[string]bool)
+
+  for _, f := range files {
+    info, err := os.Stat(f)
+    if err != nil || info.IsDir() {
+      continue
+    }
+
+    name := info.Name()
+    seen[name] = true
+
+    old, ok := c.entries[name]
+    if ok && !old.partial && old.Size == info.Size() && old.ModTime.Equal(info.ModTime()) {
+      continue
+    }
+
+    e := &Entry{
+      Name: name,
+      Size: info.Size(),
+      ModTime: info.ModTime(),
+    }
+
+    // a log still being written changes under us, keep its sync state anyway
+    if ok {
+      e.Synced, e.SyncedAt = old.Synced, old.SyncedAt
+    }
+
+    if name == c.active {
+      // Reading it all again on every look adds up while it grows, so the
+      // summary waits until it's closed.
+      e.Summary, e.partial = Summary{BatteryStart: -1, BatteryEnd: -1, Modes: []string{}}, true
+      if ok {
+        e.Summary = old.Summary
+      }
+    } else {
+      // a damaged log still gets a summary of whatever could be read
+      e.Summary, _ = SummarizeFile(f)
+    }
+
+    // The index only needs saving for a log being written when it first shows.
+    c.entries[name] = e
+    changed = changed || !e.partial || !ok
+  }
+
+  for name := range c.entries {
+    if !seen[name] {
+      delete(c.entries, name)
+      changed = true
+    }
+  }
+
+  if changed {
+    return c.save()
+  }
+  return nil
+}
+
+// Writes the index. Must be called with the lock held.
+func (c *Catalog) save() error {
+  list := make([]*Entry, 0, len(c.entries))
+  for _, e := range c.entries {
+    if e.partial {
+      // Never matches the file, so it's summarized after a restart if it
+      // wasn't before.
+      cp := *e
+      cp.ModTime = time.Time{}
+      e = &cp
+    }
+    list = append(list, e)
+  }
+
+  data, err := json.Marshal(list)
+  if err != nil {
+    return err
+  }
+
+  tmp := filepath.Join(c.dir, INDEX_FILE + ".tmp")
+  if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+    return err
+  }
+  return os.Rename(tmp, filepath.Join(c.dir, INDEX_FILE))
+}
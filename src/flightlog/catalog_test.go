@@ -0,0 +1,138 @@
+package flightlog
+
+import (
+  "bytes"
+  "io/ioutil"
+  "math"
+  "os"
+  "path/filepath"
+  "reflect"
+  "testing"
+  "time"
+
+  "mavlink/parser"
+)
+
+func packet(t *testing.T, m mavlink.Message) []byte {
+  var buf bytes.Buffer
+  if err := mavlink.NewEncoder(&buf).Encode(1, 1, m); err != nil {
+    t.Fatal(err)
+  }
+  return buf.Bytes()
+}
+
+// A short flight: climb to 20m, fly ~111m north in Position, land.
+func testFlight(t *testing.T, dir string) string {
+  var buf bytes.Buffer
+  tw := NewTlogWriter(&buf)
+  start := time.Date(2016, 8, 1, 12, 0, 0, 0, time.UTC)
+
+  msgs := []mavlink.Message{
+    &mavlink.Heartbeat{CustomMode: 4 << 16 | 2 << 24},
+    &mavlink.SysStatus{BatteryRemaining: 95},
+    &mavlink.GlobalPositionInt{Lat: 377749000, Lon: -1224194000, RelativeAlt: 0},
+    &mavlink.GlobalPositionInt{Lat: 377749000, Lon: -1224194000, RelativeAlt: 20000},
+    &mavlink.Heartbeat{CustomMode: 3 << 16},
+    &mavlink.GlobalPositionInt{Lat: 377759000, Lon: -1224194000, RelativeAlt: 19000},
+    &mavlink.Heartbeat{CustomMode: 4 << 16 | 6 << 24},
+    &mavlink.SysStatus{BatteryRemaining: 80},
+  }
+
+  for i, m := range msgs {
+    if err := tw.Write(start.Add(time.Duration(i) * 10 * time.Second), packet(t, m)); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  name := "Flight Mon Aug  1 12:00:00 UTC 2016.tlog"
+  if err := ioutil.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0644); err != nil {
+    t.Fatal(err)
+  }
+  return name
+}
+
+func TestCatalog(t *testing.T) {
+  dir, err := ioutil.TempDir("", "catalog")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  name := testFlight(t, dir)
+  cat := NewCatalog(dir)
+
+  list, err := cat.List()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(list) != 1 || list[0].Name != name {
+    t.Fatalf("got %+v", list)
+  }
+
+  sum := list[0].Summary
+  if sum.Duration != 70 || sum.Packets != 8 {
+    t.Errorf("duration %v packets %d", sum.Duration, sum.Packets)
+  }
+  if sum.MaxAltitude != 20 {
+    t.Errorf("max altitude %v", sum.MaxAltitude)
+  }
+  if math.Abs(sum.Distance - 111.2) > 1 {
+    t.Errorf("distance %v", sum.Distance)
+  }
+  if sum.BatteryStart != 95 || sum.BatteryEnd != 80 || sum.BatteryUsed != 15 {
+    t.Errorf("battery %d -> %d (%d)", sum.BatteryStart, sum.BatteryEnd, sum.BatteryUsed)
+  }
+  if want := []string{"Takeoff", "Position", "Land"}; !reflect.DeepEqual(sum.Modes, want) {
+    t.Errorf("modes %v, want %v", sum.Modes, want)
+  }
+
+  // Sync state survives a restart through the index.
+  if err := cat.MarkSynced(name); err != nil {
+    t.Fatal(err)
+  }
+  if !NewCatalog(dir).IsSynced(name) {
+    t.Errorf("sync state not persisted")
+  }
+
+  if _, err := cat.Path("../" + name); err == nil {
+    t.Errorf("path escaping the catalog was accepted")
+  }
+
+  if err := cat.Delete(name); err != nil {
+    t.Fatal(err)
+  }
+  if list, _ := cat.List(); len(list) != 0 {
+    t.Errorf("%d flights left after delete", len(list))
+  }
+}
+
+// The log being written is listed, but only summarized once it's closed.
+func TestActiveLog(t *testing.T) {
+  dir, err := ioutil.TempDir("", "catalog")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  name := testFlight(t, dir)
+  cat := NewCatalog(dir)
+  cat.SetActive(name)
+
+  list, err := cat.List()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(list) != 1 || list[0].Summary.Packets != 0 || list[0].Size == 0 {
+    t.Fatalf("got %+v", list)
+  }
+
+  // Not trusted after a restart either.
+  if e, err := NewCatalog(dir).Get(name); err != nil || e.Summary.Packets != 8 {
+    t.Errorf("after a restart got %+v %v", e, err)
+  }
+
+  cat.SetActive("")
+  if e, err := cat.Get(name); err != nil || e.Summary.Packets != 8 || e.Summary.Duration != 70 {
+    t.Errorf("after closing got %+v %v", e, err)
+  }
+}
@@ -0,0 +1,14 @@
+// +build !windows
+
+package flightlog
+
+import "syscall"
+
+// Bytes free for unprivileged writes on the filesystem holding dir.
+func DiskFree(dir string) (int64, error) {
+  var st syscall.Statfs_t
+  if err := syscall.Statfs(dir, &st); err != nil {
+    return 0, err
+  }
+  return int64(st.Bavail) * int64(st.Bsize), nil
+}
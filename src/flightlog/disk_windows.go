@@ -0,0 +1,10 @@
+// +build windows
+
+package flightlog
+
+import "math"
+
+// Free space isn't checked on windows, only the quota applies.
+func DiskFree(dir string) (int64, error) {
+  return math.MaxInt64, nil
+}
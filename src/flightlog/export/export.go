@@ -0,0 +1,368 @@
+// Package export turns flight logs into formats other tools understand: GPX,
+// KML and GeoJSON tracks built from GLOBAL_POSITION_INT, and CSV tables with one
+// row per packet of a given message.
+package export
+
+import (
+  "archive/zip"
+  "encoding/csv"
+  "encoding/json"
+  "encoding/xml"
+  "fmt"
+  "io"
+  "reflect"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+
+  "flightlog"
+  "mavlink/parser"
+)
+
+const (
+  FORMAT_GPX = "gpx"
+  FORMAT_KML = "kml"
+  FORMAT_GEOJSON = "geojson"
+  FORMAT_CSV = "csv"
+
+  CREATOR = "Dronesmith Engine"
+)
+
+// Content type and file extension for each format. CSV without a message is a
+// zip of every table.
+var Formats = map[string][2]string{
+  FORMAT_GPX:     {"application/gpx+xml", ".gpx"},
+  FORMAT_KML:     {"application/vnd.google-earth.kml+xml", ".kml"},
+  FORMAT_GEOJSON: {"application/geo+json", ".geojson"},
+  FORMAT_CSV:     {"text/csv", ".csv"},
+}
+
+// Messages that can be exported as CSV. These are the ones fmulink keeps an eye
+// on, so they're what ends up in the logs.
+var tables = map[uint8]func() mavlink.Message{
+  mavlink.MSG_ID_HEARTBEAT:                   func() mavlink.Message { return &mavlink.Heartbeat{} },
+  mavlink.MSG_ID_SYS_STATUS:                  func() mavlink.Message { return &mavlink.SysStatus{} },
+  mavlink.MSG_ID_GPS_RAW_INT:                 func() mavlink.Message { return &mavlink.GpsRawInt{} },
+  mavlink.MSG_ID_ATTITUDE:                    func() mavlink.Message { return &mavlink.Attitude{} },
+  mavlink.MSG_ID_LOCAL_POSITION_NED:          func() mavlink.Message { return &mavlink.LocalPositionNed{} },
+  mavlink.MSG_ID_GLOBAL_POSITION_INT:         func() mavlink.Message { return &mavlink.GlobalPositionInt{} },
+  mavlink.MSG_ID_VFR_HUD:                     func() mavlink.Message { return &mavlink.VfrHud{} },
+  mavlink.MSG_ID_HIGHRES_IMU:                 func() mavlink.Message { return &mavlink.HighresImu{} },
+  mavlink.MSG_ID_BATTERY_STATUS:              func() mavlink.Message { return &mavlink.BatteryStatus{} },
+  mavlink.MSG_ID_RC_CHANNELS:                 func() mavlink.Message { return &mavlink.RcChannels{} },
+  mavlink.MSG_ID_SERVO_OUTPUT_RAW:            func() mavlink.Message { return &mavlink.ServoOutputRaw{} },
+  mavlink.MSG_ID_ATTITUDE_TARGET:             func() mavlink.Message { return &mavlink.AttitudeTarget{} },
+  mavlink.MSG_ID_POSITION_TARGET_LOCAL_NED:   func() mavlink.Message { return &mavlink.PositionTargetLocalNed{} },
+  mavlink.MSG_ID_POSITION_TARGET_GLOBAL_INT:  func() mavlink.Message { return &mavlink.PositionTargetGlobalInt{} },
+  mavlink.MSG_ID_ACTUATOR_CONTROL_TARGET:     func() mavlink.Message { return &mavlink.ActuatorControlTarget{} },
+  mavlink.MSG_ID_ALTITUDE:                    func() mavlink.Message { return &mavlink.Altitude{} },
+  mavlink.MSG_ID_EXTENDED_SYS_STATE:          func() mavlink.Message { return &mavlink.ExtendedSysState{} },
+  mavlink.MSG_ID_HOME_POSITION:               func() mavlink.Message { return &mavlink.HomePosition{} },
+  mavlink.MSG_ID_RADIO_STATUS:                func() mavlink.Message { return &mavlink.RadioStatus{} },
+  mavlink.MSG_ID_STATUSTEXT:                  func() mavlink.Message { return &mavlink.Statustext{} },
+  mavlink.MSG_ID_COMMAND_ACK:                 func() mavlink.Message { return &mavlink.CommandAck{} },
+}
+
+type Point struct {
+  Time      time.Time
+  Lat       float64
+  Lon       float64
+  Alt       float64 // AMSL
+  RelAlt    float64
+}
+
+// The vehicle's path, one point per GLOBAL_POSITION_INT with a fix.
+func Track(recs []*flightlog.Record) []Point {
+  var track []Point
+
+  for _, rec := range recs {
+    pkt, err := mavlink.DecodeBytes(rec.Packet)
+    if err != nil || pkt.MsgID != mavlink.MSG_ID_GLOBAL_POSITION_INT {
+      continue
+    }
+
+    var m mavlink.GlobalPositionInt
+    if m.Unpack(pkt) != nil || (m.Lat == 0 && m.Lon == 0) {
+      continue
+    }
+
+    track = append(track, Point{
+      Time: rec.Time,
+      Lat: float64(m.Lat) / 1e7,
+      Lon: float64(m.Lon) / 1e7,
+      Alt: float64(m.Alt) / 1000,
+      RelAlt: float64(m.RelativeAlt) / 1000,
+    })
+  }
+
+  return track
+}
+
+// Writes the log in the given format. msg only applies to CSV, and picks the
+// table by message name (e.g. "GLOBAL_POSITION_INT" or "GlobalPositionInt").
+func Write(w io.Writer, format, name, msg string, recs []*flightlog.Record) error {
+  switch format {
+  case FORMAT_GPX:
+    return GPX(w, name, recs)
+  case FORMAT_KML:
+    return KML(w, name, recs)
+  case FORMAT_GEOJSON:
+    return GeoJSON(w, name, recs)
+  case FORMAT_CSV:
+    if msg == "" {
+      return CSVZip(w, recs)
+    }
+    return CSV(w, msg, recs)
+  }
+
+  return fmt.Errorf("Unknown export format %s", format)
+}
+
+// =============================================================================
+// GPX
+// =============================================================================
+
+type gpxPoint struct {
+  Lat   float64 `xml:"lat,attr"`
+  Lon   float64 `xml:"lon,attr"`
+  Ele   float64 `xml:"ele"`
+  Time  string  `xml:"time"`
+}
+
+type gpxDoc struct {
+  XMLName xml.Name    `xml:"gpx"`
+  Xmlns   string      `xml:"xmlns,attr"`
+  Version string      `xml:"version,attr"`
+  Creator string      `xml:"creator,attr"`
+  Name    string      `xml:"trk>name"`
+  Points  []gpxPoint  `xml:"trk>trkseg>trkpt"`
+}
+
+func GPX(w io.Writer, name string, recs []*flightlog.Record) error {
+  doc := gpxDoc{
+    Xmlns: "http://www.topografix.com/GPX/1/1",
+    Version: "1.1",
+    Creator: CREATOR,
+    Name: name,
+  }
+
+  for _, p := range Track(recs) {
+    doc.Points = append(doc.Points, gpxPoint{p.Lat, p.Lon, p.Alt, p.Time.UTC().Format(time.RFC3339Nano)})
+  }
+
+  return writeXML(w, doc)
+}
+
+// =============================================================================
+// KML
+// =============================================================================
+
+type kmlDoc struct {
+  XMLName       xml.Name  `xml:"kml"`
+  Xmlns         string    `xml:"xmlns,attr"`
+  Name          string    `xml:"Document>name"`
+  PlaceName     string    `xml:"Document>Placemark>name"`
+  Extrude       int       `xml:"Document>Placemark>LineString>extrude"`
+  AltitudeMode  string    `xml:"Document>Placemark>LineString>altitudeMode"`
+  Coordinates   string    `xml:"Document>Placemark>LineString>coordinates"`
+}
+
+func KML(w io.Writer, name string, recs []*flightlog.Record) error {
+  coords := make([]string, 0)
+  for _, p := range Track(recs) {
+    coords = append(coords, fmt.Sprintf("%.7f,%.7f,%.2f", p.Lon, p.Lat, p.Alt))
+  }
+
+  return writeXML(w, kmlDoc{
+    Xmlns: "http://www.opengis.net/kml/2.2",
+    Name: name,
+    PlaceName: name,
+    Extrude: 1,
+    AltitudeMode: "absolute",
+    Coordinates: strings.Join(coords, " "),
+  })
+}
+
+func writeXML(w io.Writer, doc interface{}) error {
+  if _, err := io.WriteString(w, xml.Header); err != nil {
+    return err
+  }
+
+  enc := xml.NewEncoder(w)
+  enc.Indent("", "  ")
+  if err := enc.Encode(doc); err != nil {
+    return err
+  }
+  _, err := io.WriteString(w, "\n")
+  return err
+}
+
+// =============================================================================
+// GeoJSON
+// =============================================================================
+
+func GeoJSON(w io.Writer, name string, recs []*flightlog.Record) error {
+  track := Track(recs)
+  coords := make([][3]float64, len(track))
+  times := make([]string, len(track))
+
+  for i, p := range track {
+    coords[i] = [3]float64{p.Lon, p.Lat, p.Alt}
+    times[i] = p.Time.UTC().Format(time.RFC3339Nano)
+  }
+
+  doc := map[string]interface{}{
+    "type": "FeatureCollection",
+    "features": []interface{}{
+      map[string]interface{}{
+        "type": "Feature",
+        "geometry": map[string]interface{}{
+          "type": "LineString",
+          "coordinates": coords,
+        },
+        "properties": map[string]interface{}{
+          "name": name,
+          "times": times,
+        },
+      },
+    },
+  }
+
+  return json.NewEncoder(w).Encode(doc)
+}
+
+// =============================================================================
+// CSV
+// =============================================================================
+
+func normalize(name string) string {
+  return strings.ToLower(strings.Replace(name, "_", "", -1))
+}
+
+// Finds the table for a message name, in either MAVLink or Go spelling.
+func lookup(msg string) (uint8, error) {
+  for id, mk := range tables {
+    if normalize(mk().MsgName()) == normalize(msg) {
+      return id, nil
+    }
+  }
+  return 0, fmt.Errorf("Can't export message %s", msg)
+}
+
+// Column names for a message struct. Arrays get one column per element, except
+// byte arrays which are text.
+func header(t reflect.Type) []string {
+  cols := []string{"time"}
+
+  for i := 0; i < t.NumField(); i++ {
+    f := t.Field(i)
+    if f.Type.Kind() == reflect.Array && f.Type.Elem().Kind() != reflect.Uint8 {
+      for j := 0; j < f.Type.Len(); j++ {
+        cols = append(cols, f.Name + "[" + strconv.Itoa(j) + "]")
+      }
+    } else {
+      cols = append(cols, f.Name)
+    }
+  }
+
+  return cols
+}
+
+func cell(v reflect.Value) string {
+  switch v.Kind() {
+  case reflect.Float32, reflect.Float64:
+    return strconv.FormatFloat(v.Float(), 'g', -1, 64)
+  case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+    return strconv.FormatInt(v.Int(), 10)
+  default:
+    return strconv.FormatUint(v.Uint(), 10)
+  }
+}
+
+func row(t time.Time, v reflect.Value) []string {
+  cols := []string{t.UTC().Format(time.RFC3339Nano)}
+
+  for i := 0; i < v.NumField(); i++ {
+    f := v.Field(i)
+    if f.Kind() != reflect.Array {
+      cols = append(cols, cell(f))
+    } else if f.Type().Elem().Kind() == reflect.Uint8 {
+      b := make([]byte, f.Len())
+      reflect.Copy(reflect.ValueOf(b), f)
+      cols = append(cols, strings.TrimRight(string(b), "\x00"))
+    } else {
+      for j := 0; j < f.Len(); j++ {
+        cols = append(cols, cell(f.Index(j)))
+      }
+    }
+  }
+
+  return cols
+}
+
+func writeTable(w io.Writer, id uint8, recs []*flightlog.Record) error {
+  cw := csv.NewWriter(w)
+  if err := cw.Write(header(reflect.TypeOf(tables[id]()).Elem())); err != nil {
+    return err
+  }
+
+  for _, rec := range recs {
+    pkt, err := mavlink.DecodeBytes(rec.Packet)
+    if err != nil || pkt.MsgID != id {
+      continue
+    }
+
+    m := tables[id]()
+    if m.Unpack(pkt) != nil {
+      continue
+    }
+
+    if err := cw.Write(row(rec.Time, reflect.ValueOf(m).Elem())); err != nil {
+      return err
+    }
+  }
+
+  cw.Flush()
+  return cw.Error()
+}
+
+// One row per packet of msg.
+func CSV(w io.Writer, msg string, recs []*flightlog.Record) error {
+  id, err := lookup(msg)
+  if err != nil {
+    return err
+  }
+  return writeTable(w, id, recs)
+}
+
+// A zip with a CSV for every exportable message in the log.
+func CSVZip(w io.Writer, recs []*flightlog.Record) error {
+  present := make(map[uint8]bool)
+  for _, rec := range recs {
+    if len(rec.Packet) > 5 {
+      if _, ok := tables[rec.Packet[5]]; ok {
+        present[rec.Packet[5]] = true
+      }
+    }
+  }
+
+  ids := make([]int, 0, len(present))
+  for id := range present {
+    ids = append(ids, int(id))
+  }
+  sort.Ints(ids)
+
+  zw := zip.NewWriter(w)
+  for _, id := range ids {
+    f, err := zw.Create(tables[uint8(id)]().MsgName() + ".csv")
+    if err != nil {
+      return err
+    }
+    if err := writeTable(f, uint8(id), recs); err != nil {
+      return err
+    }
+  }
+
+  return zw.Close()
+}
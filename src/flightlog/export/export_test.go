@@ -0,0 +1,122 @@
+package export
+
+import (
+  "archive/zip"
+  "bytes"
+  "encoding/csv"
+  "encoding/json"
+  "encoding/xml"
+  "strings"
+  "testing"
+  "time"
+
+  "flightlog"
+  "mavlink/parser"
+)
+
+func testLog(t *testing.T) []*flightlog.Record {
+  start := time.Date(2016, 8, 1, 12, 0, 0, 0, time.UTC)
+  msgs := []mavlink.Message{
+    &mavlink.Heartbeat{CustomMode: 3 << 16},
+    &mavlink.GlobalPositionInt{Lat: 0, Lon: 0}, // no fix yet
+    &mavlink.GlobalPositionInt{Lat: 377749000, Lon: -1224194000, Alt: 10000},
+    &mavlink.Statustext{Severity: 6, Text: [50]byte{'h', 'i'}},
+    &mavlink.GlobalPositionInt{Lat: 377750000, Lon: -1224195000, Alt: 30000, RelativeAlt: 20000},
+  }
+
+  var recs []*flightlog.Record
+  for i, m := range msgs {
+    var buf bytes.Buffer
+    if err := mavlink.NewEncoder(&buf).Encode(1, 1, m); err != nil {
+      t.Fatal(err)
+    }
+    recs = append(recs, &flightlog.Record{Time: start.Add(time.Duration(i) * time.Second), Packet: buf.Bytes()})
+  }
+  return recs
+}
+
+func TestTracks(t *testing.T) {
+  recs := testLog(t)
+
+  track := Track(recs)
+  if len(track) != 2 || track[1].Lat != 37.775 || track[1].Alt != 30 || track[1].RelAlt != 20 {
+    t.Fatalf("track %+v", track)
+  }
+
+  var buf bytes.Buffer
+  if err := Write(&buf, FORMAT_GPX, "test", "", recs); err != nil {
+    t.Fatal(err)
+  }
+  var gpx gpxDoc
+  if err := xml.Unmarshal(buf.Bytes(), &gpx); err != nil || len(gpx.Points) != 2 || gpx.Points[0].Time != "2016-08-01T12:00:02Z" {
+    t.Errorf("gpx %v %+v", err, gpx)
+  }
+
+  buf.Reset()
+  if err := Write(&buf, FORMAT_KML, "test", "", recs); err != nil {
+    t.Fatal(err)
+  }
+  if !strings.Contains(buf.String(), "<coordinates>-122.4194000,37.7749000,10.00 -122.4195000,37.7750000,30.00</coordinates>") {
+    t.Errorf("kml %s", buf.String())
+  }
+
+  buf.Reset()
+  if err := Write(&buf, FORMAT_GEOJSON, "test", "", recs); err != nil {
+    t.Fatal(err)
+  }
+  var geo struct {
+    Features []struct {
+      Geometry struct {
+        Coordinates [][3]float64
+      }
+    }
+  }
+  if err := json.Unmarshal(buf.Bytes(), &geo); err != nil || len(geo.Features) != 1 || len(geo.Features[0].Geometry.Coordinates) != 2 {
+    t.Errorf("geojson %v %s", err, buf.String())
+  }
+}
+
+func TestCSV(t *testing.T) {
+  recs := testLog(t)
+
+  var buf bytes.Buffer
+  if err := Write(&buf, FORMAT_CSV, "test", "GLOBAL_POSITION_INT", recs); err != nil {
+    t.Fatal(err)
+  }
+
+  rows, err := csv.NewReader(&buf).ReadAll()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(rows) != 4 || rows[0][0] != "time" || rows[0][2] != "Lat" || rows[3][2] != "377750000" {
+    t.Errorf("rows %v", rows)
+  }
+
+  if err := CSV(&buf, "NOT_A_MESSAGE", recs); err == nil {
+    t.Errorf("unknown message accepted")
+  }
+
+  buf.Reset()
+  if err := Write(&buf, FORMAT_CSV, "test", "", recs); err != nil {
+    t.Fatal(err)
+  }
+
+  zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  var names []string
+  for _, f := range zr.File {
+    names = append(names, f.Name)
+  }
+  if strings.Join(names, ",") != "Heartbeat.csv,GlobalPositionInt.csv,Statustext.csv" {
+    t.Errorf("zip has %v", names)
+  }
+
+  f, _ := zr.File[2].Open()
+  rows, _ = csv.NewReader(f).ReadAll()
+  if len(rows) != 2 || rows[1][2] != "hi" {
+    t.Errorf("statustext rows %v", rows)
+  }
+}
@@ -0,0 +1,147 @@
+// Package flightlog reads and writes the flight logs kept by fmulink's
+// FlightSaver.
+package flightlog
+
+import (
+  "bufio"
+  "bytes"
+  "fmt"
+  "io"
+  "time"
+)
+
+const (
+  // time.Time.MarshalBinary versions. V2 carries a seconds offset and is a
+  // byte longer, it only shows up for zones with odd historical offsets.
+  timeV1 = 1
+  timeV2 = 2
+  timeV1Len = 15
+  timeV2Len = 16
+
+  mavStart = 0xFE
+  mavOverhead = 8 // start, len, seq, sys, comp, msgid + crc
+)
+
+var (
+  ErrBadRecord = fmt.Errorf("Malformed flight log record.")
+)
+
+// A single packet from a flight log, along with the time it was received.
+type Record struct {
+  Time    time.Time
+  Packet  []byte
+}
+
+// Reads the legacy "Flight <date>.log" format: a time.Time in MarshalBinary
+// form followed by a raw MAVLink v1 frame, repeated until the end of the file.
+type LegacyReader struct {
+  r       *bufio.Reader
+}
+
+func NewLegacyReader(r io.Reader) *LegacyReader {
+  return &LegacyReader{bufio.NewReader(r)}
+}
+
+// Returns the next record, or io.EOF once the log is exhausted. A record cut
+// short at the end of the file (the saver was killed mid write) is also EOF.
+func (lr *LegacyReader) Next() (*Record, error) {
+  ver, err := lr.r.ReadByte()
+  if err != nil {
+    return nil, err
+  }
+
+  var ts []byte
+  switch ver {
+  case timeV1:
+    ts = make([]byte, timeV1Len)
+  case timeV2:
+    ts = make([]byte, timeV2Len)
+  default:
+    return nil, ErrBadRecord
+  }
+
+  ts[0] = ver
+  if _, err := io.ReadFull(lr.r, ts[1:]); err != nil {
+    return nil, truncated(err)
+  }
+
+  var rec Record
+  if err := rec.Time.UnmarshalBinary(ts); err != nil {
+    return nil, ErrBadRecord
+  }
+
+  hdr := make([]byte, 2)
+  if _, err := io.ReadFull(lr.r, hdr); err != nil {
+    return nil, truncated(err)
+  } else if hdr[0] != mavStart {
+    return nil, ErrBadRecord
+  }
+
+  rec.Packet = make([]byte, int(hdr[1]) + mavOverhead)
+  copy(rec.Packet, hdr)
+  if _, err := io.ReadFull(lr.r, rec.Packet[2:]); err != nil {
+    return nil, truncated(err)
+  }
+
+  return &rec, nil
+}
+
+// Writes the legacy layout, which the cloud's mavlinkBinary endpoint still
+// takes.
+type LegacyWriter struct {
+  w       io.Writer
+  buf     []byte
+}
+
+func NewLegacyWriter(w io.Writer) *LegacyWriter {
+  return &LegacyWriter{w: w}
+}
+
+// Writes a single record, stamp and frame in one write.
+func (lw *LegacyWriter) Write(t time.Time, pkt []byte) error {
+  ts, err := t.MarshalBinary()
+  if err != nil {
+    return err
+  }
+  lw.buf = append(append(lw.buf[:0], ts...), pkt...)
+
+  _, err = lw.w.Write(lw.buf)
+  return err
+}
+
+// Reads a .tlog as the legacy layout, a record at a time.
+func NewLegacyStream(tlog io.Reader) io.Reader {
+  ls := &legacyStream{tr: NewTlogReader(tlog)}
+  ls.lw = NewLegacyWriter(&ls.buf)
+  return ls
+}
+
+type legacyStream struct {
+  tr      *TlogReader
+  lw      *LegacyWriter
+  buf     bytes.Buffer
+  err     error
+}
+
+func (ls *legacyStream) Read(p []byte) (int, error) {
+  for ls.buf.Len() == 0 && ls.err == nil {
+    rec, err := ls.tr.Next()
+    if err != nil {
+      ls.err = err
+    } else {
+      ls.err = ls.lw.Write(rec.Time, rec.Packet)
+    }
+  }
+
+  if ls.buf.Len() > 0 {
+    return ls.buf.Read(p)
+  }
+  return 0, ls.err
+}
+
+func truncated(err error) error {
+  if err == io.ErrUnexpectedEOF {
+    return io.EOF
+  }
+  return err
+}
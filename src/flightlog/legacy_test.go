@@ -0,0 +1,85 @@
+package flightlog
+
+import (
+  "bytes"
+  "io"
+  "io/ioutil"
+  "testing"
+  "time"
+)
+
+func writeLegacy(buf *bytes.Buffer, t time.Time, pkt []byte) {
+  ts, _ := t.MarshalBinary()
+  buf.Write(ts)
+  buf.Write(pkt)
+}
+
+func TestLegacyReader(t *testing.T) {
+  var buf bytes.Buffer
+  start := time.Date(2016, 8, 1, 12, 0, 0, 0, time.UTC)
+
+  // heartbeat (9 byte payload) and a zero length frame
+  hb := append([]byte{0xFE, 9, 0, 1, 1, 0}, make([]byte, 9 + 2)...)
+  empty := []byte{0xFE, 0, 1, 1, 1, 200, 0xAA, 0xBB}
+
+  writeLegacy(&buf, start, hb)
+  writeLegacy(&buf, start.Add(250 * time.Millisecond), empty)
+
+  // half a record, as left behind when the saver dies mid write
+  ts, _ := start.Add(time.Second).MarshalBinary()
+  buf.Write(ts[:7])
+
+  recs, err := ReadAllLegacy(&buf)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if len(recs) != 2 {
+    t.Fatalf("got %d records, want 2", len(recs))
+  }
+
+  if !recs[0].Time.Equal(start) || !bytes.Equal(recs[0].Packet, hb) {
+    t.Errorf("first record mismatch: %v %x", recs[0].Time, recs[0].Packet)
+  }
+
+  if recs[1].Time.Sub(recs[0].Time) != 250 * time.Millisecond || !bytes.Equal(recs[1].Packet, empty) {
+    t.Errorf("second record mismatch: %v %x", recs[1].Time, recs[1].Packet)
+  }
+}
+
+func TestLegacyReaderGarbage(t *testing.T) {
+  lr := NewLegacyReader(bytes.NewReader([]byte{0x42, 1, 2, 3}))
+  if _, err := lr.Next(); err != ErrBadRecord {
+    t.Errorf("got %v, want ErrBadRecord", err)
+  }
+
+  lr = NewLegacyReader(bytes.NewReader(nil))
+  if _, err := lr.Next(); err != io.EOF {
+    t.Errorf("got %v, want EOF", err)
+  }
+}
+
+func TestLegacyStream(t *testing.T) {
+  var tlog, want bytes.Buffer
+  tw, lw := NewTlogWriter(&tlog), NewLegacyWriter(&want)
+  start := time.Date(2016, 8, 1, 12, 0, 0, 0, time.UTC)
+
+  hb := append([]byte{0xFE, 9, 0, 1, 1, 0}, make([]byte, 9 + 2)...)
+  for i := 0; i < 100; i++ {
+    at := start.Add(time.Duration(i) * time.Second).Local()
+    tw.Write(at, hb)
+    lw.Write(at, hb)
+  }
+
+  got, err := ioutil.ReadAll(NewLegacyStream(&tlog))
+  if err != nil {
+    t.Fatal(err)
+  } else if !bytes.Equal(got, want.Bytes()) {
+    t.Fatalf("got %d bytes, want %d", len(got), want.Len())
+  }
+
+  recs, err := ReadAllLegacy(bytes.NewReader(got))
+  if err != nil || len(recs) != 100 || !recs[99].Time.Equal(start.Add(99 * time.Second)) {
+    t.Errorf("read back %d records, %v", len(recs), err)
+  }
+}
@@ -0,0 +1,48 @@
+package flightlog
+
+import (
+  "os"
+  "path/filepath"
+  "sort"
+)
+
+// Deletes the oldest synced logs until the logs in the catalog's directory take
+// up no more than quota bytes. Logs that haven't reached the cloud yet and the
+// log named keep are never touched, so the result can still be over quota.
+// Returns the space used afterwards.
+func (c *Catalog) Trim(quota int64, keep string) (int64, error) {
+  files, err := filepath.Glob(filepath.Join(c.dir, "Flight*"))
+  if err != nil {
+    return 0, err
+  }
+
+  infos := make([]os.FileInfo, 0, len(files))
+  var used int64
+  for _, f := range files {
+    info, err := os.Stat(f)
+    if err != nil || info.IsDir() {
+      continue
+    }
+    infos = append(infos, info)
+    used += info.Size()
+  }
+
+  sort.Slice(infos, func(i, j int) bool {
+    return infos[i].ModTime().Before(infos[j].ModTime())
+  })
+
+  for _, info := range infos {
+    if used <= quota {
+      break
+    }
+    if info.Name() == keep || !c.IsSynced(info.Name()) {
+      continue
+    }
+    if err := c.Delete(info.Name()); err != nil {
+      return used, err
+    }
+    used -= info.Size()
+  }
+
+  return used, nil
+}
@@ -0,0 +1,188 @@
+package flightlog
+
+import (
+  "io"
+  "math"
+  "time"
+
+  "mavlink/parser"
+)
+
+const (
+  earthRadius = 6371000.0
+
+  // GPS jitter on the ground adds up to a surprising distance over a long log.
+  // Steps shorter than this are ignored.
+  minStep = 0.5
+)
+
+// What we can tell about a flight from its log alone.
+type Summary struct {
+  Start         time.Time `json:"start"`
+  End           time.Time `json:"end"`
+  Duration      float64   `json:"duration"`     // seconds
+  MaxAltitude   float64   `json:"maxAltitude"`  // meters above home
+  Distance      float64   `json:"distance"`     // meters over ground
+  BatteryStart  int       `json:"batteryStart"` // percent, -1 if unknown
+  BatteryEnd    int       `json:"batteryEnd"`
+  BatteryUsed   int       `json:"batteryUsed"`
+  Modes         []string  `json:"modes"`        // in the order they were entered
+  Packets       int       `json:"packets"`
+}
+
+// Names a PX4 custom_mode the same way the vehicle API does.
+func ModeName(customMode uint32) string {
+  main := (customMode >> 16) & 0xFF
+  sub := (customMode >> 24) & 0xFF
+
+  switch main {
+  case 1: return "Manual"
+  case 2: return "Altitude"
+  case 3: return "Position"
+  case 5: return "Acro"
+  case 6: return "Offboard"
+  case 7: return "Stabilized"
+  case 8: return "RAttitude"
+  case 4:
+    switch sub {
+    case 1: return "Auto"
+    case 2: return "Takeoff"
+    case 3: return "Hold"
+    case 4: return "Mission"
+    case 5: return "RTL"
+    case 6: return "Land"
+    case 7: return "RTGS"
+    case 8: return "Follow"
+    }
+  }
+
+  return "Unknown Flight Mode"
+}
+
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+  rad := math.Pi / 180
+  dLat := (lat2 - lat1) * rad
+  dLon := (lon2 - lon1) * rad
+
+  a := math.Sin(dLat / 2) * math.Sin(dLat / 2) +
+    math.Cos(lat1 * rad) * math.Cos(lat2 * rad) * math.Sin(dLon / 2) * math.Sin(dLon / 2)
+  return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// Works out a summary one packet at a time, so a log never has to be in memory
+// whole.
+type summarizer struct {
+  sum       Summary
+  lastLat   float64
+  lastLon   float64
+  haveFix   bool
+  lastMode  string
+}
+
+func newSummarizer() *summarizer {
+  return &summarizer{sum: Summary{BatteryStart: -1, BatteryEnd: -1, Modes: []string{}}}
+}
+
+func (s *summarizer) battery(pct int8) {
+  if pct < 0 {
+    return
+  }
+  if s.sum.BatteryStart < 0 {
+    s.sum.BatteryStart = int(pct)
+  }
+  s.sum.BatteryEnd = int(pct)
+}
+
+// Packets that don't decode are counted but otherwise ignored.
+func (s *summarizer) add(rec *Record) {
+  if s.sum.Packets == 0 {
+    s.sum.Start = rec.Time
+  }
+  s.sum.End = rec.Time
+  s.sum.Packets++
+
+  pkt, err := mavlink.DecodeBytes(rec.Packet)
+  if err != nil {
+    return
+  }
+
+  switch pkt.MsgID {
+  case mavlink.MSG_ID_HEARTBEAT:
+    var m mavlink.Heartbeat
+    if m.Unpack(pkt) == nil {
+      if mode := ModeName(m.CustomMode); mode != s.lastMode {
+        s.sum.Modes = append(s.sum.Modes, mode)
+        s.lastMode = mode
+      }
+    }
+
+  case mavlink.MSG_ID_GLOBAL_POSITION_INT:
+    var m mavlink.GlobalPositionInt
+    if m.Unpack(pkt) != nil || (m.Lat == 0 && m.Lon == 0) {
+      return
+    }
+
+    if alt := float64(m.RelativeAlt) / 1000; alt > s.sum.MaxAltitude {
+      s.sum.MaxAltitude = alt
+    }
+
+    lat, lon := float64(m.Lat) / 1e7, float64(m.Lon) / 1e7
+    if !s.haveFix {
+      s.lastLat, s.lastLon, s.haveFix = lat, lon, true
+    } else if d := haversine(s.lastLat, s.lastLon, lat, lon); d >= minStep {
+      s.sum.Distance += d
+      s.lastLat, s.lastLon = lat, lon
+    }
+
+  case mavlink.MSG_ID_SYS_STATUS:
+    var m mavlink.SysStatus
+    if m.Unpack(pkt) == nil {
+      s.battery(m.BatteryRemaining)
+    }
+
+  case mavlink.MSG_ID_BATTERY_STATUS:
+    var m mavlink.BatteryStatus
+    if m.Unpack(pkt) == nil {
+      s.battery(m.BatteryRemaining)
+    }
+  }
+}
+
+func (s *summarizer) done() Summary {
+  sum := s.sum
+  sum.Duration = sum.End.Sub(sum.Start).Seconds()
+  if sum.BatteryStart >= 0 {
+    sum.BatteryUsed = sum.BatteryStart - sum.BatteryEnd
+  }
+  return sum
+}
+
+// Walks a flight's packets and works out its summary.
+func Summarize(recs []*Record) Summary {
+  s := newSummarizer()
+  for _, rec := range recs {
+    s.add(rec)
+  }
+  return s.done()
+}
+
+// Summarizes a log on disk a record at a time. A damaged log still gets a
+// summary of whatever could be read, along with the error.
+func SummarizeFile(fpath string) (Summary, error) {
+  s := newSummarizer()
+  rr, f, err := openFile(fpath)
+  if err != nil {
+    return s.done(), err
+  }
+  defer f.Close()
+
+  for {
+    rec, err := rr.Next()
+    if err == io.EOF {
+      return s.done(), nil
+    } else if err != nil {
+      return s.done(), err
+    }
+    s.add(rec)
+  }
+}
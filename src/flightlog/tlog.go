@@ -0,0 +1,233 @@
+package flightlog
+
+import (
+  "bufio"
+  "compress/gzip"
+  "encoding/binary"
+  "fmt"
+  "io"
+  "os"
+  "path/filepath"
+  "strings"
+  "time"
+)
+
+const (
+  TLOG_EXT = ".tlog"
+  LEGACY_EXT = ".log"
+
+  tlogStampLen = 8
+)
+
+// Writes the .tlog layout used by MAVProxy, QGroundControl and pymavlink: each
+// frame is preceded by its receive time as big endian microseconds since the
+// Unix epoch.
+type TlogWriter struct {
+  w       io.Writer
+  buf     []byte
+}
+
+func NewTlogWriter(w io.Writer) *TlogWriter {
+  return &TlogWriter{w: w}
+}
+
+// Writes a single record. Stamp and frame go out in one write so a crash can't
+// leave a stamp without its frame.
+func (tw *TlogWriter) Write(t time.Time, pkt []byte) error {
+  tw.buf = tw.buf[:0]
+  tw.buf = append(tw.buf, make([]byte, tlogStampLen)...)
+  binary.BigEndian.PutUint64(tw.buf, uint64(t.UnixNano() / int64(time.Microsecond)))
+  tw.buf = append(tw.buf, pkt...)
+
+  _, err := tw.w.Write(tw.buf)
+  return err
+}
+
+type TlogReader struct {
+  r       *bufio.Reader
+}
+
+func NewTlogReader(r io.Reader) *TlogReader {
+  return &TlogReader{bufio.NewReader(r)}
+}
+
+// Returns the next record, or io.EOF once the log is exhausted. Only MAVLink v1
+// frames are understood, which is all the engine ever writes.
+func (tr *TlogReader) Next() (*Record, error) {
+  hdr := make([]byte, tlogStampLen + 2)
+  if _, err := io.ReadFull(tr.r, hdr[:1]); err != nil {
+    return nil, err
+  }
+  if _, err := io.ReadFull(tr.r, hdr[1:]); err != nil {
+    return nil, truncated(err)
+  }
+
+  if hdr[tlogStampLen] != mavStart {
+    return nil, ErrBadRecord
+  }
+
+  usec := binary.BigEndian.Uint64(hdr)
+  rec := &Record{
+    Time: time.Unix(0, int64(usec) * int64(time.Microsecond)),
+    Packet: make([]byte, int(hdr[tlogStampLen + 1]) + mavOverhead),
+  }
+
+  copy(rec.Packet, hdr[tlogStampLen:])
+  if _, err := io.ReadFull(tr.r, rec.Packet[2:]); err != nil {
+    return nil, truncated(err)
+  }
+
+  return rec, nil
+}
+
+type recordReader interface {
+  Next() (*Record, error)
+}
+
+func readAll(rr recordReader) ([]*Record, error) {
+  var recs []*Record
+
+  for {
+    rec, err := rr.Next()
+    if err == io.EOF {
+      return recs, nil
+    } else if err != nil {
+      return recs, err
+    }
+    recs = append(recs, rec)
+  }
+}
+
+// Reads every record in a legacy log.
+func ReadAllLegacy(r io.Reader) ([]*Record, error) {
+  return readAll(NewLegacyReader(r))
+}
+
+// Reads every record in a .tlog.
+func ReadAllTlog(r io.Reader) ([]*Record, error) {
+  return readAll(NewTlogReader(r))
+}
+
+// Reads a flight log from disk, picking the format from its extension.
+func ReadFile(fpath string) ([]*Record, error) {
+  rr, f, err := openFile(fpath)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+  return readAll(rr)
+}
+
+// Opens a flight log on disk for reading a record at a time, picking the format
+// from its extension. Closing f closes the lot.
+func openFile(fpath string) (recordReader, io.Closer, error) {
+  f, err := os.Open(fpath)
+  if err != nil {
+    return nil, nil, err
+  }
+
+  var r io.Reader = f
+  if strings.HasSuffix(fpath, GZIP_EXT) {
+    // Every block is its own gzip member, the reader runs them together. The
+    // gzip reader has nothing of its own to release.
+    zr, err := gzip.NewReader(f)
+    if err != nil {
+      f.Close()
+      return nil, nil, err
+    }
+    r = zr
+    fpath = strings.TrimSuffix(fpath, GZIP_EXT)
+  }
+
+  if strings.HasSuffix(fpath, TLOG_EXT) {
+    return NewTlogReader(r), f, nil
+  }
+  return NewLegacyReader(r), f, nil
+}
+
+// Rewrites a legacy log as a .tlog. Returns the number of records copied.
+func ConvertLegacy(src io.Reader, dst io.Writer) (int, error) {
+  lr := NewLegacyReader(src)
+  tw := NewTlogWriter(dst)
+  n := 0
+
+  for {
+    rec, err := lr.Next()
+    if err == io.EOF {
+      return n, nil
+    } else if err != nil {
+      return n, err
+    }
+
+    if err := tw.Write(rec.Time, rec.Packet); err != nil {
+      return n, err
+    }
+    n++
+  }
+}
+
+// Converts a legacy log on disk and removes the original. The .tlog is written
+// under a hidden name first, so the flight syncer never sees half a file.
+func ConvertFile(fpath string) (string, error) {
+  if !strings.HasSuffix(fpath, LEGACY_EXT) {
+    return "", fmt.Errorf("%s is not a legacy flight log.", fpath)
+  }
+
+  dir, name := filepath.Split(fpath)
+  out := filepath.Join(dir, strings.TrimSuffix(name, LEGACY_EXT) + TLOG_EXT)
+  tmp := filepath.Join(dir, "." + name + ".convert")
+
+  src, err := os.Open(fpath)
+  if err != nil {
+    return "", err
+  }
+  defer src.Close()
+
+  dst, err := os.Create(tmp)
+  if err != nil {
+    return "", err
+  }
+
+  w := bufio.NewWriter(dst)
+  if _, err = ConvertLegacy(src, w); err == nil {
+    err = w.Flush()
+  }
+  if cerr := dst.Close(); err == nil {
+    err = cerr
+  }
+
+  if err != nil {
+    os.Remove(tmp)
+    return "", err
+  }
+
+  if err := os.Rename(tmp, out); err != nil {
+    os.Remove(tmp)
+    return "", err
+  }
+
+  return out, os.Remove(fpath)
+}
+
+// Converts every legacy flight log in dir. Keeps going past bad files and
+// returns the first error along with the number converted.
+func ConvertDir(dir string) (int, error) {
+  files, err := filepath.Glob(filepath.Join(dir, "Flight*" + LEGACY_EXT))
+  if err != nil {
+    return 0, err
+  }
+
+  var firstErr error
+  n := 0
+  for _, f := range files {
+    if _, err := ConvertFile(f); err != nil {
+      if firstErr == nil {
+        firstErr = fmt.Errorf("%s: %v", f, err)
+      }
+    } else {
+      n++
+    }
+  }
+
+  return n, firstErr
+}
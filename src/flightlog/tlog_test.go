@@ -0,0 +1,79 @@
+package flightlog
+
+import (
+  "bytes"
+  "encoding/binary"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+func TestTlogLayout(t *testing.T) {
+  var buf bytes.Buffer
+  at := time.Date(2016, 8, 1, 12, 0, 0, 123456000, time.UTC)
+  pkt := []byte{0xFE, 0, 7, 1, 1, 200, 0xAA, 0xBB}
+
+  if err := NewTlogWriter(&buf).Write(at, pkt); err != nil {
+    t.Fatal(err)
+  }
+
+  b := buf.Bytes()
+  if len(b) != 8 + len(pkt) {
+    t.Fatalf("record is %d bytes, want %d", len(b), 8 + len(pkt))
+  }
+
+  if usec := binary.BigEndian.Uint64(b); usec != uint64(at.UnixNano() / 1000) {
+    t.Errorf("stamp %d, want %d", usec, at.UnixNano() / 1000)
+  }
+
+  recs, err := ReadAllTlog(&buf)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if len(recs) != 1 || !recs[0].Time.Equal(at) || !bytes.Equal(recs[0].Packet, pkt) {
+    t.Errorf("round trip mismatch: %+v", recs)
+  }
+}
+
+func TestConvertDir(t *testing.T) {
+  dir, err := ioutil.TempDir("", "flightlog")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  var legacy bytes.Buffer
+  start := time.Date(2016, 8, 1, 12, 0, 0, 0, time.UTC)
+  for i := 0; i < 3; i++ {
+    writeLegacy(&legacy, start.Add(time.Duration(i) * time.Second), []byte{0xFE, 0, byte(i), 1, 1, 0, 0, 0})
+  }
+
+  src := filepath.Join(dir, "Flight Mon Aug  1 12:00:00 UTC 2016.log")
+  if err := ioutil.WriteFile(src, legacy.Bytes(), 0644); err != nil {
+    t.Fatal(err)
+  }
+
+  if n, err := ConvertDir(dir); err != nil || n != 1 {
+    t.Fatalf("converted %d, err %v", n, err)
+  }
+
+  if _, err := os.Stat(src); !os.IsNotExist(err) {
+    t.Errorf("legacy log was not removed")
+  }
+
+  recs, err := ReadFile(src[:len(src) - len(LEGACY_EXT)] + TLOG_EXT)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if len(recs) != 3 || !recs[2].Time.Equal(start.Add(2 * time.Second)) || recs[2].Packet[2] != 2 {
+    t.Errorf("converted log mismatch: %d records", len(recs))
+  }
+
+  if left, _ := filepath.Glob(filepath.Join(dir, ".*")); len(left) != 0 {
+    t.Errorf("temp files left behind: %v", left)
+  }
+}
@@ -0,0 +1,315 @@
+package flightlog
+
+import (
+  "bytes"
+  "compress/gzip"
+  "encoding/binary"
+  "fmt"
+  "hash/crc32"
+  "io"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync"
+  "time"
+)
+
+const (
+  COMPRESS_NONE = "none"
+  COMPRESS_GZIP = "gzip"
+  COMPRESS_ZSTD = "zstd"
+
+  GZIP_EXT = ".gz"
+  INDEX_EXT = ".idx"
+
+  DEFAULT_BLOCK_SIZE = 64 * 1024
+  DEFAULT_SYNC_INTERVAL = 5 * time.Second
+
+  // offset, length, crc32
+  indexEntryLen = 8 + 4 + 4
+)
+
+type WriterOptions struct {
+  Compress      string
+  BlockSize     int
+  SyncInterval  time.Duration
+}
+
+// A flight log written in blocks. Records are buffered and written out a block
+// at a time, and every block gets an entry (offset, length, crc32) in a hidden
+// sidecar index. With compression each block is its own gzip member, so the
+// whole file is still a plain .tlog.gz that gunzip understands.
+//
+// The file and index are fsynced every SyncInterval. If power goes before the
+// log is closed, Recover uses the index to cut the file back to the last block
+// that made it to disk intact. Closing the log removes the index.
+type Writer struct {
+  mut       sync.Mutex
+  opts      WriterOptions
+  path      string
+  f         *os.File
+  idx       *os.File
+
+  buf       bytes.Buffer
+  tw        *TlogWriter
+  offset    int64
+  lastSync  time.Time
+}
+
+// File extension for logs written with the given compression.
+func Ext(compress string) string {
+  if compress == COMPRESS_GZIP {
+    return TLOG_EXT + GZIP_EXT
+  }
+  return TLOG_EXT
+}
+
+// Strips the log extension off a file name.
+func BaseName(name string) string {
+  name = strings.TrimSuffix(name, GZIP_EXT)
+  name = strings.TrimSuffix(name, TLOG_EXT)
+  return strings.TrimSuffix(name, LEGACY_EXT)
+}
+
+func indexPath(fpath string) string {
+  dir, name := filepath.Split(fpath)
+  return filepath.Join(dir, "." + name + INDEX_EXT)
+}
+
+func CheckCompression(compress string) error {
+  switch compress {
+  case COMPRESS_NONE, COMPRESS_GZIP:
+    return nil
+  case COMPRESS_ZSTD:
+    return fmt.Errorf("zstd compression is not available in this build, use gzip.")
+  }
+  return fmt.Errorf("Unknown log compression %s", compress)
+}
+
+func Create(fpath string, opts WriterOptions) (*Writer, error) {
+  if err := CheckCompression(opts.Compress); err != nil {
+    return nil, err
+  }
+  if opts.BlockSize <= 0 {
+    opts.BlockSize = DEFAULT_BLOCK_SIZE
+  }
+  if opts.SyncInterval <= 0 {
+    opts.SyncInterval = DEFAULT_SYNC_INTERVAL
+  }
+
+  f, err := os.Create(fpath)
+  if err != nil {
+    return nil, err
+  }
+
+  idx, err := os.Create(indexPath(fpath))
+  if err != nil {
+    f.Close()
+    os.Remove(fpath)
+    return nil, err
+  }
+
+  w := &Writer{
+    opts: opts,
+    path: fpath,
+    f: f,
+    idx: idx,
+    lastSync: time.Now(),
+  }
+  w.tw = NewTlogWriter(&w.buf)
+
+  return w, nil
+}
+
+func (w *Writer) Write(t time.Time, pkt []byte) error {
+  w.mut.Lock()
+  defer w.mut.Unlock()
+
+  if w.f == nil {
+    return fmt.Errorf("Flight log %s is closed.", w.path)
+  }
+
+  if err := w.tw.Write(t, pkt); err != nil {
+    return err
+  }
+
+  if w.buf.Len() >= w.opts.BlockSize {
+    if err := w.flush(); err != nil {
+      return err
+    }
+  }
+
+  if time.Since(w.lastSync) >= w.opts.SyncInterval {
+    return w.sync()
+  }
+
+  return nil
+}
+
+// Bytes written so far, counting what's still buffered.
+func (w *Writer) Size() int64 {
+  w.mut.Lock()
+  defer w.mut.Unlock()
+  return w.offset + int64(w.buf.Len())
+}
+
+// Writes out whatever is buffered and fsyncs. Must be called with the lock held.
+func (w *Writer) sync() error {
+  if err := w.flush(); err != nil {
+    return err
+  }
+
+  w.lastSync = time.Now()
+  if err := w.f.Sync(); err != nil {
+    return err
+  }
+  return w.idx.Sync()
+}
+
+// Writes the buffered records as one block. Must be called with the lock held.
+func (w *Writer) flush() error {
+  if w.buf.Len() == 0 {
+    return nil
+  }
+
+  block := w.buf.Bytes()
+  if w.opts.Compress == COMPRESS_GZIP {
+    var zbuf bytes.Buffer
+    zw := gzip.NewWriter(&zbuf)
+    if _, err := zw.Write(block); err != nil {
+      return err
+    }
+    if err := zw.Close(); err != nil {
+      return err
+    }
+    block = zbuf.Bytes()
+  }
+
+  if _, err := w.f.Write(block); err != nil {
+    return err
+  }
+
+  entry := make([]byte, indexEntryLen)
+  binary.BigEndian.PutUint64(entry, uint64(w.offset))
+  binary.BigEndian.PutUint32(entry[8:], uint32(len(block)))
+  binary.BigEndian.PutUint32(entry[12:], crc32.ChecksumIEEE(block))
+  if _, err := w.idx.Write(entry); err != nil {
+    return err
+  }
+
+  w.offset += int64(len(block))
+  w.buf.Reset()
+  return nil
+}
+
+// Flushes, fsyncs and closes the log. The index is dropped, a closed log is
+// complete by definition.
+func (w *Writer) Close() error {
+  w.mut.Lock()
+  defer w.mut.Unlock()
+
+  if w.f == nil {
+    return nil
+  }
+
+  err := w.sync()
+  if cerr := w.f.Close(); err == nil {
+    err = cerr
+  }
+  w.idx.Close()
+  w.f = nil
+
+  if err == nil {
+    err = os.Remove(indexPath(w.path))
+  }
+  return err
+}
+
+// Whether a log is still being written, or was never closed.
+func IsOpen(fpath string) bool {
+  _, err := os.Stat(indexPath(fpath))
+  return err == nil
+}
+
+// Repairs a log that was never closed. Blocks are checked against the index in
+// order, and the file is truncated after the last good one. Returns the number
+// of bytes cut. Logs without an index are left alone.
+func Recover(fpath string) (int64, error) {
+  ipath := indexPath(fpath)
+  index, err := os.ReadFile(ipath)
+  if os.IsNotExist(err) {
+    return 0, nil
+  } else if err != nil {
+    return 0, err
+  }
+
+  f, err := os.OpenFile(fpath, os.O_RDWR, 0)
+  if err != nil {
+    return 0, err
+  }
+  defer f.Close()
+
+  info, err := f.Stat()
+  if err != nil {
+    return 0, err
+  }
+
+  var good int64
+  for i := 0; i + indexEntryLen <= len(index); i += indexEntryLen {
+    off := int64(binary.BigEndian.Uint64(index[i:]))
+    length := int64(binary.BigEndian.Uint32(index[i + 8:]))
+    sum := binary.BigEndian.Uint32(index[i + 12:])
+
+    if off != good || off + length > info.Size() {
+      break
+    }
+
+    block := make([]byte, length)
+    if _, err := f.ReadAt(block, off); err != nil && err != io.EOF {
+      return 0, err
+    } else if crc32.ChecksumIEEE(block) != sum {
+      break
+    }
+
+    good = off + length
+  }
+
+  if err := f.Truncate(good); err != nil {
+    return 0, err
+  }
+  if err := f.Sync(); err != nil {
+    return 0, err
+  }
+
+  return info.Size() - good, os.Remove(ipath)
+}
+
+// Recovers every unfinished log in dir. Returns how many logs needed repair.
+func RecoverDir(dir string) (int, error) {
+  indexes, err := filepath.Glob(filepath.Join(dir, ".Flight*" + INDEX_EXT))
+  if err != nil {
+    return 0, err
+  }
+
+  var firstErr error
+  n := 0
+  for _, ipath := range indexes {
+    name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(ipath), "."), INDEX_EXT)
+    fpath := filepath.Join(dir, name)
+
+    if _, err := os.Stat(fpath); os.IsNotExist(err) {
+      os.Remove(ipath)
+      continue
+    }
+
+    if _, err := Recover(fpath); err != nil {
+      if firstErr == nil {
+        firstErr = fmt.Errorf("%s: %v", name, err)
+      }
+    } else {
+      n++
+    }
+  }
+
+  return n, firstErr
+}
@@ -0,0 +1,130 @@
+package flightlog
+
+import (
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+
+  "mavlink/parser"
+)
+
+func writeFlight(t *testing.T, fpath string, opts WriterOptions, n int) *Writer {
+  w, err := Create(fpath, opts)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  start := time.Date(2016, 8, 1, 12, 0, 0, 0, time.UTC)
+  for i := 0; i < n; i++ {
+    pkt := packet(t, &mavlink.GlobalPositionInt{TimeBootMs: uint32(i), RelativeAlt: int32(i)})
+    if err := w.Write(start.Add(time.Duration(i) * time.Second), pkt); err != nil {
+      t.Fatal(err)
+    }
+  }
+  return w
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "flightlog")
+  defer os.RemoveAll(dir)
+
+  for _, compress := range []string{COMPRESS_NONE, COMPRESS_GZIP} {
+    fpath := filepath.Join(dir, "Flight test" + Ext(compress))
+    w := writeFlight(t, fpath, WriterOptions{Compress: compress, BlockSize: 256}, 100)
+
+    if !IsOpen(fpath) {
+      t.Errorf("%s: not open while writing", compress)
+    }
+    if err := w.Close(); err != nil {
+      t.Fatal(err)
+    }
+    if IsOpen(fpath) {
+      t.Errorf("%s: index left behind after close", compress)
+    }
+
+    recs, err := ReadFile(fpath)
+    if err != nil {
+      t.Fatalf("%s: %v", compress, err)
+    } else if len(recs) != 100 {
+      t.Errorf("%s: read %d records, want 100", compress, len(recs))
+    }
+  }
+
+  if _, err := Create(filepath.Join(dir, "Flight zstd.tlog"), WriterOptions{Compress: COMPRESS_ZSTD}); err == nil {
+    t.Error("zstd accepted")
+  }
+}
+
+func TestRecover(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "flightlog")
+  defer os.RemoveAll(dir)
+
+  for _, compress := range []string{COMPRESS_NONE, COMPRESS_GZIP} {
+    fpath := filepath.Join(dir, "Flight crash" + Ext(compress))
+
+    // Write a few blocks and sync them, as if the saver had been running a while.
+    w := writeFlight(t, fpath, WriterOptions{Compress: compress, BlockSize: 256}, 50)
+    w.mut.Lock()
+    if err := w.sync(); err != nil {
+      t.Fatal(err)
+    }
+    good := w.offset
+    w.mut.Unlock()
+
+    // Power goes mid-write: garbage after the last indexed block, never closed.
+    f, _ := os.OpenFile(fpath, os.O_WRONLY | os.O_APPEND, 0)
+    f.Write([]byte{0xfe, 0x1c, 0x00, 0x01})
+    f.Close()
+
+    n, err := RecoverDir(dir)
+    if err != nil || n != 1 {
+      t.Fatalf("%s: recovered %d, %v", compress, n, err)
+    }
+    if info, _ := os.Stat(fpath); info.Size() != good {
+      t.Errorf("%s: size %d after recovery, want %d", compress, info.Size(), good)
+    }
+    if IsOpen(fpath) {
+      t.Errorf("%s: index left behind after recovery", compress)
+    }
+
+    if recs, err := ReadFile(fpath); err != nil || len(recs) != 50 {
+      t.Errorf("%s: read %d records after recovery, %v", compress, len(recs), err)
+    }
+  }
+}
+
+func TestTrim(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "flightlog")
+  defer os.RemoveAll(dir)
+
+  names := []string{"Flight a.tlog", "Flight b.tlog", "Flight c.tlog"}
+  for i, name := range names {
+    fpath := filepath.Join(dir, name)
+    ioutil.WriteFile(fpath, make([]byte, 1000), 0644)
+    mod := time.Now().Add(time.Duration(i - 10) * time.Minute)
+    os.Chtimes(fpath, mod, mod)
+  }
+
+  c := NewCatalog(dir)
+  c.List()
+  c.MarkSynced("Flight b.tlog")
+  c.MarkSynced("Flight c.tlog")
+
+  // a is oldest but hasn't been synced, b goes first.
+  used, err := c.Trim(2000, "")
+  if err != nil {
+    t.Fatal(err)
+  } else if used != 2000 {
+    t.Errorf("used %d after trim, want 2000", used)
+  }
+  if _, err := os.Stat(filepath.Join(dir, "Flight b.tlog")); !os.IsNotExist(err) {
+    t.Error("oldest synced log kept")
+  }
+
+  // c is the log being written, nothing else can go.
+  if used, _ := c.Trim(500, "Flight c.tlog"); used != 2000 {
+    t.Errorf("used %d, want 2000", used)
+  }
+}
@@ -0,0 +1,152 @@
+package fmulink
+
+import (
+  "bytes"
+  "fmt"
+  "io"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "time"
+
+  "mavlink/parser"
+  "fmulink/serial"
+
+  "cloudlink"
+  "config"
+)
+
+const (
+  // Master link value that asks fmulink to find the FMU on its own.
+  MASTER_AUTO = "auto"
+
+  // Store key holding the last serial device and baud rate that worked.
+  STORE_AUTO_MASTER = cloudlink.STORE_AUTO_MASTER
+
+  // How long to listen on a candidate port for a heartbeat.
+  AUTO_PROBE_TIME = 2 * time.Second
+  AUTO_READ_TIMEOUT = 100 * time.Millisecond
+)
+
+var (
+  // Device patterns scanned in auto mode, in order of preference.
+  // ttyMFD1 is the Edison's UART to the FMU, the rest cover USB connections.
+  AutoDevices = []string{
+    "/dev/ttyMFD1",
+    "/dev/ttyACM*",
+    "/dev/ttyUSB*",
+    "/dev/ttyAMA0",
+    "/dev/tty.usbmodem*",
+    "/dev/tty.usbserial*",
+  }
+
+  // Baud rates tried on each device, fastest first.
+  AutoBauds = []int{921600, 115200, 57600}
+)
+
+// Scans candidate serial devices and baud rates until one of them produces a
+// valid MAVLink heartbeat. The winning `<device>:<baud>` pair is returned in the
+// same format as the -master flag, and remembered in the store so the next boot
+// tries it first.
+func autoDetect(store *cloudlink.Store) (string, error) {
+  var candidates []string
+
+  if store != nil {
+    if last := store.Get(STORE_AUTO_MASTER); last != "" {
+      candidates = append(candidates, last)
+    }
+  }
+
+  for _, pattern := range AutoDevices {
+    matches, err := filepath.Glob(pattern)
+    if err != nil {
+      continue
+    }
+
+    for _, dev := range matches {
+      for _, baud := range AutoBauds {
+        candidates = append(candidates, dev + ":" + strconv.Itoa(baud))
+      }
+    }
+  }
+
+  if len(candidates) == 0 {
+    return "", fmt.Errorf("Auto detect: no serial devices found.")
+  }
+
+  for _, cand := range candidates {
+    cfg := strings.SplitN(cand, ":", 2)
+    if len(cfg) < 2 {
+      continue
+    }
+
+    baud, err := strconv.Atoi(cfg[1])
+    if err != nil {
+      continue
+    }
+
+    config.Log(config.LOG_DEBUG, "fl: ", "Probing", cfg[0], "at", baud)
+    if found, err := probePort(cfg[0], baud); err != nil {
+      config.Log(config.LOG_DEBUG, "fl: ", "Probe failed:", err)
+    } else if found {
+      config.Log(config.LOG_INFO, "fl: ", "Auto detected FMU on", cand)
+      if store != nil {
+        if err := store.Set(STORE_AUTO_MASTER, cand); err != nil {
+          config.Log(config.LOG_WARN, "fl: ", "Could not remember master:", err)
+        }
+      }
+      return cand, nil
+    }
+  }
+
+  return "", fmt.Errorf("Auto detect: no heartbeat on any of %d candidates.", len(candidates))
+}
+
+// Opens a port and listens for a short while. Returns true if a heartbeat with
+// a valid checksum could be decoded, or the FMU is sitting in its NSH shell.
+func probePort(name string, baud int) (bool, error) {
+  port, err := serial.OpenPort(&serial.Config{Name: name, Baud: baud, ReadTimeout: AUTO_READ_TIMEOUT})
+  if err != nil {
+    return false, err
+  } else if port == nil {
+    // the non-cgo driver hands back nothing for rates it does not know about.
+    return false, fmt.Errorf("Unsupported baud rate %d", baud)
+  }
+  defer port.Close()
+
+  var buf bytes.Buffer
+  chunk := make([]byte, 263)
+  deadline := time.Now().Add(AUTO_PROBE_TIME)
+
+  for time.Now().Before(deadline) {
+    n, err := port.Read(chunk)
+    if err != nil && err != io.EOF {
+      return false, err
+    }
+
+    if n > 0 {
+      buf.Write(chunk[:n])
+
+      if strings.Contains(buf.String(), "\r\nnsh>") || hasHeartbeat(buf.Bytes()) {
+        return true, nil
+      }
+    }
+  }
+
+  return false, nil
+}
+
+// Runs the decoder over everything collected so far. At the wrong baud rate
+// we'll just see garbage, which fails the CRC check.
+func hasHeartbeat(data []byte) bool {
+  dec := mavlink.NewDecoder(bytes.NewReader(data))
+
+  for {
+    pkt, err := dec.Decode()
+    if err == io.EOF || err == io.ErrUnexpectedEOF {
+      return false
+    } else if err == nil && pkt.MsgID == mavlink.MSG_ID_HEARTBEAT {
+      return true
+    }
+  }
+}
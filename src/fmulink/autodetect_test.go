@@ -0,0 +1,65 @@
+package fmulink
+
+import (
+  "bytes"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+
+  "mavlink/parser"
+
+  "cloudlink"
+)
+
+func TestHasHeartbeat(t *testing.T) {
+  var buf bytes.Buffer
+  if err := mavlink.NewEncoder(&buf).Encode(1, 1, &mavlink.Heartbeat{}); err != nil {
+    t.Fatal(err)
+  }
+  hb := buf.Bytes()
+
+  if !hasHeartbeat(hb) {
+    t.Error("missed a heartbeat")
+  }
+  // Line noise ahead of it, as at the start of a probe.
+  if !hasHeartbeat(append([]byte{0x00, 0x42, 0x13}, hb...)) {
+    t.Error("missed a heartbeat after noise")
+  }
+
+  // What a wrong baud rate looks like: frames with bad checksums.
+  bad := append([]byte(nil), hb...)
+  bad[len(bad) - 1] ^= 0xFF
+  if hasHeartbeat(bad) || hasHeartbeat(hb[:len(hb) - 3]) || hasHeartbeat(nil) {
+    t.Error("found a heartbeat that isn't there")
+  }
+}
+
+func TestAutoDetectCandidates(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "fmulink")
+  defer os.RemoveAll(dir)
+
+  old := AutoDevices
+  defer func() { AutoDevices = old }()
+  AutoDevices = []string{filepath.Join(dir, "ttyNone*")}
+
+  if _, err := autoDetect(nil); err == nil || !strings.Contains(err.Error(), "no serial devices") {
+    t.Fatal("expected no devices, got", err)
+  }
+
+  // The last port that worked is tried even when the scan finds nothing.
+  store, err := cloudlink.NewStore(dir + "/")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := store.Set(STORE_AUTO_MASTER, filepath.Join(dir, "ttyGone") + ":57600"); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := autoDetect(store); err == nil || !strings.Contains(err.Error(), "1 candidates") {
+    t.Fatal("expected the stored port to be probed, got", err)
+  }
+  if got := store.Get(STORE_AUTO_MASTER); !strings.HasSuffix(got, "ttyGone:57600") {
+    t.Errorf("a failed probe changed the stored port to %q", got)
+  }
+}
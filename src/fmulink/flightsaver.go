@@ -2,127 +2,353 @@ package fmulink
 
 import (
   "path"
-  "os"
   "time"
   "fmt"
+  "errors"
   "config"
   "sync"
+
+  "flightlog"
 )
 
+const (
+  // How often the quota and free space are checked while logging.
+  SPACE_CHECK_INTERVAL = 10 * time.Second
+
+  // Once logging has failed, out of space or otherwise, don't try again on
+  // every heartbeat.
+  SPACE_RETRY_INTERVAL = 60 * time.Second
+
+  // Always leave this much room on the disk for everything else.
+  MIN_FREE_SPACE = 16 * 1024 * 1024
+
+  // Cap on the pre-trigger buffer, whatever -logpre asks for.
+  MAX_PRE_TRIGGER_BYTES = 1024 * 1024
+)
+
+var ErrNoSpace = errors.New("Not enough space left for flight logs.")
+
 type FlightSaver struct {
   logPath     string
   isLogging   bool
-  file        *os.File
+  log         *flightlog.Writer
   fname       string
-  msgSet      map[uint8]bool
+  base        string
+  part        int
+  profile     LogProfile
   duration    time.Duration
-  timer       *time.Timer
+  lastLogged  map[uint8]time.Time
+
+  catalog     *flightlog.Catalog
+  opts        flightlog.WriterOptions
+  rotateSize  int64
+  quota       int64
+  lastCheck   time.Time
+  full        bool
+
+  // Why logging last stopped or couldn't start, nil once it starts again.
+  failure     error
+  failedAt    time.Time
+
+  // The last few seconds before a log starts, written out at the top of it.
+  pre         time.Duration
+  ring        []*flightlog.Record
+  ringBytes   int
+
+  // Called with the new file name when a flight rolls over to another file.
+  OnRotate    func(string)
   mut         sync.Mutex
-  quit        chan bool
 }
 
-func NewFlightSaver(fpath string) *FlightSaver {
-  dur := time.Duration(*config.SyncThrottle) * time.Millisecond
+func NewFlightSaver(fpath string, catalog *flightlog.Catalog) *FlightSaver {
+  dur := time.Duration(config.Get().Sync) * time.Millisecond
+
+  profile, err := ParseLogProfile(config.LogProfile)
+  if err != nil {
+    config.Log(config.LOG_WARN, "fl: ", err, "Using the default log profile.")
+    profile = DefaultLogProfile()
+  }
+
+  compress := *config.LogCompress
+  if err := flightlog.CheckCompression(compress); err != nil {
+    config.Log(config.LOG_WARN, "fl: ", err, "Writing uncompressed logs.")
+    compress = flightlog.COMPRESS_NONE
+  }
 
-  return &FlightSaver{
+  fs := &FlightSaver{
     fpath,
     false,
     nil,
     "",
-    make(map[uint8]bool),
+    "",
+    0,
+    profile,
     dur,
+    make(map[uint8]time.Time),
+    catalog,
+    flightlog.WriterOptions{Compress: compress},
+    int64(*config.LogRotateSize) * 1024 * 1024,
+    int64(*config.LogQuota) * 1024 * 1024,
+    time.Time{},
+    false,
+    nil,
+    time.Time{},
+    time.Duration(*config.LogPreTrigger) * time.Second,
+    nil,
+    0,
     nil,
     sync.Mutex{},
-    make(chan bool),
   }
-}
 
-// We want to throttle the messages but also ensure we're accessing them fairely.
-// My solution is to use a set that contains the packet Id, and flush
-// the set at the end of an interval. If it's not in the set, that means it hasn't
-// been accessed in the time period, and should be logged. Otherwise, ignore it
-// until the timer is up. This ensures a fairness bound on all incoming messages. The GC
-// will handle the dangling reference when the set is reallocated.
-//
-// TODO - there are certain messages like mission data we want to log regardless. Perhaps
-// making the bool double as a flag that this message should be logged always.
-func (fs *FlightSaver) throttler() {
-  for {
-    select {
-    case <- fs.timer.C:
-      // empty the set to allow more messages
-      // config.Log(config.LOG_DEBUG, "Timer wake up")
+  // Messages outside the profile follow -sync when it's reloaded.
+  config.OnChange(func(names []string) {
+    if config.Changed(names, "sync") {
       fs.mut.Lock()
-      fs.msgSet = make(map[uint8]bool)
-      fs.timer.Reset(fs.duration)
+      fs.duration = time.Duration(config.Get().Sync) * time.Millisecond
       fs.mut.Unlock()
-
-    case <- fs.quit:
-      return
     }
+  })
+  return fs
+}
+
+// Each message ID gets its own interval from the log profile, anything not in
+// the profile is logged at most once per -sync period. Timing is done per ID
+// against the last packet we kept, so a chatty message can't crowd out the rest.
+func (fs *FlightSaver) shouldLog(hdr uint8, now time.Time) bool {
+  interval, found := fs.profile[hdr]
+  if !found {
+    interval = fs.duration
+  }
+
+  switch {
+  case interval == LOG_ALWAYS:
+    return true
+  case interval < 0:
+    return false
   }
+
+  if last, ok := fs.lastLogged[hdr]; ok && now.Sub(last) < interval {
+    return false
+  }
+
+  fs.lastLogged[hdr] = now
+  return true
 }
 
-func (fs *FlightSaver) Start() error {
-  if fs.timer != nil {
-    fs.timer.Reset(fs.duration)
+// Makes room under the quota by dropping the oldest synced logs, and checks the
+// disk itself still has space. Must be called with the lock held.
+func (fs *FlightSaver) checkSpace() error {
+  fs.lastCheck = time.Now()
+
+  var used int64
+  if fs.quota > 0 {
+    var err error
+    if used, err = fs.catalog.Trim(fs.quota, fs.fname); err != nil {
+      config.Log(config.LOG_WARN, "fl: ", "Could not trim old flight logs:", err)
+    }
+  }
+
+  err := ErrNoSpace
+  if fs.quota > 0 && used >= fs.quota {
+    config.Log(config.LOG_DEBUG, "fl: ", "Flight logs at quota,", used, "bytes")
+  } else if free, ferr := flightlog.DiskFree(fs.logPath); ferr == nil && free < MIN_FREE_SPACE {
+    config.Log(config.LOG_DEBUG, "fl: ", "Only", free, "bytes free on disk")
   } else {
-    fs.timer = time.NewTimer(fs.duration)
+    err = nil
+  }
+
+  if err != nil && !fs.full {
+    config.Log(config.LOG_ERROR, "fl: ", "Out of space for flight logs, logging stopped.")
+  }
+  fs.full = err != nil
+  return err
+}
+
+// Opens the file for the current part. Must be called with the lock held.
+func (fs *FlightSaver) open() error {
+  fs.fname = fs.base + flightlog.Ext(fs.opts.Compress)
+  if fs.part > 1 {
+    fs.fname = fmt.Sprintf("%s part %d%s", fs.base, fs.part, flightlog.Ext(fs.opts.Compress))
   }
 
-  fs.msgSet = make(map[uint8]bool)
-  fs.fname =  "Flight " + time.Now().Format(time.UnixDate) + ".log"
-  fpath := path.Join(fs.logPath, fs.fname)
-  if f, err := os.Create(fpath); err != nil {
-        println("Error making file")
+  w, err := flightlog.Create(path.Join(fs.logPath, fs.fname), fs.opts)
+  if err != nil {
+    fs.fname = ""
     return err
-  } else {
+  }
 
-    go fs.throttler()
+  fs.log = w
+  if fs.catalog != nil {
+    fs.catalog.SetActive(fs.fname)
+  }
+  return nil
+}
 
-    fs.file = f
-    fs.mut.Lock()
-    fs.isLogging = true
-    fs.mut.Unlock()
+// Closes the current file and stops logging. Must be called with the lock held.
+func (fs *FlightSaver) stop() {
+  if fs.log != nil {
+    if err := fs.log.Close(); err != nil {
+      config.Log(config.LOG_ERROR, "fl: ", "Closing", fs.fname, err)
+    }
+  }
+
+  fs.isLogging = false
+  fs.log = nil
+  fs.fname = ""
+  if fs.catalog != nil {
+    fs.catalog.SetActive("")
+  }
+}
+
+func (fs *FlightSaver) Start() error {
+  fs.mut.Lock()
+  defer fs.mut.Unlock()
+
+  if fs.isLogging {
+    // The trigger and the API can race to start the same flight.
     return nil
   }
+
+  if fs.failure != nil && time.Since(fs.failedAt) < SPACE_RETRY_INTERVAL {
+    return fs.failure
+  }
+
+  fs.fname = ""
+  if err := fs.checkSpace(); err != nil {
+    return fs.fail(err)
+  }
+
+  fs.base = "Flight " + time.Now().Format(time.UnixDate)
+  fs.part = 1
+  if err := fs.open(); err != nil {
+    return fs.fail(err)
+  }
+
+  // Everything buffered went through the profile already, so keep its timing.
+  if len(fs.ring) == 0 {
+    fs.lastLogged = make(map[uint8]time.Time)
+  }
+  for _, rec := range fs.ring {
+    if err := fs.log.Write(rec.Time, rec.Packet); err != nil {
+      fs.stop()
+      return fs.fail(err)
+    }
+  }
+  fs.ring = nil
+  fs.ringBytes = 0
+
+  fs.isLogging = true
+  fs.failure = nil
+  return nil
+}
+
+// Notes why logging stopped, holding off the next start. Must be called with
+// the lock held.
+func (fs *FlightSaver) fail(err error) error {
+  // Running out of space is logged by checkSpace.
+  if err != ErrNoSpace {
+    config.Log(config.LOG_ERROR, "fl: ", "Flight logging stopped:", err)
+  }
+  fs.failure, fs.failedAt = err, time.Now()
+  return err
+}
+
+// Why logging last stopped or couldn't start, nil if it didn't fail.
+func (fs *FlightSaver) Failure() error {
+  fs.mut.Lock()
+  defer fs.mut.Unlock()
+  return fs.failure
+}
+
+// Keeps a packet in the pre-trigger buffer, dropping anything that's aged out.
+// Must be called with the lock held.
+func (fs *FlightSaver) buffer(now time.Time, data []byte) {
+  pkt := make([]byte, len(data))
+  copy(pkt, data)
+  fs.ring = append(fs.ring, &flightlog.Record{Time: now, Packet: pkt})
+  fs.ringBytes += len(pkt)
+
+  drop := 0
+  for drop < len(fs.ring) && (now.Sub(fs.ring[drop].Time) > fs.pre || fs.ringBytes > MAX_PRE_TRIGGER_BYTES) {
+    fs.ringBytes -= len(fs.ring[drop].Packet)
+    drop++
+  }
+
+  if drop > 0 {
+    // Copy down rather than reslice, so the dropped packets can be collected.
+    n := copy(fs.ring, fs.ring[drop:])
+    for i := n; i < len(fs.ring); i++ {
+      fs.ring[i] = nil
+    }
+    fs.ring = fs.ring[:n]
+  }
 }
 
 func (fs *FlightSaver) End() {
-  fs.isLogging  = false
-  fs.fname = ""
-  fs.file.Close()
-  fs.timer.Stop()
-  fs.quit <- true
+  fs.mut.Lock()
+  defer fs.mut.Unlock()
+  fs.stop()
 }
 
+// Closes the current file and carries on in the next part. Must be called with
+// the lock held.
+func (fs *FlightSaver) rotate() error {
+  if err := fs.log.Close(); err != nil {
+    config.Log(config.LOG_ERROR, "fl: ", "Closing", fs.fname, err)
+  }
+  fs.log = nil
+
+  fs.part++
+  if err := fs.open(); err != nil {
+    return err
+  }
+
+  config.Log(config.LOG_INFO, "fl: ", "Flight log continues in", fs.fname)
+  if fs.OnRotate != nil {
+    fs.OnRotate(fs.fname)
+  }
+  return nil
+}
+
+// Writes a packet to the current flight, or holds on to it for the next one
+// while nothing is being logged. If the disk fills up or the log can't be
+// written, logging stops, the error is returned, and Start holds off for a
+// while.
 func (fs *FlightSaver) Persist(data *[]byte, hdr uint8) error {
-  if fs.isLogging && fs.file != nil {
-    if chunk, err := time.Now().MarshalBinary(); err != nil {
-      return err
-    } else {
-      fs.mut.Lock()
-      if _, found := fs.msgSet[hdr]; !found {
-        fs.msgSet[hdr] = true
-        fs.mut.Unlock()
-        if _, err := fs.file.Write(chunk); err != nil {
-          return err
-        } else if _, err := fs.file.Write(*data); err != nil {
-          return err
-        } else {
-          return nil
-        }
-      } else {
-        fs.mut.Unlock() // not deferring this because we want to not lock asap
-        // Message is in the set, so avoid syncing till the timer empties the set.
-        return nil
-      }
+  fs.mut.Lock()
+  defer fs.mut.Unlock()
+
+  if !fs.isLogging && fs.pre <= 0 {
+    return nil
+  }
+
+  now := time.Now()
+  if !fs.shouldLog(hdr, now) {
+    return nil
+  }
+
+  if !fs.isLogging || fs.log == nil {
+    fs.buffer(now, *data)
+    return nil
+  }
+
+  if now.Sub(fs.lastCheck) >= SPACE_CHECK_INTERVAL {
+    if err := fs.checkSpace(); err != nil {
+      fs.stop()
+      return fs.fail(err)
     }
+  }
 
-  } else {
-    // Probably won't catch this error, but indicate it anyways.
-    return fmt.Errorf("Attempted to log flight data when none are open!")
+  err := fs.log.Write(now, *data)
+  if err == nil && fs.rotateSize > 0 && fs.log.Size() >= fs.rotateSize {
+    err = fs.rotate()
+  }
+
+  if err != nil {
+    fs.stop()
+    return fs.fail(err)
   }
+  return nil
 }
 
 func (fs *FlightSaver) IsLogging() bool {
@@ -132,5 +358,7 @@ func (fs *FlightSaver) IsLogging() bool {
 }
 
 func (fs *FlightSaver) Name() string {
+  fs.mut.Lock()
+  defer fs.mut.Unlock()
   return fs.fname
 }
@@ -2,7 +2,6 @@ package fmulink
 
 import (
   "math"
-  "net"
   "regexp"
   "sync"
   "time"
@@ -12,7 +11,7 @@ import (
   "strings"
 
   "mavlink/parser"
-  "fmulink/serial"
+  "flightlog"
 
   "cloudlink"
   "config"
@@ -24,7 +23,7 @@ const (
   FMUSTATUS_GOOD = "online"
   FMUSTATUS_ERROR = "error"
 
-  UDP_REGEX = `^(((\d{1,3}\.){3}\d)|localhost):\d{1,5}$`
+  UDP_REGEX = `^(((\d{1,3}\.){3}\d{1,3})|localhost):\d{1,5}$`
   DEFAULT_BAUD = 57600
 
   // New versions of PX4 dropped the `rc.usb` script
@@ -35,17 +34,19 @@ var (
   status         Status
   fmu            Fmu
 
-  mavConn       io.ReadWriter
+  mavConn       io.ReadWriteCloser
+  connMut       sync.RWMutex
   RawDataPipe   chan []byte
   ConnReady     chan bool
+  readyOnce     sync.Once
 
   Params         map[string]interface{}
   Managers       map[int]*MsgManager
   Outputs        *OutputManager = NewOutputManager()
   Saver          *FlightSaver
+  Trigger        *LogTrigger
 
   enc            *mavlink.Encoder
-  dec            *mavlink.Decoder
 
   // Telem         map[string]mavlink.Message
 
@@ -56,6 +57,9 @@ type Status struct {
   // Link
   Link        string
 
+  // Master link lifecycle, see LINK_* states.
+  LinkState   string
+
   // Flight Data
   FlightData  string
 
@@ -141,13 +145,18 @@ type Fmu struct {
   mut               sync.RWMutex
 }
 
-func GetConn() io.ReadWriter {
-  fmu.mut.RLock()
-  defer fmu.mut.RUnlock()
-  if mavConn == nil {
-    panic("API: Tried to grab a nil conn object!!!")
+// The returned writer stays valid across reconnects, it always writes to
+// whichever master link is currently up.
+func GetConn() io.Writer {
+  return linkWriter{}
+}
+
+// Name of the flight log being written right now, or "" when not recording.
+func RecordingName() string {
+  if Saver == nil || !Saver.IsLogging() {
+    return ""
   }
-  return mavConn
+  return Saver.Name()
 }
 
 func FmuReadLock() {
@@ -159,100 +168,24 @@ func FmuReadUnlock() {
 }
 
 func Serve(cl *cloudlink.CloudLink) {
-  defer func() {
-    if r := recover(); r != nil {
-      config.Log(config.LOG_ERROR, "fl: ", "LINK LOST. Is the master link alive?")
-
-      <- time.After(5 * time.Second)
-      Serve(cl)
-    }
-  }()
-
   RawDataPipe = make(chan []byte, 50)
 
-  addr := config.LinkPath
-  out := config.Output
-
-  if matched, err := regexp.MatchString(UDP_REGEX, *addr); err != nil {
-    panic(err)
-  } else if matched {
-
-    if *config.Remote != "" {
-      udpAddr, err := net.ResolveUDPAddr("udp", *addr)
-      if err != nil {
-        config.Log(config.LOG_ERROR, err)
-        panic(err)
-      }
-      sudpAddr, err2 := net.ResolveUDPAddr("udp", *config.Remote)
-      if err != nil {
-        config.Log(config.LOG_ERROR, err2)
-        panic(err)
-      }
-
-      conn, listenerr := net.DialUDP("udp", udpAddr, sudpAddr)
-      if listenerr != nil {
-        config.Log(config.LOG_ERROR, listenerr)
-        panic(listenerr)
-      }
-
-      mavConn = conn
-      config.Log(config.LOG_INFO, "[REMOTE] ", "Listening on", udpAddr)
-    } else {
-      udpAddr, err := net.ResolveUDPAddr("udp", *addr)
-      if err != nil {
-        panic(err)
-      }
-
-      conn, listenerr := net.ListenUDP("udp", udpAddr)
-      if listenerr != nil {
-        panic(listenerr)
-      }
-
-      mavConn = conn
-      config.Log(config.LOG_INFO, "fl: ", "Listening on", udpAddr)
-    }
+  initFmu(cl)
 
+  enc = mavlink.NewEncoder(linkWriter{})
 
-  } else {
-
-    /*
-    Example formats
-
-    Windows:
-      COM43:115200
-
-    Linux:
-      /dev/ttyMFD1:115200
-
-    OSX:
-      /dev/tty.usbserial:115200
-    */
-
-    cfg := regexp.MustCompile(`:`).Split(*addr, 2)
-    var baud int
-
-    // assume a baudrate if none provided
-    if len(cfg) < 2 {
-      baud = DEFAULT_BAUD
-    } else {
-      var err error
-      baud, err = strconv.Atoi(cfg[1])
-      if err != nil {
-        baud = DEFAULT_BAUD
+  // listen for inputs
+  go func() {
+    for {
+      b := <- Outputs.Input
+      if _, err := (linkWriter{}).Write(b); err != nil {
+        config.Log(config.LOG_DEBUG, "fl: ", err)
       }
     }
-
-    config.Log(config.LOG_DEBUG, "Opening port", cfg[0], "with", baud)
-    if conn, err := serial.OpenPort(&serial.Config{Name: cfg[0], Baud: baud}); err != nil {
-      panic(err)
-    } else {
-      mavConn = conn
-      config.Log(config.LOG_INFO, "fl: ", "Listening on", *addr)
-    }
-  }
+  }()
 
   // create outputs from command line. Max of 20 may be init at once.
-  outs := regexp.MustCompile(`,`).Split(*out, 20)
+  outs := splitOutputs(config.Get().Output)
 
   for i := range outs {
     if outs[i] != "" {
@@ -270,14 +203,59 @@ func Serve(cl *cloudlink.CloudLink) {
     }
   }
 
-  enc = mavlink.NewEncoder(mavConn)
-	dec = mavlink.NewDecoder(mavConn)
+  // Outputs from config follow it when it's reloaded.
+  config.OnChange(func(names []string) {
+    if config.Changed(names, "output") {
+      next := splitOutputs(config.Get().Output)
+      reloadOutputs(outs, next)
+      outs = next
+    }
+  })
+
+  // A master picked over the API sticks across restarts, unless -master was
+  // given on the command line.
+  linkMut.Lock()
+  masterAddr = *config.LinkPath
+  stored := cl.GetStore().Get(STORE_MASTER)
+  switch {
+  case stored == "":
+  case config.Source("master") == config.SOURCE_FLAG:
+    config.Log(config.LOG_WARN, "fl: ", "Ignoring stored master link", stored, "for -master", masterAddr)
+  default:
+    config.Log(config.LOG_WARN, "fl: ", "Using stored master link", stored, "instead of", masterAddr)
+    masterAddr = stored
+  }
+  linkMut.Unlock()
+
+  // Link lifecycle. Each pass opens the master link, reads from it until it
+  // fails, then tears it down completely before trying again.
+  for {
+    linkPass(cl, func(conn io.ReadWriteCloser) error {
+      // Let API know we're ready to roll
+      readyOnce.Do(func() { ConnReady <- true })
 
-  // Let API know we're ready to roll
-  ConnReady <- true
+      // See if our link sending MAVLink or in the shell.
+      checkShell(conn)
 
-  gotCaps := false
+      err := readLoop(conn, cl)
+
+      // Don't leave a half written flight open on a dead link.
+      Trigger.Reset()
+      if Saver.IsLogging() {
+        config.Log(config.LOG_INFO, "fl: Link lost: Stop logging.")
+        Saver.End()
+        cl.SendSyncUnlock()
+      }
+      return err
+    })
 
+    linkRetry(LINK_RETRY)
+  }
+}
+
+// Sets up the state shared across reconnects. Only done once, so the status
+// managers and their goroutines aren't duplicated every time the link drops.
+func initFmu(cl *cloudlink.CloudLink) {
   status = Status{
     Link: FMUSTATUS_UNKNOWN,
   }
@@ -286,11 +264,32 @@ func Serve(cl *cloudlink.CloudLink) {
     Generic: make(map[string]mavlink.Packet),
     CloudOnline: FMUSTATUS_DOWN,
   }
+  fmu.Meta.Link = FMUSTATUS_UNKNOWN
 
-  Params :=     make(map[string]interface{})
-  Managers :=   make(map[int]MsgManager)
+  Params =     make(map[string]interface{})
   // Telem :=      make(map[string]mavlink.Message)
-  Saver = NewFlightSaver(*config.FlightLogPath)
+  Saver = NewFlightSaver(*config.FlightLogPath, cl.GetCatalog())
+  Saver.OnRotate = cl.SendSyncLock
+  Trigger = NewLogTrigger(*config.LogTrigger, time.Duration(*config.LogPostTrigger) * time.Second)
+
+  // Logs left open by a power loss are cut back to their last good block.
+  if n, err := flightlog.RecoverDir(*config.FlightLogPath); err != nil {
+    config.Log(config.LOG_WARN, "fl: ", "Recovering flight logs:", err)
+  } else if n > 0 {
+    config.Log(config.LOG_INFO, "fl: ", "Recovered", n, "unfinished flight logs")
+  }
+
+  // Flights recorded before the switch to .tlog get converted so the syncer and
+  // replay only ever deal with one format.
+  if n, err := flightlog.ConvertDir(*config.FlightLogPath); err != nil {
+    config.Log(config.LOG_WARN, "fl: ", "Converting old flight logs:", err)
+  } else if n > 0 {
+    config.Log(config.LOG_INFO, "fl: ", "Converted", n, "old flight logs to tlog")
+  }
+
+  managersMut.Lock()
+  defer managersMut.Unlock()
+  Managers =   make(map[int]*MsgManager)
 
   {
     hbmm := NewMsgManager(time.Second * 2)
@@ -298,299 +297,304 @@ func Serve(cl *cloudlink.CloudLink) {
       config.Log(config.LOG_ERROR, "fl: ", "Link Down")
       fmu.Meta.Link = FMUSTATUS_DOWN
     }
-    Managers[mavlink.MSG_ID_HEARTBEAT] = *hbmm
+    Managers[mavlink.MSG_ID_HEARTBEAT] = hbmm
 
     vfrmm := NewMsgManager(time.Second)
     vfrmm.OnDown = func() { fmu.Meta.FlightData = FMUSTATUS_DOWN }
-    Managers[mavlink.MSG_ID_VFR_HUD] = *vfrmm
+    Managers[mavlink.MSG_ID_VFR_HUD] = vfrmm
 
     attCtrlmm := NewMsgManager(time.Second)
     attCtrlmm.OnDown = func() { fmu.Meta.AttCtrl = FMUSTATUS_DOWN }
-    Managers[mavlink.MSG_ID_ATTITUDE_TARGET] = *attCtrlmm
+    Managers[mavlink.MSG_ID_ATTITUDE_TARGET] = attCtrlmm
 
     attEstmm := NewMsgManager(time.Second)
     attEstmm.OnDown = func() { fmu.Meta.AttEst = FMUSTATUS_DOWN }
-    Managers[mavlink.MSG_ID_ATTITUDE] = *attEstmm
+    Managers[mavlink.MSG_ID_ATTITUDE] = attEstmm
 
     batStatusmm := NewMsgManager(time.Second * 4)
     batStatusmm.OnDown = func() { fmu.Meta.Power = FMUSTATUS_DOWN }
-    Managers[mavlink.MSG_ID_BATTERY_STATUS] = *batStatusmm
+    Managers[mavlink.MSG_ID_BATTERY_STATUS] = batStatusmm
 
     imumm := NewMsgManager(time.Second)
     imumm.OnDown = func() { fmu.Meta.Sensors = FMUSTATUS_DOWN }
-    Managers[mavlink.MSG_ID_HIGHRES_IMU] = *imumm
+    Managers[mavlink.MSG_ID_HIGHRES_IMU] = imumm
 
     rcmm := NewMsgManager(time.Second)
     rcmm.OnDown = func() { fmu.Meta.RC = FMUSTATUS_DOWN }
-    Managers[mavlink.MSG_ID_RC_CHANNELS] = *rcmm
+    Managers[mavlink.MSG_ID_RC_CHANNELS] = rcmm
 
     localmm := NewMsgManager(time.Second)
     localmm.OnDown = func() { fmu.Meta.LocalPosEst = FMUSTATUS_DOWN }
-    Managers[mavlink.MSG_ID_LOCAL_POSITION_NED] = *localmm
+    Managers[mavlink.MSG_ID_LOCAL_POSITION_NED] = localmm
 
     globalEstmm := NewMsgManager(time.Second)
     globalEstmm.OnDown = func() { fmu.Meta.GlobalPosEst = FMUSTATUS_DOWN }
-    Managers[mavlink.MSG_ID_GLOBAL_POSITION_INT] = *globalEstmm
+    Managers[mavlink.MSG_ID_GLOBAL_POSITION_INT] = globalEstmm
 
     globalPosmm := NewMsgManager(time.Second)
     globalPosmm.OnDown = func() { fmu.Meta.GlobalPosCtrl = FMUSTATUS_DOWN }
-    Managers[mavlink.MSG_ID_POSITION_TARGET_GLOBAL_INT] = *globalPosmm
+    Managers[mavlink.MSG_ID_POSITION_TARGET_GLOBAL_INT] = globalPosmm
 
     gpsmm := NewMsgManager(time.Second * 2)
     gpsmm.OnDown = func() { fmu.Meta.Gps = FMUSTATUS_DOWN }
-    Managers[mavlink.MSG_ID_GPS_RAW_INT] = *gpsmm
+    Managers[mavlink.MSG_ID_GPS_RAW_INT] = gpsmm
 
     altmm := NewMsgManager(time.Second * 2)
     altmm.OnDown = func() { fmu.Meta.Altitude = FMUSTATUS_DOWN }
-    Managers[mavlink.MSG_ID_ALTITUDE] = *altmm
+    Managers[mavlink.MSG_ID_ALTITUDE] = altmm
 
     servomm := NewMsgManager(time.Second)
     servomm.OnDown = func() { fmu.Meta.Servos = FMUSTATUS_DOWN }
-    Managers[mavlink.MSG_ID_SERVO_OUTPUT_RAW] = *servomm
+    Managers[mavlink.MSG_ID_SERVO_OUTPUT_RAW] = servomm
 
     actmm := NewMsgManager(time.Second)
     actmm.OnDown = func() { fmu.Meta.Actuators = FMUSTATUS_DOWN }
-    Managers[mavlink.MSG_ID_ACTUATOR_CONTROL_TARGET] = *actmm
+    Managers[mavlink.MSG_ID_ACTUATOR_CONTROL_TARGET] = actmm
   }
+}
 
-  // listen for inputs
-  go func() {
-    for {
-      b := <- Outputs.Input
-      mavConn.Write(b)
+// Reads packets off the link until it fails. Bad packets are expected on a noisy
+// line and just get skipped; anything else means the link itself is gone.
+func readLoop(conn io.Reader, cl *cloudlink.CloudLink) error {
+  dec := mavlink.NewDecoder(conn)
+
+  for {
+    // Add a small delay to give the handler some down time.
+    // XXX if this causes latency issue, consider going to a higher resolution.
+    // Probably not a good idea to remove all together, as it can cause mavlink read issues.
+    time.Sleep(50 * time.Microsecond)
+
+    if pkt, err := dec.Decode(); err != nil {
+      if !isDecodeError(err) {
+        return err
+      }
+      if err == mavlink.ErrCrcFail {
+        decodeErrors.With("crc").Inc()
+      } else {
+        decodeErrors.With("unknown_msg").Inc()
+      }
+      config.Log(config.LOG_DEBUG, "fl: ", "Decode fail:", err)
+    } else {
+      handlePacket(pkt, cl)
     }
-  }()
+  }
+}
 
-  // handle outputs
-  go func() {
-    for {
-      // inBuf, num := getPacket(mavConn)
-      // num, _ := mavConn.Read(inBuf)
-      // if num > 0 {
-
-        // Add a small delay to give the handler some down time.
-        // XXX if this causes latency issue, consider going to a higher resolution.
-        // Probably not a good idea to remove all together, as it can cause mavlink read issues.
-        time.Sleep(50 * time.Microsecond)
-
-        // log.Println(inBuf[:num])
-    		if pkt, err := dec.Decode(); err != nil {
-          // if _, ok := err.(io.Reader); !ok {
-          //   panic(err)
-          // }
-    			config.Log(config.LOG_DEBUG, "fl: ", "Decode fail:", err)
-    		} else {
-
-          // get byte array
-          bin := unrollPacket(pkt)
-          // Echo to outputs
-          Outputs.Send(bin)
-
-          // Pretty much all of DS Link's functionality is contingent on this
-          // thread, so we don't want the read thread to hang on this.
-          {
-            copyBuff := make([]byte, len(*bin))
-            copy(copyBuff, *bin)
-
-            select {
-            case RawDataPipe <- copyBuff:
-            default:
-              // do nothing, due to different timings, it will happen, a lot.
-            }
-          }
-
-          // Log Data (if in log mode)
-          if !*config.DisableFlights && Saver.IsLogging() {
-            if err := Saver.Persist(bin, pkt.MsgID); err != nil {
-              config.Log(config.LOG_ERROR, "fmu: ", err)
-            }
-          }
-
-          // Update cloud
-          go cl.UpdateFromFMU(*bin)
-
-          {
-            chunk := cl.GetRawFmuCmd()
-            if chunk != nil {
-
-              p := &mavlink.Packet{
-            		SeqID:  chunk[2],
-            		SysID:  chunk[3],
-            		CompID: chunk[4],
-            		MsgID:  chunk[5],
-                Payload: chunk[6:len(chunk)-2],
-              }
-
-              if err := enc.EncodePacket(p); err != nil {
-                config.Log(config.LOG_ERROR, err)
-              }
-              cl.NullRawFmuCmd()
-            }
-          }
-
-          // Update FMU struct
-          fmu.Meta.mut.Lock()
-          fmu.mut.Lock()
-
-          // XXX we'll consider this an `update` and check to see if the cloud is up.
-          // Probably better to decouple this, but for now it's ok.
-
-          {
-            b := cl.IsOnlineNonBlock()
-            if b {
-              fmu.CloudOnline = FMUSTATUS_GOOD
-            } else {
-              fmu.CloudOnline = FMUSTATUS_DOWN
-            }
-          }
-
-          switch pkt.MsgID {
-
-            // Params
-          case mavlink.MSG_ID_PARAM_VALUE:
-            var pv mavlink.ParamValue
-            if err := pv.Unpack(pkt); err == nil {
-              Params[string(pv.ParamId[:len(pv.ParamId)])] = pv.ParamValue
-            }
-
-          case mavlink.MSG_ID_AUTOPILOT_VERSION:
-            var pv mavlink.AutopilotVersion
-            if err := pv.Unpack(pkt); err == nil {
-              AutopilotCaps = &pv
-              gotCaps = true
-              cl.UpdateSerialId(pv.Uid)
-            }
-
-            // Status Text
-          case mavlink.MSG_ID_STATUSTEXT:
-            var pv mavlink.Statustext
-            if err := pv.Unpack(pkt); err == nil {
-              handleStatusText(&pv)
-            }
-
-            // VFR
-          case mavlink.MSG_ID_VFR_HUD:
-            var pv mavlink.VfrHud
-            if err := pv.Unpack(pkt); err == nil {
-              fmu.Vfr = pv
-              mm := Managers[int(pkt.MsgID)]
-              fmu.Meta.FlightData = FMUSTATUS_GOOD
-              mm.Update()
-            }
-
-            // Attitude Controller
-          case mavlink.MSG_ID_ATTITUDE_TARGET:
-            var pv mavlink.AttitudeTarget
-            if err := pv.Unpack(pkt); err == nil {
-              fmu.AttCtrl = pv
-              mm := Managers[int(pkt.MsgID)]
-              fmu.Meta.AttCtrl = FMUSTATUS_GOOD
-              mm.Update()
-            }
-
-            // Attitude Estimator
-          case mavlink.MSG_ID_ATTITUDE:
-            var pv mavlink.Attitude
-            if err := pv.Unpack(pkt); err == nil {
-              fmu.AttEst = pv
-              mm := Managers[int(pkt.MsgID)]
-              fmu.Meta.AttEst = FMUSTATUS_GOOD
-              mm.Update()
-            }
-
-            // Global Position
-          case mavlink.MSG_ID_GLOBAL_POSITION_INT:
-            var pv mavlink.GlobalPositionInt
-            if err := pv.Unpack(pkt); err == nil {
-              fmu.GlobalPos = pv
-              mm := Managers[int(pkt.MsgID)]
-              fmu.Meta.GlobalPosEst = FMUSTATUS_GOOD
-              mm.Update()
-            }
-
-            // Local Position
-          case mavlink.MSG_ID_LOCAL_POSITION_NED:
-            var pv mavlink.LocalPositionNed
-            if err := pv.Unpack(pkt); err == nil {
-              fmu.LocalPos = pv
-              mm := Managers[int(pkt.MsgID)]
-              fmu.Meta.LocalPosEst = FMUSTATUS_GOOD
-              mm.Update()
-            }
-
-            // Global Position Target
-          case mavlink.MSG_ID_POSITION_TARGET_GLOBAL_INT:
-            var pv mavlink.PositionTargetGlobalInt
-            if err := pv.Unpack(pkt); err == nil {
-              fmu.GlobalPosTarget = pv
-              mm := Managers[int(pkt.MsgID)]
-              fmu.Meta.GlobalPosCtrl = FMUSTATUS_GOOD
-              mm.Update()
-            }
-
-            // Gps data
-          case mavlink.MSG_ID_GPS_RAW_INT:
-            var pv mavlink.GpsRawInt
-            if err := pv.Unpack(pkt); err == nil {
-              fmu.Gps = pv
-              mm := Managers[int(pkt.MsgID)]
-              fmu.Meta.Gps = FMUSTATUS_GOOD
-              mm.Update()
-            }
-
-            // Gps home
-          case mavlink.MSG_ID_GPS_GLOBAL_ORIGIN:
-            var pv mavlink.GpsGlobalOrigin
-            if err := pv.Unpack(pkt); err == nil {
-              fmu.GpsGlobalOrigin = pv
-            }
-
-            // Sensors
-          case mavlink.MSG_ID_HIGHRES_IMU:
-            var pv mavlink.HighresImu
-            if err := pv.Unpack(pkt); err == nil {
-              fmu.Imu = pv
-              mm := Managers[int(pkt.MsgID)]
-              fmu.Meta.Sensors = FMUSTATUS_GOOD
-              mm.Update()
-            }
-
-            // Battery
-          case mavlink.MSG_ID_BATTERY_STATUS:
-            var pv mavlink.BatteryStatus
-            if err := pv.Unpack(pkt); err == nil {
-              fmu.Battery = pv
-              mm := Managers[int(pkt.MsgID)]
-              fmu.Meta.Power = FMUSTATUS_GOOD
-              mm.Update()
-            }
-
-            // RC Values
-          case mavlink.MSG_ID_RC_CHANNELS:
-            var pv mavlink.RcChannels
-            if err := pv.Unpack(pkt); err == nil {
-              fmu.RcValues = pv
-              mm := Managers[int(pkt.MsgID)]
-              fmu.Meta.RC = FMUSTATUS_GOOD
-              mm.Update()
-            }
-
-            // RC Status
-          case mavlink.MSG_ID_RADIO_STATUS:
-            var pv mavlink.RadioStatus
-            if err := pv.Unpack(pkt); err == nil {
-              fmu.RcStatus = pv
-            }
-
-            // Basic Connectivity
-          case mavlink.MSG_ID_HEARTBEAT:
-            var pv mavlink.Heartbeat
-            if err := pv.Unpack(pkt); err == nil {
-              fmu.Hb = pv
-
-              // if !gotCaps {
-              //   getCaps(enc)
-              // }
+func handlePacket(pkt *mavlink.Packet, cl *cloudlink.CloudLink) {
+  // get byte array
+  bin := unrollPacket(pkt)
+  packetsReceived.With(METRIC_LINK_MASTER, metricMsg(pkt.MsgID)).Inc()
+  // Echo to outputs
+  Outputs.Send(bin)
+
+  // Pretty much all of DS Link's functionality is contingent on this
+  // thread, so we don't want the read thread to hang on this.
+  {
+    copyBuff := make([]byte, len(*bin))
+    copy(copyBuff, *bin)
+
+    select {
+    case RawDataPipe <- copyBuff:
+    default:
+      // do nothing, due to different timings, it will happen, a lot.
+      rawPipeDrops.Inc()
+    }
+  }
+
+  // Log Data, or keep it in the pre-trigger buffer
+  if !*config.DisableFlights && GetReplay() == nil {
+    // Failures are logged by the saver.
+    if err := Saver.Persist(bin, pkt.MsgID); err != nil && !Saver.IsLogging() {
+      cl.SendSyncUnlock()
+    }
+  }
+
+  // Update cloud. A replay is history, not the drone's state now.
+  if GetReplay() == nil {
+    go cl.UpdateFromFMU(*bin)
+  }
+
+  {
+    chunk := cl.GetRawFmuCmd()
+    if chunk != nil {
+
+      p := &mavlink.Packet{
+    		SeqID:  chunk[2],
+    		SysID:  chunk[3],
+    		CompID: chunk[4],
+    		MsgID:  chunk[5],
+        Payload: chunk[6:len(chunk)-2],
+      }
+
+      if err := enc.EncodePacket(p); err != nil {
+        config.Log(config.LOG_ERROR, err)
+      }
+      cl.NullRawFmuCmd()
+    }
+  }
+
+  // Update FMU struct
+  fmu.Meta.mut.Lock()
+  fmu.mut.Lock()
+
+  // XXX we'll consider this an `update` and check to see if the cloud is up.
+  // Probably better to decouple this, but for now it's ok.
+
+  {
+    b := cl.IsOnlineNonBlock()
+    if b {
+      fmu.CloudOnline = FMUSTATUS_GOOD
+    } else {
+      fmu.CloudOnline = FMUSTATUS_DOWN
+    }
+  }
+
+  switch pkt.MsgID {
+
+    // Params
+  case mavlink.MSG_ID_PARAM_VALUE:
+    var pv mavlink.ParamValue
+    if err := pv.Unpack(pkt); err == nil {
+      Params[string(pv.ParamId[:len(pv.ParamId)])] = pv.ParamValue
+    }
+
+  case mavlink.MSG_ID_AUTOPILOT_VERSION:
+    var pv mavlink.AutopilotVersion
+    if err := pv.Unpack(pkt); err == nil {
+      AutopilotCaps = &pv
+      cl.UpdateSerialId(pv.Uid)
+    }
+
+    // Status Text
+  case mavlink.MSG_ID_STATUSTEXT:
+    var pv mavlink.Statustext
+    if err := pv.Unpack(pkt); err == nil {
+      handleStatusText(&pv)
+    }
+
+    // VFR
+  case mavlink.MSG_ID_VFR_HUD:
+    var pv mavlink.VfrHud
+    if err := pv.Unpack(pkt); err == nil {
+      fmu.Vfr = pv
+      mm := Managers[int(pkt.MsgID)]
+      fmu.Meta.FlightData = FMUSTATUS_GOOD
+      mm.Update()
+    }
+
+    // Attitude Controller
+  case mavlink.MSG_ID_ATTITUDE_TARGET:
+    var pv mavlink.AttitudeTarget
+    if err := pv.Unpack(pkt); err == nil {
+      fmu.AttCtrl = pv
+      mm := Managers[int(pkt.MsgID)]
+      fmu.Meta.AttCtrl = FMUSTATUS_GOOD
+      mm.Update()
+    }
+
+    // Attitude Estimator
+  case mavlink.MSG_ID_ATTITUDE:
+    var pv mavlink.Attitude
+    if err := pv.Unpack(pkt); err == nil {
+      fmu.AttEst = pv
+      mm := Managers[int(pkt.MsgID)]
+      fmu.Meta.AttEst = FMUSTATUS_GOOD
+      mm.Update()
+    }
+
+    // Global Position
+  case mavlink.MSG_ID_GLOBAL_POSITION_INT:
+    var pv mavlink.GlobalPositionInt
+    if err := pv.Unpack(pkt); err == nil {
+      fmu.GlobalPos = pv
+      mm := Managers[int(pkt.MsgID)]
+      fmu.Meta.GlobalPosEst = FMUSTATUS_GOOD
+      mm.Update()
+    }
+
+    // Local Position
+  case mavlink.MSG_ID_LOCAL_POSITION_NED:
+    var pv mavlink.LocalPositionNed
+    if err := pv.Unpack(pkt); err == nil {
+      fmu.LocalPos = pv
+      mm := Managers[int(pkt.MsgID)]
+      fmu.Meta.LocalPosEst = FMUSTATUS_GOOD
+      mm.Update()
+    }
+
+    // Global Position Target
+  case mavlink.MSG_ID_POSITION_TARGET_GLOBAL_INT:
+    var pv mavlink.PositionTargetGlobalInt
+    if err := pv.Unpack(pkt); err == nil {
+      fmu.GlobalPosTarget = pv
+      mm := Managers[int(pkt.MsgID)]
+      fmu.Meta.GlobalPosCtrl = FMUSTATUS_GOOD
+      mm.Update()
+    }
+
+    // Gps data
+  case mavlink.MSG_ID_GPS_RAW_INT:
+    var pv mavlink.GpsRawInt
+    if err := pv.Unpack(pkt); err == nil {
+      fmu.Gps = pv
+      mm := Managers[int(pkt.MsgID)]
+      fmu.Meta.Gps = FMUSTATUS_GOOD
+      mm.Update()
+    }
+
+    // Gps home
+  case mavlink.MSG_ID_GPS_GLOBAL_ORIGIN:
+    var pv mavlink.GpsGlobalOrigin
+    if err := pv.Unpack(pkt); err == nil {
+      fmu.GpsGlobalOrigin = pv
+    }
+
+    // Sensors
+  case mavlink.MSG_ID_HIGHRES_IMU:
+    var pv mavlink.HighresImu
+    if err := pv.Unpack(pkt); err == nil {
+      fmu.Imu = pv
+      mm := Managers[int(pkt.MsgID)]
+      fmu.Meta.Sensors = FMUSTATUS_GOOD
+      mm.Update()
+    }
+
+    // Battery
+  case mavlink.MSG_ID_BATTERY_STATUS:
+    var pv mavlink.BatteryStatus
+    if err := pv.Unpack(pkt); err == nil {
+      fmu.Battery = pv
+      mm := Managers[int(pkt.MsgID)]
+      fmu.Meta.Power = FMUSTATUS_GOOD
+      mm.Update()
+    }
+
+    // RC Values
+  case mavlink.MSG_ID_RC_CHANNELS:
+    var pv mavlink.RcChannels
+    if err := pv.Unpack(pkt); err == nil {
+      fmu.RcValues = pv
+      mm := Managers[int(pkt.MsgID)]
+      fmu.Meta.RC = FMUSTATUS_GOOD
+      mm.Update()
+    }
+
+    // RC Status
+  case mavlink.MSG_ID_RADIO_STATUS:
+    var pv mavlink.RadioStatus
+    if err := pv.Unpack(pkt); err == nil {
+      fmu.RcStatus = pv
+    }
+
+    // Basic Connectivity
+  case mavlink.MSG_ID_HEARTBEAT:
+    var pv mavlink.Heartbeat
+    if err := pv.Unpack(pkt); err == nil {
+      fmu.Hb = pv
+
+      // if !gotCaps {
+      //   getCaps(enc)
+      // }
 
 		// Need to let the link know we're alive so we can send commands
 		hbcmd := &mavlink.Heartbeat{
@@ -606,136 +610,122 @@ func Serve(cl *cloudlink.CloudLink) {
 		}
 
 
-              mm := Managers[int(pkt.MsgID)]
-
-              if fmu.Meta.Link == FMUSTATUS_DOWN || fmu.Meta.Link == FMUSTATUS_UNKNOWN {
-                config.Log(config.LOG_INFO, "fl: ", "Link Established.")
-                config.Log(config.LOG_INFO, "fl: ", "\tType:", pv.Type)
-                config.Log(config.LOG_INFO, "fl: ", "\tAutopilot:", pv.Autopilot)
-                config.Log(config.LOG_INFO, "fl: ", "\tPrimary Mode:", pv.BaseMode)
-                config.Log(config.LOG_INFO, "fl: ", "\tSecondary Mode:", pv.CustomMode)
-                config.Log(config.LOG_INFO, "fl: ", "\tSystem Status:", pv.SystemStatus)
-                config.Log(config.LOG_INFO, "fl: ", "\tVersion:", pv.MavlinkVersion)
-              }
-
-              // Use Acro/Manual as our trigger for testing.
-              // if pv.BaseMode & 16 == 16 && !Saver.IsLogging() {
-              //   config.Log(config.LOG_INFO, "fl: Event Trigger: Start logging.")
-              //   Saver.Start()
-              //   cl.SendSyncLock(Saver.Name())
-              // } else if pv.BaseMode & 16 == 0 && Saver.IsLogging() {
-              //   config.Log(config.LOG_INFO, "fl: Event Trigger: Stop logging.")
-              //   Saver.End()
-              //   cl.SendSyncUnlock()
-              // }
-
-              if !*config.DisableFlights {
-                if pv.BaseMode & 128 == 128 && !Saver.IsLogging() {
-                  config.Log(config.LOG_INFO, "fl: Event Trigger: Start logging.")
-                  Saver.Start()
-                  cl.SendSyncLock(Saver.Name())
-                } else if pv.BaseMode & 128 == 0 && Saver.IsLogging() {
-                  config.Log(config.LOG_INFO, "fl: Event Trigger: Stop logging.")
-                  Saver.End()
-                  cl.SendSyncUnlock()
-                }
-              }
-
-              fmu.Meta.Link = FMUSTATUS_GOOD
-
-              mm.Update()
-            }
-
-          // case mavlink.MSG_ID_MISSION_CURRENT:
-            // got a mission current message
-            // TODO
-
-            // System Status
-          case mavlink.MSG_ID_SYS_STATUS:
-            var pv mavlink.SysStatus
-            if err := pv.Unpack(pkt); err == nil {
-              fmu.Sys = pv
-            }
-
-          case mavlink.MSG_ID_SERVO_OUTPUT_RAW:
-            var pv mavlink.ServoOutputRaw
-            if err := pv.Unpack(pkt); err == nil {
-              fmu.Servos = pv
-              mm := Managers[int(pkt.MsgID)]
-              fmu.Meta.Servos = FMUSTATUS_GOOD
-              mm.Update()
-            }
-
-          case mavlink.MSG_ID_ACTUATOR_CONTROL_TARGET:
-            var pv mavlink.ActuatorControlTarget
-            if err := pv.Unpack(pkt); err == nil {
-              fmu.Actuators = pv
-              mm := Managers[int(pkt.MsgID)]
-              fmu.Meta.Actuators = FMUSTATUS_GOOD
-              mm.Update()
-            }
-
-          case mavlink.MSG_ID_ALTITUDE:
-            var pv mavlink.Altitude
-            if err := pv.Unpack(pkt); err == nil {
-
-              // Golang JSON cannot parse NaNs, so we'll make these 0.
-              // So far this issue is only encountered in these altitude messages,
-              // but if it persists, we'll add a formal prune method.
-              if math.IsNaN(float64(pv.AltitudeAmsl)) {
-                pv.AltitudeAmsl = 0.0
-              }
-
-              if math.IsNaN(float64(pv.AltitudeMonotonic)) {
-                pv.AltitudeMonotonic = 0.0
-              }
-
-              if math.IsNaN(float64(pv.AltitudeLocal)) {
-                pv.AltitudeLocal = 0.0
-              }
-
-              if math.IsNaN(float64(pv.AltitudeRelative)) {
-                pv.AltitudeRelative = 0.0
-              }
-
-              if math.IsNaN(float64(pv.AltitudeTerrain)) {
-                pv.AltitudeTerrain = 0.0
-              }
-
-              if math.IsNaN(float64(pv.BottomClearance)) {
-                pv.BottomClearance = 0.0
-              }
-
-              fmu.Altitude = pv
-              mm := Managers[int(pkt.MsgID)]
-              fmu.Meta.Altitude = FMUSTATUS_GOOD
-              mm.Update()
-            }
-
-          case mavlink.MSG_ID_EXTENDED_SYS_STATE:
-            var pv mavlink.ExtendedSysState
-            if err := pv.Unpack(pkt); err == nil {
-              fmu.ExSys = pv
-            }
-
-
-          default:
-
-            // SITL mode TODO
-            //if pkt.MsgID != 31 && pkt.MsgID != 85 && pkt.MsgID != 231 && pkt.MsgID != 242 && pkt.MsgID != 241 {
-              // config.Log(config.LOG_DEBUG, "fl: ", "Unknown MSG:", pkt.MsgID)
-            //}
-            fmu.Generic[strconv.Itoa(int(pkt.MsgID))] = *pkt
-          }
-          fmu.Meta.mut.Unlock()
-          fmu.mut.Unlock()
-        }
+      mm := Managers[int(pkt.MsgID)]
+
+      if fmu.Meta.Link == FMUSTATUS_DOWN || fmu.Meta.Link == FMUSTATUS_UNKNOWN {
+        config.Log(config.LOG_INFO, "fl: ", "Link Established.")
+        config.Log(config.LOG_INFO, "fl: ", "\tType:", pv.Type)
+        config.Log(config.LOG_INFO, "fl: ", "\tAutopilot:", pv.Autopilot)
+        config.Log(config.LOG_INFO, "fl: ", "\tPrimary Mode:", pv.BaseMode)
+        config.Log(config.LOG_INFO, "fl: ", "\tSecondary Mode:", pv.CustomMode)
+        config.Log(config.LOG_INFO, "fl: ", "\tSystem Status:", pv.SystemStatus)
+        config.Log(config.LOG_INFO, "fl: ", "\tVersion:", pv.MavlinkVersion)
+      }
+
+      // Use Acro/Manual as our trigger for testing.
+      // if pv.BaseMode & 16 == 16 && !Saver.IsLogging() {
+      //   config.Log(config.LOG_INFO, "fl: Event Trigger: Start logging.")
+      //   Saver.Start()
+      //   cl.SendSyncLock(Saver.Name())
+      // } else if pv.BaseMode & 16 == 0 && Saver.IsLogging() {
+      //   config.Log(config.LOG_INFO, "fl: Event Trigger: Stop logging.")
+      //   Saver.End()
+      //   cl.SendSyncUnlock()
       // }
+
+      Trigger.SetArmed(pv.BaseMode & 128 == 128)
+      checkLogging(cl)
+
+      fmu.Meta.Link = FMUSTATUS_GOOD
+
+      mm.Update()
     }
-  }()
 
-  // See if our link sending MAVLink or in the shell.
-  checkShell(mavConn)
+  // case mavlink.MSG_ID_MISSION_CURRENT:
+    // got a mission current message
+    // TODO
+
+    // System Status
+  case mavlink.MSG_ID_SYS_STATUS:
+    var pv mavlink.SysStatus
+    if err := pv.Unpack(pkt); err == nil {
+      fmu.Sys = pv
+    }
+
+  case mavlink.MSG_ID_SERVO_OUTPUT_RAW:
+    var pv mavlink.ServoOutputRaw
+    if err := pv.Unpack(pkt); err == nil {
+      fmu.Servos = pv
+      mm := Managers[int(pkt.MsgID)]
+      fmu.Meta.Servos = FMUSTATUS_GOOD
+      mm.Update()
+    }
+
+  case mavlink.MSG_ID_ACTUATOR_CONTROL_TARGET:
+    var pv mavlink.ActuatorControlTarget
+    if err := pv.Unpack(pkt); err == nil {
+      fmu.Actuators = pv
+      mm := Managers[int(pkt.MsgID)]
+      fmu.Meta.Actuators = FMUSTATUS_GOOD
+      mm.Update()
+    }
+
+  case mavlink.MSG_ID_ALTITUDE:
+    var pv mavlink.Altitude
+    if err := pv.Unpack(pkt); err == nil {
+
+      // Golang JSON cannot parse NaNs, so we'll make these 0.
+      // So far this issue is only encountered in these altitude messages,
+      // but if it persists, we'll add a formal prune method.
+      if math.IsNaN(float64(pv.AltitudeAmsl)) {
+        pv.AltitudeAmsl = 0.0
+      }
+
+      if math.IsNaN(float64(pv.AltitudeMonotonic)) {
+        pv.AltitudeMonotonic = 0.0
+      }
+
+      if math.IsNaN(float64(pv.AltitudeLocal)) {
+        pv.AltitudeLocal = 0.0
+      }
+
+      if math.IsNaN(float64(pv.AltitudeRelative)) {
+        pv.AltitudeRelative = 0.0
+      }
+
+      if math.IsNaN(float64(pv.AltitudeTerrain)) {
+        pv.AltitudeTerrain = 0.0
+      }
+
+      if math.IsNaN(float64(pv.BottomClearance)) {
+        pv.BottomClearance = 0.0
+      }
+
+      fmu.Altitude = pv
+      mm := Managers[int(pkt.MsgID)]
+      fmu.Meta.Altitude = FMUSTATUS_GOOD
+      mm.Update()
+    }
+
+  case mavlink.MSG_ID_EXTENDED_SYS_STATE:
+    var pv mavlink.ExtendedSysState
+    if err := pv.Unpack(pkt); err == nil {
+      fmu.ExSys = pv
+      Trigger.SetLandedState(pv.LandedState)
+      checkLogging(cl)
+    }
+
+
+  default:
+
+    // SITL mode TODO
+    //if pkt.MsgID != 31 && pkt.MsgID != 85 && pkt.MsgID != 231 && pkt.MsgID != 242 && pkt.MsgID != 241 {
+      // config.Log(config.LOG_DEBUG, "fl: ", "Unknown MSG:", pkt.MsgID)
+    //}
+    fmu.Generic[strconv.Itoa(int(pkt.MsgID))] = *pkt
+  }
+  fmu.Meta.mut.Unlock()
+  fmu.mut.Unlock()
 }
 
 func StartBind(mode uint) {
@@ -875,7 +865,13 @@ func checkShell(conn io.ReadWriter) {
   // }()
 
   for {
-    if n, _ := conn.Read(b); n > 0 {
+    n, err := conn.Read(b)
+    if err != nil {
+      // dead link, the read loop will notice and tear it down.
+      return
+    }
+
+    if n > 0 {
       // gotReply = true
       if strings.Contains(string(b[:n]), "\r\nnsh>") {
         config.Log(config.LOG_INFO, "fl: ", "Link is in SHELL Mode")
@@ -888,3 +884,36 @@ func checkShell(conn io.ReadWriter) {
     }
   }
 }
+
+func splitOutputs(str string) []string {
+  return regexp.MustCompile(`,`).Split(str, 20)
+}
+
+// Adds and removes outputs to go from the configured list old to next.
+func reloadOutputs(old, next []string) {
+  has := func(list []string, addr string) bool {
+    for _, a := range list {
+      if a == addr {
+        return true
+      }
+    }
+    return false
+  }
+
+  for _, addr := range old {
+    if addr != "" && !has(next, addr) {
+      if err := Outputs.Remove(addr); err != nil {
+        config.Log(config.LOG_ERROR, "fl: ", err)
+      }
+    }
+  }
+  for _, addr := range next {
+    if addr != "" && !has(old, addr) {
+      if err := Outputs.Add(addr); err != nil {
+        config.Log(config.LOG_ERROR, "fl: ", err)
+      } else {
+        config.Log(config.LOG_INFO, "fl: ", "Output added.")
+      }
+    }
+  }
+}
@@ -0,0 +1,62 @@
+package fmulink
+
+import (
+  "sort"
+  "sync"
+  "time"
+
+  "mavlink/parser"
+)
+
+// Names for the status managers, for readiness checks.
+var subsystemMsgs = map[string]int{
+  "heartbeat":  mavlink.MSG_ID_HEARTBEAT,
+  "flightdata": mavlink.MSG_ID_VFR_HUD,
+  "attctrl":    mavlink.MSG_ID_ATTITUDE_TARGET,
+  "attest":     mavlink.MSG_ID_ATTITUDE,
+  "power":      mavlink.MSG_ID_BATTERY_STATUS,
+  "imu":        mavlink.MSG_ID_HIGHRES_IMU,
+  "rc":         mavlink.MSG_ID_RC_CHANNELS,
+  "localpos":   mavlink.MSG_ID_LOCAL_POSITION_NED,
+  "globalpos":  mavlink.MSG_ID_GLOBAL_POSITION_INT,
+  "posctrl":    mavlink.MSG_ID_POSITION_TARGET_GLOBAL_INT,
+  "gps":        mavlink.MSG_ID_GPS_RAW_INT,
+  "altitude":   mavlink.MSG_ID_ALTITUDE,
+  "servos":     mavlink.MSG_ID_SERVO_OUTPUT_RAW,
+  "actuators":  mavlink.MSG_ID_ACTUATOR_CONTROL_TARGET,
+}
+
+var managersMut sync.RWMutex
+
+type SubsystemStatus struct {
+  Online    bool        `json:"online"`
+  LastSeen  *time.Time  `json:"lastSeen,omitempty"`
+}
+
+func SubsystemNames() []string {
+  names := make([]string, 0, len(subsystemMsgs))
+  for name := range subsystemMsgs {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  return names
+}
+
+// Every subsystem by name. They're all offline until the first link comes up.
+func Subsystems() map[string]SubsystemStatus {
+  managersMut.RLock()
+  defer managersMut.RUnlock()
+
+  subs := make(map[string]SubsystemStatus, len(subsystemMsgs))
+  for name, id := range subsystemMsgs {
+    var st SubsystemStatus
+    if mm, ok := Managers[id]; ok {
+      st.Online = mm.Online()
+      if last := mm.LastSeen(); !last.IsZero() {
+        st.LastSeen = &last
+      }
+    }
+    subs[name] = st
+  }
+  return subs
+}
@@ -0,0 +1,77 @@
+package fmulink
+
+import (
+  "testing"
+  "time"
+
+  "mavlink/parser"
+)
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+  deadline := time.Now().Add(2 * time.Second)
+  for !cond() {
+    if time.Now().After(deadline) {
+      t.Fatal("timed out waiting for", what)
+    }
+    time.Sleep(5 * time.Millisecond)
+  }
+}
+
+func TestMsgManagerOnline(t *testing.T) {
+  down := make(chan bool, 10)
+  mm := &MsgManager{
+    quit: make(chan bool),
+    stamp: make(chan time.Time),
+    OnDown: func() { down <- true },
+  }
+  mm.Sched(20 * time.Millisecond)
+  defer mm.Stop()
+
+  if mm.Online() || !mm.LastSeen().IsZero() {
+    t.Fatal("online before anything was seen")
+  }
+
+  mm.Update()
+  waitFor(t, "an update", mm.Online)
+  if mm.LastSeen().IsZero() {
+    t.Fatal("online without being seen")
+  }
+
+  // Going quiet takes it offline.
+  waitFor(t, "the message to go quiet", func() bool { return !mm.Online() })
+  <-down
+  if mm.LastSeen().IsZero() {
+    t.Error("forgot when it was last seen")
+  }
+
+  mm.Update()
+  waitFor(t, "another update", mm.Online)
+}
+
+func TestSubsystems(t *testing.T) {
+  mm := NewMsgManager(time.Hour)
+  defer mm.Stop()
+
+  managersMut.Lock()
+  old := Managers
+  Managers = map[int]*MsgManager{mavlink.MSG_ID_HEARTBEAT: mm}
+  managersMut.Unlock()
+  defer func() {
+    managersMut.Lock()
+    Managers = old
+    managersMut.Unlock()
+  }()
+
+  mm.Update()
+  waitFor(t, "an update", mm.Online)
+  subs := Subsystems()
+  if len(subs) != len(SubsystemNames()) {
+    t.Errorf("got %d subsystems, want %d", len(subs), len(SubsystemNames()))
+  }
+  if hb := subs["heartbeat"]; !hb.Online || hb.LastSeen == nil {
+    t.Errorf("heartbeat %+v", hb)
+  }
+  if gps := subs["gps"]; gps.Online || gps.LastSeen != nil {
+    t.Errorf("gps %+v", gps)
+  }
+}
@@ -0,0 +1,365 @@
+package fmulink
+
+import (
+  "fmt"
+  "io"
+  "net"
+  "os"
+  "regexp"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+
+  "mavlink/parser"
+  "fmulink/replay"
+  "fmulink/serial"
+  "fmulink/sim"
+
+  "cloudlink"
+  "config"
+)
+
+const (
+  // Master link states. The link cycles connecting -> connected -> lost ->
+  // reconnecting -> connecting for as long as the engine runs.
+  LINK_CONNECTING = "connecting"
+  LINK_CONNECTED = "connected"
+  LINK_LOST = "lost"
+  LINK_RECONNECTING = "reconnecting"
+
+  // How long to wait after losing the link before trying it again.
+  LINK_RETRY = 5 * time.Second
+
+  // Store key for a master link chosen at runtime. Overrides -master from
+  // config.json or the environment, but not from the command line.
+  STORE_MASTER = cloudlink.STORE_MASTER
+
+  TCP_PREFIX = "tcp://"
+  TCP_DIAL_TIMEOUT = 5 * time.Second
+)
+
+type LinkEvent struct {
+  State     string    `json:"state"`
+  Address   string    `json:"address"`
+  Error     string    `json:"error,omitempty"`
+  Time      time.Time `json:"time"`
+}
+
+var (
+  // Every state transition is published here. Nobody is required to listen,
+  // events are dropped if the buffer is full.
+  LinkEvents    = make(chan LinkEvent, 10)
+
+  linkEvent     = LinkEvent{State: LINK_CONNECTING}
+  linkMut       sync.RWMutex
+
+  masterAddr    string
+  switchNow     = make(chan bool, 1)
+)
+
+// Address of the master link currently in use, or about to be.
+func GetMaster() string {
+  linkMut.RLock()
+  defer linkMut.RUnlock()
+  return masterAddr
+}
+
+// Switches the master link without restarting the engine. The current link is
+// torn down and the lifecycle loop reconnects straight away on the new address.
+// Everything downstream (outputs, cloud, flight logs) keeps running. Only a bad
+// address is an error; once it's accepted the switch is under way.
+func SetMaster(addr string) error {
+  if err := ValidateMaster(addr); err != nil {
+    return err
+  }
+
+  linkMut.Lock()
+  masterAddr = addr
+  linkMut.Unlock()
+
+  config.Log(config.LOG_INFO, "fl: ", "Switching master link to", addr)
+
+  select {
+  case switchNow <- true:
+  default:
+  }
+
+  connMut.RLock()
+  defer connMut.RUnlock()
+  if mavConn != nil {
+    if err := mavConn.Close(); err != nil {
+      config.Log(config.LOG_WARN, "fl: ", "Closing old master link:", err)
+    }
+  }
+  return nil
+}
+
+// Checks addr is something openLink can make sense of, and for serial ports that
+// the device is actually there.
+func ValidateMaster(addr string) error {
+  if addr == "" {
+    return fmt.Errorf("Master address is required.")
+  }
+
+  if addr == MASTER_AUTO {
+    return nil
+  }
+
+  if strings.HasPrefix(addr, sim.PREFIX) {
+    _, err := sim.ParseHome(addr)
+    return err
+  }
+
+  if strings.HasPrefix(addr, replay.PREFIX) {
+    if _, err := os.Stat(addr[len(replay.PREFIX):]); err != nil {
+      return fmt.Errorf("Flight log not found: %s", addr[len(replay.PREFIX):])
+    }
+    return nil
+  }
+
+  if matched, _ := regexp.MatchString(UDP_REGEX, addr); matched {
+    return nil
+  }
+
+  if strings.HasPrefix(addr, TCP_PREFIX) {
+    if _, port, err := net.SplitHostPort(addr[len(TCP_PREFIX):]); err != nil {
+      return err
+    } else if _, err := strconv.Atoi(port); err != nil {
+      return fmt.Errorf("Invalid TCP port %s", port)
+    }
+    return nil
+  }
+
+  cfg := strings.SplitN(addr, ":", 2)
+  if len(cfg) == 2 {
+    if baud, err := strconv.Atoi(cfg[1]); err != nil || baud <= 0 {
+      return fmt.Errorf("Invalid baud rate %s", cfg[1])
+    }
+  }
+
+  if _, err := os.Stat(cfg[0]); err != nil {
+    return fmt.Errorf("Not a UDP address, TCP address, simulator, flight log or serial device: %s", addr)
+  }
+
+  return nil
+}
+
+// Current state of the master link.
+func GetLinkState() LinkEvent {
+  linkMut.RLock()
+  defer linkMut.RUnlock()
+  return linkEvent
+}
+
+func setLinkState(state, addr string, err error) {
+  ev := LinkEvent{State: state, Address: addr, Time: time.Now()}
+  if err != nil {
+    ev.Error = err.Error()
+  }
+
+  linkMut.Lock()
+  linkEvent = ev
+  linkMut.Unlock()
+
+  fmu.mut.Lock()
+  fmu.Meta.LinkState = state
+  fmu.mut.Unlock()
+
+  switch state {
+  case LINK_LOST:
+    config.Log(config.LOG_ERROR, "fl: ", "LINK LOST. Is the master link alive?", ev.Error)
+  case LINK_CONNECTED:
+    config.Log(config.LOG_INFO, "fl: ", "Link connected on", addr)
+  default:
+    config.Log(config.LOG_DEBUG, "fl: ", "Link", state, addr)
+  }
+
+  select {
+  case LinkEvents <- ev:
+  default:
+  }
+}
+
+// One pass of the link lifecycle: opens the master link, hands it to serve
+// until that returns, then tears it down.
+func linkPass(cl *cloudlink.CloudLink, serve func(conn io.ReadWriteCloser) error) {
+  master := GetMaster()
+  setLinkState(LINK_CONNECTING, master, nil)
+
+  conn, addr, err := openLink(master, cl)
+  if err != nil {
+    setLinkState(LINK_LOST, master, err)
+    return
+  }
+
+  setConn(conn)
+  setLinkState(LINK_CONNECTED, addr, nil)
+
+  err = serve(conn)
+
+  setConn(nil)
+  conn.Close()
+  setLinkState(LINK_LOST, addr, err)
+}
+
+// Waits out the retry delay, unless we were asked to switch links.
+func linkRetry(delay time.Duration) {
+  select {
+  case <- time.After(delay):
+  case <- switchNow:
+  }
+  setLinkState(LINK_RECONNECTING, GetMaster(), nil)
+}
+
+func setConn(conn io.ReadWriteCloser) {
+  connMut.Lock()
+  mavConn = conn
+  connMut.Unlock()
+}
+
+// The replay driving the master link, or nil when the link is a real vehicle
+// (or the simulator).
+func GetReplay() *replay.Replay {
+  connMut.RLock()
+  defer connMut.RUnlock()
+
+  if r, ok := mavConn.(*replay.Replay); ok {
+    return r
+  }
+  return nil
+}
+
+// Writer handed out to everyone that sends to the FMU. It holds no connection
+// of its own, so it keeps working after the link is torn down and recreated.
+type linkWriter struct{}
+
+func (lw linkWriter) Write(b []byte) (int, error) {
+  connMut.RLock()
+  defer connMut.RUnlock()
+
+  if mavConn == nil {
+    return 0, fmt.Errorf("Master link is down.")
+  }
+
+  countPacket(packetsSent, METRIC_LINK_MASTER, b)
+  return mavConn.Write(b)
+}
+
+// Opens the master link described by addr. Returns the connection along with
+// the address actually used, which differs from addr in auto mode.
+func openLink(addr string, cl *cloudlink.CloudLink) (io.ReadWriteCloser, string, error) {
+  // Find the FMU ourselves. If nothing answers we'll scan again on the next pass.
+  if addr == MASTER_AUTO {
+    if found, err := autoDetect(cl.GetStore()); err != nil {
+      return nil, addr, err
+    } else {
+      addr = found
+    }
+  }
+
+  if strings.HasPrefix(addr, sim.PREFIX) {
+    conn, err := sim.Open(addr)
+    if err != nil {
+      return nil, addr, err
+    }
+
+    config.Log(config.LOG_INFO, "fl: ", "Flying the simulator at", addr)
+    return conn, addr, nil
+  }
+
+  if strings.HasPrefix(addr, replay.PREFIX) {
+    conn, err := replay.Open(addr)
+    if err != nil {
+      return nil, addr, err
+    }
+
+    config.Log(config.LOG_INFO, "fl: ", "Replaying", addr)
+    return conn, addr, nil
+  }
+
+  if strings.HasPrefix(addr, TCP_PREFIX) {
+    conn, err := net.DialTimeout("tcp", addr[len(TCP_PREFIX):], TCP_DIAL_TIMEOUT)
+    if err != nil {
+      return nil, addr, err
+    }
+
+    config.Log(config.LOG_INFO, "fl: ", "Connected to", addr)
+    return conn, addr, nil
+  }
+
+  if matched, err := regexp.MatchString(UDP_REGEX, addr); err != nil {
+    return nil, addr, err
+  } else if matched {
+    udpAddr, err := net.ResolveUDPAddr("udp", addr)
+    if err != nil {
+      return nil, addr, err
+    }
+
+    if *config.Remote != "" {
+      sudpAddr, err := net.ResolveUDPAddr("udp", *config.Remote)
+      if err != nil {
+        return nil, addr, err
+      }
+
+      conn, err := net.DialUDP("udp", udpAddr, sudpAddr)
+      if err != nil {
+        return nil, addr, err
+      }
+
+      config.Log(config.LOG_INFO, "[REMOTE] ", "Listening on", udpAddr)
+      return conn, addr, nil
+    } else {
+      conn, err := net.ListenUDP("udp", udpAddr)
+      if err != nil {
+        return nil, addr, err
+      }
+
+      config.Log(config.LOG_INFO, "fl: ", "Listening on", udpAddr)
+      return conn, addr, nil
+    }
+  }
+
+  /*
+  Example formats
+
+  Windows:
+    COM43:115200
+
+  Linux:
+    /dev/ttyMFD1:115200
+
+  OSX:
+    /dev/tty.usbserial:115200
+  */
+
+  cfg := regexp.MustCompile(`:`).Split(addr, 2)
+  var baud int
+
+  // assume a baudrate if none provided
+  if len(cfg) < 2 {
+    baud = DEFAULT_BAUD
+  } else {
+    var err error
+    baud, err = strconv.Atoi(cfg[1])
+    if err != nil {
+      baud = DEFAULT_BAUD
+    }
+  }
+
+  config.Log(config.LOG_DEBUG, "Opening port", cfg[0], "with", baud)
+  if conn, err := serial.OpenPort(&serial.Config{Name: cfg[0], Baud: baud}); err != nil {
+    return nil, addr, err
+  } else if conn == nil {
+    return nil, addr, fmt.Errorf("Unsupported baud rate %d", baud)
+  } else {
+    config.Log(config.LOG_INFO, "fl: ", "Listening on", addr)
+    return conn, addr, nil
+  }
+}
+
+// Decode errors are per packet and the link survives them. Anything else came
+// from the underlying reader, e.g. EOF or EIO when a USB FMU gets unplugged.
+func isDecodeError(err error) bool {
+  return err == mavlink.ErrCrcFail || err == mavlink.ErrUnknownMsgID
+}
@@ -0,0 +1,188 @@
+package fmulink
+
+import (
+  "io"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+
+  "flightlog"
+  "fmulink/replay"
+  "fmulink/sim"
+)
+
+// A flight log with a few heartbeats in it, for replay: addresses.
+func writeReplay(t *testing.T, dir string) string {
+  fpath := filepath.Join(dir, "Flight 1.tlog")
+  f, err := os.Create(fpath)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer f.Close()
+
+  tw := flightlog.NewTlogWriter(f)
+  start := time.Now()
+  for i := 0; i < 10; i++ {
+    tw.Write(start.Add(time.Duration(i) * time.Second), append([]byte{0xFE, 9, byte(i), 1, 1, 0}, make([]byte, 9 + 2)...))
+  }
+  return fpath
+}
+
+func TestValidateMaster(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "fmulink")
+  defer os.RemoveAll(dir)
+  log := writeReplay(t, dir)
+
+  tests := []struct {
+    addr    string
+    ok      bool
+  }{
+    {"", false},
+    {MASTER_AUTO, true},
+    {"127.0.0.1:14550", true},
+    {"localhost:14550", true},
+    {"127.0.0.1", false},
+    {"tcp://127.0.0.1:5760", true},
+    {"tcp://drone.local:5760", true},
+    {"tcp://127.0.0.1", false},
+    {"tcp://127.0.0.1:mav", false},
+    {"sim://", true},
+    {"sim://47.39,8.54", true},
+    {"sim://47.39,8.54,488", true},
+    {"sim://47.39", false},
+    {"sim://north,east", false},
+    {replay.PREFIX + log, true},
+    {replay.PREFIX + filepath.Join(dir, "missing.tlog"), false},
+    {log, true},
+    {log + ":57600", true},
+    {log + ":0", false},
+    {log + ":fast", false},
+    {filepath.Join(dir, "ttyNone") + ":57600", false},
+  }
+
+  for _, tt := range tests {
+    if err := ValidateMaster(tt.addr); (err == nil) != tt.ok {
+      t.Errorf("%q: got %v, want ok %v", tt.addr, err, tt.ok)
+    }
+  }
+}
+
+// Drains events left over from earlier tests.
+func drainLinkEvents() {
+  for {
+    select {
+    case <-LinkEvents:
+    case <-switchNow:
+    default:
+      return
+    }
+  }
+}
+
+func expectLinkEvent(t *testing.T, state, addr string) LinkEvent {
+  select {
+  case ev := <-LinkEvents:
+    if ev.State != state || ev.Address != addr {
+      t.Fatalf("got %s %s, want %s %s", ev.State, ev.Address, state, addr)
+    }
+    return ev
+  case <-time.After(5 * time.Second):
+    t.Fatalf("timed out waiting for %s %s", state, addr)
+  }
+  return LinkEvent{}
+}
+
+// Reads until the link is closed under it.
+func drainLink(conn io.ReadWriteCloser) error {
+  b := make([]byte, 263)
+  for {
+    if _, err := conn.Read(b); err != nil {
+      return err
+    }
+  }
+}
+
+func TestLinkStates(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "fmulink")
+  defer os.RemoveAll(dir)
+  log := replay.PREFIX + writeReplay(t, dir)
+
+  drainLinkEvents()
+  defer func() {
+    linkMut.Lock()
+    masterAddr = ""
+    linkMut.Unlock()
+    drainLinkEvents()
+  }()
+
+  pass := func() chan bool {
+    done := make(chan bool)
+    go func() {
+      linkPass(nil, drainLink)
+      close(done)
+    }()
+    return done
+  }
+
+  // A bad address is turned away, and nothing moves.
+  if err := SetMaster("tcp://127.0.0.1"); err == nil {
+    t.Fatal("accepted a TCP address without a port")
+  } else if GetMaster() != "" || len(switchNow) != 0 {
+    t.Fatal("a bad address started a switch")
+  }
+
+  if err := SetMaster(sim.PREFIX); err != nil {
+    t.Fatal(err)
+  }
+  <-switchNow
+
+  done := pass()
+  expectLinkEvent(t, LINK_CONNECTING, sim.PREFIX)
+  expectLinkEvent(t, LINK_CONNECTED, sim.PREFIX)
+
+  // Switching closes the link in use and skips the retry delay.
+  if err := SetMaster(log); err != nil {
+    t.Fatal(err)
+  } else if GetMaster() != log {
+    t.Fatalf("master is %s after switching to %s", GetMaster(), log)
+  }
+  <-done
+  expectLinkEvent(t, LINK_LOST, sim.PREFIX)
+
+  linkRetry(time.Hour)
+  expectLinkEvent(t, LINK_RECONNECTING, log)
+
+  done = pass()
+  expectLinkEvent(t, LINK_CONNECTING, log)
+  expectLinkEvent(t, LINK_CONNECTED, log)
+  if GetReplay() == nil {
+    t.Error("no replay behind a replay: link")
+  }
+
+  // Somewhere nothing answers: lost again, with the reason.
+  if err := SetMaster("tcp://127.0.0.1:1"); err != nil {
+    t.Fatal(err)
+  }
+  <-done
+  expectLinkEvent(t, LINK_LOST, log)
+  if GetReplay() != nil {
+    t.Error("replay still in use after switching away")
+  }
+
+  linkRetry(time.Hour)
+  expectLinkEvent(t, LINK_RECONNECTING, "tcp://127.0.0.1:1")
+
+  done = pass()
+  expectLinkEvent(t, LINK_CONNECTING, "tcp://127.0.0.1:1")
+  if ev := expectLinkEvent(t, LINK_LOST, "tcp://127.0.0.1:1"); !strings.Contains(ev.Error, "refused") {
+    t.Errorf("lost with %q", ev.Error)
+  }
+  <-done
+
+  if st := GetLinkState(); st.State != LINK_LOST || st.Error == "" {
+    t.Errorf("link state %+v after a failed pass", st)
+  }
+}
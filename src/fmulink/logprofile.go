@@ -0,0 +1,132 @@
+package fmulink
+
+import (
+  "fmt"
+  "strconv"
+  "strings"
+  "time"
+
+  "mavlink/parser"
+)
+
+const (
+  // Logging intervals with a special meaning.
+  LOG_ALWAYS = time.Duration(0)
+  LOG_NEVER = time.Duration(-1)
+
+  // Slowest rate a profile can ask for, once every 100 seconds. Much slower and
+  // the interval no longer fits in a Duration.
+  MIN_LOG_RATE = 0.01
+)
+
+// Minimum time between two logged packets of the same message ID. Messages
+// without an entry fall back to the -sync interval.
+type LogProfile map[uint8]time.Duration
+
+// Names accepted in the "logprofile" section of config.json, as well as plain
+// message IDs.
+var logProfileNames = map[string]uint8{
+  "HEARTBEAT":                  mavlink.MSG_ID_HEARTBEAT,
+  "SYS_STATUS":                 mavlink.MSG_ID_SYS_STATUS,
+  "PARAM_VALUE":                mavlink.MSG_ID_PARAM_VALUE,
+  "GPS_RAW_INT":                mavlink.MSG_ID_GPS_RAW_INT,
+  "ATTITUDE":                   mavlink.MSG_ID_ATTITUDE,
+  "LOCAL_POSITION_NED":         mavlink.MSG_ID_LOCAL_POSITION_NED,
+  "GLOBAL_POSITION_INT":        mavlink.MSG_ID_GLOBAL_POSITION_INT,
+  "SERVO_OUTPUT_RAW":           mavlink.MSG_ID_SERVO_OUTPUT_RAW,
+  "MISSION_ITEM":               mavlink.MSG_ID_MISSION_ITEM,
+  "MISSION_REQUEST":            mavlink.MSG_ID_MISSION_REQUEST,
+  "MISSION_SET_CURRENT":        mavlink.MSG_ID_MISSION_SET_CURRENT,
+  "MISSION_CURRENT":            mavlink.MSG_ID_MISSION_CURRENT,
+  "MISSION_REQUEST_LIST":       mavlink.MSG_ID_MISSION_REQUEST_LIST,
+  "MISSION_COUNT":              mavlink.MSG_ID_MISSION_COUNT,
+  "MISSION_CLEAR_ALL":          mavlink.MSG_ID_MISSION_CLEAR_ALL,
+  "MISSION_ITEM_REACHED":       mavlink.MSG_ID_MISSION_ITEM_REACHED,
+  "MISSION_ACK":                mavlink.MSG_ID_MISSION_ACK,
+  "MISSION_REQUEST_INT":        mavlink.MSG_ID_MISSION_REQUEST_INT,
+  "MISSION_ITEM_INT":           mavlink.MSG_ID_MISSION_ITEM_INT,
+  "RC_CHANNELS":                mavlink.MSG_ID_RC_CHANNELS,
+  "VFR_HUD":                    mavlink.MSG_ID_VFR_HUD,
+  "COMMAND_ACK":                mavlink.MSG_ID_COMMAND_ACK,
+  "ATTITUDE_TARGET":            mavlink.MSG_ID_ATTITUDE_TARGET,
+  "POSITION_TARGET_LOCAL_NED":  mavlink.MSG_ID_POSITION_TARGET_LOCAL_NED,
+  "POSITION_TARGET_GLOBAL_INT": mavlink.MSG_ID_POSITION_TARGET_GLOBAL_INT,
+  "HIGHRES_IMU":                mavlink.MSG_ID_HIGHRES_IMU,
+  "ACTUATOR_CONTROL_TARGET":    mavlink.MSG_ID_ACTUATOR_CONTROL_TARGET,
+  "ALTITUDE":                   mavlink.MSG_ID_ALTITUDE,
+  "BATTERY_STATUS":             mavlink.MSG_ID_BATTERY_STATUS,
+  "AUTOPILOT_VERSION":          mavlink.MSG_ID_AUTOPILOT_VERSION,
+  "EXTENDED_SYS_STATE":         mavlink.MSG_ID_EXTENDED_SYS_STATE,
+  "HOME_POSITION":              mavlink.MSG_ID_HOME_POSITION,
+  "RADIO_STATUS":               mavlink.MSG_ID_RADIO_STATUS,
+  "STATUSTEXT":                 mavlink.MSG_ID_STATUSTEXT,
+}
+
+func hz(rate float64) time.Duration {
+  return time.Duration(float64(time.Second) / rate)
+}
+
+// Anything needed to make sense of a flight afterwards is always logged, and
+// the estimator outputs get enough resolution to plot.
+func DefaultLogProfile() LogProfile {
+  p := LogProfile{
+    mavlink.MSG_ID_STATUSTEXT:           LOG_ALWAYS,
+    mavlink.MSG_ID_COMMAND_ACK:          LOG_ALWAYS,
+    mavlink.MSG_ID_PARAM_VALUE:          LOG_ALWAYS,
+    mavlink.MSG_ID_HEARTBEAT:            LOG_ALWAYS,
+    mavlink.MSG_ID_ATTITUDE:             hz(10),
+    mavlink.MSG_ID_GLOBAL_POSITION_INT:  hz(5),
+    mavlink.MSG_ID_LOCAL_POSITION_NED:   hz(5),
+    mavlink.MSG_ID_GPS_RAW_INT:          hz(5),
+  }
+
+  for name, id := range logProfileNames {
+    if strings.HasPrefix(name, "MISSION_") {
+      p[id] = LOG_ALWAYS
+    }
+  }
+
+  return p
+}
+
+// Builds a profile from the "logprofile" section of config.json, on top of the
+// defaults. Keys are message names or IDs, values a rate in Hz (0 to never log
+// the message) or "always".
+//
+//   "logprofile": { "ATTITUDE": 50, "HIGHRES_IMU": 20, "105": 0, "SERVO_OUTPUT_RAW": "always" }
+func ParseLogProfile(raw map[string]interface{}) (LogProfile, error) {
+  p := DefaultLogProfile()
+
+  for key, val := range raw {
+    id, ok := logProfileNames[strings.ToUpper(key)]
+    if !ok {
+      n, err := strconv.ParseUint(key, 10, 8)
+      if err != nil {
+        return p, fmt.Errorf("Unknown message %s in log profile.", key)
+      }
+      id = uint8(n)
+    }
+
+    switch v := val.(type) {
+    case string:
+      if v != "always" {
+        return p, fmt.Errorf("Invalid log rate %q for %s.", v, key)
+      }
+      p[id] = LOG_ALWAYS
+    case float64:
+      if v < 0 {
+        return p, fmt.Errorf("Invalid log rate %v for %s.", v, key)
+      } else if v > 0 && v < MIN_LOG_RATE {
+        return p, fmt.Errorf("Log rate %v for %s is below the minimum of %v Hz.", v, key, MIN_LOG_RATE)
+      } else if v == 0 {
+        p[id] = LOG_NEVER
+      } else {
+        p[id] = hz(v)
+      }
+    default:
+      return p, fmt.Errorf("Invalid log rate for %s.", key)
+    }
+  }
+
+  return p, nil
+}
@@ -0,0 +1,42 @@
+package fmulink
+
+import (
+  "testing"
+  "time"
+
+  "mavlink/parser"
+)
+
+func TestParseLogProfile(t *testing.T) {
+  cases := []struct {
+    raw   map[string]interface{}
+    id    uint8
+    want  time.Duration
+    ok    bool
+  }{
+    {map[string]interface{}{"ATTITUDE": 50.0}, mavlink.MSG_ID_ATTITUDE, 20 * time.Millisecond, true},
+    {map[string]interface{}{"attitude": 2.0}, mavlink.MSG_ID_ATTITUDE, 500 * time.Millisecond, true},
+    {map[string]interface{}{"105": 0.0}, mavlink.MSG_ID_HIGHRES_IMU, LOG_NEVER, true},
+    {map[string]interface{}{"SERVO_OUTPUT_RAW": "always"}, mavlink.MSG_ID_SERVO_OUTPUT_RAW, LOG_ALWAYS, true},
+    {map[string]interface{}{"VFR_HUD": MIN_LOG_RATE}, mavlink.MSG_ID_VFR_HUD, 100 * time.Second, true},
+    {nil, mavlink.MSG_ID_GLOBAL_POSITION_INT, 200 * time.Millisecond, true},
+    {nil, mavlink.MSG_ID_MISSION_ITEM, LOG_ALWAYS, true},
+
+    {map[string]interface{}{"VFR_HUD": MIN_LOG_RATE / 2}, 0, 0, false},
+    {map[string]interface{}{"VFR_HUD": 1e-12}, 0, 0, false},
+    {map[string]interface{}{"VFR_HUD": -1.0}, 0, 0, false},
+    {map[string]interface{}{"VFR_HUD": "sometimes"}, 0, 0, false},
+    {map[string]interface{}{"VFR_HUD": true}, 0, 0, false},
+    {map[string]interface{}{"NOT_A_MESSAGE": 1.0}, 0, 0, false},
+    {map[string]interface{}{"256": 1.0}, 0, 0, false},
+  }
+
+  for _, c := range cases {
+    p, err := ParseLogProfile(c.raw)
+    if (err == nil) != c.ok {
+      t.Errorf("%v: got error %v", c.raw, err)
+    } else if c.ok && p[c.id] != c.want {
+      t.Errorf("%v: message %d every %v, want %v", c.raw, c.id, p[c.id], c.want)
+    }
+  }
+}
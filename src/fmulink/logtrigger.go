@@ -0,0 +1,219 @@
+package fmulink
+
+import (
+  "fmt"
+  "sync"
+  "time"
+
+  "cloudlink"
+  "config"
+  "mavlink/parser"
+)
+
+const (
+  TRIGGER_ARMED = "armed"
+  TRIGGER_INAIR = "inair"
+  TRIGGER_MANUAL = "manual"
+  TRIGGER_ALWAYS = "always"
+)
+
+type LogTriggerStatus struct {
+  Policy    string  `json:"policy"`
+  Logging   bool    `json:"logging"`
+  File      string  `json:"file"`
+  Manual    bool    `json:"manual"`
+  Armed     bool    `json:"armed"`
+  InAir     bool    `json:"inAir"`
+  Error     string  `json:"error,omitempty"`   // why logging last stopped, if it failed
+}
+
+// Decides when a flight log starts and stops. The policy picks the automatic
+// condition, and the API can start or stop a log on top of it. When the
+// condition drops, logging carries on for the tail so the landing and disarm
+// make it into the log.
+type LogTrigger struct {
+  policy      string
+  tail        time.Duration
+
+  armed       bool
+  inAir       bool
+  landedKnown bool
+
+  // Started from the API, runs until stopped from the API.
+  manual      bool
+  // Stopped from the API, stays off until the condition drops again.
+  suppressed  bool
+  stopAt      time.Time
+  mut         sync.Mutex
+}
+
+func ValidateTrigger(policy string) error {
+  switch policy {
+  case TRIGGER_ARMED, TRIGGER_INAIR, TRIGGER_MANUAL, TRIGGER_ALWAYS:
+    return nil
+  }
+  return fmt.Errorf("Unknown log trigger %s.", policy)
+}
+
+func NewLogTrigger(policy string, tail time.Duration) *LogTrigger {
+  if err := ValidateTrigger(policy); err != nil {
+    config.Log(config.LOG_WARN, "fl: ", err, "Logging while armed.")
+    policy = TRIGGER_ARMED
+  }
+
+  return &LogTrigger{
+    policy: policy,
+    tail: tail,
+  }
+}
+
+func (lt *LogTrigger) SetArmed(armed bool) {
+  lt.mut.Lock()
+  lt.armed = armed
+  lt.mut.Unlock()
+}
+
+func (lt *LogTrigger) SetLandedState(state uint8) {
+  lt.mut.Lock()
+  lt.landedKnown = state != mavlink.MAV_LANDED_STATE_UNDEFINED
+  lt.inAir = state == mavlink.MAV_LANDED_STATE_IN_AIR
+  lt.mut.Unlock()
+}
+
+// Forgets the vehicle state, for when the link goes away.
+func (lt *LogTrigger) Reset() {
+  lt.mut.Lock()
+  lt.armed, lt.inAir, lt.landedKnown = false, false, false
+  lt.stopAt = time.Time{}
+  lt.mut.Unlock()
+}
+
+// Must be called with the lock held.
+func (lt *LogTrigger) condition() bool {
+  switch lt.policy {
+  case TRIGGER_ALWAYS:
+    return true
+  case TRIGGER_INAIR:
+    // Not every autopilot sends EXTENDED_SYS_STATE, fall back to armed.
+    if lt.landedKnown {
+      return lt.inAir
+    }
+    return lt.armed
+  case TRIGGER_ARMED:
+    return lt.armed
+  }
+  return false
+}
+
+// Whether a log should be started or stopped now, given whether one is open.
+func (lt *LogTrigger) Check(logging bool, now time.Time) (start, stop bool) {
+  lt.mut.Lock()
+  defer lt.mut.Unlock()
+
+  cond := lt.condition()
+  if !cond {
+    lt.suppressed = false
+  }
+
+  if lt.manual || (cond && !lt.suppressed) {
+    lt.stopAt = time.Time{}
+    return !logging, false
+  }
+
+  if !logging {
+    return false, false
+  }
+
+  if lt.stopAt.IsZero() {
+    lt.stopAt = now.Add(lt.tail)
+  }
+  if !now.Before(lt.stopAt) {
+    lt.stopAt = time.Time{}
+    return false, true
+  }
+  return false, false
+}
+
+func (lt *LogTrigger) Status() LogTriggerStatus {
+  lt.mut.Lock()
+  defer lt.mut.Unlock()
+
+  return LogTriggerStatus{
+    Policy: lt.policy,
+    Manual: lt.manual,
+    Armed: lt.armed,
+    InAir: lt.inAir,
+  }
+}
+
+// Applies the trigger, starting or stopping the flight log.
+func checkLogging(cl *cloudlink.CloudLink) {
+  // A replayed flight has already been logged once.
+  if *config.DisableFlights || GetReplay() != nil {
+    return
+  }
+
+  start, stop := Trigger.Check(Saver.IsLogging(), time.Now())
+  if start {
+    // Failures are logged by the saver, which holds off retrying.
+    if err := Saver.Start(); err == nil {
+      config.Log(config.LOG_INFO, "fl: Event Trigger: Start logging.")
+      cl.SendSyncLock(Saver.Name())
+    }
+  } else if stop {
+    config.Log(config.LOG_INFO, "fl: Event Trigger: Stop logging.")
+    Saver.End()
+    cl.SendSyncUnlock()
+  }
+}
+
+// Starts a log from the API. It runs until StopLogging, whatever the policy.
+func StartLogging(cl *cloudlink.CloudLink) error {
+  if *config.DisableFlights {
+    return fmt.Errorf("Flight logging is disabled.")
+  } else if GetReplay() != nil {
+    return fmt.Errorf("Can't log a replayed flight.")
+  }
+
+  Trigger.mut.Lock()
+  Trigger.manual = true
+  Trigger.mut.Unlock()
+
+  if !Saver.IsLogging() {
+    if err := Saver.Start(); err != nil {
+      Trigger.mut.Lock()
+      Trigger.manual = false
+      Trigger.mut.Unlock()
+      return err
+    }
+    config.Log(config.LOG_INFO, "fl: API Trigger: Start logging.")
+    cl.SendSyncLock(Saver.Name())
+  }
+  return nil
+}
+
+// Stops the log from the API, straight away and without the tail. An automatic
+// log won't restart until its condition has dropped and come back.
+func StopLogging(cl *cloudlink.CloudLink) {
+  Trigger.mut.Lock()
+  Trigger.manual = false
+  Trigger.suppressed = Trigger.condition()
+  Trigger.stopAt = time.Time{}
+  Trigger.mut.Unlock()
+
+  if Saver.IsLogging() {
+    config.Log(config.LOG_INFO, "fl: API Trigger: Stop logging.")
+    Saver.End()
+    cl.SendSyncUnlock()
+  }
+}
+
+func LoggingStatus() LogTriggerStatus {
+  st := Trigger.Status()
+  st.Logging = Saver.IsLogging()
+  st.File = Saver.Name()
+  if err := Saver.Failure(); err != nil {
+    st.Error = err.Error()
+  }
+  return st
+}
@@ -0,0 +1,212 @@
+package fmulink
+
+import (
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+
+  "flightlog"
+  "mavlink/parser"
+)
+
+// One call to Check, after applying do to the vehicle (or API) state.
+type triggerStep struct {
+  do        string
+  at        time.Duration
+  start     bool
+  stop      bool
+}
+
+func TestLogTrigger(t *testing.T) {
+  const tail = 5 * time.Second
+
+  cases := []struct {
+    name    string
+    policy  string
+    steps   []triggerStep
+  }{
+    {"armed with tail", TRIGGER_ARMED, []triggerStep{
+      {"", 0, false, false},
+      {"arm", 0, true, false},
+      {"", time.Second, false, false},
+      {"disarm", 10 * time.Second, false, false},
+      {"", 14 * time.Second, false, false},
+      {"", 15 * time.Second, false, true},
+      {"", 16 * time.Second, false, false},
+    }},
+    {"rearmed during tail", TRIGGER_ARMED, []triggerStep{
+      {"arm", 0, true, false},
+      {"disarm", 0, false, false},
+      {"arm", 2 * time.Second, false, false},
+      {"disarm", 3 * time.Second, false, false},
+      {"", 7 * time.Second, false, false},
+      {"", 8 * time.Second, false, true},
+    }},
+    {"in air", TRIGGER_INAIR, []triggerStep{
+      {"air", 0, true, false},
+      {"land", time.Second, false, false},
+      {"", time.Second + tail, false, true},
+    }},
+    {"in air waits for takeoff", TRIGGER_INAIR, []triggerStep{
+      {"land", 0, false, false},
+      {"arm", 0, false, false},
+      {"air", time.Second, true, false},
+    }},
+    {"in air without landed state", TRIGGER_INAIR, []triggerStep{
+      {"undef", 0, false, false},
+      {"arm", 0, true, false},
+      {"disarm", 0, false, false},
+      {"", tail, false, true},
+    }},
+    {"manual ignores arming", TRIGGER_MANUAL, []triggerStep{
+      {"arm", 0, false, false},
+      {"manual", 0, true, false},
+      {"disarm", time.Second, false, false},
+      {"unmanual", 2 * time.Second, false, false},
+      {"", 2 * time.Second + tail, false, true},
+    }},
+    {"always", TRIGGER_ALWAYS, []triggerStep{
+      {"", 0, true, false},
+      {"", time.Hour, false, false},
+    }},
+    {"api stop holds until condition drops", TRIGGER_ARMED, []triggerStep{
+      {"arm", 0, true, false},
+      {"apistop", time.Second, false, false},
+      {"", 2 * time.Second, false, false},
+      {"disarm", 3 * time.Second, false, false},
+      {"arm", 4 * time.Second, true, false},
+    }},
+    {"api start outlives condition", TRIGGER_ARMED, []triggerStep{
+      {"arm", 0, true, false},
+      {"manual", 0, false, false},
+      {"disarm", time.Second, false, false},
+      {"", time.Second + 2 * tail, false, false},
+    }},
+  }
+
+  for _, c := range cases {
+    lt := NewLogTrigger(c.policy, tail)
+    start := time.Now()
+    logging := false
+
+    for i, s := range c.steps {
+      switch s.do {
+      case "arm":
+        lt.SetArmed(true)
+      case "disarm":
+        lt.SetArmed(false)
+      case "air":
+        lt.SetLandedState(mavlink.MAV_LANDED_STATE_IN_AIR)
+      case "land":
+        lt.SetLandedState(mavlink.MAV_LANDED_STATE_ON_GROUND)
+      case "undef":
+        lt.SetLandedState(mavlink.MAV_LANDED_STATE_UNDEFINED)
+      case "manual":
+        lt.manual = true
+      case "unmanual":
+        lt.manual = false
+      case "apistop":
+        // as StopLogging does
+        lt.manual = false
+        lt.suppressed = lt.condition()
+        lt.stopAt = time.Time{}
+        logging = false
+      }
+
+      st, sp := lt.Check(logging, start.Add(s.at))
+      if st != s.start || sp != s.stop {
+        t.Fatalf("%s: step %d (%s at %v): got start %v stop %v, want %v %v", c.name, i, s.do, s.at, st, sp, s.start, s.stop)
+      }
+      if st {
+        logging = true
+      } else if sp {
+        logging = false
+      }
+    }
+  }
+}
+
+func TestUnknownTrigger(t *testing.T) {
+  if err := ValidateTrigger("sometimes"); err == nil {
+    t.Error("unknown policy accepted")
+  }
+  if lt := NewLogTrigger("sometimes", 0); lt.policy != TRIGGER_ARMED {
+    t.Errorf("fell back to %s", lt.policy)
+  }
+}
+
+func TestPreTriggerBuffer(t *testing.T) {
+  start := time.Now()
+
+  cases := []struct {
+    name    string
+    pre     time.Duration
+    size    int
+    at      []time.Duration
+    keep    int
+  }{
+    {"ages out", 2 * time.Second, 10, []time.Duration{0, time.Second, 2 * time.Second, 3 * time.Second}, 3},
+    {"everything recent", time.Minute, 10, []time.Duration{0, time.Second, 2 * time.Second}, 3},
+    {"byte cap", time.Minute, MAX_PRE_TRIGGER_BYTES / 3 - 1, []time.Duration{0, 0, 0, 0, 0}, 3},
+    {"packet over the cap", time.Minute, MAX_PRE_TRIGGER_BYTES + 1, []time.Duration{0}, 0},
+  }
+
+  for _, c := range cases {
+    fs := &FlightSaver{pre: c.pre}
+    for i, at := range c.at {
+      pkt := make([]byte, c.size)
+      pkt[0] = byte(i)
+      fs.buffer(start.Add(at), pkt)
+    }
+
+    if len(fs.ring) != c.keep {
+      t.Errorf("%s: kept %d packets, want %d", c.name, len(fs.ring), c.keep)
+      continue
+    }
+
+    bytes := 0
+    for i, rec := range fs.ring {
+      bytes += len(rec.Packet)
+      // the newest are the ones kept
+      if want := byte(len(c.at) - c.keep + i); rec.Packet[0] != want {
+        t.Errorf("%s: packet %d is %d, want %d", c.name, i, rec.Packet[0], want)
+      }
+    }
+    if bytes != fs.ringBytes || bytes > MAX_PRE_TRIGGER_BYTES {
+      t.Errorf("%s: %d bytes buffered, counted %d", c.name, bytes, fs.ringBytes)
+    }
+  }
+}
+
+// A failed start isn't tried again on every heartbeat.
+func TestStartHoldsOff(t *testing.T) {
+  dir, err := ioutil.TempDir("", "flights")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  fpath := filepath.Join(dir, "flights")
+  fs := &FlightSaver{logPath: fpath, lastLogged: make(map[uint8]time.Time), opts: flightlog.WriterOptions{Compress: flightlog.COMPRESS_NONE}}
+
+  first := fs.Start()
+  if first == nil || fs.IsLogging() {
+    t.Fatal("started logging into a missing directory")
+  }
+
+  os.Mkdir(fpath, 0755)
+  if err := fs.Start(); err != first || fs.Failure() != first {
+    t.Fatalf("retried straight away: %v", err)
+  }
+
+  fs.failedAt = fs.failedAt.Add(-SPACE_RETRY_INTERVAL)
+  if err := fs.Start(); err != nil || !fs.IsLogging() {
+    t.Fatalf("didn't retry after the interval: %v", err)
+  }
+  if fs.Failure() != nil {
+    t.Errorf("still failed: %v", fs.Failure())
+  }
+  fs.End()
+}
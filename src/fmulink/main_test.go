@@ -0,0 +1,16 @@
+package fmulink
+
+import (
+  "flag"
+  "os"
+  "testing"
+
+  "config"
+)
+
+func TestMain(m *testing.M) {
+  // Log to the console only.
+  flag.Set("log", "")
+  config.Init()
+  os.Exit(m.Run())
+}
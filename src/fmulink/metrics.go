@@ -0,0 +1,54 @@
+package fmulink
+
+import (
+  "strconv"
+
+  "metrics"
+)
+
+const (
+  METRIC_LINK_MASTER = "master"
+  METRIC_LINK_OUTPUT = "output"
+)
+
+var (
+  packetsReceived = metrics.NewCounterVec("dslink_mavlink_packets_received_total",
+    "MAVLink packets received, by link and message.", "link", "msg")
+  packetsSent = metrics.NewCounterVec("dslink_mavlink_packets_sent_total",
+    "MAVLink packets sent, by link and message.", "link", "msg")
+  decodeErrors = metrics.NewCounterVec("dslink_mavlink_decode_errors_total",
+    "MAVLink packets from the master link that couldn't be decoded, by reason: crc or unknown_msg.", "reason")
+  rawPipeDrops = metrics.NewCounter("dslink_raw_data_pipe_drops_total",
+    "Packets not passed on to RawDataPipe because it was full.")
+  outputWriteErrors = metrics.NewCounter("dslink_output_write_errors_total",
+    "Failed writes to output links.")
+)
+
+func init() {
+  metrics.NewGaugeFunc("dslink_output_links", "Output links open.", func() float64 {
+    return float64(Outputs.Length())
+  })
+}
+
+// Message names for labels, from the log profile names, else the ID.
+var metricMsgNames = func() map[uint8]string {
+  names := make(map[uint8]string, len(logProfileNames))
+  for name, id := range logProfileNames {
+    names[id] = name
+  }
+  return names
+}()
+
+func metricMsg(id uint8) string {
+  if name, ok := metricMsgNames[id]; ok {
+    return name
+  }
+  return strconv.Itoa(int(id))
+}
+
+// Counts a raw MAVLink 1 packet.
+func countPacket(vec *metrics.CounterVec, link string, b []byte) {
+  if len(b) > 5 && b[0] == 0xFE {
+    vec.With(link, metricMsg(b[5])).Inc()
+  }
+}
@@ -12,6 +12,9 @@ type MsgManager struct {
   mut     sync.RWMutex
   quit    chan bool
   stamp   chan time.Time
+
+  last    time.Time
+  down    bool
 }
 
 func NewMsgManager(interval time.Duration) *MsgManager {
@@ -43,11 +46,17 @@ func (mm *MsgManager) Sched(interval time.Duration) {
       case c := <-mm.timer.C:
         dt := mm.getDt(c, lastPrev)
         if dt > uint64(interval / time.Millisecond) {
+          mm.mut.Lock()
+          mm.down = true
+          mm.mut.Unlock()
           mm.OnDown()
         }
 
       case prev := <- mm.stamp:
         lastPrev = prev
+        mm.mut.Lock()
+        mm.last, mm.down = prev, false
+        mm.mut.Unlock()
 
       case <- mm.quit:
         return
@@ -56,6 +65,20 @@ func (mm *MsgManager) Sched(interval time.Duration) {
   }()
 }
 
+// Whether the message has been seen, and not gone quiet since.
+func (mm *MsgManager) Online() bool {
+  mm.mut.RLock()
+  defer mm.mut.RUnlock()
+  return !mm.last.IsZero() && !mm.down
+}
+
+// When the message was last seen, zero if it never was.
+func (mm *MsgManager) LastSeen() time.Time {
+  mm.mut.RLock()
+  defer mm.mut.RUnlock()
+  return mm.last
+}
+
 func (mm *MsgManager) Stop() {
   mm.quit <- true
 }
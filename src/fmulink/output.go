@@ -50,7 +50,10 @@ func (o *OutputManager) listen() {
         // var buf bytes.Buffer
         // binary.Write(&buf, binary.BigEndian, pkt)
         if _, err := e.Conn.Write(*pkt); err != nil {
-          config.Log(config.LOG_DEBUG, "out: ", err)
+          outputWriteErrors.Inc()
+          config.Log(config.LOG_DEBUG, "fl: ", "Output write:", err)
+        } else {
+          countPacket(packetsSent, METRIC_LINK_OUTPUT, *pkt)
         }
       }
       o.mut.RUnlock()
@@ -75,7 +78,7 @@ func (o *OutputManager) Add(addr string) error {
 
   conn, err := net.Dial("udp", addr)
   if err != nil {
-    config.Log(config.LOG_ERROR, "outputs: ", err)
+    config.Log(config.LOG_ERROR, "fl: ", err)
     return err
   }
 
@@ -91,8 +94,9 @@ func (o *OutputManager) Add(addr string) error {
       select {
       case <- timer.C:
         if size, err := conn.Read(b); err != nil {
-          config.Log(config.LOG_DEBUG, "in: ", err)
+          config.Log(config.LOG_DEBUG, "fl: ", "Output read:", err)
         } else if size > 0 {
+          countPacket(packetsReceived, METRIC_LINK_OUTPUT, b[:size])
           o.Input <- b
         }
 
@@ -0,0 +1,258 @@
+// Package replay plays a recorded flight log back as if it were a live FMU.
+// It's opened as a master link (replay:<path>) and paced by the timestamps in
+// the log, so everything downstream sees the flight as it happened.
+package replay
+
+import (
+  "fmt"
+  "io"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+
+  "flightlog"
+)
+
+const (
+  PREFIX = "replay:"
+
+  MAX_SPEED = 64.0
+
+  // Gaps longer than this (the saver was throttled, or the link dropped while
+  // recording) are skipped rather than waited out.
+  MAX_GAP = 5 * time.Second
+
+  OUT_QUEUE = 64
+)
+
+type Status struct {
+  File      string  `json:"file"`
+  Position  float64 `json:"position"`
+  Duration  float64 `json:"duration"`
+  Speed     float64 `json:"speed"`
+  Paused    bool    `json:"paused"`
+  Finished  bool    `json:"finished"`
+}
+
+type Replay struct {
+  mut       sync.Mutex
+  path      string
+  recs      []*flightlog.Record
+
+  pos       int
+  gen       uint64
+  seeks     uint64
+  speed     float64
+  paused    bool
+
+  out       chan frame
+  pending   []byte
+  wake      chan bool
+  done      chan bool
+  closeOnce sync.Once
+}
+
+// A queued packet, and the seek it was queued after.
+type frame struct {
+  seek      uint64
+  data      []byte
+}
+
+// Loads a flight log and starts playing it at real time.
+func Open(addr string) (*Replay, error) {
+  fpath := strings.TrimPrefix(addr, PREFIX)
+
+  recs, err := flightlog.ReadFile(fpath)
+  if err != nil {
+    return nil, err
+  } else if len(recs) == 0 {
+    return nil, fmt.Errorf("Flight log %s has no packets.", fpath)
+  }
+
+  return newReplay(fpath, recs), nil
+}
+
+func newReplay(fpath string, recs []*flightlog.Record) *Replay {
+  r := &Replay{
+    path: fpath,
+    recs: recs,
+    speed: 1.0,
+    out: make(chan frame, OUT_QUEUE),
+    wake: make(chan bool, 1),
+    done: make(chan bool),
+  }
+
+  go r.run()
+  return r
+}
+
+// Recorded packets, paced by their timestamps.
+func (r *Replay) Read(b []byte) (int, error) {
+  for len(r.pending) == 0 {
+    select {
+    case f := <-r.out:
+      // Anything queued before a seek is from the old position.
+      r.mut.Lock()
+      if f.seek == r.seeks {
+        r.pending = f.data
+      }
+      r.mut.Unlock()
+    case <-r.done:
+      return 0, io.EOF
+    }
+  }
+
+  n := copy(b, r.pending)
+  r.pending = r.pending[n:]
+  return n, nil
+}
+
+// There's nobody on the other end, commands and requests go nowhere.
+func (r *Replay) Write(b []byte) (int, error) {
+  select {
+  case <-r.done:
+    return 0, io.ErrClosedPipe
+  default:
+    return len(b), nil
+  }
+}
+
+func (r *Replay) Close() error {
+  r.closeOnce.Do(func() { close(r.done) })
+  return nil
+}
+
+func (r *Replay) Pause() {
+  r.mut.Lock()
+  r.paused = true
+  r.changed()
+  r.mut.Unlock()
+}
+
+func (r *Replay) Resume() {
+  r.mut.Lock()
+  r.paused = false
+  r.changed()
+  r.mut.Unlock()
+}
+
+func (r *Replay) SetSpeed(speed float64) error {
+  if speed <= 0 || speed > MAX_SPEED {
+    return fmt.Errorf("Replay speed must be between 0 and %.0f.", MAX_SPEED)
+  }
+
+  r.mut.Lock()
+  r.speed = speed
+  r.changed()
+  r.mut.Unlock()
+  return nil
+}
+
+// Jumps to the first packet at or after offset from the start of the flight.
+func (r *Replay) Seek(offset time.Duration) error {
+  if offset < 0 || offset > r.duration() {
+    return fmt.Errorf("Seek position is outside the flight.")
+  }
+
+  target := r.recs[0].Time.Add(offset)
+
+  r.mut.Lock()
+  r.pos = sort.Search(len(r.recs), func(i int) bool {
+    return !r.recs[i].Time.Before(target)
+  })
+  r.seeks++
+  r.changed()
+  r.mut.Unlock()
+  return nil
+}
+
+func (r *Replay) Status() Status {
+  r.mut.Lock()
+  defer r.mut.Unlock()
+
+  st := Status{
+    File: r.path,
+    Duration: r.duration().Seconds(),
+    Speed: r.speed,
+    Paused: r.paused,
+    Finished: r.pos >= len(r.recs),
+  }
+
+  if st.Finished {
+    st.Position = st.Duration
+  } else {
+    st.Position = r.recs[r.pos].Time.Sub(r.recs[0].Time).Seconds()
+  }
+
+  return st
+}
+
+func (r *Replay) duration() time.Duration {
+  return r.recs[len(r.recs) - 1].Time.Sub(r.recs[0].Time)
+}
+
+// Wakes the player so it picks up a new position, speed or pause state. Must be
+// called with the lock held.
+func (r *Replay) changed() {
+  r.gen++
+  select {
+  case r.wake <- true:
+  default:
+  }
+}
+
+func (r *Replay) run() {
+  for {
+    r.mut.Lock()
+    if r.paused || r.pos >= len(r.recs) {
+      // Hold at the end, so whoever is watching keeps the final state.
+      r.mut.Unlock()
+      select {
+      case <-r.wake:
+        continue
+      case <-r.done:
+        return
+      }
+    }
+
+    gen := r.gen
+    rec := r.recs[r.pos]
+
+    var delay time.Duration
+    if r.pos > 0 {
+      delay = rec.Time.Sub(r.recs[r.pos - 1].Time)
+      if delay < 0 || delay > MAX_GAP {
+        delay = 0
+      }
+      delay = time.Duration(float64(delay) / r.speed)
+    }
+    r.mut.Unlock()
+
+    if delay > 0 {
+      select {
+      case <-time.After(delay):
+      case <-r.wake:
+        continue
+      case <-r.done:
+        return
+      }
+    }
+
+    r.mut.Lock()
+    if gen != r.gen {
+      // seeked or paused while we were waiting
+      r.mut.Unlock()
+      continue
+    }
+    r.pos++
+    f := frame{seek: r.seeks, data: rec.Packet}
+    r.mut.Unlock()
+
+    select {
+    case r.out <- f:
+    case <-r.done:
+      return
+    }
+  }
+}
@@ -0,0 +1,153 @@
+package replay
+
+import (
+  "testing"
+  "time"
+
+  "flightlog"
+)
+
+// n one-byte packets holding their index, step apart.
+func testLog(n int, step time.Duration) []*flightlog.Record {
+  start := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+  recs := make([]*flightlog.Record, n)
+  for i := range recs {
+    recs[i] = &flightlog.Record{Time: start.Add(time.Duration(i) * step), Packet: []byte{byte(i)}}
+  }
+  return recs
+}
+
+func next(t *testing.T, r *Replay) byte {
+  got := make(chan byte, 1)
+  go func() {
+    b := make([]byte, 8)
+    if n, err := r.Read(b); err == nil && n == 1 {
+      got <- b[0]
+    }
+  }()
+
+  select {
+  case b := <-got:
+    return b
+  case <-time.After(2 * time.Second):
+    t.Fatal("timed out waiting for a packet")
+  }
+  return 0
+}
+
+func TestPacing(t *testing.T) {
+  cases := []struct {
+    name  string
+    step  time.Duration
+    speed float64
+    min   time.Duration
+    max   time.Duration
+  }{
+    {"real time", 50 * time.Millisecond, 1, 180 * time.Millisecond, 600 * time.Millisecond},
+    {"4x", 100 * time.Millisecond, 4, 90 * time.Millisecond, 300 * time.Millisecond},
+    {"gaps skipped", 2 * MAX_GAP, 1, 0, 300 * time.Millisecond},
+  }
+
+  for _, c := range cases {
+    r := newReplay("test", testLog(5, c.step))
+    if err := r.SetSpeed(c.speed); err != nil {
+      t.Fatal(err)
+    }
+
+    start := time.Now()
+    for i := 0; i < 5; i++ {
+      if b := next(t, r); b != byte(i) {
+        t.Fatalf("%s: packet %d out of order, got %d", c.name, i, b)
+      }
+    }
+    if d := time.Since(start); d < c.min || d > c.max {
+      t.Errorf("%s: took %v, want %v to %v", c.name, d, c.min, c.max)
+    }
+    r.Close()
+  }
+}
+
+func TestSpeedRange(t *testing.T) {
+  r := newReplay("test", testLog(2, time.Second))
+  defer r.Close()
+
+  for _, speed := range []float64{0, -1, MAX_SPEED + 1} {
+    if err := r.SetSpeed(speed); err == nil {
+      t.Errorf("speed %v accepted", speed)
+    }
+  }
+  if err := r.SetSpeed(MAX_SPEED); err != nil {
+    t.Error(err)
+  }
+}
+
+func TestSeek(t *testing.T) {
+  r := newReplay("test", testLog(10, time.Second))
+  defer r.Close()
+  r.Pause()
+
+  if err := r.Seek(-time.Second); err == nil {
+    t.Error("seek before the start accepted")
+  }
+  if err := r.Seek(10 * time.Second); err == nil {
+    t.Error("seek past the end accepted")
+  }
+
+  // Between packets lands on the next one.
+  if err := r.Seek(4500 * time.Millisecond); err != nil {
+    t.Fatal(err)
+  }
+  if st := r.Status(); st.Position != 5 || st.Duration != 9 || !st.Paused {
+    t.Fatalf("status %+v", st)
+  }
+
+  r.Resume()
+  if b := next(t, r); b != 5 {
+    t.Fatalf("got packet %d after seek, want 5", b)
+  }
+}
+
+// With the queue full and the player blocked on the next send, nothing from
+// before the seek may come out after it.
+func TestSeekDropsQueued(t *testing.T) {
+  r := newReplay("test", testLog(OUT_QUEUE * 2, 2 * MAX_GAP))
+  defer r.Close()
+
+  deadline := time.Now().Add(2 * time.Second)
+  for len(r.out) < OUT_QUEUE {
+    if time.Now().After(deadline) {
+      t.Fatal("queue never filled")
+    }
+    time.Sleep(time.Millisecond)
+  }
+
+  if err := r.Seek(100 * 2 * MAX_GAP); err != nil {
+    t.Fatal(err)
+  }
+  if b := next(t, r); b != 100 {
+    t.Fatalf("got packet %d after seek, want 100", b)
+  }
+  if b := next(t, r); b != 101 {
+    t.Fatalf("got packet %d, want 101", b)
+  }
+}
+
+func TestFinished(t *testing.T) {
+  r := newReplay("test", testLog(3, 0))
+  defer r.Close()
+
+  for i := 0; i < 3; i++ {
+    next(t, r)
+  }
+
+  deadline := time.Now().Add(2 * time.Second)
+  for !r.Status().Finished {
+    if time.Now().After(deadline) {
+      t.Fatal("never finished")
+    }
+    time.Sleep(time.Millisecond)
+  }
+  if st := r.Status(); st.Position != st.Duration {
+    t.Errorf("status %+v", st)
+  }
+}
@@ -3,6 +3,7 @@
 package serial
 
 import (
+	"io"
 	"os"
 	"syscall"
 	"time"
@@ -96,7 +97,9 @@ func openPort(name string, baud int, databits byte, parity Parity, stopbits Stop
 	default:
 		return nil, ErrBadParity
 	}
-	fd := f.Fd()
+	// The fd stays non-blocking so reads go through the runtime poller: Close
+	// then interrupts a pending Read instead of waiting for the next byte, and
+	// the read timeout is a deadline rather than VTIME.
 	vmin, vtime := posixTimeoutValues(readTimeout)
 	t := syscall.Termios{
 		Iflag:  syscall.IGNPAR,
@@ -106,33 +109,68 @@ func openPort(name string, baud int, databits byte, parity Parity, stopbits Stop
 		Ospeed: rate,
 	}
 
-	if _, _, errno := syscall.Syscall6(
-		syscall.SYS_IOCTL,
-		uintptr(fd),
-		uintptr(syscall.TCSETS),
-		uintptr(unsafe.Pointer(&t)),
-		0,
-		0,
-		0,
-	); errno != 0 {
-		return nil, errno
+	err = control(f, func(fd uintptr) error {
+		if _, _, errno := syscall.Syscall6(
+			syscall.SYS_IOCTL,
+			fd,
+			uintptr(syscall.TCSETS),
+			uintptr(unsafe.Pointer(&t)),
+			0,
+			0,
+			0,
+		); errno != 0 {
+			return errno
+		}
+		return nil
+	})
+	if err != nil {
+		return
 	}
 
-	if err = syscall.SetNonblock(int(fd), false); err != nil {
-		return
+	return &Port{f: f, timeout: readTimeout}, nil
+}
+
+// Runs fn on the raw fd. Unlike f.Fd() this leaves the file in non-blocking
+// mode.
+func control(f *os.File, fn func(fd uintptr) error) error {
+	raw, err := f.SyscallConn()
+	if err != nil {
+		return err
 	}
 
-	return &Port{f: f}, nil
+	var ferr error
+	if err := raw.Control(func(fd uintptr) { ferr = fn(fd) }); err != nil {
+		return err
+	}
+	return ferr
 }
 
 type Port struct {
 	// We intentionly do not use an "embedded" struct so that we
 	// don't export File
 	f *os.File
+	timeout time.Duration
 }
 
+// Blocks until at least one byte arrives, the read timeout passes (0, io.EOF,
+// as with VTIME) or the port is closed.
 func (p *Port) Read(b []byte) (n int, err error) {
-	return p.f.Read(b)
+	if p.timeout > 0 {
+		if err = p.f.SetReadDeadline(time.Now().Add(p.timeout)); err != nil {
+			return
+		}
+	}
+
+	n, err = p.f.Read(b)
+	if p.timeout > 0 && os.IsTimeout(err) {
+		return n, io.EOF
+	}
+	return
+}
+
+// Sets a deadline for pending and future reads. A zero time clears it.
+func (p *Port) SetReadDeadline(t time.Time) error {
+	return p.f.SetReadDeadline(t)
 }
 
 func (p *Port) Write(b []byte) (n int, err error) {
@@ -143,13 +181,17 @@ func (p *Port) Write(b []byte) (n int, err error) {
 // or data received but not read
 func (p *Port) Flush() error {
 	const TCFLSH = 0x540B
-	_, _, err := syscall.Syscall(
-		syscall.SYS_IOCTL,
-		uintptr(p.f.Fd()),
-		uintptr(TCFLSH),
-		uintptr(syscall.TCIOFLUSH),
-	)
-	return err
+	return control(p.f, func(fd uintptr) error {
+		if _, _, errno := syscall.Syscall(
+			syscall.SYS_IOCTL,
+			fd,
+			uintptr(TCFLSH),
+			uintptr(syscall.TCIOFLUSH),
+		); errno != 0 {
+			return errno
+		}
+		return nil
+	})
 }
 
 func (p *Port) Close() (err error) {
@@ -0,0 +1,731 @@
+/**
+ * Dronesmith API
+ *
+ * Copyright (C) 2016 Dronesmith Technologies Inc, all rights reserved.
+ * Unauthorized copying of any source code or assets within this project, via
+ * any medium is strictly prohibited.
+ *
+ * Proprietary and confidential.
+ */
+
+// Package sim is a small kinematic multicopter that speaks MAVLink like a PX4
+// FMU. It's opened as a master link (sim://) so the rest of the engine can be
+// exercised without hardware or a SITL build. There's no dynamics model, the
+// vehicle simply flies toward its target at the configured speeds.
+package sim
+
+import (
+  "bytes"
+  "fmt"
+  "io"
+  "math"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+
+  "mavlink/parser"
+)
+
+const (
+  PREFIX = "sim://"
+
+  SYS_ID = 1
+  COMP_ID = 1
+
+  // Physics runs at 10Hz, heartbeat and status go out every 10th step.
+  STEP = 100 * time.Millisecond
+  SLOW_DIVIDER = 10
+  GPS_DIVIDER = 2
+
+  // PX4 main modes, shifted into bits 16-23 of custom_mode.
+  MAIN_MANUAL = 1
+  MAIN_ALTCTL = 2
+  MAIN_POSCTL = 3
+  MAIN_AUTO = 4
+  MAIN_ACRO = 5
+  MAIN_OFFBOARD = 6
+  MAIN_STABILIZED = 7
+  MAIN_RATTITUDE = 8
+
+  // PX4 auto sub modes, shifted into bits 24-31.
+  SUB_READY = 1
+  SUB_TAKEOFF = 2
+  SUB_LOITER = 3
+  SUB_MISSION = 4
+  SUB_RTL = 5
+  SUB_LAND = 6
+
+  EARTH_RADIUS = 6378137.0
+
+  // Queued frames for the reader. When the engine stops reading we drop the
+  // oldest telemetry, same as a UART would.
+  OUT_QUEUE = 256
+)
+
+var (
+  // Somewhere in San Francisco.
+  DefaultHome = [3]float64{37.7749, -122.4194, 10}
+)
+
+type param struct {
+  name  string
+  value float32
+}
+
+type Sim struct {
+  mut         sync.Mutex
+  speedup     float64
+
+  out         chan []byte
+  pending     []byte
+  in          *io.PipeWriter
+  done        chan bool
+  closeOnce   sync.Once
+
+  enc         *mavlink.Encoder
+  encBuf      bytes.Buffer
+
+  steps       uint64
+
+  // home, in degrees and meters AMSL
+  homeLat     float64
+  homeLon     float64
+  homeAlt     float64
+
+  // local NED position relative to home, meters
+  x, y, z     float64
+  vx, vy, vz  float64
+  yaw         float64
+
+  tx, ty, tz  float64
+  hasTarget   bool
+
+  armed       bool
+  inAir       bool
+  mainMode    uint32
+  subMode     uint32
+  battery     float64
+
+  params      []param
+}
+
+// Opens a simulator from a master link address. Accepts `sim://` on its own,
+// or `sim://<lat>,<lon>[,<alt>]` to put home somewhere else.
+func Open(addr string) (*Sim, error) {
+  home, err := ParseHome(addr)
+  if err != nil {
+    return nil, err
+  }
+
+  return NewSim(home[0], home[1], home[2], 1.0), nil
+}
+
+// Home position encoded in a sim:// address, or DefaultHome if there is none.
+func ParseHome(addr string) ([3]float64, error) {
+  home := DefaultHome
+  if !strings.HasPrefix(addr, PREFIX) {
+    return home, fmt.Errorf("Not a simulator address: %s", addr)
+  }
+
+  rest := addr[len(PREFIX):]
+  if rest == "" {
+    return home, nil
+  }
+
+  parts := strings.Split(rest, ",")
+  if len(parts) < 2 || len(parts) > 3 {
+    return home, fmt.Errorf("Simulator home must be lat,lon[,alt]: %s", rest)
+  }
+
+  for i, p := range parts {
+    v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+    if err != nil {
+      return home, fmt.Errorf("Invalid simulator home: %s", rest)
+    }
+    home[i] = v
+  }
+
+  return home, nil
+}
+
+// Starts a simulated vehicle sitting disarmed at the given home. speedup scales
+// simulated time against the wall clock, tests use it to fly a pattern quickly.
+func NewSim(lat, lon, alt float64, speedup float64) *Sim {
+  if speedup <= 0 {
+    speedup = 1.0
+  }
+
+  s := &Sim{
+    speedup: speedup,
+    out: make(chan []byte, OUT_QUEUE),
+    done: make(chan bool),
+    homeLat: lat,
+    homeLon: lon,
+    homeAlt: alt,
+    mainMode: MAIN_AUTO,
+    subMode: SUB_LOITER,
+    battery: 100.0,
+    params: []param{
+      {"SYS_AUTOSTART", 4001},
+      {"SYS_MC_EST_GROUP", 2},
+      {"MAV_TYPE", mavlink.MAV_TYPE_QUADROTOR},
+      {"MIS_TAKEOFF_ALT", 2.5},
+      {"MPC_XY_CRUISE", 5},
+      {"MPC_Z_VEL_MAX_UP", 3},
+      {"MPC_Z_VEL_MAX_DN", 1},
+      {"MPC_LAND_SPEED", 0.7},
+      {"NAV_ACC_RAD", 2},
+      {"RTL_RETURN_ALT", 30},
+      {"BAT_N_CELLS", 3},
+      {"COM_RC_IN_MODE", 1},
+    },
+  }
+
+  s.enc = mavlink.NewEncoder(&s.encBuf)
+
+  pr, pw := io.Pipe()
+  s.in = pw
+
+  go s.listen(pr)
+  go s.run()
+
+  return s
+}
+
+// Telemetry as encoded MAVLink, one or more frames per call.
+func (s *Sim) Read(b []byte) (int, error) {
+  if len(s.pending) == 0 {
+    select {
+    case frame := <-s.out:
+      s.pending = frame
+    case <-s.done:
+      return 0, io.EOF
+    }
+  }
+
+  n := copy(b, s.pending)
+  s.pending = s.pending[n:]
+  return n, nil
+}
+
+// Accepts MAVLink from the engine. Anything that isn't MAVLink is skipped by the
+// decoder, so the NSH exec string is harmless.
+func (s *Sim) Write(b []byte) (int, error) {
+  select {
+  case <-s.done:
+    return 0, io.ErrClosedPipe
+  default:
+  }
+
+  return s.in.Write(b)
+}
+
+func (s *Sim) Close() error {
+  s.closeOnce.Do(func() {
+    close(s.done)
+    s.in.Close()
+  })
+  return nil
+}
+
+func (s *Sim) listen(r io.Reader) {
+  dec := mavlink.NewDecoder(r)
+
+  for {
+    pkt, err := dec.Decode()
+    if err == mavlink.ErrCrcFail || err == mavlink.ErrUnknownMsgID {
+      continue
+    } else if err != nil {
+      return
+    }
+
+    s.handle(pkt)
+  }
+}
+
+func (s *Sim) run() {
+  ticker := time.NewTicker(time.Duration(float64(STEP) / s.speedup))
+  defer ticker.Stop()
+
+  for {
+    select {
+    case <-ticker.C:
+      s.step(STEP.Seconds())
+    case <-s.done:
+      return
+    }
+  }
+}
+
+// Must be called with the lock held.
+func (s *Sim) send(m mavlink.Message) {
+  s.encBuf.Reset()
+  if err := s.enc.Encode(SYS_ID, COMP_ID, m); err != nil {
+    return
+  }
+
+  frame := make([]byte, s.encBuf.Len())
+  copy(frame, s.encBuf.Bytes())
+
+  for {
+    select {
+    case s.out <- frame:
+      return
+    default:
+    }
+
+    select {
+    case <-s.out:
+    default:
+    }
+  }
+}
+
+func (s *Sim) paramValue(m *param, idx int) *mavlink.ParamValue {
+  var id [16]byte
+  copy(id[:], m.name)
+
+  return &mavlink.ParamValue{
+    ParamValue: m.value,
+    ParamCount: uint16(len(s.params)),
+    ParamIndex: uint16(idx),
+    ParamId: id,
+    ParamType: mavlink.MAV_PARAM_TYPE_REAL32,
+  }
+}
+
+// Must be called with the lock held.
+func (s *Sim) param(name string) float64 {
+  for _, p := range s.params {
+    if p.name == name {
+      return float64(p.value)
+    }
+  }
+  return 0
+}
+
+func paramName(id [16]byte) string {
+  if n := bytes.IndexByte(id[:], 0); n >= 0 {
+    return string(id[:n])
+  }
+  return string(id[:])
+}
+
+func (s *Sim) handle(pkt *mavlink.Packet) {
+  s.mut.Lock()
+  defer s.mut.Unlock()
+
+  switch pkt.MsgID {
+  case mavlink.MSG_ID_PARAM_REQUEST_LIST:
+    for i := range s.params {
+      s.send(s.paramValue(&s.params[i], i))
+    }
+
+  case mavlink.MSG_ID_PARAM_REQUEST_READ:
+    var m mavlink.ParamRequestRead
+    if err := m.Unpack(pkt); err != nil {
+      return
+    }
+
+    name := paramName(m.ParamId)
+    for i := range s.params {
+      if int(m.ParamIndex) == i || (m.ParamIndex < 0 && s.params[i].name == name) {
+        s.send(s.paramValue(&s.params[i], i))
+        return
+      }
+    }
+
+  case mavlink.MSG_ID_PARAM_SET:
+    var m mavlink.ParamSet
+    if err := m.Unpack(pkt); err != nil {
+      return
+    }
+
+    name := paramName(m.ParamId)
+    for i := range s.params {
+      if s.params[i].name == name {
+        s.params[i].value = m.ParamValue
+        s.send(s.paramValue(&s.params[i], i))
+        return
+      }
+    }
+
+  case mavlink.MSG_ID_COMMAND_LONG:
+    var m mavlink.CommandLong
+    if err := m.Unpack(pkt); err != nil {
+      return
+    }
+
+    s.send(&mavlink.CommandAck{
+      Command: m.Command,
+      Result: s.command(&m),
+    })
+  }
+}
+
+// Runs a command and returns its MAV_RESULT. Must be called with the lock held.
+func (s *Sim) command(m *mavlink.CommandLong) uint8 {
+  switch m.Command {
+  case mavlink.MAV_CMD_REQUEST_AUTOPILOT_CAPABILITIES:
+    if m.Param1 == 1 {
+      s.send(&mavlink.AutopilotVersion{
+        Capabilities: mavlink.MAV_PROTOCOL_CAPABILITY_MISSION_FLOAT |
+          mavlink.MAV_PROTOCOL_CAPABILITY_PARAM_FLOAT |
+          mavlink.MAV_PROTOCOL_CAPABILITY_MISSION_INT |
+          mavlink.MAV_PROTOCOL_CAPABILITY_COMMAND_INT |
+          mavlink.MAV_PROTOCOL_CAPABILITY_SET_POSITION_TARGET_GLOBAL_INT,
+        Uid: 0x53494d,
+        FlightSwVersion: 1 << 24 | 5 << 16 | 0 << 8 | 0xFF,
+      })
+    }
+    return mavlink.MAV_RESULT_ACCEPTED
+
+  case mavlink.MAV_CMD_COMPONENT_ARM_DISARM:
+    return s.setArmed(m.Param1 == 1)
+
+  case mavlink.MAV_CMD_DO_SET_MODE:
+    base := uint8(m.Param1)
+    if res := s.setArmed(base & mavlink.MAV_MODE_FLAG_SAFETY_ARMED > 0); res != mavlink.MAV_RESULT_ACCEPTED {
+      return res
+    }
+
+    if base & mavlink.MAV_MODE_FLAG_CUSTOM_MODE_ENABLED == 0 {
+      return mavlink.MAV_RESULT_UNSUPPORTED
+    }
+    return s.setMode(uint32(m.Param2), uint32(m.Param3))
+
+  case mavlink.MAV_CMD_NAV_TAKEOFF:
+    if !s.armed {
+      return mavlink.MAV_RESULT_DENIED
+    }
+
+    alt := s.param("MIS_TAKEOFF_ALT")
+    if !math.IsNaN(float64(m.Param7)) && float64(m.Param7) > s.homeAlt {
+      alt = float64(m.Param7) - s.homeAlt
+    }
+
+    s.tx, s.ty, s.tz = s.x, s.y, -alt
+    s.hasTarget = true
+    s.mainMode, s.subMode = MAIN_AUTO, SUB_TAKEOFF
+    return mavlink.MAV_RESULT_ACCEPTED
+
+  case mavlink.MAV_CMD_DO_REPOSITION:
+    if !s.armed || !s.inAir {
+      return mavlink.MAV_RESULT_DENIED
+    }
+
+    s.tx, s.ty = s.toLocal(float64(m.Param5), float64(m.Param6))
+    s.tz = s.z
+    if !math.IsNaN(float64(m.Param7)) {
+      s.tz = -(float64(m.Param7) - s.homeAlt)
+    }
+
+    s.hasTarget = true
+    s.mainMode, s.subMode = MAIN_AUTO, SUB_LOITER
+    return mavlink.MAV_RESULT_ACCEPTED
+
+  case mavlink.MAV_CMD_NAV_LAND:
+    return s.setMode(MAIN_AUTO, SUB_LAND)
+
+  case mavlink.MAV_CMD_NAV_RETURN_TO_LAUNCH:
+    return s.setMode(MAIN_AUTO, SUB_RTL)
+
+  case mavlink.MAV_CMD_DO_SET_HOME:
+    // Keep the vehicle where it is and move the frame around it.
+    lat, lon := s.toGlobal(s.x, s.y)
+    alt := s.homeAlt - s.z
+
+    if m.Param1 == 1 {
+      s.homeLat, s.homeLon, s.homeAlt = lat, lon, alt
+    } else {
+      s.homeLat, s.homeLon, s.homeAlt = float64(m.Param5), float64(m.Param6), float64(m.Param7)
+    }
+
+    s.x, s.y = s.toLocal(lat, lon)
+    s.z = s.homeAlt - alt
+    s.tx, s.ty, s.tz = s.x, s.y, s.z
+    return mavlink.MAV_RESULT_ACCEPTED
+  }
+
+  return mavlink.MAV_RESULT_UNSUPPORTED
+}
+
+// Must be called with the lock held.
+func (s *Sim) setArmed(arm bool) uint8 {
+  if arm == s.armed {
+    return mavlink.MAV_RESULT_ACCEPTED
+  }
+
+  if !arm && s.inAir {
+    return mavlink.MAV_RESULT_TEMPORARILY_REJECTED
+  }
+
+  if arm && s.battery < 10 {
+    return mavlink.MAV_RESULT_DENIED
+  }
+
+  s.armed = arm
+  if arm {
+    s.tx, s.ty, s.tz = s.x, s.y, s.z
+    s.hasTarget = true
+  }
+  return mavlink.MAV_RESULT_ACCEPTED
+}
+
+// Must be called with the lock held.
+func (s *Sim) setMode(main, sub uint32) uint8 {
+  if main < MAIN_MANUAL || main > MAIN_RATTITUDE {
+    return mavlink.MAV_RESULT_DENIED
+  }
+
+  s.mainMode, s.subMode = main, 0
+  if main == MAIN_AUTO {
+    s.subMode = sub
+  }
+
+  switch {
+  case main != MAIN_AUTO, sub == SUB_LOITER, sub == SUB_MISSION, sub == SUB_READY:
+    // No sticks or missions here, so everything else just holds position.
+    s.tx, s.ty, s.tz = s.x, s.y, s.z
+    s.hasTarget = true
+  case sub == SUB_TAKEOFF:
+    s.tx, s.ty, s.tz = s.x, s.y, -s.param("MIS_TAKEOFF_ALT")
+    s.hasTarget = true
+  case sub == SUB_RTL:
+    s.tx, s.ty = 0, 0
+    s.tz = math.Min(s.z, -s.param("RTL_RETURN_ALT"))
+    s.hasTarget = true
+  case sub == SUB_LAND:
+    s.tx, s.ty, s.tz = s.x, s.y, 0
+    s.hasTarget = true
+  }
+
+  return mavlink.MAV_RESULT_ACCEPTED
+}
+
+func (s *Sim) toGlobal(x, y float64) (float64, float64) {
+  lat := s.homeLat + x / EARTH_RADIUS * 180 / math.Pi
+  lon := s.homeLon + y / (EARTH_RADIUS * math.Cos(s.homeLat * math.Pi / 180)) * 180 / math.Pi
+  return lat, lon
+}
+
+func (s *Sim) toLocal(lat, lon float64) (float64, float64) {
+  x := (lat - s.homeLat) * math.Pi / 180 * EARTH_RADIUS
+  y := (lon - s.homeLon) * math.Pi / 180 * EARTH_RADIUS * math.Cos(s.homeLat * math.Pi / 180)
+  return x, y
+}
+
+// Moves toward the target for dt seconds of simulated time, then publishes.
+func (s *Sim) step(dt float64) {
+  s.mut.Lock()
+  defer s.mut.Unlock()
+
+  s.steps++
+  s.vx, s.vy, s.vz = 0, 0, 0
+
+  if s.armed && s.hasTarget {
+    cruise := s.param("MPC_XY_CRUISE")
+    up := s.param("MPC_Z_VEL_MAX_UP")
+    down := s.param("MPC_Z_VEL_MAX_DN")
+    if s.mainMode == MAIN_AUTO && s.subMode == SUB_LAND {
+      down = s.param("MPC_LAND_SPEED")
+    }
+
+    // RTL climbs first, then comes home, then lands.
+    if s.mainMode == MAIN_AUTO && s.subMode == SUB_RTL {
+      if s.z > s.tz + 0.5 {
+        s.tx, s.ty = s.x, s.y
+      } else {
+        s.tx, s.ty = 0, 0
+        if math.Hypot(s.x, s.y) < 0.5 {
+          s.subMode = SUB_LAND
+          s.tz = 0
+        }
+      }
+    }
+
+    dx, dy := s.tx - s.x, s.ty - s.y
+    if dist := math.Hypot(dx, dy); dist > 0.01 {
+      speed := math.Min(cruise, dist / dt)
+      s.vx, s.vy = dx / dist * speed, dy / dist * speed
+      if dist > 1 {
+        s.yaw = math.Atan2(dy, dx)
+      }
+    }
+
+    if dz := s.tz - s.z; dz < 0 {
+      s.vz = math.Max(-up, dz / dt)
+    } else if dz > 0 {
+      s.vz = math.Min(down, dz / dt)
+    }
+
+    s.x += s.vx * dt
+    s.y += s.vy * dt
+    s.z += s.vz * dt
+
+    // Takeoff hands over to loiter once it reaches altitude.
+    if s.mainMode == MAIN_AUTO && s.subMode == SUB_TAKEOFF && math.Abs(s.tz - s.z) < 0.1 {
+      s.subMode = SUB_LOITER
+    }
+  }
+
+  if s.z < -0.1 {
+    s.inAir = true
+  } else if s.inAir {
+    // Touchdown. PX4 disarms on its own once it's sure it has landed.
+    s.z = 0
+    s.inAir = false
+    s.armed = false
+    s.hasTarget = false
+    s.mainMode, s.subMode = MAIN_AUTO, SUB_LOITER
+  }
+
+  if s.armed {
+    drain := 0.02
+    if s.inAir {
+      drain = 0.1
+    }
+    s.battery = math.Max(0, s.battery - drain * dt)
+  }
+
+  s.publish()
+}
+
+// Must be called with the lock held.
+func (s *Sim) publish() {
+  bootMs := uint32(float64(s.steps) * STEP.Seconds() * 1000)
+  lat, lon := s.toGlobal(s.x, s.y)
+  alt := s.homeAlt - s.z
+
+  heading := math.Mod(s.yaw * 180 / math.Pi + 360, 360)
+  speed := math.Hypot(s.vx, s.vy)
+
+  // Lean into the direction of travel, a few degrees per m/s.
+  fwd := s.vx * math.Cos(s.yaw) + s.vy * math.Sin(s.yaw)
+  side := -s.vx * math.Sin(s.yaw) + s.vy * math.Cos(s.yaw)
+
+  s.send(&mavlink.Attitude{
+    TimeBootMs: bootMs,
+    Roll: float32(side * 0.05),
+    Pitch: float32(-fwd * 0.05),
+    Yaw: float32(s.yaw),
+  })
+
+  s.send(&mavlink.LocalPositionNed{
+    TimeBootMs: bootMs,
+    X: float32(s.x), Y: float32(s.y), Z: float32(s.z),
+    Vx: float32(s.vx), Vy: float32(s.vy), Vz: float32(s.vz),
+  })
+
+  s.send(&mavlink.GlobalPositionInt{
+    TimeBootMs: bootMs,
+    Lat: int32(lat * 1e7),
+    Lon: int32(lon * 1e7),
+    Alt: int32(alt * 1000),
+    RelativeAlt: int32(-s.z * 1000),
+    Vx: int16(s.vx * 100),
+    Vy: int16(s.vy * 100),
+    Vz: int16(s.vz * 100),
+    Hdg: uint16(heading * 100),
+  })
+
+  if s.steps % GPS_DIVIDER == 0 {
+    s.send(&mavlink.GpsRawInt{
+      TimeUsec: uint64(bootMs) * 1000,
+      Lat: int32(lat * 1e7),
+      Lon: int32(lon * 1e7),
+      Alt: int32(alt * 1000),
+      Eph: 80,
+      Epv: 120,
+      Vel: uint16(speed * 100),
+      Cog: uint16(heading * 100),
+      FixType: mavlink.GPS_FIX_TYPE_3D_FIX,
+      SatellitesVisible: 12,
+    })
+
+    throttle := uint16(0)
+    if s.armed {
+      throttle = uint16(50 - s.vz * 10)
+    }
+
+    s.send(&mavlink.VfrHud{
+      Airspeed: float32(speed),
+      Groundspeed: float32(speed),
+      Alt: float32(alt),
+      Climb: float32(-s.vz),
+      Heading: int16(heading),
+      Throttle: throttle,
+    })
+  }
+
+  if s.steps % SLOW_DIVIDER != 1 {
+    return
+  }
+
+  baseMode := uint8(mavlink.MAV_MODE_FLAG_CUSTOM_MODE_ENABLED)
+  state := uint8(mavlink.MAV_STATE_STANDBY)
+  if s.armed {
+    baseMode |= mavlink.MAV_MODE_FLAG_SAFETY_ARMED
+    state = mavlink.MAV_STATE_ACTIVE
+  }
+
+  s.send(&mavlink.Heartbeat{
+    CustomMode: s.mainMode << 16 | s.subMode << 24,
+    Type: mavlink.MAV_TYPE_QUADROTOR,
+    Autopilot: mavlink.MAV_AUTOPILOT_PX4,
+    BaseMode: baseMode,
+    SystemStatus: state,
+    MavlinkVersion: 3,
+  })
+
+  // 3S pack, 12.6V full down to 10.5V empty.
+  cells := s.param("BAT_N_CELLS")
+  volts := cells * (3.5 + 0.7 * s.battery / 100)
+  current := 0.5
+  if s.inAir {
+    current = 12
+  }
+
+  s.send(&mavlink.SysStatus{
+    Load: 250,
+    VoltageBattery: uint16(volts * 1000),
+    CurrentBattery: int16(current * 100),
+    BatteryRemaining: int8(s.battery),
+  })
+
+  var cellVolts [10]uint16
+  for i := range cellVolts {
+    cellVolts[i] = math.MaxUint16
+    if i < int(cells) {
+      cellVolts[i] = uint16(volts / cells * 1000)
+    }
+  }
+
+  s.send(&mavlink.BatteryStatus{
+    CurrentConsumed: int32((100 - s.battery) * 50),
+    EnergyConsumed: -1,
+    Temperature: math.MaxInt16,
+    Voltages: cellVolts,
+    CurrentBattery: int16(current * 100),
+    BatteryRemaining: int8(s.battery),
+  })
+
+  landed := uint8(mavlink.MAV_LANDED_STATE_ON_GROUND)
+  if s.inAir {
+    landed = mavlink.MAV_LANDED_STATE_IN_AIR
+  }
+
+  s.send(&mavlink.ExtendedSysState{
+    VtolState: mavlink.MAV_VTOL_STATE_MC,
+    LandedState: landed,
+  })
+
+  homeQ := [4]float32{1, 0, 0, 0}
+  s.send(&mavlink.HomePosition{
+    Latitude: int32(s.homeLat * 1e7),
+    Longitude: int32(s.homeLon * 1e7),
+    Altitude: int32(s.homeAlt * 1000),
+    Q: homeQ,
+  })
+}
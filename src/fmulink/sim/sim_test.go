@@ -0,0 +1,142 @@
+package sim
+
+import (
+  "testing"
+  "time"
+
+  "mavlink/parser"
+)
+
+// Reads packets until pred accepts one or the deadline passes.
+func waitFor(t *testing.T, dec *mavlink.Decoder, what string, pred func(*mavlink.Packet) bool) {
+  deadline := time.Now().Add(5 * time.Second)
+  for time.Now().Before(deadline) {
+    pkt, err := dec.Decode()
+    if err != nil {
+      t.Fatalf("decode while waiting for %s: %v", what, err)
+    }
+    if pred(pkt) {
+      return
+    }
+  }
+  t.Fatalf("timed out waiting for %s", what)
+}
+
+func ack(cmd uint16, result uint8) func(*mavlink.Packet) bool {
+  return func(p *mavlink.Packet) bool {
+    if p.MsgID != mavlink.MSG_ID_COMMAND_ACK {
+      return false
+    }
+    var m mavlink.CommandAck
+    return m.Unpack(p) == nil && m.Command == cmd && m.Result == result
+  }
+}
+
+func TestParseHome(t *testing.T) {
+  cases := []struct {
+    addr  string
+    home  [3]float64
+    ok    bool
+  }{
+    {"sim://", DefaultHome, true},
+    {"sim://47.1,8.5", [3]float64{47.1, 8.5, DefaultHome[2]}, true},
+    {"sim://47.1,8.5,400", [3]float64{47.1, 8.5, 400}, true},
+    {"sim://47.1", DefaultHome, false},
+    {"sim://a,b", DefaultHome, false},
+    {"/dev/ttyUSB0", DefaultHome, false},
+  }
+
+  for _, c := range cases {
+    home, err := ParseHome(c.addr)
+    if (err == nil) != c.ok {
+      t.Errorf("%s: got error %v", c.addr, err)
+    } else if c.ok && home != c.home {
+      t.Errorf("%s: got %v, want %v", c.addr, home, c.home)
+    }
+  }
+}
+
+func TestParamsAndVersion(t *testing.T) {
+  s := NewSim(DefaultHome[0], DefaultHome[1], DefaultHome[2], 10)
+  defer s.Close()
+
+  dec := mavlink.NewDecoder(s)
+  enc := mavlink.NewEncoder(s)
+
+  if err := enc.Encode(255, 0, &mavlink.ParamRequestList{TargetSystem: SYS_ID, TargetComponent: COMP_ID}); err != nil {
+    t.Fatal(err)
+  }
+
+  seen := make(map[uint16]bool)
+  waitFor(t, dec, "all params", func(p *mavlink.Packet) bool {
+    if p.MsgID != mavlink.MSG_ID_PARAM_VALUE {
+      return false
+    }
+    var m mavlink.ParamValue
+    if err := m.Unpack(p); err != nil {
+      return false
+    }
+    seen[m.ParamIndex] = true
+    return len(seen) == int(m.ParamCount)
+  })
+
+  err := enc.Encode(255, 0, &mavlink.CommandLong{
+    Param1: 1,
+    Command: mavlink.MAV_CMD_REQUEST_AUTOPILOT_CAPABILITIES,
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  waitFor(t, dec, "autopilot version", func(p *mavlink.Packet) bool {
+    return p.MsgID == mavlink.MSG_ID_AUTOPILOT_VERSION
+  })
+}
+
+func TestTakeoffAndLand(t *testing.T) {
+  s := NewSim(DefaultHome[0], DefaultHome[1], DefaultHome[2], 50)
+  defer s.Close()
+
+  dec := mavlink.NewDecoder(s)
+  enc := mavlink.NewEncoder(s)
+
+  cmd := func(c mavlink.CommandLong) {
+    if err := enc.Encode(255, 0, &c); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  // Can't take off on the ground without arming.
+  cmd(mavlink.CommandLong{Param7: float32(DefaultHome[2] + 5), Command: mavlink.MAV_CMD_NAV_TAKEOFF})
+  waitFor(t, dec, "takeoff denied", ack(mavlink.MAV_CMD_NAV_TAKEOFF, mavlink.MAV_RESULT_DENIED))
+
+  cmd(mavlink.CommandLong{Param1: 1, Command: mavlink.MAV_CMD_COMPONENT_ARM_DISARM})
+  waitFor(t, dec, "arm ack", ack(mavlink.MAV_CMD_COMPONENT_ARM_DISARM, mavlink.MAV_RESULT_ACCEPTED))
+
+  waitFor(t, dec, "armed heartbeat", func(p *mavlink.Packet) bool {
+    var m mavlink.Heartbeat
+    return p.MsgID == mavlink.MSG_ID_HEARTBEAT && m.Unpack(p) == nil &&
+      m.BaseMode & mavlink.MAV_MODE_FLAG_SAFETY_ARMED > 0 && m.SystemStatus == mavlink.MAV_STATE_ACTIVE
+  })
+
+  cmd(mavlink.CommandLong{Param7: float32(DefaultHome[2] + 5), Command: mavlink.MAV_CMD_NAV_TAKEOFF})
+  waitFor(t, dec, "takeoff ack", ack(mavlink.MAV_CMD_NAV_TAKEOFF, mavlink.MAV_RESULT_ACCEPTED))
+
+  waitFor(t, dec, "5m altitude", func(p *mavlink.Packet) bool {
+    var m mavlink.GlobalPositionInt
+    return p.MsgID == mavlink.MSG_ID_GLOBAL_POSITION_INT && m.Unpack(p) == nil && m.RelativeAlt > 4900
+  })
+
+  // Disarming in the air is refused.
+  cmd(mavlink.CommandLong{Param1: 0, Command: mavlink.MAV_CMD_COMPONENT_ARM_DISARM})
+  waitFor(t, dec, "disarm rejected", ack(mavlink.MAV_CMD_COMPONENT_ARM_DISARM, mavlink.MAV_RESULT_TEMPORARILY_REJECTED))
+
+  cmd(mavlink.CommandLong{Command: mavlink.MAV_CMD_NAV_LAND})
+  waitFor(t, dec, "land ack", ack(mavlink.MAV_CMD_NAV_LAND, mavlink.MAV_RESULT_ACCEPTED))
+
+  waitFor(t, dec, "disarmed on the ground", func(p *mavlink.Packet) bool {
+    var m mavlink.Heartbeat
+    return p.MsgID == mavlink.MSG_ID_HEARTBEAT && m.Unpack(p) == nil &&
+      m.BaseMode & mavlink.MAV_MODE_FLAG_SAFETY_ARMED == 0
+  })
+}
@@ -0,0 +1,345 @@
+// Leveled logging by subsystem (fl, cl, ss, sync, vehicle...), to the
+// console and a file that's rotated by size and age, with recent entries kept
+// in memory for the status server.
+package logger
+
+import (
+  "encoding/json"
+  "fmt"
+  "io"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+const (
+  DEBUG = iota
+  INFO
+  WARN
+  ERROR
+)
+
+const (
+  FORMAT_TEXT = "text"
+  FORMAT_JSON = "json"
+
+  TIME_FORMAT = "2006/01/02 15:04:05"
+  ROTATE_SUFFIX = "20060102-150405.000"
+
+  SUBSCRIBER_BUFFER = 256
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func LevelName(level int) string {
+  if level < DEBUG || level > ERROR {
+    return "unknown"
+  }
+  return levelNames[level]
+}
+
+func ParseLevel(name string) (int, error) {
+  for i, n := range levelNames {
+    if strings.EqualFold(n, name) {
+      return i, nil
+    }
+  }
+  return INFO, fmt.Errorf("Unknown log level %q.", name)
+}
+
+// Per subsystem levels, as "fl=debug,cl=warn".
+func ParseLevels(str string) (map[string]int, error) {
+  levels := make(map[string]int)
+  for _, pair := range strings.Split(str, ",") {
+    pair = strings.TrimSpace(pair)
+    if pair == "" {
+      continue
+    }
+    kv := strings.SplitN(pair, "=", 2)
+    if len(kv) != 2 || kv[0] == "" {
+      return nil, fmt.Errorf("Log level %q isn't subsystem=level.", pair)
+    }
+    level, err := ParseLevel(kv[1])
+    if err != nil {
+      return nil, err
+    }
+    levels[strings.TrimSpace(kv[0])] = level
+  }
+  return levels, nil
+}
+
+type Entry struct {
+  Time      time.Time `json:"time"`
+  Level     string    `json:"level"`
+  Subsystem string    `json:"subsystem,omitempty"`
+  Msg       string    `json:"msg"`
+
+  level     int
+}
+
+func (e Entry) String() string {
+  sub := ""
+  if e.Subsystem != "" {
+    sub = e.Subsystem + ": "
+  }
+  return fmt.Sprintf("[%s] %s %s%s", strings.ToUpper(e.Level), e.Time.Format(TIME_FORMAT), sub, e.Msg)
+}
+
+type Options struct {
+  Path      string        // "" for no file
+  Format    string        // of the file, text or json
+  Console   io.Writer     // nil for none, always text
+  MaxSize   int64         // bytes before the file is rotated, 0 for no limit
+  MaxAge    time.Duration // age before the file is rotated, 0 for no limit
+  Keep      int           // rotated files kept, 0 keeps them all
+  History   int           // entries kept in memory
+}
+
+type Logger struct {
+  opts      Options
+
+  mut       sync.Mutex
+  file      *os.File
+  size      int64
+  opened    time.Time
+
+  level     int
+  levels    map[string]int
+
+  history   []Entry
+  next      int
+  full      bool
+
+  subs      map[chan Entry]bool
+}
+
+func New(opts Options) (*Logger, error) {
+  l := &Logger{
+    opts: opts,
+    level: INFO,
+    levels: make(map[string]int),
+    history: make([]Entry, opts.History),
+    subs: make(map[chan Entry]bool),
+  }
+
+  if opts.Path != "" {
+    if err := l.open(); err != nil {
+      return nil, err
+    }
+  }
+  return l, nil
+}
+
+// The level for subsystems without their own.
+func (l *Logger) SetLevel(level int) {
+  l.mut.Lock()
+  l.level = level
+  l.mut.Unlock()
+}
+
+// Replaces every per subsystem level.
+func (l *Logger) SetLevels(levels map[string]int) {
+  l.mut.Lock()
+  l.levels = make(map[string]int, len(levels))
+  for k, v := range levels {
+    l.levels[k] = v
+  }
+  l.mut.Unlock()
+}
+
+// Must be called with the lock held.
+func (l *Logger) enabled(subsystem string, level int) bool {
+  min, ok := l.levels[subsystem]
+  if !ok {
+    min = l.level
+  }
+  return level >= min
+}
+
+func (l *Logger) Log(subsystem string, level int, msg string) {
+  l.mut.Lock()
+  defer l.mut.Unlock()
+
+  if !l.enabled(subsystem, level) {
+    return
+  }
+
+  e := Entry{time.Now(), LevelName(level), subsystem, msg, level}
+
+  if l.opts.Console != nil {
+    fmt.Fprintln(l.opts.Console, e.String())
+  }
+  l.write(e)
+
+  if len(l.history) != 0 {
+    l.history[l.next] = e
+    l.next = (l.next + 1) % len(l.history)
+    if l.next == 0 {
+      l.full = true
+    }
+  }
+
+  for ch := range l.subs {
+    select {
+    case ch <- e:
+    default:
+    }
+  }
+}
+
+// Must be called with the lock held.
+func (l *Logger) write(e Entry) {
+  if l.file == nil {
+    return
+  }
+
+  var line []byte
+  if l.opts.Format == FORMAT_JSON {
+    line, _ = json.Marshal(e)
+    line = append(line, '\n')
+  } else {
+    line = []byte(e.String() + "\n")
+  }
+
+  if (l.opts.MaxSize > 0 && l.size + int64(len(line)) > l.opts.MaxSize && l.size > 0) ||
+     (l.opts.MaxAge > 0 && time.Since(l.opened) > l.opts.MaxAge) {
+    if err := l.rotate(); err != nil {
+      fmt.Fprintln(os.Stderr, "logger:", err)
+    }
+  }
+
+  if l.file != nil {
+    n, _ := l.file.Write(line)
+    l.size += int64(n)
+  }
+}
+
+// Must be called with the lock held.
+func (l *Logger) open() error {
+  f, err := os.OpenFile(l.opts.Path, os.O_CREATE | os.O_WRONLY | os.O_APPEND, 0644)
+  if err != nil {
+    return err
+  }
+  info, err := f.Stat()
+  if err != nil {
+    f.Close()
+    return err
+  }
+
+  l.file, l.size, l.opened = f, info.Size(), time.Now()
+  if info.Size() > 0 {
+    l.opened = l.started(info.ModTime())
+  }
+  return nil
+}
+
+// When a file left from before a restart was started. That's when the last
+// one was rotated out, if there's a record of it, else its last write.
+func (l *Logger) started(modTime time.Time) time.Time {
+  old, _ := filepath.Glob(l.opts.Path + ".*")
+  sort.Strings(old)
+  if len(old) > 0 {
+    suffix := strings.TrimPrefix(old[len(old) - 1], l.opts.Path + ".")
+    if t, err := time.ParseInLocation(ROTATE_SUFFIX, suffix, time.Local); err == nil && t.Before(modTime) {
+      return t
+    }
+  }
+  return modTime
+}
+
+// Must be called with the lock held. The file is renamed with the time, and
+// the oldest past the number to keep are deleted.
+func (l *Logger) rotate() error {
+  l.file.Close()
+  l.file = nil
+
+  rotated := l.opts.Path + "." + time.Now().Format(ROTATE_SUFFIX)
+  if err := os.Rename(l.opts.Path, rotated); err != nil {
+    l.open()
+    return err
+  }
+  if err := l.open(); err != nil {
+    return err
+  }
+
+  if l.opts.Keep > 0 {
+    old, _ := filepath.Glob(l.opts.Path + ".*")
+    sort.Strings(old)
+    for len(old) > l.opts.Keep {
+      os.Remove(old[0])
+      old = old[1:]
+    }
+  }
+  return nil
+}
+
+type Filter struct {
+  Level     int       // least important level, DEBUG for all
+  Subsystem string    // "" for all
+  Since     time.Time
+  Contains  string
+  Limit     int       // most recent entries returned, 0 for all
+}
+
+func (f Filter) Match(e Entry) bool {
+  return e.level >= f.Level &&
+    (f.Subsystem == "" || e.Subsystem == f.Subsystem) &&
+    !e.Time.Before(f.Since) &&
+    (f.Contains == "" || strings.Contains(e.Msg, f.Contains))
+}
+
+// The entries in memory that match f, oldest first.
+func (l *Logger) Recent(f Filter) []Entry {
+  l.mut.Lock()
+  var all []Entry
+  if l.full {
+    all = append(all, l.history[l.next:]...)
+  }
+  all = append(all, l.history[:l.next]...)
+  l.mut.Unlock()
+
+  matched := []Entry{}
+  for _, e := range all {
+    if f.Match(e) {
+      matched = append(matched, e)
+    }
+  }
+  if f.Limit > 0 && len(matched) > f.Limit {
+    matched = matched[len(matched) - f.Limit:]
+  }
+  return matched
+}
+
+// Every entry logged from now on. Entries are dropped for subscribers that
+// fall behind.
+func (l *Logger) Subscribe() (<-chan Entry, func()) {
+  ch := make(chan Entry, SUBSCRIBER_BUFFER)
+
+  l.mut.Lock()
+  l.subs[ch] = true
+  l.mut.Unlock()
+
+  return ch, func() {
+    l.mut.Lock()
+    if l.subs[ch] {
+      delete(l.subs, ch)
+      close(ch)
+    }
+    l.mut.Unlock()
+  }
+}
+
+func (l *Logger) Close() error {
+  l.mut.Lock()
+  defer l.mut.Unlock()
+
+  if l.file == nil {
+    return nil
+  }
+  err := l.file.Close()
+  l.file = nil
+  return err
+}
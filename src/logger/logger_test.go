@@ -0,0 +1,147 @@
+package logger
+
+import (
+  "bytes"
+  "encoding/json"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestLevels(t *testing.T) {
+  var console bytes.Buffer
+  l, _ := New(Options{Console: &console, History: 10})
+
+  levels, err := ParseLevels("fl=debug, cl=error")
+  if err != nil {
+    t.Fatal(err)
+  }
+  l.SetLevels(levels)
+
+  l.Log("fl", DEBUG, "fl debug")
+  l.Log("cl", WARN, "cl warn")
+  l.Log("ss", DEBUG, "ss debug")
+  l.Log("ss", INFO, "ss info")
+
+  out := console.String()
+  if !strings.Contains(out, "fl: fl debug") || !strings.Contains(out, "[INFO]") || strings.Contains(out, "cl warn") || strings.Contains(out, "ss debug") {
+    t.Errorf("got %q", out)
+  }
+
+  if _, err := ParseLevels("fl=loud"); err == nil {
+    t.Error("bad level parsed")
+  }
+}
+
+func TestHistory(t *testing.T) {
+  l, _ := New(Options{History: 3})
+  for _, msg := range []string{"one", "two", "three", "four"} {
+    l.Log("cl", INFO, msg)
+  }
+  l.Log("ss", WARN, "five")
+
+  all := l.Recent(Filter{})
+  if len(all) != 3 || all[0].Msg != "three" || all[2].Msg != "five" {
+    t.Fatalf("got %v", all)
+  }
+
+  if got := l.Recent(Filter{Subsystem: "cl"}); len(got) != 2 {
+    t.Errorf("got %v", got)
+  }
+  if got := l.Recent(Filter{Level: WARN}); len(got) != 1 || got[0].Msg != "five" {
+    t.Errorf("got %v", got)
+  }
+  if got := l.Recent(Filter{Limit: 1, Contains: "f"}); len(got) != 1 || got[0].Msg != "five" {
+    t.Errorf("got %v", got)
+  }
+
+  ch, unsub := l.Subscribe()
+  l.Log("sync", ERROR, "six")
+  if e := <-ch; e.Msg != "six" || e.Level != "error" {
+    t.Errorf("got %v", e)
+  }
+  unsub()
+  l.Log("sync", ERROR, "seven")
+}
+
+func TestRotateJSON(t *testing.T) {
+  dir, err := ioutil.TempDir("", "logger")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  path := filepath.Join(dir, "dsengine.log")
+  l, err := New(Options{Path: path, Format: FORMAT_JSON, MaxSize: 200, Keep: 1})
+  if err != nil {
+    t.Fatal(err)
+  }
+  for i := 0; i < 10; i++ {
+    l.Log("cl", INFO, strings.Repeat("x", 50))
+  }
+  l.Close()
+
+  rotated, _ := filepath.Glob(path + ".*")
+  if len(rotated) != 1 {
+    t.Errorf("kept %v", rotated)
+  }
+
+  data, _ := ioutil.ReadFile(path)
+  if int64(len(data)) > 200 {
+    t.Errorf("file grew to %d", len(data))
+  }
+  var e Entry
+  line := strings.SplitN(string(data), "\n", 2)[0]
+  if err := json.Unmarshal([]byte(line), &e); err != nil || e.Subsystem != "cl" || e.Level != "info" {
+    t.Errorf("got %q %v", line, err)
+  }
+}
+
+// Age counts from when the file was started, not from when it was reopened.
+func TestRotateAgeAfterRestart(t *testing.T) {
+  dir, err := ioutil.TempDir("", "logger")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  path := filepath.Join(dir, "dsengine.log")
+  twoHours := time.Now().Add(-2 * time.Hour)
+  cases := []struct {
+    name    string
+    rotated time.Time
+    written time.Time
+    rotate  bool
+  }{
+    {"idle since before max age", time.Time{}, twoHours, true},
+    {"written recently", time.Time{}, time.Now(), false},
+    {"rotated out before max age", twoHours, time.Now(), true},
+  }
+
+  for _, c := range cases {
+    old, _ := filepath.Glob(path + "*")
+    for _, f := range old {
+      os.Remove(f)
+    }
+    if !c.rotated.IsZero() {
+      ioutil.WriteFile(path + "." + c.rotated.Format(ROTATE_SUFFIX), []byte("old\n"), 0644)
+    }
+    ioutil.WriteFile(path, []byte("before the restart\n"), 0644)
+    os.Chtimes(path, c.written, c.written)
+
+    l, err := New(Options{Path: path, MaxAge: time.Hour})
+    if err != nil {
+      t.Fatal(err)
+    }
+    l.Log("", INFO, "after the restart")
+    l.Close()
+
+    data, _ := ioutil.ReadFile(path)
+    if rotated := !strings.Contains(string(data), "before the restart"); rotated != c.rotate {
+      t.Errorf("%s: rotated %v, want %v", c.name, rotated, c.rotate)
+    }
+  }
+}
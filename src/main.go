@@ -6,9 +6,13 @@ import (
 	"cloudlink"
 	"config"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
+	config.Init()
 
 	//
 	// Cloud Listener
@@ -27,6 +31,15 @@ func main() {
 	config.Log(config.LOG_INFO, "DRONESMITH ENGINE ver", config.Version)
 	config.Log(config.LOG_INFO, "===============================================================")
 
+	// Reread config on SIGHUP.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			config.Reload()
+		}
+	}()
+
 	// Needs to be initialized here, since we can't rely on fmulink completing in time.
 	fmulink.ConnReady = make(chan bool)
 
@@ -39,6 +52,7 @@ func main() {
 	// Status Server
 	//
 	status := statusServer.NewStatusServer(*config.StatusPort, cl)
+	status.Listen()
 
 	// We got to wait for the FMULink to give us the thumbs up.
 	<- fmulink.ConnReady
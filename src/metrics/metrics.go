@@ -0,0 +1,347 @@
+// Counters, gauges and histograms, served in the Prometheus text format.
+// Metrics made with the New functions are registered with Default; packages
+// keep theirs in package variables.
+package metrics
+
+import (
+  "bytes"
+  "fmt"
+  "io"
+  "math"
+  "net/http"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "sync/atomic"
+)
+
+const CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// Seconds, for latencies.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var Default = NewRegistry()
+
+// A float64 that can be added to from many goroutines.
+type value struct {
+  bits      uint64
+}
+
+func (v *value) Add(d float64) {
+  for {
+    old := atomic.LoadUint64(&v.bits)
+    next := math.Float64bits(math.Float64frombits(old) + d)
+    if atomic.CompareAndSwapUint64(&v.bits, old, next) {
+      return
+    }
+  }
+}
+
+func (v *value) Set(f float64) {
+  atomic.StoreUint64(&v.bits, math.Float64bits(f))
+}
+
+func (v *value) Get() float64 {
+  return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+type Counter struct {
+  value
+}
+
+func (c *Counter) Inc() {
+  c.Add(1)
+}
+
+type Gauge struct {
+  value
+}
+
+func (g *Gauge) Inc() {
+  g.Add(1)
+}
+
+func (g *Gauge) Dec() {
+  g.Add(-1)
+}
+
+type Histogram struct {
+  buckets   []float64
+  mut       sync.Mutex
+  counts    []uint64
+  count     uint64
+  sum       float64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+  return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *Histogram) Observe(v float64) {
+  h.mut.Lock()
+  defer h.mut.Unlock()
+
+  for i, b := range h.buckets {
+    if v <= b {
+      h.counts[i]++
+    }
+  }
+  h.count++
+  h.sum += v
+}
+
+// A metric and all its labelled children.
+type family struct {
+  name      string
+  help      string
+  kind      string
+  labels    []string
+  buckets   []float64
+
+  mut       sync.Mutex
+  children  map[string]interface{}
+  values    map[string][]string
+  fn        func() float64
+}
+
+func (f *family) child(vals []string) interface{} {
+  if len(vals) != len(f.labels) {
+    panic(fmt.Sprintf("metrics: %s takes %d labels, got %d", f.name, len(f.labels), len(vals)))
+  }
+  key := strings.Join(vals, "\xff")
+
+  f.mut.Lock()
+  defer f.mut.Unlock()
+
+  if c, ok := f.children[key]; ok {
+    return c
+  }
+
+  var c interface{}
+  switch f.kind {
+  case "counter":
+    c = &Counter{}
+  case "gauge":
+    c = &Gauge{}
+  case "histogram":
+    c = newHistogram(f.buckets)
+  }
+  f.children[key] = c
+  f.values[key] = append([]string(nil), vals...)
+  return c
+}
+
+type CounterVec struct {
+  f         *family
+}
+
+func (v *CounterVec) With(labels ...string) *Counter {
+  return v.f.child(labels).(*Counter)
+}
+
+type GaugeVec struct {
+  f         *family
+}
+
+func (v *GaugeVec) With(labels ...string) *Gauge {
+  return v.f.child(labels).(*Gauge)
+}
+
+type HistogramVec struct {
+  f         *family
+}
+
+func (v *HistogramVec) With(labels ...string) *Histogram {
+  return v.f.child(labels).(*Histogram)
+}
+
+type Registry struct {
+  mut       sync.RWMutex
+  families  map[string]*family
+}
+
+func NewRegistry() *Registry {
+  return &Registry{families: make(map[string]*family)}
+}
+
+func (r *Registry) add(name, help, kind string, labels []string, buckets []float64) *family {
+  r.mut.Lock()
+  defer r.mut.Unlock()
+
+  if _, ok := r.families[name]; ok {
+    panic("metrics: " + name + " registered twice")
+  }
+  f := &family{
+    name: name,
+    help: help,
+    kind: kind,
+    labels: labels,
+    buckets: buckets,
+    children: make(map[string]interface{}),
+    values: make(map[string][]string),
+  }
+  r.families[name] = f
+  return f
+}
+
+func (r *Registry) NewCounter(name, help string) *Counter {
+  return r.add(name, help, "counter", nil, nil).child(nil).(*Counter)
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+  return &CounterVec{r.add(name, help, "counter", labels, nil)}
+}
+
+func (r *Registry) NewGauge(name, help string) *Gauge {
+  return r.add(name, help, "gauge", nil, nil).child(nil).(*Gauge)
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+  return &GaugeVec{r.add(name, help, "gauge", labels, nil)}
+}
+
+// A gauge read from f each time metrics are written.
+func (r *Registry) NewGaugeFunc(name, help string, f func() float64) {
+  r.add(name, help, "gauge", nil, nil).fn = f
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+  return r.add(name, help, "histogram", nil, buckets).child(nil).(*Histogram)
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+  return &HistogramVec{r.add(name, help, "histogram", labels, buckets)}
+}
+
+func NewCounter(name, help string) *Counter {
+  return Default.NewCounter(name, help)
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+  return Default.NewCounterVec(name, help, labels...)
+}
+
+func NewGauge(name, help string) *Gauge {
+  return Default.NewGauge(name, help)
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+  return Default.NewGaugeVec(name, help, labels...)
+}
+
+func NewGaugeFunc(name, help string, f func() float64) {
+  Default.NewGaugeFunc(name, help, f)
+}
+
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+  return Default.NewHistogram(name, help, buckets)
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+  return Default.NewHistogramVec(name, help, buckets, labels...)
+}
+
+// Writes every metric in the text exposition format, sorted by name.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+  r.mut.RLock()
+  names := make([]string, 0, len(r.families))
+  for name := range r.families {
+    names = append(names, name)
+  }
+  fams := make([]*family, 0, len(names))
+  sort.Strings(names)
+  for _, name := range names {
+    fams = append(fams, r.families[name])
+  }
+  r.mut.RUnlock()
+
+  var buf bytes.Buffer
+  for _, f := range fams {
+    f.write(&buf)
+  }
+  return buf.WriteTo(w)
+}
+
+func (f *family) write(buf *bytes.Buffer) {
+  fmt.Fprintf(buf, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+  fmt.Fprintf(buf, "# TYPE %s %s\n", f.name, f.kind)
+
+  if f.fn != nil {
+    fmt.Fprintf(buf, "%s %s\n", f.name, formatFloat(f.fn()))
+    return
+  }
+
+  f.mut.Lock()
+  keys := make([]string, 0, len(f.children))
+  for k := range f.children {
+    keys = append(keys, k)
+  }
+  sort.Strings(keys)
+
+  for _, k := range keys {
+    labels := f.values[k]
+    switch c := f.children[k].(type) {
+    case *Counter:
+      fmt.Fprintf(buf, "%s%s %s\n", f.name, formatLabels(f.labels, labels, "", ""), formatFloat(c.Get()))
+    case *Gauge:
+      fmt.Fprintf(buf, "%s%s %s\n", f.name, formatLabels(f.labels, labels, "", ""), formatFloat(c.Get()))
+    case *Histogram:
+      c.mut.Lock()
+      for i, b := range c.buckets {
+        fmt.Fprintf(buf, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, labels, "le", formatFloat(b)), c.counts[i])
+      }
+      fmt.Fprintf(buf, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, labels, "le", "+Inf"), c.count)
+      fmt.Fprintf(buf, "%s_sum%s %s\n", f.name, formatLabels(f.labels, labels, "", ""), formatFloat(c.sum))
+      fmt.Fprintf(buf, "%s_count%s %d\n", f.name, formatLabels(f.labels, labels, "", ""), c.count)
+      c.mut.Unlock()
+    }
+  }
+  f.mut.Unlock()
+}
+
+func formatLabels(names, vals []string, extraName, extraVal string) string {
+  if len(names) == 0 && extraName == "" {
+    return ""
+  }
+
+  pairs := make([]string, 0, len(names) + 1)
+  for i, n := range names {
+    pairs = append(pairs, n + "=\"" + escapeLabel(vals[i]) + "\"")
+  }
+  if extraName != "" {
+    pairs = append(pairs, extraName + "=\"" + extraVal + "\"")
+  }
+  return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+  switch {
+  case math.IsInf(f, 1):
+    return "+Inf"
+  case math.IsInf(f, -1):
+    return "-Inf"
+  case math.IsNaN(f):
+    return "NaN"
+  }
+  return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var helpEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n")
+var labelEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\"", "\\\"")
+
+func escapeHelp(s string) string {
+  return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+  return labelEscaper.Replace(s)
+}
+
+// Serves Default.
+func Handler() http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", CONTENT_TYPE)
+    Default.WriteTo(w)
+  })
+}
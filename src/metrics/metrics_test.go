@@ -0,0 +1,66 @@
+package metrics
+
+import (
+  "bytes"
+  "strings"
+  "testing"
+)
+
+func TestExposition(t *testing.T) {
+  r := NewRegistry()
+
+  packets := r.NewCounterVec("dslink_packets_total", "Packets by link.", "link", "msg")
+  packets.With("master", "HEARTBEAT").Inc()
+  packets.With("master", "HEARTBEAT").Add(2)
+  packets.With("output", "say \"hi\"\n").Inc()
+
+  clients := r.NewGauge("dslink_clients", "Clients.")
+  clients.Inc()
+  clients.Inc()
+  clients.Dec()
+
+  r.NewGaugeFunc("dslink_up", "Always up.", func() float64 { return 1 })
+
+  lat := r.NewHistogram("dslink_ack_seconds", "Ack latency.", []float64{0.1, 1})
+  lat.Observe(0.05)
+  lat.Observe(0.5)
+  lat.Observe(5)
+
+  var buf bytes.Buffer
+  r.WriteTo(&buf)
+  out := buf.String()
+
+  for _, want := range []string{
+    "# TYPE dslink_packets_total counter\n",
+    "dslink_packets_total{link=\"master\",msg=\"HEARTBEAT\"} 3\n",
+    "dslink_packets_total{link=\"output\",msg=\"say \\\"hi\\\"\\n\"} 1\n",
+    "# TYPE dslink_clients gauge\ndslink_clients 1\n",
+    "dslink_up 1\n",
+    "dslink_ack_seconds_bucket{le=\"0.1\"} 1\n",
+    "dslink_ack_seconds_bucket{le=\"1\"} 2\n",
+    "dslink_ack_seconds_bucket{le=\"+Inf\"} 3\n",
+    "dslink_ack_seconds_sum 5.55\n",
+    "dslink_ack_seconds_count 3\n",
+  } {
+    if !strings.Contains(out, want) {
+      t.Errorf("missing %q in\n%s", want, out)
+    }
+  }
+
+  // Sorted by name.
+  if strings.Index(out, "dslink_ack_seconds") > strings.Index(out, "dslink_up") {
+    t.Error("not sorted")
+  }
+}
+
+func TestRegisterTwice(t *testing.T) {
+  r := NewRegistry()
+  r.NewCounter("dslink_x", "")
+
+  defer func() {
+    if recover() == nil {
+      t.Error("no panic")
+    }
+  }()
+  r.NewGauge("dslink_x", "")
+}
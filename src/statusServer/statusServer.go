@@ -5,6 +5,7 @@ import (
   "fmt"
   "html/template"
   "io"
+  "io/ioutil"
   "os"
   "encoding/json"
   "log"
@@ -17,9 +18,16 @@ import (
 
   "apiservice"
   "fmulink"
+  "fmulink/replay"
   "cloudlink"
+  "cloudlink/codejob"
+  "cloudlink/terminal"
   "github.com/googollee/go-socket.io"
+  "golang.org/x/net/websocket"
   "config"
+  "config/settings"
+  "logger"
+  "metrics"
 )
 
 const (
@@ -29,6 +37,8 @@ const (
   LUCI_MAIN_TITLE = "Dronesmith Engine | Status"
 )
 
+var socketClients = metrics.NewGauge("dslink_socket_clients", "Socket.io clients of the status page.")
+
 var (
   SOCKET_ADDRESS = "ws:///index/fmu"
   NETWORKS_FILE = *config.SetupPath + "networks.txt"
@@ -47,6 +57,9 @@ type StatusServer struct {
   // Streaming API
   streamApi     *apiservice.StreamBroker
 
+  // Flight log catalog
+  flightApi     *apiservice.FlightAPI
+
   // events
   fmuEvent      chan fmulink.Fmu
   quit          chan bool
@@ -64,7 +77,7 @@ func NewStatusServer(address int, cloud *cloudlink.CloudLink) (*StatusServer) {
     address,
     *http.NewServeMux(),
     cloud,
-    nil, nil,
+    nil, nil, nil,
     make(chan fmulink.Fmu),
     make(chan bool),
     make(chan error),
@@ -78,6 +91,18 @@ func NewStatusServer(address int, cloud *cloudlink.CloudLink) (*StatusServer) {
 // Status Server
 // =============================================================================
 
+// Starts answering straight away, with just the health checks. The rest of the
+// routes are added by Serve once the flight controller link is up.
+func (s *StatusServer) Listen() {
+  http.HandleFunc(    "/healthz",       s.healthResponse)
+  http.HandleFunc(    "/readyz",        s.readyResponse)
+
+  go func() {
+    config.Log(config.LOG_INFO, "ss:  Listening on port", strconv.Itoa(s.address))
+    s.err <- http.ListenAndServe(":" + strconv.Itoa(s.address), nil)
+  }()
+}
+
 func (s *StatusServer) Serve() {
   // Set up websocket connection
   SocketServer, err := socketio.NewServer(nil)
@@ -94,11 +119,13 @@ func (s *StatusServer) Serve() {
     }
   }()
 
+  s.flightApi = apiservice.NewFlightAPI(s.cloud.GetCatalog(), fmulink.RecordingName)
+
   broker := apiservice.NewStreamListener()
 	go func() {
 		for {
       // Sync rate TODO
-			time.Sleep(time.Millisecond * time.Duration(*config.SyncAPI))
+			time.Sleep(time.Millisecond * time.Duration(config.Get().Stream))
 
       telem := s.droneApi.GetLocalVehicle().Telem()
 
@@ -121,14 +148,19 @@ func (s *StatusServer) Serve() {
 
     s.socketLock.Lock()
     s.socketCnt += 1
+    socketClients.Set(float64(s.socketCnt))
     s.socketLock.Unlock()
 
     quit := make(chan bool)
 
+    // Link state changes are pushed to everyone as they happen.
+    so.Join("fmu")
+
     so.On("disconnection", func() {
       config.Log(config.LOG_INFO, "ss: Socket Disconnect")
       s.socketLock.Lock()
       s.socketCnt -= 1
+      socketClients.Set(float64(s.socketCnt))
       s.socketLock.Unlock()
       quit <- true
     })
@@ -155,6 +187,13 @@ func (s *StatusServer) Serve() {
     log.Println("error:", err)
   })
 
+  go func() {
+    for {
+      ev := <- fmulink.LinkEvents
+      SocketServer.BroadcastTo("fmu", "fmu:link", ev)
+    }
+  }()
+
 
   // Set up routing table
   s.fileServer.Handle("/",            http.FileServer(http.Dir(STATIC_PATH)))
@@ -165,8 +204,24 @@ func (s *StatusServer) Serve() {
   http.HandleFunc(    "/index/logout",  s.logoutResponse)
   http.HandleFunc(    "/api/sensor/",   s.sensorResponse)
   http.HandleFunc(    "/index/bind",    s.bindResponse)
+  http.HandleFunc(    "/index/link",    s.linkResponse)
+  http.HandleFunc(    "/index/master",  s.masterResponse)
+  http.HandleFunc(    "/index/replay",  s.replayResponse)
+  http.HandleFunc(    "/index/logging", s.loggingResponse)
+  http.HandleFunc(    "/index/sync",    s.syncResponse)
+  http.HandleFunc(    "/index/devicekey", s.deviceKeyResponse)
+  http.HandleFunc(    "/index/config",  s.configResponse)
+  http.HandleFunc(    "/index/logs",    s.logsResponse)
+  http.HandleFunc(    "/index/logs/",   s.logsResponse)
+  http.Handle(        "/metrics",       metrics.Handler())
+  http.HandleFunc(    "/index/code",    s.codeResponse)
+  http.HandleFunc(    "/index/code/",   s.codeResponse)
+  http.HandleFunc(    "/index/terminal", s.terminalResponse)
+  http.Handle(        "/index/terminal/ws", websocket.Server{Handshake: s.terminalHandshake, Handler: s.terminalSocket})
   http.Handle(        "/api/drone/",    s.droneApi)
   http.Handle(        "/api/stream/",   broker)
+  http.Handle(        "/api/flights",   s.flightApi)
+  http.Handle(        "/api/flights/",  s.flightApi)
   http.Handle(        "/socket.io/",  SocketServer)
 
   // Compile templates
@@ -174,9 +229,8 @@ func (s *StatusServer) Serve() {
     config.Log(config.LOG_ERROR, "ss: ", err)
     log.Fatal(err)
 	} else {
-    config.Log(config.LOG_INFO, "ss:  Listening on port", strconv.Itoa(s.address))
     go s.periodicFmuStatus(1 * time.Second)
-    log.Fatal(http.ListenAndServe(":" + strconv.Itoa(s.address), nil))
+    log.Fatal(<-s.err)
   }
 }
 
@@ -297,6 +351,124 @@ func (s *StatusServer) periodicFmuStatus(d time.Duration) {
 }
 
 
+// =============================================================================
+// API: /healthz [GET], /readyz [GET]
+// =============================================================================
+
+type APIHealthRes struct {
+  Version     string  `json:"version"`
+  Uptime      int64   `json:"uptime"`    // seconds
+  Status      string  `json:"status"`
+}
+
+type APIReadyCheck struct {
+  Ok          bool                `json:"ok"`
+  Required    bool                `json:"required"`
+  Detail      string              `json:"detail,omitempty"`
+  LastSeen    *time.Time          `json:"lastSeen,omitempty"`
+}
+
+type APIReadyRes struct {
+  Ready       bool                      `json:"ready"`
+  Link        APIReadyCheck             `json:"link"`
+  Subsystems  map[string]APIReadyCheck  `json:"subsystems"`
+  Cloud       APIReadyCheck             `json:"cloud"`
+  Storage     map[string]APIReadyCheck  `json:"storage"`
+  Status      string                    `json:"status"`
+}
+
+var startTime = time.Now()
+
+// The process is up and serving.
+func (s *StatusServer) healthResponse(w http.ResponseWriter, r* http.Request) {
+  res := APIHealthRes{config.Version, int64(time.Since(startTime).Seconds()), "OK"}
+  writeHealth(w, 200, res)
+}
+
+// Ready when the master link is connected, the subsystems in readysubsystems
+// are online, storage is writable, and with readycloud there's a cloud
+// session. 503 otherwise, with the same breakdown.
+func (s *StatusServer) readyResponse(w http.ResponseWriter, r* http.Request) {
+  c := config.Get()
+
+  storage := make(map[string]APIReadyCheck)
+  if !*config.DisableFlights {
+    storage["flights"] = checkWritable(*config.FlightLogPath)
+  }
+  storage["assets"] = checkWritable(*config.AssetsPath + ".")
+
+  cloud := APIReadyCheck{Ok: s.cloud.IsOnlineNonBlock(), Required: c.ReadyCloud}
+  res := checkReady(fmulink.GetLinkState(), fmulink.Subsystems(), c.ReadySubsystems, cloud, storage)
+
+  code := 200
+  res.Status = "OK"
+  if !res.Ready {
+    code, res.Status = 503, "error"
+  }
+  writeHealth(w, code, res)
+}
+
+// Puts the checks together. required is the comma separated readysubsystems.
+func checkReady(link fmulink.LinkEvent, subs map[string]fmulink.SubsystemStatus, required string, cloud APIReadyCheck, storage map[string]APIReadyCheck) APIReadyRes {
+  res := APIReadyRes{Subsystems: make(map[string]APIReadyCheck), Cloud: cloud, Storage: storage}
+
+  res.Link = APIReadyCheck{
+    Ok: link.State == fmulink.LINK_CONNECTED && subs["heartbeat"].Online,
+    Required: true,
+    Detail: strings.TrimSpace(link.State + " " + link.Address + " " + link.Error),
+  }
+
+  need := make(map[string]bool)
+  for _, name := range strings.Split(required, ",") {
+    if name = strings.TrimSpace(name); name != "" {
+      need[name] = true
+    }
+  }
+  for name, st := range subs {
+    res.Subsystems[name] = APIReadyCheck{Ok: st.Online, Required: need[name], LastSeen: st.LastSeen}
+    delete(need, name)
+  }
+  for name := range need {
+    res.Subsystems[name] = APIReadyCheck{Required: true, Detail: "Unknown subsystem."}
+  }
+
+  res.Ready = readyOk(res.Link) && readyOk(res.Cloud)
+  for _, c := range res.Subsystems {
+    res.Ready = res.Ready && readyOk(c)
+  }
+  for _, c := range res.Storage {
+    res.Ready = res.Ready && readyOk(c)
+  }
+  return res
+}
+
+func readyOk(c APIReadyCheck) bool {
+  return c.Ok || !c.Required
+}
+
+func checkWritable(dir string) APIReadyCheck {
+  f, err := ioutil.TempFile(dir, ".readyz")
+  if err != nil {
+    return APIReadyCheck{Required: true, Detail: err.Error()}
+  }
+  f.Close()
+  os.Remove(f.Name())
+  return APIReadyCheck{Ok: true, Required: true}
+}
+
+func writeHealth(w http.ResponseWriter, code int, res interface{}) {
+  if data, err := json.Marshal(res); err != nil {
+    panic(err)
+  } else {
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.WriteHeader(code)
+    if _ , err := w.Write(data); err != nil {
+      panic(err)
+    }
+  }
+}
+
 // =============================================================================
 // API: /index/logout [POST]
 // =============================================================================
@@ -541,6 +713,9 @@ func (s *StatusServer) setupResponse(w http.ResponseWriter, r* http.Request) {
 
       if !auth {
         store.Del()
+        if terms := s.cloud.Terminals(); terms != nil {
+          terms.CloseAll()
+        }
         res = APIPostSetupRes{Error: "Authentication failed.", Status: "error"}
       } else {
         if err := store.Set("step", SETUP_STEP_DSSCOMPLETE); err != nil {
@@ -649,6 +824,785 @@ func (s *StatusServer) bindResponse(w http.ResponseWriter, r* http.Request) {
   }
 }
 
+// =============================================================================
+// API: /index/link [GET]
+// =============================================================================
+
+func (s *StatusServer) linkResponse(w http.ResponseWriter, r* http.Request) {
+  switch r.Method {
+  case "GET":
+    if data, err := json.Marshal(fmulink.GetLinkState()); err != nil {
+      panic(err)
+    } else {
+      if _ , err := w.Write(data); err != nil {
+        panic(err)
+      }
+    }
+  default:
+    http.Error(w, http.StatusText(404), 404)
+  }
+}
+
+// =============================================================================
+// API: /index/master [GET, PUT]
+// =============================================================================
+
+type APIPutMasterReq struct {
+  Address     string  `json:"address"`
+}
+
+type APIMasterRes struct {
+  Address     string  `json:"address"`
+  State       string  `json:"state"`
+  Status      string  `json:"status"`
+  Error       string  `json:"error"`
+}
+
+func (s *StatusServer) masterResponse(w http.ResponseWriter, r* http.Request) {
+  switch r.Method {
+  case "GET":
+    res := APIMasterRes{
+      Address: fmulink.GetMaster(),
+      State: fmulink.GetLinkState().State,
+      Status: "OK",
+    }
+
+    if data, err := json.Marshal(res); err != nil {
+      panic(err)
+    } else {
+      if _ , err := w.Write(data); err != nil {
+        panic(err)
+      }
+    }
+
+  case "PUT":
+    var obj APIPutMasterReq
+    decoder := json.NewDecoder(r.Body)
+    err := decoder.Decode(&obj)
+    if err != nil {
+      panic(err)
+    }
+
+    store := s.cloud.GetStore()
+    addr := obj.Address
+
+    // An empty address drops the override and goes back to the configured link.
+    if addr == "" {
+      addr = *config.LinkPath
+    }
+
+    // Checked and saved before switching, so a failure leaves both the link
+    // and the stored choice as they were.
+    if err = fmulink.ValidateMaster(addr); err == nil {
+      if err = store.Set(fmulink.STORE_MASTER, obj.Address); err == nil {
+        err = fmulink.SetMaster(addr)
+        config.Log(config.LOG_INFO, "ss: ", "Master link changed to", addr)
+      }
+    }
+
+    var res APIMasterRes
+    if err != nil {
+      config.Log(config.LOG_ERROR, "ss: ", err.Error())
+      res = APIMasterRes{Address: fmulink.GetMaster(), Error: err.Error(), Status: "error"}
+    } else {
+      res = APIMasterRes{Address: addr, State: fmulink.GetLinkState().State, Status: "OK"}
+    }
+
+    if data, err := json.Marshal(res); err != nil {
+      panic(err)
+    } else {
+      if _ , err := w.Write(data); err != nil {
+        panic(err)
+      }
+    }
+
+  default:
+    http.Error(w, http.StatusText(404), 404)
+  }
+}
+
+// =============================================================================
+// API: /index/replay [GET, PUT]
+// =============================================================================
+
+type APIPutReplayReq struct {
+  Action      string  `json:"action"`   // pause, resume, seek or speed
+  Position    float64 `json:"position"` // seconds from the start, for seek
+  Speed       float64 `json:"speed"`
+}
+
+type APIReplayRes struct {
+  Replay      *replay.Status  `json:"replay"`
+  Status      string          `json:"status"`
+  Error       string          `json:"error"`
+}
+
+func (s *StatusServer) replayResponse(w http.ResponseWriter, r* http.Request) {
+  var res APIReplayRes
+  rp := fmulink.GetReplay()
+
+  switch r.Method {
+  case "GET":
+    if rp == nil {
+      res = APIReplayRes{Error: "Master link is not a replay.", Status: "error"}
+    } else {
+      st := rp.Status()
+      res = APIReplayRes{Replay: &st, Status: "OK"}
+    }
+
+  case "PUT":
+    var obj APIPutReplayReq
+    decoder := json.NewDecoder(r.Body)
+    err := decoder.Decode(&obj)
+    if err != nil {
+      panic(err)
+    }
+
+    if rp == nil {
+      err = fmt.Errorf("Master link is not a replay.")
+    } else {
+      switch obj.Action {
+      case "pause":   rp.Pause()
+      case "resume":  rp.Resume()
+      case "seek":    err = rp.Seek(time.Duration(obj.Position * float64(time.Second)))
+      case "speed":   err = rp.SetSpeed(obj.Speed)
+      default:
+        err = fmt.Errorf("Unknown replay action %s", obj.Action)
+      }
+    }
+
+    if err != nil {
+      config.Log(config.LOG_ERROR, "ss: ", err.Error())
+      res = APIReplayRes{Error: err.Error(), Status: "error"}
+    } else {
+      st := rp.Status()
+      res = APIReplayRes{Replay: &st, Status: "OK"}
+    }
+
+  default:
+    http.Error(w, http.StatusText(404), 404)
+    return
+  }
+
+  if data, err := json.Marshal(res); err != nil {
+    panic(err)
+  } else {
+    if _ , err := w.Write(data); err != nil {
+      panic(err)
+    }
+  }
+}
+
+// =============================================================================
+// API: /index/logging [GET, PUT]
+// =============================================================================
+
+type APIPutLoggingReq struct {
+  Action      string  `json:"action"`   // start or stop
+}
+
+type APILoggingRes struct {
+  Logging     *fmulink.LogTriggerStatus `json:"logging"`
+  Status      string                    `json:"status"`
+  Error       string                    `json:"error"`
+}
+
+func (s *StatusServer) loggingResponse(w http.ResponseWriter, r* http.Request) {
+  var res APILoggingRes
+
+  switch r.Method {
+  case "GET":
+    st := fmulink.LoggingStatus()
+    res = APILoggingRes{Logging: &st, Status: "OK"}
+
+  case "PUT":
+    var obj APIPutLoggingReq
+    decoder := json.NewDecoder(r.Body)
+    err := decoder.Decode(&obj)
+    if err != nil {
+      panic(err)
+    }
+
+    switch obj.Action {
+    case "start": err = fmulink.StartLogging(s.cloud)
+    case "stop":  fmulink.StopLogging(s.cloud)
+    default:
+      err = fmt.Errorf("Unknown logging action %s", obj.Action)
+    }
+
+    st := fmulink.LoggingStatus()
+    if err != nil {
+      config.Log(config.LOG_ERROR, "ss: ", err.Error())
+      res = APILoggingRes{Logging: &st, Error: err.Error(), Status: "error"}
+    } else {
+      res = APILoggingRes{Logging: &st, Status: "OK"}
+    }
+
+  default:
+    http.Error(w, http.StatusText(404), 404)
+    return
+  }
+
+  if data, err := json.Marshal(res); err != nil {
+    panic(err)
+  } else {
+    if _ , err := w.Write(data); err != nil {
+      panic(err)
+    }
+  }
+}
+
+// =============================================================================
+// API: /index/sync [GET]
+// =============================================================================
+
+type APISyncRes struct {
+  Sync        cloudlink.SyncStatus  `json:"sync"`
+  Status      string                `json:"status"`
+}
+
+func (s *StatusServer) syncResponse(w http.ResponseWriter, r* http.Request) {
+  if r.Method != "GET" {
+    http.Error(w, http.StatusText(404), 404)
+    return
+  }
+
+  res := APISyncRes{s.cloud.SyncStatus(), "OK"}
+  if data, err := json.Marshal(res); err != nil {
+    panic(err)
+  } else {
+    if _ , err := w.Write(data); err != nil {
+      panic(err)
+    }
+  }
+}
+
+// =============================================================================
+// API: /index/devicekey [GET, PUT, DELETE]
+// =============================================================================
+
+type APIPutDeviceKeyReq struct {
+  Key         string  `json:"key"`   // 32 bytes, hex encoded
+}
+
+type APIDeviceKeyRes struct {
+  Provisioned bool    `json:"provisioned"`
+  Fingerprint string  `json:"fingerprint"`
+  Status      string  `json:"status"`
+  Error       string  `json:"error"`
+}
+
+// The key itself is write only, GET just says whether there is one.
+func (s *StatusServer) deviceKeyResponse(w http.ResponseWriter, r* http.Request) {
+  var err error
+
+  switch r.Method {
+  case "GET":
+
+  case "PUT":
+    var obj APIPutDeviceKeyReq
+    decoder := json.NewDecoder(r.Body)
+    if err := decoder.Decode(&obj); err != nil {
+      panic(err)
+    }
+
+    if obj.Key == "" {
+      err = fmt.Errorf("No key given.")
+    } else if err = s.cloud.SetDeviceKey(obj.Key); err == nil {
+      config.Log(config.LOG_INFO, "ss: ", "Device key provisioned.")
+    }
+
+  case "DELETE":
+    if err = s.cloud.SetDeviceKey(""); err == nil {
+      config.Log(config.LOG_INFO, "ss: ", "Device key removed.")
+    }
+
+  default:
+    http.Error(w, http.StatusText(404), 404)
+    return
+  }
+
+  fp := s.cloud.DeviceKeyFingerprint()
+  res := APIDeviceKeyRes{Provisioned: fp != "", Fingerprint: fp, Status: "OK"}
+  if err != nil {
+    config.Log(config.LOG_ERROR, "ss: ", err.Error())
+    res.Status, res.Error = "error", err.Error()
+  }
+
+  if data, err := json.Marshal(res); err != nil {
+    panic(err)
+  } else {
+    if _ , err := w.Write(data); err != nil {
+      panic(err)
+    }
+  }
+}
+
+// =============================================================================
+// API: /index/config [GET, PATCH]
+// =============================================================================
+
+type APIConfigRes struct {
+  Config      map[string]interface{}  `json:"config"`
+  Sources     map[string]string       `json:"sources"`
+  Reloadable  []string                `json:"reloadable"`
+  Changed     []string                `json:"changed,omitempty"`   // applied now
+  Restart     []string                `json:"restart,omitempty"`   // saved, applied on restart
+  Errors      settings.Errors         `json:"errors,omitempty"`
+  Status      string                  `json:"status"`
+  Error       string                  `json:"error"`
+}
+
+// PATCH takes an object of settings, like {"syncrate": 64}, and saves them to
+// config.json. Nothing is saved if any of them are bad.
+func (s *StatusServer) configResponse(w http.ResponseWriter, r* http.Request) {
+  var res APIConfigRes
+
+  // Settings pick what code runs as and which shell terminals get, so changing
+  // them takes the same token as a terminal.
+  if r.Method != "GET" && !s.cloud.CheckTerminalToken(requestToken(r)) {
+    config.Log(config.LOG_WARN, "ss: ", "Config change refused for", r.RemoteAddr)
+    http.Error(w, "Bad terminal token.", 401)
+    return
+  }
+
+  switch r.Method {
+  case "GET":
+
+  case "PATCH":
+    body, err := ioutil.ReadAll(r.Body)
+    if err != nil {
+      panic(err)
+    }
+
+    if res.Errors = checkLogProfile(body); len(res.Errors) == 0 {
+      res.Changed, res.Restart, res.Errors = config.Patch(body)
+    }
+    if len(res.Errors) != 0 {
+      config.Log(config.LOG_ERROR, "ss: ", res.Errors.Error())
+      res.Status, res.Error = "error", res.Errors.Error()
+    }
+
+  default:
+    http.Error(w, http.StatusText(404), 404)
+    return
+  }
+
+  res.Config, res.Sources = config.Current()
+  res.Reloadable = config.Reloadable()
+  if res.Status == "" {
+    res.Status = "OK"
+  }
+
+  if data, err := json.Marshal(res); err != nil {
+    panic(err)
+  } else {
+    if _ , err := w.Write(data); err != nil {
+      panic(err)
+    }
+  }
+}
+
+// A log profile is only read by the flight saver at the next start, so check
+// it before it's saved.
+func checkLogProfile(body []byte) settings.Errors {
+  var patch struct {
+    LogProfile  map[string]interface{}  `json:"logprofile"`
+  }
+  if json.Unmarshal(body, &patch) != nil || patch.LogProfile == nil {
+    // Anything malformed is reported by config.Patch.
+    return nil
+  }
+  if _, err := fmulink.ParseLogProfile(patch.LogProfile); err != nil {
+    return settings.Errors{{Path: "logprofile", Msg: err.Error()}}
+  }
+  return nil
+}
+
+// =============================================================================
+// API: /index/logs [GET], /index/logs/stream [GET, server sent events]
+// =============================================================================
+
+const LOGS_LIMIT = 200
+
+type APILogsRes struct {
+  Logs        []logger.Entry  `json:"logs"`
+  Status      string          `json:"status"`
+  Error       string          `json:"error"`
+}
+
+// Filters are given as ?level=warn&subsystem=cl&since=10m&q=text&limit=50.
+// since is a duration back from now or an RFC 3339 time.
+func logsFilter(r *http.Request) (logger.Filter, error) {
+  q := r.URL.Query()
+  f := logger.Filter{Subsystem: q.Get("subsystem"), Contains: q.Get("q"), Limit: LOGS_LIMIT}
+
+  if lv := q.Get("level"); lv != "" {
+    level, err := logger.ParseLevel(lv)
+    if err != nil {
+      return f, err
+    }
+    f.Level = level
+  }
+
+  if since := q.Get("since"); since != "" {
+    if d, err := time.ParseDuration(since); err == nil {
+      f.Since = time.Now().Add(-d)
+    } else if t, err := time.Parse(time.RFC3339, since); err == nil {
+      f.Since = t
+    } else {
+      return f, fmt.Errorf("Invalid since %s.", since)
+    }
+  }
+
+  if limit := q.Get("limit"); limit != "" {
+    n, err := strconv.Atoi(limit)
+    if err != nil || n < 0 {
+      return f, fmt.Errorf("Invalid limit %s.", limit)
+    }
+    f.Limit = n
+  }
+  return f, nil
+}
+
+func (s *StatusServer) logsResponse(w http.ResponseWriter, r* http.Request) {
+  if r.Method != "GET" {
+    http.Error(w, http.StatusText(404), 404)
+    return
+  }
+
+  f, err := logsFilter(r)
+  if err != nil {
+    http.Error(w, err.Error(), 400)
+    return
+  }
+
+  if strings.Trim(strings.TrimPrefix(r.URL.Path, "/index/logs"), "/") == "stream" {
+    s.logsStream(w, r, f)
+    return
+  }
+
+  res := APILogsRes{Logs: config.Logger().Recent(f), Status: "OK"}
+  if data, err := json.Marshal(res); err != nil {
+    panic(err)
+  } else {
+    if _ , err := w.Write(data); err != nil {
+      panic(err)
+    }
+  }
+}
+
+// Entries matching the filter as they're logged, one JSON logger.Entry per
+// message. since and limit don't apply.
+func (s *StatusServer) logsStream(w http.ResponseWriter, r* http.Request, f logger.Filter) {
+  flusher, ok := w.(http.Flusher)
+  if !ok {
+    http.Error(w, http.StatusText(404), 404)
+    return
+  }
+
+  w.Header().Set("Content-Type", "text/event-stream")
+  w.Header().Set("Cache-Control", "no-cache")
+  w.Header().Set("Connection", "keep-alive")
+
+  entries, unsub := config.Logger().Subscribe()
+  defer unsub()
+
+  notify := w.(http.CloseNotifier).CloseNotify()
+  flusher.Flush()
+
+  for {
+    select {
+    case <-notify:
+      return
+    case e, ok := <-entries:
+      if !ok {
+        return
+      }
+      if !f.Match(e) {
+        continue
+      }
+      if data, err := json.Marshal(e); err == nil {
+        fmt.Fprintf(w, "data: %s\n\n", data)
+        flusher.Flush()
+      }
+    }
+  }
+}
+
+// =============================================================================
+// API: /index/code [GET, POST], /index/code/<id> [GET, DELETE],
+//      /index/code/stream [GET, server sent events]
+// =============================================================================
+
+type APIPostCodeReq struct {
+  Code        string  `json:"code"`
+}
+
+type APICodeRes struct {
+  Job         *codejob.Job  `json:"job,omitempty"`
+  Jobs        []codejob.Job `json:"jobs,omitempty"`
+  Status      string        `json:"status"`
+  Error       string        `json:"error"`
+}
+
+func (s *StatusServer) codeResponse(w http.ResponseWriter, r* http.Request) {
+  jobs := s.cloud.Jobs()
+  if jobs == nil {
+    http.Error(w, "Running code is disabled.", 404)
+    return
+  }
+
+  rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/index/code"), "/")
+  if rest == "stream" {
+    s.codeStream(w, r, jobs)
+    return
+  }
+
+  // Running or cancelling code takes the same token as a terminal.
+  if r.Method != "GET" && !s.cloud.CheckTerminalToken(requestToken(r)) {
+    config.Log(config.LOG_WARN, "ss: ", "Code refused for", r.RemoteAddr)
+    http.Error(w, "Bad terminal token.", 401)
+    return
+  }
+
+  var res APICodeRes
+  var err error
+
+  if rest == "" {
+    switch r.Method {
+    case "GET":
+      res.Jobs = jobs.Jobs()
+
+    case "POST":
+      var obj APIPostCodeReq
+      decoder := json.NewDecoder(r.Body)
+      if err := decoder.Decode(&obj); err != nil {
+        panic(err)
+      }
+
+      var j codejob.Job
+      if j, err = jobs.Submit(obj.Code, codejob.SOURCE_LOCAL); err == nil {
+        config.Log(config.LOG_INFO, "ss: ", "Queued code job", j.Id)
+        res.Job = &j
+      }
+
+    default:
+      http.Error(w, http.StatusText(404), 404)
+      return
+    }
+  } else {
+    id, perr := strconv.Atoi(rest)
+    if perr != nil {
+      http.Error(w, http.StatusText(404), 404)
+      return
+    }
+
+    switch r.Method {
+    case "GET":
+
+    case "DELETE":
+      if err = jobs.Cancel(id); err == nil {
+        config.Log(config.LOG_INFO, "ss: ", "Cancelling code job", id)
+      }
+
+    default:
+      http.Error(w, http.StatusText(404), 404)
+      return
+    }
+
+    if j, jerr := jobs.Job(id); jerr != nil {
+      err = jerr
+    } else {
+      res.Job = &j
+    }
+  }
+
+  res.Status = "OK"
+  if err != nil {
+    config.Log(config.LOG_ERROR, "ss: ", err.Error())
+    res.Status, res.Error = "error", err.Error()
+  }
+
+  if data, err := json.Marshal(res); err != nil {
+    panic(err)
+  } else {
+    if _ , err := w.Write(data); err != nil {
+      panic(err)
+    }
+  }
+}
+
+// Every job event as it happens, one JSON codejob.Event per message.
+func (s *StatusServer) codeStream(w http.ResponseWriter, r* http.Request, jobs *codejob.Service) {
+  flusher, ok := w.(http.Flusher)
+  if !ok || r.Method != "GET" {
+    http.Error(w, http.StatusText(404), 404)
+    return
+  }
+
+  w.Header().Set("Content-Type", "text/event-stream")
+  w.Header().Set("Cache-Control", "no-cache")
+  w.Header().Set("Connection", "keep-alive")
+
+  events, unsub := jobs.Subscribe()
+  defer unsub()
+
+  notify := w.(http.CloseNotifier).CloseNotify()
+  flusher.Flush()
+
+  for {
+    select {
+    case <-notify:
+      return
+    case ev, ok := <-events:
+      if !ok {
+        return
+      }
+      if data, err := json.Marshal(ev); err == nil {
+        fmt.Fprintf(w, "data: %s\n\n", data)
+        flusher.Flush()
+      }
+    }
+  }
+}
+
+// =============================================================================
+// API: /index/terminal [GET, PUT], /index/terminal/ws [websocket]
+// =============================================================================
+
+type APIPutTerminalReq struct {
+  Token       string  `json:"token"`
+  Current     string  `json:"current"`   // needed to change an existing token
+}
+
+type APITerminalRes struct {
+  Enabled     bool                `json:"enabled"`
+  HasToken    bool                `json:"hasToken"`
+  Sessions    []*terminal.Session `json:"sessions"`
+  Status      string              `json:"status"`
+  Error       string              `json:"error"`
+}
+
+func (s *StatusServer) terminalResponse(w http.ResponseWriter, r* http.Request) {
+  var err error
+
+  switch r.Method {
+  case "GET":
+
+  case "PUT":
+    var obj APIPutTerminalReq
+    decoder := json.NewDecoder(r.Body)
+    if err := decoder.Decode(&obj); err != nil {
+      panic(err)
+    }
+
+    if err = s.cloud.SetTerminalToken(obj.Token, obj.Current); err == nil {
+      config.Log(config.LOG_INFO, "ss: ", "Terminal token set.")
+    }
+
+  default:
+    http.Error(w, http.StatusText(404), 404)
+    return
+  }
+
+  terms := s.cloud.Terminals()
+  res := APITerminalRes{Enabled: terms != nil, HasToken: s.cloud.HasTerminalToken(), Status: "OK"}
+  if terms != nil {
+    res.Sessions = terms.Sessions()
+  }
+  if err != nil {
+    config.Log(config.LOG_ERROR, "ss: ", err.Error())
+    res.Status, res.Error = "error", err.Error()
+  }
+
+  if data, err := json.Marshal(res); err != nil {
+    panic(err)
+  } else {
+    if _ , err := w.Write(data); err != nil {
+      panic(err)
+    }
+  }
+}
+
+// The token comes as a bearer token or, since browsers can't set headers on
+// a websocket, a token query parameter.
+func requestToken(r* http.Request) string {
+  if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+    return strings.TrimPrefix(auth, "Bearer ")
+  }
+  return r.URL.Query().Get("token")
+}
+
+func (s *StatusServer) terminalHandshake(cfg *websocket.Config, r* http.Request) error {
+  if s.cloud.Terminals() == nil {
+    return fmt.Errorf("Terminals are disabled.")
+  }
+
+  if !s.cloud.CheckTerminalToken(requestToken(r)) {
+    config.Log(config.LOG_WARN, "ss: ", "Terminal refused for", r.RemoteAddr)
+    return fmt.Errorf("Bad terminal token.")
+  }
+  return nil
+}
+
+// Output goes out as binary messages. Incoming messages start with a type
+// byte: '0' for input, '1' for a JSON resize, {"rows": 24, "cols": 80}.
+func (s *StatusServer) terminalSocket(ws *websocket.Conn) {
+  defer ws.Close()
+
+  q := ws.Request().URL.Query()
+  rows, _ := strconv.Atoi(q.Get("rows"))
+  cols, _ := strconv.Atoi(q.Get("cols"))
+
+  sess, err := s.cloud.Terminals().Open("local " + ws.Request().RemoteAddr, uint16(rows), uint16(cols))
+  if err != nil {
+    config.Log(config.LOG_ERROR, "ss: ", err)
+    websocket.Message.Send(ws, err.Error())
+    return
+  }
+  defer sess.Close()
+  config.Log(config.LOG_INFO, "ss: ", "Terminal", sess.Id, "opened for", ws.Request().RemoteAddr)
+
+  go func() {
+    buf := make([]byte, 4096)
+    for {
+      n, err := sess.Read(buf)
+      if err != nil {
+        ws.Close()
+        return
+      }
+      if err := websocket.Message.Send(ws, buf[:n]); err != nil {
+        return
+      }
+    }
+  }()
+
+  for {
+    var msg []byte
+    if err := websocket.Message.Receive(ws, &msg); err != nil {
+      break
+    }
+    if len(msg) == 0 {
+      continue
+    }
+
+    switch msg[0] {
+    case '0':
+      sess.Write(msg[1:])
+    case '1':
+      var size struct {
+        Rows  uint16  `json:"rows"`
+        Cols  uint16  `json:"cols"`
+      }
+      if json.Unmarshal(msg[1:], &size) == nil {
+        sess.Resize(size.Rows, size.Cols)
+      }
+    }
+  }
+  config.Log(config.LOG_INFO, "ss: ", "Terminal", sess.Id, "closed")
+}
+
 // =============================================================================
 // API: /index/aps
 // =============================================================================
@@ -708,7 +1662,7 @@ func (s *StatusServer) apsResponse(w http.ResponseWriter, r* http.Request) {
       // no password
       updateWifi = true
     case "WEP":
-      if (len(obj.Password) != 5 || len(obj.Password) != 13) {
+      if (len(obj.Password) != 5 && len(obj.Password) != 13) {
         err = fmt.Errorf("Network password must be either 5 or 13 characters in length.")
       } else {
         updateWifi = true
@@ -0,0 +1,190 @@
+package statusServer
+
+import (
+  "encoding/json"
+  "io/ioutil"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+
+  "cloudlink"
+  "config"
+  "fmulink"
+)
+
+func TestCheckReady(t *testing.T) {
+  seen := time.Now()
+  up := fmulink.LinkEvent{State: fmulink.LINK_CONNECTED, Address: "127.0.0.1:14550"}
+  subs := func(online ...string) map[string]fmulink.SubsystemStatus {
+    m := map[string]fmulink.SubsystemStatus{"heartbeat": {}, "gps": {}, "imu": {}}
+    for _, name := range online {
+      m[name] = fmulink.SubsystemStatus{Online: true, LastSeen: &seen}
+    }
+    return m
+  }
+  writable := map[string]APIReadyCheck{"flights": {Ok: true, Required: true}}
+  full := map[string]APIReadyCheck{"flights": {Required: true, Detail: "read-only file system"}}
+
+  cases := []struct {
+    name      string
+    link      fmulink.LinkEvent
+    subs      map[string]fmulink.SubsystemStatus
+    required  string
+    cloud     APIReadyCheck
+    storage   map[string]APIReadyCheck
+    ready     bool
+  }{
+    {"all up", up, subs("heartbeat"), "heartbeat", APIReadyCheck{}, writable, true},
+    {"link down", fmulink.LinkEvent{State: fmulink.LINK_LOST}, subs("heartbeat"), "heartbeat", APIReadyCheck{}, writable, false},
+    {"no heartbeat", up, subs(), "", APIReadyCheck{}, writable, false},
+    {"required subsystem offline", up, subs("heartbeat"), "heartbeat,gps", APIReadyCheck{}, writable, false},
+    {"required subsystems online", up, subs("heartbeat", "gps", "imu"), " heartbeat , gps,,imu ", APIReadyCheck{}, writable, true},
+    {"optional subsystem offline", up, subs("heartbeat", "gps"), "gps", APIReadyCheck{}, writable, true},
+    {"unknown subsystem", up, subs("heartbeat"), "heartbeat,lidar", APIReadyCheck{}, writable, false},
+    {"cloud required", up, subs("heartbeat"), "", APIReadyCheck{Required: true}, writable, false},
+    {"cloud required and online", up, subs("heartbeat"), "", APIReadyCheck{Ok: true, Required: true}, writable, true},
+    {"storage not writable", up, subs("heartbeat"), "", APIReadyCheck{}, full, false},
+  }
+
+  for _, c := range cases {
+    res := checkReady(c.link, c.subs, c.required, c.cloud, c.storage)
+    if res.Ready != c.ready {
+      t.Errorf("%s: ready %v, want %v: %+v", c.name, res.Ready, c.ready, res)
+    }
+  }
+
+  res := checkReady(up, subs("heartbeat"), "heartbeat,lidar", APIReadyCheck{}, writable)
+  if lidar := res.Subsystems["lidar"]; !lidar.Required || lidar.Ok || lidar.Detail != "Unknown subsystem." {
+    t.Errorf("unknown subsystem reported as %+v", lidar)
+  }
+  if hb := res.Subsystems["heartbeat"]; !hb.Required || !hb.Ok || hb.LastSeen == nil {
+    t.Errorf("heartbeat reported as %+v", hb)
+  }
+  if gps := res.Subsystems["gps"]; gps.Required {
+    t.Errorf("gps reported as %+v", gps)
+  }
+  if res.Link.Detail != "connected 127.0.0.1:14550" {
+    t.Errorf("link detail %q", res.Link.Detail)
+  }
+}
+
+func TestReadyResponse(t *testing.T) {
+  dir, err := ioutil.TempDir("", "readyz")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  *config.FlightLogPath = dir
+  *config.AssetsPath = filepath.Join(dir, "missing") + "/"
+
+  s := &StatusServer{cloud: &cloudlink.CloudLink{}}
+  w := httptest.NewRecorder()
+  s.readyResponse(w, httptest.NewRequest("GET", "/readyz", nil))
+
+  // No flight controller in a test.
+  if w.Code != 503 {
+    t.Errorf("got %d", w.Code)
+  }
+  if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+    t.Errorf("content type %q", ct)
+  }
+
+  var res APIReadyRes
+  if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+    t.Fatal(err)
+  }
+  if res.Ready || res.Status != "error" || res.Link.Ok || !res.Link.Required {
+    t.Errorf("got %+v", res)
+  }
+  if res.Cloud.Ok || res.Cloud.Required {
+    t.Errorf("cloud %+v, want offline and not required by default", res.Cloud)
+  }
+  for _, name := range fmulink.SubsystemNames() {
+    st, ok := res.Subsystems[name]
+    if !ok || st.Ok || st.Required != (name == "heartbeat") {
+      t.Errorf("subsystem %s reported as %+v", name, st)
+    }
+  }
+  if f := res.Storage["flights"]; !f.Ok {
+    t.Errorf("flights %+v", f)
+  }
+  if a := res.Storage["assets"]; a.Ok || !a.Required || a.Detail == "" {
+    t.Errorf("assets %+v", a)
+  }
+}
+
+func TestCheckLogProfile(t *testing.T) {
+  cases := []struct {
+    body  string
+    ok    bool
+  }{
+    {`{"syncrate": 64}`, true},
+    {`{"logprofile": {"ATTITUDE": 10}}`, true},
+    {`{"logprofile": {"NO_SUCH_MESSAGE": 10}}`, false},
+    {`{"logprofile": {"ATTITUDE": "often"}}`, false},
+  }
+
+  for _, c := range cases {
+    errs := checkLogProfile([]byte(c.body))
+    if (len(errs) == 0) != c.ok {
+      t.Errorf("%s: got %v", c.body, errs)
+    } else if !c.ok && errs[0].Path != "logprofile" {
+      t.Errorf("%s: error for %s", c.body, errs[0].Path)
+    }
+  }
+}
+
+// The choice is checked and stored before the link switches, and a bad one
+// leaves both alone.
+func TestMasterSwitch(t *testing.T) {
+  dir, _ := ioutil.TempDir("", "statusServer")
+  defer os.RemoveAll(dir)
+
+  assets, flights := *config.AssetsPath, *config.FlightLogPath
+  *config.AssetsPath, *config.FlightLogPath = dir + "/", dir
+  defer func() { *config.AssetsPath, *config.FlightLogPath = assets, flights }()
+
+  cl, err := cloudlink.NewCloudLink()
+  if err != nil {
+    t.Fatal(err)
+  }
+  s := &StatusServer{cloud: cl}
+
+  put := func(addr string) APIMasterRes {
+    body, _ := json.Marshal(APIPutMasterReq{Address: addr})
+    w := httptest.NewRecorder()
+    s.masterResponse(w, httptest.NewRequest("PUT", "/index/master", strings.NewReader(string(body))))
+
+    var res APIMasterRes
+    if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+      t.Fatal(err)
+    }
+    return res
+  }
+
+  if res := put("sim://"); res.Status != "OK" || res.Address != "sim://" {
+    t.Fatalf("switching to the simulator: %+v", res)
+  }
+  if fmulink.GetMaster() != "sim://" || cl.GetStore().Get(fmulink.STORE_MASTER) != "sim://" {
+    t.Fatal("switch not made or not stored")
+  }
+
+  if res := put("tcp://127.0.0.1"); res.Status != "error" || res.Address != "sim://" {
+    t.Errorf("switching to a bad address: %+v", res)
+  }
+  if fmulink.GetMaster() != "sim://" || cl.GetStore().Get(fmulink.STORE_MASTER) != "sim://" {
+    t.Error("a bad address changed the link or the stored choice")
+  }
+
+  // Back to the configured link, with nothing stored.
+  if res := put(""); res.Status != "OK" || res.Address != *config.LinkPath {
+    t.Errorf("dropping the override: %+v", res)
+  }
+  if fmulink.GetMaster() != *config.LinkPath || cl.GetStore().Get(fmulink.STORE_MASTER) != "" {
+    t.Error("override not dropped")
+  }
+}
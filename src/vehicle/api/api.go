@@ -163,9 +163,13 @@ type Param struct {
   Encode   uint8 // used to encode the param for MAVLink
 }
 
+// Status of a command with no ack yet. Must be greater than 4 due to MAV_RESULT.
+const COMMAND_PENDING = 10
+
 type VehicleCommand struct {
   Status    uint
   TimesSent uint
+  FirstSent time.Time
   Command   *mavlink.CommandLong
 }
 
@@ -262,7 +266,7 @@ func (v *VehicleApi) GetMASLAlt() float32 {
 }
 
 func NewVehicleApi(id string) *VehicleApi {
-  config.Log(config.LOG_INFO, id, "Vehicle <" + id + "> Init")
+  config.Log(config.LOG_INFO, "vehicle: ", id, "Vehicle <" + id + "> Init")
   api := &VehicleApi{}
   api.id = id
   api.sysId = 0
@@ -292,7 +296,7 @@ func (v *VehicleApi) UpdateSubSystem(name string) error {
   } else {
     if !subsystem.Online {
       subsystem.Online = true
-      config.Log(config.LOG_INFO, v.id, "Subsystem", name, "online.")
+      config.Log(config.LOG_INFO, "vehicle: ", v.id, "Subsystem", name, "online.")
     }
     subsystem.Updated = time.Now()
     return nil
@@ -318,7 +322,7 @@ func (v *VehicleApi) CheckSubSystems() {
   for name, subsystem := range v.subSystems {
     if (subsystem.Online) && (time.Now().Sub(subsystem.Updated) > 5 * time.Second) {
       subsystem.Online = false
-      config.Log(config.LOG_INFO, v.id, "Subsystem", name, "offline.")
+      config.Log(config.LOG_INFO, "vehicle: ", v.id, "Subsystem", name, "offline.")
     }
   }
 }
@@ -363,7 +367,7 @@ func (v *VehicleApi) CheckSysOnline() {
 
   if v.status.Online && (time.Now().Sub(v.info.LastUpdate) > 5 * time.Second) {
     v.status.Online = false
-    config.Log(config.LOG_INFO, v.id, "FMU Offline")
+    config.Log(config.LOG_INFO, "vehicle: ", v.id, "FMU Offline")
   }
 }
 
@@ -374,7 +378,7 @@ func (v *VehicleApi) UpdateFromHeartbeat(m *mavlink.Heartbeat) {
   if !v.status.Online {
     v.info.LastOnline = time.Now()
     v.status.Online = true
-    config.Log(config.LOG_INFO, v.id, "FMU Online")
+    config.Log(config.LOG_INFO, "vehicle: ", v.id, "FMU Online")
   }
 
   v.info.LastUpdate = time.Now()
@@ -719,62 +723,62 @@ func (v *VehicleApi) CheckCapability(cap uint64) bool {
 }
 
 func (v *VehicleApi) PrintCapabilities() {
-  config.Log(config.LOG_INFO, v.id, "[WELCOME TO DSC]")
-  config.Log(config.LOG_INFO, v.id, "Comms Protocol:", v.info.Protocol)
-  config.Log(config.LOG_INFO, v.id, "Vehicle Configuration:", v.info.Type)
-  config.Log(config.LOG_INFO, v.id, "Firmware:", v.info.Firmware)
-  config.Log(config.LOG_INFO, v.id, "Version:", v.fmuGit)
+  config.Log(config.LOG_INFO, "vehicle: ", v.id, "[WELCOME TO DSC]")
+  config.Log(config.LOG_INFO, "vehicle: ", v.id, "Comms Protocol:", v.info.Protocol)
+  config.Log(config.LOG_INFO, "vehicle: ", v.id, "Vehicle Configuration:", v.info.Type)
+  config.Log(config.LOG_INFO, "vehicle: ", v.id, "Firmware:", v.info.Firmware)
+  config.Log(config.LOG_INFO, "vehicle: ", v.id, "Version:", v.fmuGit)
 
   if v.CheckCapability(mavlink.MAV_PROTOCOL_CAPABILITY_MISSION_FLOAT) {
-    config.Log(config.LOG_INFO, v.id, "\tCOMMAND LONG SUPPORTED")
+    config.Log(config.LOG_INFO, "vehicle: ", v.id, "\tCOMMAND LONG SUPPORTED")
   }
 
   if v.CheckCapability(mavlink.MAV_PROTOCOL_CAPABILITY_PARAM_FLOAT) {
-    config.Log(config.LOG_INFO, v.id, "\tFLOAT PARAMS SUPPORTED")
+    config.Log(config.LOG_INFO, "vehicle: ", v.id, "\tFLOAT PARAMS SUPPORTED")
   }
 
   if v.CheckCapability(mavlink.MAV_PROTOCOL_CAPABILITY_MISSION_INT) {
-    config.Log(config.LOG_INFO, v.id, "\tMISSION INT SUPPORTED")
+    config.Log(config.LOG_INFO, "vehicle: ", v.id, "\tMISSION INT SUPPORTED")
   }
 
   if v.CheckCapability(mavlink.MAV_PROTOCOL_CAPABILITY_COMMAND_INT) {
-    config.Log(config.LOG_INFO, v.id, "\tCOMMAND INT SUPPORTED")
+    config.Log(config.LOG_INFO, "vehicle: ", v.id, "\tCOMMAND INT SUPPORTED")
   }
 
   if v.CheckCapability(mavlink.MAV_PROTOCOL_CAPABILITY_PARAM_UNION) {
-    config.Log(config.LOG_INFO, v.id, "\tUNION PARAMS SUPPORTED")
+    config.Log(config.LOG_INFO, "vehicle: ", v.id, "\tUNION PARAMS SUPPORTED")
   }
 
   if v.CheckCapability(mavlink.MAV_PROTOCOL_CAPABILITY_FTP) {
-    config.Log(config.LOG_INFO, v.id, "\tFTP FROM NONVOLATILE STORAGE SUPPORTED")
+    config.Log(config.LOG_INFO, "vehicle: ", v.id, "\tFTP FROM NONVOLATILE STORAGE SUPPORTED")
   }
 
   if v.CheckCapability(mavlink.MAV_PROTOCOL_CAPABILITY_SET_ATTITUDE_TARGET) {
-    config.Log(config.LOG_INFO, v.id, "\tATTITUDE TARGET SETPOINTS SUPPORTED")
+    config.Log(config.LOG_INFO, "vehicle: ", v.id, "\tATTITUDE TARGET SETPOINTS SUPPORTED")
   }
 
   if v.CheckCapability(mavlink.MAV_PROTOCOL_CAPABILITY_SET_POSITION_TARGET_LOCAL_NED) {
-    config.Log(config.LOG_INFO, v.id, "\tLOCAL POSITION TARGET SETPOINTS SUPPORTED")
+    config.Log(config.LOG_INFO, "vehicle: ", v.id, "\tLOCAL POSITION TARGET SETPOINTS SUPPORTED")
   }
 
   if v.CheckCapability(mavlink.MAV_PROTOCOL_CAPABILITY_SET_POSITION_TARGET_GLOBAL_INT) {
-    config.Log(config.LOG_INFO, v.id, "\tGLOBAL POSITION TARGET SETPOINTS SUPPORTED")
+    config.Log(config.LOG_INFO, "vehicle: ", v.id, "\tGLOBAL POSITION TARGET SETPOINTS SUPPORTED")
   }
 
   if v.CheckCapability(mavlink.MAV_PROTOCOL_CAPABILITY_TERRAIN) {
-    config.Log(config.LOG_INFO, v.id, "\tTERRAIN ESTIMATION SUPPORTED")
+    config.Log(config.LOG_INFO, "vehicle: ", v.id, "\tTERRAIN ESTIMATION SUPPORTED")
   }
 
   if v.CheckCapability(mavlink.MAV_PROTOCOL_CAPABILITY_SET_ACTUATOR_TARGET) {
-    config.Log(config.LOG_INFO, v.id, "\tMOTOR TARGET SETPOINTS SUPPORTED")
+    config.Log(config.LOG_INFO, "vehicle: ", v.id, "\tMOTOR TARGET SETPOINTS SUPPORTED")
   }
 
   if v.CheckCapability(mavlink.MAV_PROTOCOL_CAPABILITY_FLIGHT_TERMINATION) {
-    config.Log(config.LOG_INFO, v.id, "\tFLIGHT TERMINATION SUPPORTED")
+    config.Log(config.LOG_INFO, "vehicle: ", v.id, "\tFLIGHT TERMINATION SUPPORTED")
   }
 
   if v.CheckCapability(mavlink.MAV_PROTOCOL_CAPABILITY_COMPASS_CALIBRATION) {
-    config.Log(config.LOG_INFO, v.id, "\tCOMPASS CALIBRATION SUPPORTED")
+    config.Log(config.LOG_INFO, "vehicle: ", v.id, "\tCOMPASS CALIBRATION SUPPORTED")
   }
 }
 
@@ -785,22 +789,26 @@ func (v *VehicleApi) UpdateFromAck(m *mavlink.CommandAck, queue *utils.PQueue) {
 
     // Only update if they are the same command.
     if pri == int(m.Command) {
+      // The first answer to a command times it.
+      if cmd.Status == COMMAND_PENDING && !cmd.FirstSent.IsZero() {
+        ackLatency.With(ackResult(m.Result)).Observe(time.Since(cmd.FirstSent).Seconds())
+      }
       cmd.Status = uint(m.Result)
     }
   }
 
   switch m.Result {
   case mavlink.MAV_RESULT_ACCEPTED:
-    config.Log(config.LOG_INFO, v.id, "Command Accepted:", m.Command)
+    config.Log(config.LOG_INFO, "vehicle: ", v.id, "Command Accepted:", m.Command)
   case mavlink.MAV_RESULT_TEMPORARILY_REJECTED:
-    config.Log(config.LOG_INFO, v.id, "Command Rejected:", m.Command)
+    config.Log(config.LOG_INFO, "vehicle: ", v.id, "Command Rejected:", m.Command)
   case mavlink.MAV_RESULT_DENIED:
-    config.Log(config.LOG_INFO, v.id, "Command Cannot be completed:", m.Command)
+    config.Log(config.LOG_INFO, "vehicle: ", v.id, "Command Cannot be completed:", m.Command)
   default: fallthrough
   case mavlink.MAV_RESULT_UNSUPPORTED:
-    config.Log(config.LOG_INFO, v.id, "Command Unknown:", m.Command)
+    config.Log(config.LOG_INFO, "vehicle: ", v.id, "Command Unknown:", m.Command)
   case mavlink.MAV_RESULT_FAILED:
-    config.Log(config.LOG_INFO, v.id, "Tried to execute command, but failed", m.Command)
+    config.Log(config.LOG_INFO, "vehicle: ", v.id, "Tried to execute command, but failed", m.Command)
   }
 }
 
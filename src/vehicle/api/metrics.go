@@ -0,0 +1,25 @@
+package api
+
+import (
+  "metrics"
+  "mavlink/parser"
+)
+
+var ackLatency = metrics.NewHistogramVec("dslink_command_ack_seconds",
+  "Time from first sending a command to its first ack, by result.", metrics.DefBuckets, "result")
+
+func ackResult(result uint8) string {
+  switch result {
+  case mavlink.MAV_RESULT_ACCEPTED:
+    return "accepted"
+  case mavlink.MAV_RESULT_TEMPORARILY_REJECTED:
+    return "temporarily_rejected"
+  case mavlink.MAV_RESULT_DENIED:
+    return "denied"
+  case mavlink.MAV_RESULT_UNSUPPORTED:
+    return "unsupported"
+  case mavlink.MAV_RESULT_FAILED:
+    return "failed"
+  }
+  return "unknown"
+}
@@ -0,0 +1,8 @@
+package vehicle
+
+import (
+  "metrics"
+)
+
+var commandQueueDepth = metrics.NewGauge("dslink_command_queue_depth",
+  "Commands waiting to be sent or acked.")
@@ -61,14 +61,14 @@ type Vehicle struct {
 
 func checkError(err error) {
   if err != nil {
-    config.Log(config.LOG_ERROR, "Error:" , err)
+    config.Log(config.LOG_ERROR, "vehicle: ", "Error:", err)
     os.Exit(1)
   }
 }
 
 func mavParseError(err error) {
   if err != nil {
-    config.Log(config.LOG_INFO, sysId, "Mavlink failed to parse:", err)
+    config.Log(config.LOG_INFO, "vehicle: ", sysId, "Mavlink failed to parse:", err)
   }
 }
 
@@ -138,7 +138,7 @@ func (v *Vehicle) GetParams() {
 func (v *Vehicle) ProcessPacket(pack []byte) {
   packet, err := mavlink.DecodeBytes(pack)
   if err != nil {
-    config.Log(config.LOG_INFO, sysId, "Parser:", err)
+    config.Log(config.LOG_INFO, "vehicle: ", sysId, "Parser:", err)
   } else {
     v.processPacket(packet)
   }
@@ -158,7 +158,7 @@ func (v *Vehicle) Listen() {
   for {
     packet, err := v.mavlinkReader.Decode()
     if err != nil {
-      config.Log(config.LOG_INFO, sysId, "Parser:", err)
+      config.Log(config.LOG_INFO, "vehicle: ", sysId, "Parser:", err)
     } else {
       v.processPacket(packet)
     }
@@ -173,7 +173,7 @@ func (v *Vehicle) Close() {
 
 func (v *Vehicle) sendMAVLink(m mavlink.Message) {
   if err := v.mavlinkWriter.Encode(0, 0, m); err != nil {
-    config.Log(config.LOG_INFO, sysId, err)
+    config.Log(config.LOG_INFO, "vehicle: ", sysId, err)
   }
 }
 
@@ -202,10 +202,14 @@ func (v *Vehicle) sysOnlineHandler() {
       // We tried 5 times, but got no ack, so throw it out and send next item.
       v.commandQueue.Pop()
     } else {
+      if cmd.TimesSent == 0 {
+        cmd.FirstSent = time.Now()
+      }
       v.sendMAVLink(cmd.Command)
       cmd.TimesSent += 1
     }
   }
+  commandQueueDepth.Set(float64(v.commandQueue.Size()))
 }
 
 //
@@ -225,10 +229,10 @@ func (v *Vehicle) stateHandler() {
       if !caps {
         // Get caps
         v.sendMAVLink(v.api.RequestVehicleInfo())
-        config.Log(config.LOG_INFO, sysId, "Loading vehicle info...")
+        config.Log(config.LOG_INFO, "vehicle: ", sysId, "Loading vehicle info...")
       } else {
         if !v.api.ParamsInit() {
-          config.Log(config.LOG_INFO, sysId, "Loading params...")
+          config.Log(config.LOG_INFO, "vehicle: ", sysId, "Loading params...")
           v.GetParams()
           v.ParamsTimer = time.Now()
         } else {
@@ -243,7 +247,7 @@ func (v *Vehicle) stateHandler() {
                   notFound = append(notFound, i)
                 }
               }
-              config.Log(config.LOG_INFO, sysId, "WARN Failed to fetch the following params: ", notFound, "Total:", total)
+              config.Log(config.LOG_INFO, "vehicle: ", sysId, "WARN Failed to fetch the following params: ", notFound, "Total:", total)
               v.paramsLock.Lock()
               v.missingParams = notFound
               v.paramsLock.Unlock()
@@ -262,7 +266,7 @@ func (v *Vehicle) stateHandler() {
               // wait a teensy bit to give the firmware time to receive
               time.Sleep(5 * time.Millisecond)
             }
-            config.Log(config.LOG_INFO, sysId, int((float32(foundCnt) / float32(int(total))) * 100), "Percent of params loaded...")
+            config.Log(config.LOG_INFO, "vehicle: ", sysId, int((float32(foundCnt) / float32(int(total))) * 100), "Percent of params loaded...")
           }
         }
       }
@@ -450,7 +454,7 @@ func (v *Vehicle) processPacket(p *mavlink.Packet) {
     err := m.Unpack(p)
     mavParseError(err)
     v.knownMsgs[m.MsgName()] = &m
-    config.Log(config.LOG_INFO, sysId, ">>>", string(m.Text[:]))
+    config.Log(config.LOG_INFO, "vehicle: ", sysId, ">>>", string(m.Text[:]))
     v.syslogQueue.Prepend(&api.VehicleLog{
       Msg: string(m.Text[:]),
       Time: time.Now(),
@@ -544,7 +548,7 @@ func (v *Vehicle) SetModeAndArm(updateMode, updateArm bool, mode string, armed b
   }
 
   cmd := &api.VehicleCommand{
-    Status: 10, // Must be greater than 4 due to MAV_RESULT
+    Status: api.COMMAND_PENDING,
     TimesSent: 0,
     Command: v.api.PackComandLong(mavlink.MAV_CMD_DO_SET_MODE,
       [7]float32{float32(mainMode), float32(manualMode), float32(autoMode)}),
@@ -563,7 +567,7 @@ func (v *Vehicle) SetHome(lat, lon, alt float32, relative bool) {
   }
 
   cmd := &api.VehicleCommand{
-    Status: 10, // Must be greater than 4 due to MAV_RESULT
+    Status: api.COMMAND_PENDING,
     TimesSent: 0,
     Command: v.api.PackComandLong(mavlink.MAV_CMD_DO_SET_HOME,
       [7]float32{relParam, 0.0, 0.0, 0.0, lat, lon, alt}),
@@ -574,7 +578,7 @@ func (v *Vehicle) SetHome(lat, lon, alt float32, relative bool) {
 
 func (v *Vehicle) DoGenericCommand(op int, params [7]float32) {
   cmd := &api.VehicleCommand{
-    Status: 10, // Must be greater than 4 due to MAV_RESULT
+    Status: api.COMMAND_PENDING,
     TimesSent: 0,
     Command: v.api.PackComandLong(uint16(op), params),
   }